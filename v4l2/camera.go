@@ -1,7 +1,10 @@
 package v4l2
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"sync"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -19,27 +22,83 @@ type Camera interface {
 	HasFormat(bufType BufType, pixFormat PixFmt) (bool, error)
 	HasFormatDescription(bufType BufType, description string) (bool, error)
 	EnumFrameSizes(pixFormat PixFmt) ([]*FrameSizeEnum, error)
+	EnumFrameIntervals(pixFormat PixFmt, width, height uint32) ([]*FrameIntervalEnum, error)
+	FrameRate() (Fract, error)
+	SetCrop(rect Rect) (*Rect, error)
+	EnumInputs() ([]*Input, error)
+	GetInput() (uint32, error)
+	SetInput(index uint32) error
+	InputStatus() (InputStatus, error)
+	EnumAudio() ([]*Audio, error)
+	GetAudio() (*Audio, error)
+	SetAudio(index uint32, mode AudMode) error
+	EnumStandards() ([]*Standard, error)
+	GetStandard() (StdID, error)
+	SetStandard(id StdID) error
+	QueryStandard() (StdID, error)
+	FollowSourceChange() (*DVTimings, error)
+	GetEDID() ([]byte, error)
+	SetEDID(data []byte) error
+	GetTuner() (*Tuner, error)
+	SetAudioMode(mode TunerMode) error
+	GetFrequency() (uint64, error)
+	SetFrequency(hz uint64) (uint64, error)
+	EnumFreqBands() ([]*FrequencyBand, error)
+	SeekFrequency(upward, wrap bool) (uint64, error)
+	GetModulator() (*Modulator, error)
+	SetModulator(txSubChans TunerSub) error
+	GetModulatorFrequency() (uint64, error)
+	SetModulatorFrequency(hz uint64) (uint64, error)
 	QueryControls() ([]*QueryCtrl, error)
 	GetControl(id CtrlID) (*Control, error)
 	SetControl(control *Control) error
 	QueryMenus(id CtrlID) ([]*QueryMenu, error)
+	QueryExtControls() ([]*QueryExtCtrl, error)
+	GetExtControls(which CtrlWhich, controls []*ExtControlValue) error
+	SetExtControls(which CtrlWhich, controls []*ExtControlValue) error
+	TryExtControls(which CtrlWhich, controls []*ExtControlValue) error
 	StreamOn() error
 	StreamOff() error
 	GrabFrame() ([]byte, error)
+	DequeueFrame() (*Frame, error)
+	Leases() int
+	ExportBuffer(index, plane uint32) (int, error)
+	Stream(ctx context.Context) (<-chan *Frame, error)
+	Errors() <-chan error
+	SubscribeEvent(eventType EventType, id uint32, flags EventSubFlag) error
+	UnsubscribeEvent(eventType EventType, id uint32) error
+	Events(ctx context.Context) (<-chan *Event, error)
 }
 
+// IOMethod selects how a camera exchanges frames with the driver.
+type IOMethod uint32
+
+const (
+	IOMethodAuto      IOMethod = iota // Streaming when supported, read() otherwise.
+	IOMethodStreaming                 // Streaming I/O using Memory buffers.
+	IOMethodReadWrite                 // read() I/O of one frame per call.
+)
+
 type CameraConfig struct {
 	Path      string
+	Device    Device // Optional, opened from Path when nil.
 	BufType   BufType
 	PixFormat PixFmt
 	Width     uint32
 	Height    uint32
+	FrameRate Fract // Frames per second, e.g. 30000/1001, zero leaves the driver default in place.
 	Memory    Memory
 	BufCount  uint32
+	DMABufFDs [][]int // Imported when Memory is MemoryDMABuf, indexed by buffer and plane.
+	IOMethod  IOMethod
+	Standard  StdID // Optional, set before the format for analog inputs.
+	DetectStd bool  // Narrows Standard to the one sensed on the input, if there is a signal.
 }
 
 type camera struct {
 	path      string
+	config    CameraConfig // As passed to NewCamera, for reallocating buffers.
+	device    Device
 	fd        int
 	driver    string
 	card      string
@@ -47,17 +106,25 @@ type camera struct {
 	bufType   BufType
 	pixFormat PixFmt
 	memory    Memory
+	ioMethod  IOMethod
+	sizeImage uint32
 	width     uint32
 	height    uint32
-	buffers   [][]byte
-}
-
-func (c *camera) Close() error {
-	if err := unix.Close(c.fd); err != nil {
-		return err
-	}
-	c.fd = -1
-	return nil
+	buffers   [][][]byte // Mapped data indexed by buffer and plane.
+	dmabufs   [][]int    // Imported DMABUF fds indexed by buffer and plane.
+	errors    chan error
+	lifecycle sync.RWMutex  // Read-held by operations, write-held by Close.
+	closing   chan struct{} // Closed when Close is called.
+	closeOnce sync.Once
+	closeErr  error
+	capturing sync.WaitGroup // Counts running Stream and Events goroutines.
+	mutex     sync.Mutex     // Guards the fields below.
+	state     cameraState
+	streaming bool   // A Stream goroutine is running.
+	watching  bool   // An Events goroutine is running.
+	sequence  uint32 // Sequence number of the next frame read with read().
+	leased    map[uint32]*Frame
+	exported  []int // Exported DMABUF fds, closed with the camera.
 }
 
 func (c *camera) Path() string {
@@ -77,10 +144,18 @@ func (c *camera) BusInfo() string {
 }
 
 func (c *camera) QueryCapabilities() (*Capability, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
 	return QueryCapabilities(c.fd)
 }
 
 func (c *camera) EnumFormats(bufType BufType) ([]*FmtDesc, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
 	return EnumFormats(c.fd, bufType)
 }
 
@@ -123,6 +198,10 @@ func (c *camera) HasFormatDescription(bufType BufType, description string) (bool
 }
 
 func (c *camera) EnumFrameSizes(pixFormat PixFmt) ([]*FrameSizeEnum, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
 	return EnumFrameSizes(c.fd, pixFormat)
 }
 
@@ -157,69 +236,382 @@ func (c *camera) SupportsFrameSize(pixFormat PixFmt, width, height uint32) (bool
 	return false, nil
 }
 
+func (c *camera) EnumFrameIntervals(pixFormat PixFmt, width, height uint32) ([]*FrameIntervalEnum, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	return EnumFrameIntervals(c.fd, pixFormat, width, height)
+}
+
+// FrameRate returns the frame rate currently applied by the driver, which is
+// the one it accepted for CameraConfig.FrameRate if one was requested.
+func (c *camera) FrameRate() (Fract, error) {
+	if err := c.enter(); err != nil {
+		return Fract{}, err
+	}
+	defer c.leave()
+	interval, err := GetTimePerFrame(c.fd, c.bufType)
+	if err != nil {
+		return Fract{}, err
+	}
+	return Fract{Numerator: interval.Denominator, Denominator: interval.Numerator}, nil
+}
+
+func (c *camera) SetCrop(rect Rect) (*Rect, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	return SetSelection(c.fd, c.bufType, SelTgtCrop, 0, rect)
+}
+
+func (c *camera) EnumInputs() ([]*Input, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	return EnumInputs(c.fd)
+}
+
+func (c *camera) GetInput() (uint32, error) {
+	if err := c.enter(); err != nil {
+		return 0, err
+	}
+	defer c.leave()
+	return GetInput(c.fd)
+}
+
+func (c *camera) SetInput(index uint32) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	return SetInput(c.fd, index)
+}
+
+func (c *camera) InputStatus() (InputStatus, error) {
+	if err := c.enter(); err != nil {
+		return 0, err
+	}
+	defer c.leave()
+	return QueryInputStatus(c.fd)
+}
+
+// EnumAudio returns the audio inputs that can be combined with the current video input.
+func (c *camera) EnumAudio() ([]*Audio, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	index, err := GetInput(c.fd)
+	if err != nil {
+		return nil, err
+	}
+	return InputAudio(c.fd, index)
+}
+
+func (c *camera) GetAudio() (*Audio, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	return GetAudio(c.fd)
+}
+
+func (c *camera) SetAudio(index uint32, mode AudMode) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	return SetAudio(c.fd, index, mode)
+}
+
+func (c *camera) EnumStandards() ([]*Standard, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	return EnumStandards(c.fd)
+}
+
+func (c *camera) GetStandard() (StdID, error) {
+	if err := c.enter(); err != nil {
+		return 0, err
+	}
+	defer c.leave()
+	return GetStandard(c.fd)
+}
+
+func (c *camera) SetStandard(id StdID) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	return SetStandard(c.fd, id)
+}
+
+func (c *camera) QueryStandard() (StdID, error) {
+	if err := c.enter(); err != nil {
+		return 0, err
+	}
+	defer c.leave()
+	return QueryStandard(c.fd)
+}
+
+func (c *camera) GetEDID() ([]byte, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	return GetEDID(c.fd, 0)
+}
+
+func (c *camera) SetEDID(data []byte) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	return SetEDID(c.fd, 0, data)
+}
+
+// FollowSourceChange handles an EventTypeSourceChange event on a DV input: it
+// locks to the sensed timings, renegotiates the format for the new frame size
+// and reallocates the buffers. Streaming started with StreamOn is resumed;
+// a Stream must be cancelled first and leased frames released. Buffers
+// exported with ExportBuffer are closed, as the driver cannot release them
+// otherwise.
+func (c *camera) FollowSourceChange() (*DVTimings, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.streaming {
+		return nil, ErrStreaming
+	}
+	if len(c.leased) > 0 {
+		return nil, ErrBusy
+	}
+	timings, err := QueryDVTimings(c.fd)
+	if err != nil {
+		return nil, err
+	}
+	resume := c.state == stateStreaming
+	if resume {
+		if err := c.halt(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.closeExported(); err != nil {
+		return nil, err
+	}
+	if c.state == stateBuffersAllocated {
+		if err := c.freeBuffers(); err != nil {
+			return nil, err
+		}
+		c.state = stateConfigured
+	}
+	if timings, err = SetDVTimings(c.fd, timings); err != nil {
+		return nil, err
+	}
+	bt, err := timings.BT()
+	if err != nil {
+		return nil, err
+	}
+	width, height, sizes, err := negotiateFormat(c.fd, c.bufType, c.pixFormat, bt.Width, bt.Height)
+	if err != nil {
+		return nil, err
+	}
+	c.width, c.height, c.sizeImage = width, height, sumSizes(sizes)
+	if c.ioMethod == IOMethodStreaming {
+		if err := c.allocateBuffers(&c.config, sizes); err != nil {
+			return nil, err
+		}
+	}
+	if resume {
+		if err := c.streamOn(); err != nil {
+			return nil, err
+		}
+	}
+	return timings, nil
+}
+
 func (c *camera) QueryControls() ([]*QueryCtrl, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
 	return QueryControls(c.fd)
 }
 
 func (c *camera) GetControl(id CtrlID) (*Control, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
 	return GetControl(c.fd, id)
 }
 
 func (c *camera) SetControl(control *Control) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
 	return SetControl(c.fd, control)
 }
 
 func (c *camera) QueryMenus(id CtrlID) ([]*QueryMenu, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
 	return QueryMenus(c.fd, id)
 }
 
+func (c *camera) QueryExtControls() ([]*QueryExtCtrl, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	return QueryExtControls(c.fd)
+}
+
+func (c *camera) GetExtControls(which CtrlWhich, controls []*ExtControlValue) error {
+	if which == CtrlWhichRequestVal {
+		return ErrUnsupported
+	}
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	return GetExtControls(c.fd, which, 0, controls)
+}
+
+func (c *camera) SetExtControls(which CtrlWhich, controls []*ExtControlValue) error {
+	if which == CtrlWhichRequestVal {
+		return ErrUnsupported
+	}
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	return SetExtControls(c.fd, which, 0, controls)
+}
+
+func (c *camera) TryExtControls(which CtrlWhich, controls []*ExtControlValue) error {
+	if which == CtrlWhichRequestVal {
+		return ErrUnsupported
+	}
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	return TryExtControls(c.fd, which, 0, controls)
+}
+
 func (c *camera) StreamOn() error {
-	return StreamOn(c.fd, c.bufType)
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.streamOn()
 }
 
 func (c *camera) StreamOff() error {
-	return StreamOff(c.fd, c.bufType)
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.streamOff()
 }
 
 func (c *camera) GrabFrame() ([]byte, error) {
-	return GrabFrame(c.fd, c.bufType, c.memory, c.buffers)
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	if c.isStreaming() {
+		return nil, ErrStreaming
+	}
+	frame, err := c.nextFrame(grabTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if frame == nil {
+		return nil, ErrTimeout
+	}
+	if len(frame.Planes) == 1 {
+		return frame.Data, nil
+	}
+	data := make([]byte, 0)
+	for _, plane := range frame.Planes {
+		data = append(data, plane.Data...)
+	}
+	return data, nil
+}
+
+func (c *camera) ExportBuffer(index, plane uint32) (int, error) {
+	if err := c.enter(); err != nil {
+		return -1, err
+	}
+	defer c.leave()
+	dmabufFD, err := ExportBuffer(c.fd, c.bufType, index, plane, unix.O_CLOEXEC|unix.O_RDWR)
+	if err != nil {
+		return -1, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.exported = append(c.exported, dmabufFD)
+	return dmabufFD, nil
 }
 
 func NewCamera(config *CameraConfig) (Camera, error) {
 	var err error
-	fd, err := unix.Open(config.Path, unix.O_RDWR, 0)
+	device, err := openDevice(config.Device, config.Path)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
 		if err != nil {
-			unix.Close(fd)
+			device.Close()
 		}
 	}()
+	fd := device.Fd()
 	capabilities, err := QueryCapabilities(fd)
 	if err != nil {
 		return nil, err
 	}
+	ioMethod, err := selectIOMethod(capabilities, config.IOMethod)
+	if err != nil {
+		return nil, err
+	}
 	driver := BytesToString(capabilities.Driver[:])
 	card := BytesToString(capabilities.Card[:])
 	busInfo := BytesToString(capabilities.BusInfo[:])
-	width, height, err := SetFormat(fd, config.BufType, config.PixFormat, config.Width, config.Height)
-	if err != nil {
+	if err = selectStandard(fd, config.Standard, config.DetectStd); err != nil {
 		return nil, err
 	}
-	count, err := RequestDriverBuffers(fd, config.BufCount, config.BufType, config.Memory)
+	var width, height uint32
+	var sizes []uint32
+	width, height, sizes, err = negotiateFormat(fd, config.BufType, config.PixFormat, config.Width, config.Height)
 	if err != nil {
 		return nil, err
 	}
-	var buffers [][]byte
-	if config.Memory == MemoryMmap {
-		buffers, err = MmapBuffers(fd, count, config.BufType)
-		if err != nil {
+	if config.FrameRate.Numerator != 0 && config.FrameRate.Denominator != 0 {
+		if err = setFrameRate(fd, config.BufType, config.FrameRate); err != nil {
 			return nil, err
 		}
 	}
-	return &camera{
+	c := &camera{
 		path:      config.Path,
+		config:    *config,
+		device:    device,
 		fd:        fd,
 		driver:    driver,
 		card:      card,
@@ -227,8 +619,135 @@ func NewCamera(config *CameraConfig) (Camera, error) {
 		bufType:   config.BufType,
 		pixFormat: config.PixFormat,
 		memory:    config.Memory,
+		ioMethod:  ioMethod,
+		sizeImage: sumSizes(sizes),
 		width:     width,
 		height:    height,
-		buffers:   buffers,
-	}, nil
+		errors:    make(chan error, 1),
+		closing:   make(chan struct{}),
+		leased:    make(map[uint32]*Frame),
+	}
+	if ioMethod == IOMethodStreaming {
+		if err = c.allocateBuffers(config, sizes); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// selectIOMethod resolves the requested I/O method against the device capabilities.
+func selectIOMethod(capability *Capability, ioMethod IOMethod) (IOMethod, error) {
+	caps := capability.Capabilities
+	if caps&CapDeviceCaps != 0 {
+		caps = capability.DeviceCaps
+	}
+	switch ioMethod {
+	case IOMethodAuto:
+		if caps&CapStreaming == 0 && caps&CapReadWrite != 0 {
+			return IOMethodReadWrite, nil
+		}
+		return IOMethodStreaming, nil
+	case IOMethodStreaming:
+		if caps&CapStreaming == 0 {
+			return 0, ErrUnsupported
+		}
+		return IOMethodStreaming, nil
+	case IOMethodReadWrite:
+		if caps&CapReadWrite == 0 {
+			return 0, ErrUnsupported
+		}
+		return IOMethodReadWrite, nil
+	}
+	return 0, ErrUnsupported
+}
+
+// negotiateFormat sets the format and returns the frame size applied by the
+// driver along with the image size of every plane.
+func negotiateFormat(fd int, bufType BufType, pixFormat PixFmt, width, height uint32) (uint32, uint32, []uint32, error) {
+	var sizes []uint32
+	if IsMultiPlanar(bufType) {
+		pix, err := SetFormatMPlane(fd, bufType, pixFormat, width, height)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		for i := uint8(0); i < pix.NumPlanes; i++ {
+			sizes = append(sizes, pix.PlaneFmt[i].SizeImage)
+		}
+		return pix.Width, pix.Height, sizes, nil
+	}
+	width, height, err := SetFormat(fd, bufType, pixFormat, width, height)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	format, err := GetFormat(fd, bufType)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	sizes = append(sizes, (*PixFormat)(unsafe.Pointer(&format.RawData[0])).SizeImage)
+	return width, height, sizes, nil
+}
+
+// setFrameRate sets the frame interval matching rate, which the driver may
+// adjust to the nearest one it supports.
+func setFrameRate(fd int, bufType BufType, rate Fract) error {
+	streamParm, err := GetStreamParm(fd, bufType)
+	if err != nil {
+		return err
+	}
+	if parmCapability(streamParm)&ParmCapTimePerFrame == 0 {
+		return fmt.Errorf("%w: the frame rate of the device cannot be set", ErrUnsupported)
+	}
+	_, err = SetTimePerFrame(fd, bufType, Fract{Numerator: rate.Denominator, Denominator: rate.Numerator})
+	return err
+}
+
+// sumSizes returns the total image size of all planes.
+func sumSizes(sizes []uint32) uint32 {
+	var sizeImage uint32
+	for _, size := range sizes {
+		sizeImage += size
+	}
+	return sizeImage
+}
+
+// selectStandard sets the configured video standard, narrowed to the sensed
+// standard when detect is set. Nothing is set if the result is StdUnknown.
+func selectStandard(fd int, standard StdID, detect bool) error {
+	if detect {
+		detected, err := QueryStandard(fd)
+		if err != nil {
+			return err
+		}
+		if standard == StdUnknown {
+			standard = detected
+		} else if standard&detected != 0 {
+			standard &= detected
+		}
+	}
+	if standard == StdUnknown {
+		return nil
+	}
+	return SetStandard(fd, standard)
+}
+
+// mmapDMABuf maps every plane of an imported DMABUF buffer. If any plane
+// cannot be mapped, the planes mapped so far are unmapped again and nil is
+// returned.
+func mmapDMABuf(dmabufFDs []int) [][]byte {
+	var planes [][]byte
+	for _, dmabufFD := range dmabufFDs {
+		size, err := unix.Seek(dmabufFD, 0, io.SeekEnd)
+		if err == nil {
+			var data []byte
+			if data, err = unix.Mmap(dmabufFD, 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED); err == nil {
+				planes = append(planes, data)
+				continue
+			}
+		}
+		for _, plane := range planes {
+			unix.Munmap(plane)
+		}
+		return nil
+	}
+	return planes
 }
@@ -1,10 +1,23 @@
 package v4l2
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
 
 func TestNewCamera(t *testing.T) {
 	camera, err := NewCamera(&CameraConfig{
 		Path:      "/dev/video0",
+		Device:    openTestDevice(t),
 		BufType:   BufTypeVideoCapture,
 		PixFormat: PixFmtMJPEG,
 		Width:     1920,
@@ -17,3 +30,1137 @@ func TestNewCamera(t *testing.T) {
 	}
 	camera.Close()
 }
+
+func TestCameraGrabFrame(t *testing.T) {
+	camera, err := NewCamera(&CameraConfig{
+		Device:    openTestDevice(t),
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		FrameRate: Fract{Numerator: 30000, Denominator: 1001},
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	frameRate, err := camera.FrameRate()
+	if err != nil {
+		t.Fatal("unable to get frame rate")
+	}
+	if frameRate != (Fract{Numerator: 30, Denominator: 1}) {
+		t.Fatal("accepted frame rate not reported")
+	}
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer camera.StreamOff()
+	for i := 0; i < 8; i++ {
+		frame, err := camera.GrabFrame()
+		if err != nil {
+			t.Fatal("unable to grab frame")
+		}
+		if len(frame) == 0 {
+			t.Fatal("empty frame returned")
+		}
+	}
+}
+
+func TestCameraStreamOffOn(t *testing.T) {
+	camera, err := NewCamera(&CameraConfig{
+		Device:    openTestDevice(t),
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	for run := 0; run < 2; run++ {
+		if err := camera.StreamOn(); err != nil {
+			t.Fatal("unable to turn on streaming")
+		}
+		for i := 0; i < 6; i++ {
+			if _, err := camera.GrabFrame(); err != nil {
+				t.Fatal("unable to grab frame")
+			}
+		}
+		if err := camera.StreamOff(); err != nil {
+			t.Fatal("unable to turn off streaming")
+		}
+	}
+}
+
+func TestCameraFixedFrameRate(t *testing.T) {
+	config := testFakeConfig()
+	config.FixedRate = true
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	_, err = NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		FrameRate: Fract{Numerator: 60, Denominator: 1},
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatal("frame rate set on a device without ParmCapTimePerFrame")
+	}
+}
+
+func TestCameraControls(t *testing.T) {
+	camera, err := NewCamera(&CameraConfig{
+		Device:    openTestDevice(t),
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	queryCtrls, err := camera.QueryControls()
+	if err != nil {
+		t.Fatal("unable to query controls")
+	}
+	if len(queryCtrls) == 0 {
+		t.Fatal("no controls returned")
+	}
+	control, err := camera.GetControl(CidBrightness)
+	if err != nil {
+		t.Fatal("unable to get control")
+	}
+	control.Value++
+	if err := camera.SetControl(control); err != nil {
+		t.Fatal("unable to set control")
+	}
+	updated, err := camera.GetControl(CidBrightness)
+	if err != nil {
+		t.Fatal("unable to get control")
+	}
+	if updated.Value != control.Value {
+		t.Fatal("control value not updated")
+	}
+	controls := []*ExtControlValue{{ID: CidBrightness}}
+	if err := camera.GetExtControls(CtrlWhichRequestVal, controls); !errors.Is(err, ErrUnsupported) {
+		t.Fatal("request controls not rejected")
+	}
+	if err := camera.SetExtControls(CtrlWhichRequestVal, controls); !errors.Is(err, ErrUnsupported) {
+		t.Fatal("request controls not rejected")
+	}
+}
+
+func TestCameraSetCrop(t *testing.T) {
+	camera, err := NewCamera(&CameraConfig{
+		Device:    openTestDevice(t),
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	rect, err := camera.SetCrop(Rect{Left: 100, Top: 100, Width: 320, Height: 240})
+	if err != nil {
+		t.Fatal("unable to set crop")
+	}
+	if rect.Width == 0 || rect.Height == 0 {
+		t.Fatal("applied crop is empty")
+	}
+}
+
+func TestCameraInputStatus(t *testing.T) {
+	fake, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	inputs, err := camera.EnumInputs()
+	if err != nil || len(inputs) != 1 {
+		t.Fatal("unable to enumerate inputs")
+	}
+	if status, err := camera.InputStatus(); err != nil || status.SignalLost() {
+		t.Fatal("input status incorrect")
+	}
+	if err := fake.SetInputStatus(0, InputStatusNoPower); err != nil {
+		t.Fatal("unable to set input status")
+	}
+	if status, err := camera.InputStatus(); err != nil || !status.SignalLost() {
+		t.Fatal("signal loss not reported")
+	}
+	if err := camera.SetInput(0); err != nil {
+		t.Fatal("unable to reselect current input")
+	}
+}
+
+func TestCameraStandard(t *testing.T) {
+	config := testFakeConfig()
+	config.Standards = []FakeStandard{{ID: StdNTSCM, Name: "NTSC-M"}, {ID: StdPALBG, Name: "PAL-BG"}}
+	config.Detected = StdPALG
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  2,
+		Standard:  StdAll,
+		DetectStd: true,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if id, err := camera.GetStandard(); err != nil || id != StdPALBG {
+		t.Fatal("detected standard not selected")
+	}
+	if err := camera.SetStandard(StdNTSC); !errors.Is(err, syscall.EBUSY) {
+		t.Fatal("standard change with allocated buffers not rejected")
+	}
+}
+
+func TestCameraAudio(t *testing.T) {
+	config := testFakeConfig()
+	config.Inputs = []FakeInput{{Name: "Camera", Type: InputTypeCamera, AudioSet: 0b10}}
+	config.Audio = []FakeAudio{{Name: "Line"}, {Name: "Microphone"}}
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	audios, err := camera.EnumAudio()
+	if err != nil || len(audios) != 1 || BytesToString(audios[0].Name[:]) != "Microphone" {
+		t.Fatal("incorrect audio inputs returned")
+	}
+	if audio, err := camera.GetAudio(); err != nil || audio.Index != 1 {
+		t.Fatal("associated audio input not selected")
+	}
+}
+
+func TestCameraTuner(t *testing.T) {
+	config := testFakeConfig()
+	config.Inputs = []FakeInput{{Name: "Television", Type: InputTypeTuner}, {Name: "Composite", Type: InputTypeCamera}}
+	config.Tuners = []FakeTuner{{
+		Name:       "TV",
+		Type:       TunerTypeAnalogTV,
+		Capability: TunerCapNorm | TunerCapStereo,
+		RangeLow:   704,
+		RangeHigh:  15328,
+		Stations:   []uint32{884, 3448},
+	}}
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if hz, err := camera.GetFrequency(); err != nil || hz != 44000000 {
+		t.Fatal("incorrect initial frequency returned")
+	}
+	if hz, err := camera.SetFrequency(55250000); err != nil || hz != 55250000 {
+		t.Fatal("unable to set frequency")
+	}
+	tuner, err := camera.GetTuner()
+	if err != nil || tuner.Signal == 0 {
+		t.Fatal("no signal reported on station")
+	}
+	if err := camera.SetAudioMode(TunerModeLang2); err != nil {
+		t.Fatal("unable to set audio mode")
+	}
+	bands, err := camera.EnumFreqBands()
+	if err != nil || len(bands) != 1 || bands[0].Modulation != BandModulationVSB {
+		t.Fatal("unable to enumerate frequency bands")
+	}
+	if hz, err := camera.SeekFrequency(true, false); err != nil || hz != 215500000 {
+		t.Fatal("seek did not find the next station")
+	}
+	if _, err := camera.SeekFrequency(true, true); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("seek with unsupported wrap around not rejected")
+	}
+}
+
+func TestCameraRadioTuner(t *testing.T) {
+	config := testFakeConfig()
+	config.Capabilities |= CapTuner | CapRadio
+	config.Tuners = []FakeTuner{{
+		Name:       "FM",
+		Type:       TunerTypeRadio,
+		Capability: TunerCapLow | TunerCapStereo,
+		RangeLow:   1400000,
+		RangeHigh:  1728000,
+	}}
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if _, err := camera.EnumInputs(); !errors.Is(err, ErrUnsupported) {
+		t.Fatal("radio device reported inputs")
+	}
+	if hz, err := camera.SetFrequency(98100000); err != nil || hz != 98100000 {
+		t.Fatal("unable to tune a radio device without inputs")
+	}
+}
+
+func TestCameraModulator(t *testing.T) {
+	config := testFakeConfig()
+	config.Capabilities |= CapModulator | CapRadio
+	config.Modulators = []FakeModulator{{
+		Name:       "FM",
+		Type:       TunerTypeRadio,
+		Capability: TunerCapLow | TunerCapStereo | TunerCapRDS,
+		RangeLow:   1216000,
+		RangeHigh:  1728000,
+	}}
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	modulator, err := camera.GetModulator()
+	if err != nil || modulator.Capability&TunerCapRDS == 0 {
+		t.Fatal("unable to get modulator")
+	}
+	if low, high := modulator.RangeHz(); low != 76000000 || high != 108000000 {
+		t.Fatal("incorrect modulator range returned")
+	}
+	if hz, err := camera.GetModulatorFrequency(); err != nil || hz != 76000000 {
+		t.Fatal("incorrect initial modulator frequency returned")
+	}
+	if hz, err := camera.SetModulatorFrequency(98100000); err != nil || hz != 98100000 {
+		t.Fatal("unable to set modulator frequency")
+	}
+	if hz, err := camera.SetModulatorFrequency(120000000); err != nil || hz != 108000000 {
+		t.Fatal("modulator frequency not clamped to the range")
+	}
+	if err := camera.SetModulator(TunerSubStereo | TunerSubRDS); err != nil {
+		t.Fatal("unable to set transmitted sub-channels")
+	}
+	if modulator, err := camera.GetModulator(); err != nil || modulator.TXSubChans != TunerSubStereo|TunerSubRDS {
+		t.Fatal("transmitted sub-channels not applied")
+	}
+}
+
+func TestCameraNoModulator(t *testing.T) {
+	config := testFakeConfig()
+	config.Outputs = []FakeOutput{{Name: "Composite", Type: OutputTypeAnalog}}
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if _, err := camera.GetModulatorFrequency(); !errors.Is(err, ErrNoModulator) {
+		t.Fatal("frequency returned for an output without a modulator")
+	}
+}
+
+func TestCameraNoTuner(t *testing.T) {
+	fake, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if _, err := camera.GetFrequency(); !errors.Is(err, ErrNoTuner) {
+		t.Fatal("frequency returned for an input without a tuner")
+	}
+}
+
+func TestCameraFollowSourceChange(t *testing.T) {
+	config := testFakeConfig()
+	config.Formats = config.Formats[2:]
+	config.Formats[0].FrameSizes = []FrameSizeDiscrete{{Width: 1280, Height: 720}, {Width: 1920, Height: 1080}}
+	config.DVTimings = testDVTimings()
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     1280,
+		Height:    720,
+		Memory:    MemoryMmap,
+		BufCount:  2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if err := camera.SubscribeEvent(EventTypeSourceChange, 0, 0); err != nil {
+		t.Fatal("unable to subscribe to source change events")
+	}
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	fake.SetSignal(&testDVTimings()[1])
+	event, err := DequeueEvent(fake.Fd())
+	if err != nil || event.SrcChange().Changes&EventSrcChResolution == 0 {
+		t.Fatal("source change not reported")
+	}
+	dmabufFD, err := camera.ExportBuffer(0, 0)
+	if err != nil {
+		t.Fatal("unable to export buffer")
+	}
+	timings, err := camera.FollowSourceChange()
+	if err != nil {
+		t.Fatal("unable to follow source change")
+	}
+	if bt, err := timings.BT(); err != nil || bt.Width != 1920 {
+		t.Fatal("incorrect DV timings applied")
+	}
+	if _, err := unix.FcntlInt(uintptr(dmabufFD), unix.F_GETFD, 0); err != unix.EBADF {
+		t.Fatal("exported buffer not closed by source change")
+	}
+	frame, err := camera.GrabFrame()
+	if err != nil {
+		t.Fatal("unable to grab frame")
+	}
+	if len(frame) != 1920*1080*2 {
+		t.Fatal("format not renegotiated")
+	}
+	fake.SetSignal(nil)
+	if _, err := camera.FollowSourceChange(); !errors.Is(err, syscall.ENOLINK) {
+		t.Fatal("missing signal not reported")
+	}
+}
+
+func TestCameraStream(t *testing.T) {
+	camera, err := NewCamera(&CameraConfig{
+		Device:    openTestDevice(t),
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	for run := 0; run < 2; run++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		frames, err := camera.Stream(ctx)
+		if err != nil {
+			t.Fatal("unable to start streaming")
+		}
+		if _, err := camera.Stream(ctx); err != ErrStreaming {
+			t.Fatal("second stream not rejected")
+		}
+		if _, err := camera.GrabFrame(); err != ErrStreaming {
+			t.Fatal("grab while streaming not rejected")
+		}
+		if _, err := camera.DequeueFrame(); err != ErrStreaming {
+			t.Fatal("dequeue while streaming not rejected")
+		}
+		var sequence uint32
+		for i := 0; i < 5; i++ {
+			frame, ok := <-frames
+			if !ok {
+				t.Fatal("frame channel closed prematurely")
+			}
+			if len(frame.Data) == 0 || frame.BytesUsed != uint32(len(frame.Data)) {
+				t.Fatal("frame has incorrect size")
+			}
+			if i > 0 && frame.Sequence <= sequence {
+				t.Fatal("frame sequence not increasing")
+			}
+			sequence = frame.Sequence
+		}
+		cancel()
+		for range frames {
+		}
+		select {
+		case err := <-camera.Errors():
+			t.Fatalf("unexpected streaming error: %v", err)
+		default:
+		}
+	}
+}
+
+func TestCameraStreamDeviceGone(t *testing.T) {
+	fake, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	frames, err := camera.Stream(context.Background())
+	if err != nil {
+		t.Fatal("unable to start streaming")
+	}
+	<-frames
+	fake.Unplug()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-frames:
+			if ok {
+				continue
+			}
+		case <-timeout:
+			t.Fatal("frame channel not closed")
+		}
+		break
+	}
+	select {
+	case err := <-camera.Errors():
+		if !errors.Is(err, ErrDeviceGone) {
+			t.Fatalf("unexpected streaming error: %v", err)
+		}
+	case <-timeout:
+		t.Fatal("no streaming error reported")
+	}
+}
+
+func TestCameraDequeueFrame(t *testing.T) {
+	camera, err := NewCamera(&CameraConfig{
+		Device:    openTestDevice(t),
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer camera.StreamOff()
+	frames := make([]*Frame, 0, 4)
+	for i := 0; i < 4; i++ {
+		frame, err := camera.DequeueFrame()
+		if err != nil {
+			t.Fatal("unable to dequeue frame")
+		}
+		if len(frame.Data) == 0 {
+			t.Fatal("empty frame returned")
+		}
+		frames = append(frames, frame)
+	}
+	if camera.Leases() != 3 {
+		t.Fatal("driver queue not protected from starvation")
+	}
+	data := frames[0].Copy()
+	if len(data) != len(frames[0].Data) {
+		t.Fatal("incorrect copy returned")
+	}
+	for _, frame := range frames {
+		if err := frame.Release(); err != nil {
+			t.Fatal("unable to release frame")
+		}
+		if err := frame.Release(); err != ErrFrameReleased {
+			t.Fatal("double release not detected")
+		}
+	}
+	if camera.Leases() != 0 {
+		t.Fatal("leases outstanding after release")
+	}
+	frame, err := camera.DequeueFrame()
+	if err != nil {
+		t.Fatal("unable to dequeue frame after release")
+	}
+	frame.Release()
+}
+
+func TestCameraCloseLeasedFrame(t *testing.T) {
+	camera, err := NewCamera(&CameraConfig{
+		Device:    openTestDevice(t),
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	frame, err := camera.DequeueFrame()
+	if err != nil {
+		t.Fatal("unable to dequeue frame")
+	}
+	data := frame.Copy()
+	if err := camera.Close(); err != nil {
+		t.Fatal("unable to close camera with a leased frame")
+	}
+	if !bytes.Equal(frame.Data, data) || !bytes.Equal(frame.Planes[0].Data, data) {
+		t.Fatal("leased frame data not kept by close")
+	}
+	if err := frame.Release(); err != nil {
+		t.Fatal("unable to release frame after close")
+	}
+}
+
+func TestCameraMPlane(t *testing.T) {
+	config := testFakeConfig()
+	config.Capabilities = CapVideoCaptureMPlane | CapStreaming
+	config.Formats = []FakeFormat{{PixFormat: PixFmtNV12M, Description: "Y/CbCr 4:2:0 (N-C)", FrameSizes: config.Formats[0].FrameSizes}}
+	device, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    device,
+		BufType:   BufTypeVideCaptureMPlane,
+		PixFormat: PixFmtNV12M,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer camera.StreamOff()
+	frame, err := camera.DequeueFrame()
+	if err != nil {
+		t.Fatal("unable to dequeue frame")
+	}
+	defer frame.Release()
+	if len(frame.Planes) != 2 || len(frame.Planes[0].Data) != 640*480 || len(frame.Planes[1].Data) != 640*480/2 {
+		t.Fatal("frame has incorrect planes")
+	}
+	data, err := camera.GrabFrame()
+	if err != nil {
+		t.Fatal("unable to grab frame")
+	}
+	if len(data) != 640*480*3/2 {
+		t.Fatal("grabbed frame has incorrect size")
+	}
+}
+
+func TestCameraDMABuf(t *testing.T) {
+	config := testFakeConfig()
+	config.Formats = config.Formats[2:]
+	config.Frame = nil
+	device, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	dmabufs := make([][]int, 3)
+	for i := range dmabufs {
+		memfd, err := unix.MemfdCreate("dmabuf", unix.MFD_CLOEXEC)
+		if err != nil {
+			t.Fatal("unable to create memfd")
+		}
+		defer unix.Close(memfd)
+		if err := unix.Ftruncate(memfd, 640*480*2); err != nil {
+			t.Fatal("unable to size memfd")
+		}
+		dmabufs[i] = []int{memfd}
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    device,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryDMABuf,
+		DMABufFDs: dmabufs,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer camera.StreamOff()
+	for sequence := 0; sequence < 4; sequence++ {
+		frame, err := camera.GrabFrame()
+		if err != nil {
+			t.Fatal("unable to grab frame")
+		}
+		if len(frame) != 640*480*2 || frame[0] != byte(sequence) {
+			t.Fatal("frame has incorrect content")
+		}
+	}
+	if _, err := camera.ExportBuffer(0, 0); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("export of imported buffer not rejected")
+	}
+}
+
+func TestCameraDMABufUnmappable(t *testing.T) {
+	config := testFakeConfig()
+	config.Formats = config.Formats[2:]
+	config.Frame = nil
+	device, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	dmabufs := make([][]int, 3)
+	for i := range dmabufs {
+		memfd, err := unix.MemfdCreate("dmabuf", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+		if err != nil {
+			t.Fatal("unable to create memfd")
+		}
+		defer unix.Close(memfd)
+		if err := unix.Ftruncate(memfd, 640*480*2); err != nil {
+			t.Fatal("unable to size memfd")
+		}
+		if _, err := unix.FcntlInt(uintptr(memfd), unix.F_ADD_SEALS, unix.F_SEAL_WRITE); err != nil {
+			t.Fatal("unable to seal memfd")
+		}
+		dmabufs[i] = []int{memfd}
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    device,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryDMABuf,
+		DMABufFDs: dmabufs,
+	})
+	if err != nil {
+		t.Fatal("unable to create camera with unmappable buffers")
+	}
+	defer camera.Close()
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer camera.StreamOff()
+	frame, err := camera.DequeueFrame()
+	if err != nil {
+		t.Fatal("unable to dequeue frame")
+	}
+	if frame.Planes != nil || frame.Data != nil || frame.BytesUsed != 640*480*2 {
+		t.Fatal("incorrect frame of unmappable buffer")
+	}
+	if err := frame.Release(); err != nil {
+		t.Fatal("unable to release frame")
+	}
+}
+
+func TestCameraExportBuffer(t *testing.T) {
+	camera, err := NewCamera(&CameraConfig{
+		Device:    openTestDevice(t),
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	dmabufFD, err := camera.ExportBuffer(0, 0)
+	if err != nil {
+		t.Fatal("unable to export buffer")
+	}
+	if _, err := unix.FcntlInt(uintptr(dmabufFD), unix.F_GETFD, 0); err != nil {
+		t.Fatal("exported file descriptor is not open")
+	}
+	camera.Close()
+	if _, err := unix.FcntlInt(uintptr(dmabufFD), unix.F_GETFD, 0); err != unix.EBADF {
+		t.Fatal("exported file descriptor not closed with camera")
+	}
+}
+
+func TestCameraUserPtr(t *testing.T) {
+	config := testFakeConfig()
+	config.Formats = config.Formats[2:]
+	config.Frame = nil
+	device, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    device,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryUserPtr,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer camera.StreamOff()
+	for sequence := 0; sequence < 8; sequence++ {
+		frame, err := camera.DequeueFrame()
+		if err != nil {
+			t.Fatal("unable to dequeue frame")
+		}
+		if len(frame.Data) != 640*480*2 || frame.Data[0] != byte(sequence) || frame.Data[len(frame.Data)-1] != byte(sequence) {
+			t.Fatal("frame has incorrect content")
+		}
+		if err := frame.Release(); err != nil {
+			t.Fatal("unable to release frame")
+		}
+	}
+}
+
+func TestCameraReadWrite(t *testing.T) {
+	config := testFakeConfig()
+	config.Capabilities = CapVideoCapture | CapReadWrite
+	config.Formats = config.Formats[2:]
+	config.Frame = nil
+	device, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    device,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtYUYV,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	for sequence := 0; sequence < 4; sequence++ {
+		frame, err := camera.GrabFrame()
+		if err != nil {
+			t.Fatal("unable to grab frame")
+		}
+		if len(frame) != 640*480*2 || frame[0] != byte(sequence) {
+			t.Fatal("frame has incorrect content")
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	frames, err := camera.Stream(ctx)
+	if err != nil {
+		t.Fatal("unable to start streaming")
+	}
+	frame := <-frames
+	if frame == nil || frame.Sequence != 4 || len(frame.Data) != 640*480*2 {
+		t.Fatal("streamed frame is incorrect")
+	}
+	cancel()
+	for range frames {
+	}
+}
+
+func TestCameraIOMethod(t *testing.T) {
+	device, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	_, err = NewCamera(&CameraConfig{
+		Device:    device,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+		IOMethod:  IOMethodReadWrite,
+	})
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatal("unsupported I/O method not rejected")
+	}
+	config := testFakeConfig()
+	config.Capabilities = CapVideoCapture | CapReadWrite
+	if device, err = NewFakeDevice(config); err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	_, err = NewCamera(&CameraConfig{
+		Device:    device,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+		IOMethod:  IOMethodStreaming,
+	})
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatal("unsupported streaming I/O not rejected")
+	}
+}
+
+// recordingDevice records the ioctls made through a device and keeps the
+// device open when closed.
+type recordingDevice struct {
+	Device
+	mutex    sync.Mutex
+	requests []uint32
+	closed   bool
+}
+
+func (d *recordingDevice) Ioctl(request uint32, arg unsafe.Pointer) error {
+	d.mutex.Lock()
+	d.requests = append(d.requests, request)
+	d.mutex.Unlock()
+	return d.Device.Ioctl(request, arg)
+}
+
+func (d *recordingDevice) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.closed = true
+	return nil
+}
+
+func TestCameraClose(t *testing.T) {
+	fake, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	device := &recordingDevice{Device: fake}
+	RegisterDevice(device)
+	defer RegisterDevice(fake)
+	camera, err := NewCamera(&CameraConfig{
+		Device:    device,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	if err := camera.StreamOn(); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	frame, err := camera.DequeueFrame()
+	if err != nil {
+		t.Fatal("unable to dequeue frame")
+	}
+	frames, err := camera.Stream(context.Background())
+	if err != nil {
+		t.Fatal("unable to start streaming")
+	}
+	<-frames
+	if err := camera.Close(); err != nil {
+		t.Fatalf("unable to close camera: %v", err)
+	}
+	for range frames {
+	}
+	// The capture goroutine may still have been dequeueing when Close began.
+	start := slices.Index(device.requests, VidIocStreamOff)
+	if start < 0 || !slices.Equal(device.requests[start:], []uint32{VidIocStreamOff, VidIocReqBufs}) || !device.closed {
+		t.Fatal("camera not torn down in order")
+	}
+	if err := camera.Close(); err != nil {
+		t.Fatal("second close failed")
+	}
+	if _, err := camera.GrabFrame(); !errors.Is(err, ErrClosed) {
+		t.Fatal("grab after close not rejected")
+	}
+	if _, err := camera.QueryControls(); !errors.Is(err, ErrClosed) {
+		t.Fatal("control query after close not rejected")
+	}
+	if _, err := camera.Stream(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatal("stream after close not rejected")
+	}
+	if err := frame.Release(); err != nil {
+		t.Fatal("release of a frame detached by close failed")
+	}
+	select {
+	case err := <-camera.Errors():
+		t.Fatalf("unexpected streaming error: %v", err)
+	default:
+	}
+	if _, err := RequestDriverBuffers(fake.Fd(), 4, BufTypeVideoCapture, MemoryMmap); err != nil {
+		t.Fatal("buffers not released by close")
+	}
+}
+
+func TestCameraEvents(t *testing.T) {
+	fake, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	camera, err := NewCamera(&CameraConfig{
+		Device:    fake,
+		BufType:   BufTypeVideoCapture,
+		PixFormat: PixFmtMJPEG,
+		Width:     640,
+		Height:    480,
+		Memory:    MemoryMmap,
+		BufCount:  4,
+	})
+	if err != nil {
+		t.Fatal("unable to create new camera")
+	}
+	defer camera.Close()
+	if err := camera.SubscribeEvent(EventTypeCtrl, uint32(CidBrightness), 0); err != nil {
+		t.Fatal("unable to subscribe to control events")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	frames, err := camera.Stream(ctx)
+	if err != nil {
+		t.Fatal("unable to start streaming")
+	}
+	events, err := camera.Events(ctx)
+	if err != nil {
+		t.Fatal("unable to start watching events")
+	}
+	if _, err := camera.Events(ctx); err != ErrWatching {
+		t.Fatal("second event watch not rejected")
+	}
+	if _, ok := <-frames; !ok {
+		t.Fatal("frame channel closed prematurely")
+	}
+	if err := fake.ChangeControl(CidBrightness, 200); err != nil {
+		t.Fatal("unable to change control")
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventTypeCtrl || event.Ctrl().Value != 200 {
+			t.Fatal("event has incorrect content")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered")
+	}
+	if _, ok := <-frames; !ok {
+		t.Fatal("frame channel closed while watching events")
+	}
+	if err := camera.Close(); err != nil {
+		t.Fatal("unable to close camera")
+	}
+	for range events {
+	}
+	if err := camera.SubscribeEvent(EventTypeEOS, 0, 0); !errors.Is(err, ErrClosed) {
+		t.Fatal("subscribe after close not rejected")
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Decoder is a stateful memory-to-memory hardware decoder. Packets are fed
+// with Decode and the decoded frames taken with NextFrame, which may run in
+// separate goroutines. The CAPTURE queue is set up once the decoder has parsed
+// the stream and set up again whenever the resolution changes, so Width,
+// Height and PixFormat are zero until the first frame can be decoded.
+type Decoder interface {
+	Width() uint32
+	Height() uint32
+	PixFormat() PixFmt
+	Decode(data []byte, timestamp time.Duration) error
+	NextFrame(timeout time.Duration) (*Frame, error)
+	Drain() error
+	Flush() error
+	Close() error
+}
+
+// DecoderConfig is the configuration of a Decoder.
+type DecoderConfig struct {
+	Path        string
+	Device      Device // Optional, opened from Path when nil.
+	CodedFormat PixFmt // Format of the packets, such as PixFmtH264.
+	Width       uint32 // Coded size if known, the stream decides either way.
+	Height      uint32
+	PixFormat   PixFmt // Format of the decoded frames, zero for the decoder's choice.
+	BufCount    uint32 // Buffers per queue, raised to what the decoder needs for CAPTURE.
+}
+
+type decoder struct {
+	device       Device
+	fd           int
+	pixFormat    PixFmt // Requested format of the decoded frames.
+	bufCount     uint32
+	captureType  BufType
+	output       *m2mQueue
+	capture      *m2mQueue  // Nil until the stream resolution is known.
+	changed      bool       // A source change awaits reconfiguring the CAPTURE queue.
+	last         bool       // The last buffer before a drain or source change was dequeued.
+	outputMutex  sync.Mutex // Guards the OUTPUT queue.
+	captureMutex sync.Mutex // Guards the CAPTURE queue.
+	formatMutex  sync.Mutex // Guards the decoded format.
+	format       PixFormat
+	closed       bool // Written with both queue mutexes held.
+	closeOnce    sync.Once
+	closeErr     error
+}
+
+// NewDecoder configures the OUTPUT queue of a decoder and starts streaming it.
+func NewDecoder(config *DecoderConfig) (Decoder, error) {
+	var err error
+	device, err := openDevice(config.Device, config.Path)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{device: device, fd: device.Fd(), pixFormat: config.PixFormat, bufCount: config.BufCount}
+	defer func() {
+		if err != nil {
+			d.teardown()
+		}
+	}()
+	capabilities, err := QueryCapabilities(d.fd)
+	if err != nil {
+		return nil, err
+	}
+	outputType, captureType, err := m2mBufTypes(capabilities)
+	if err != nil {
+		return nil, err
+	}
+	d.captureType = captureType
+	var outputSizes []uint32
+	if _, _, outputSizes, err = negotiateFormat(d.fd, outputType, config.CodedFormat, config.Width, config.Height); err != nil {
+		return nil, err
+	}
+	if err = SubscribeEvent(d.fd, EventTypeSourceChange, 0, 0); err != nil {
+		return nil, err
+	}
+	d.output = newM2MQueue(device, outputType, outputSizes)
+	if err = d.output.allocate(config.BufCount); err != nil {
+		return nil, err
+	}
+	if err = StreamOn(d.fd, outputType); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *decoder) Width() uint32 {
+	d.formatMutex.Lock()
+	defer d.formatMutex.Unlock()
+	return d.format.Width
+}
+
+func (d *decoder) Height() uint32 {
+	d.formatMutex.Lock()
+	defer d.formatMutex.Unlock()
+	return d.format.Height
+}
+
+func (d *decoder) PixFormat() PixFmt {
+	d.formatMutex.Lock()
+	defer d.formatMutex.Unlock()
+	return d.format.PixFormat
+}
+
+// Decode queues a packet, waiting for the decoder to free an OUTPUT buffer if
+// necessary. Until the stream resolution is known the decoder may hold on to
+// the packets queued, so NextFrame must be called to make progress.
+func (d *decoder) Decode(data []byte, timestamp time.Duration) error {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	index, err := d.output.acquire(m2mTimeout)
+	if err != nil {
+		return err
+	}
+	if err := d.output.enqueue(index, data, 0, timestamp); err != nil {
+		d.output.free = append(d.output.free, index)
+		return err
+	}
+	return nil
+}
+
+// NextFrame waits up to timeout for a decoded frame, whose timestamp is that
+// of the packet it was decoded from. Source changes are handled along the way
+// by setting up the CAPTURE queue again. Once a drain has completed it
+// returns io.EOF.
+func (d *decoder) NextFrame(timeout time.Duration) (*Frame, error) {
+	d.captureMutex.Lock()
+	defer d.captureMutex.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if d.last && !d.changed {
+			if err := d.handleEvents(); err != nil {
+				return nil, err
+			}
+		}
+		if d.changed && (d.capture == nil || d.last) {
+			if err := d.configureCapture(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if d.last {
+			return nil, io.EOF
+		}
+		events := int16(unix.POLLPRI)
+		if d.capture != nil {
+			events |= unix.POLLIN
+		}
+		revents, err := poll(d.device, events, max(time.Until(deadline), 0))
+		if err != nil {
+			return nil, err
+		}
+		if revents&unix.POLLPRI != 0 {
+			if err := d.handleEvents(); err != nil {
+				return nil, err
+			}
+		}
+		if revents&unix.POLLIN != 0 && d.capture != nil {
+			frame, err := d.dequeueFrame()
+			if err != nil || frame != nil {
+				return frame, err
+			}
+		}
+		if revents&(unix.POLLIN|unix.POLLPRI) == 0 {
+			if err := pollError(d.fd, revents); err != nil {
+				return nil, err
+			}
+			if time.Now().After(deadline) {
+				return nil, ErrTimeout
+			}
+		}
+	}
+}
+
+// handleEvents dequeues the pending events, noting resolution changes.
+func (d *decoder) handleEvents() error {
+	for {
+		event, err := DequeueEvent(d.fd)
+		if errors.Is(err, syscall.ENOENT) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if event.Type == EventTypeSourceChange && event.SrcChange().Changes&EventSrcChResolution != 0 {
+			d.changed = true
+		}
+	}
+}
+
+// dequeueFrame dequeues a CAPTURE buffer and hands it back, returning a copy
+// of the frame it holds or nil if it holds none. The buffer flagged
+// BufFlagLast ends a drain or precedes setting up the CAPTURE queue again.
+func (d *decoder) dequeueFrame() (*Frame, error) {
+	buffer, err := d.capture.dequeueBuffer()
+	switch {
+	case errors.Is(err, syscall.EPIPE):
+		d.last = true
+		return nil, nil
+	case errors.Is(err, syscall.EAGAIN):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	if buffer.Flags&BufFlagLast != 0 {
+		d.last = true
+	}
+	var frame *Frame
+	if buffer.Planes[0].BytesUsed > 0 && buffer.Flags&BufFlagError == 0 {
+		frame = newFrame(buffer, d.capture.buffers[buffer.Index], true)
+	}
+	if err := d.capture.enqueue(buffer.Index, nil, 0, 0); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// configureCapture releases the CAPTURE queue, if any, and sets it up again
+// for the format the decoder reports for the stream.
+func (d *decoder) configureCapture() error {
+	if d.capture != nil {
+		err := errors.Join(StreamOff(d.fd, d.captureType), d.capture.release())
+		d.capture = nil
+		if err != nil {
+			return err
+		}
+	}
+	d.changed = false
+	d.last = false
+	format, err := GetFormat(d.fd, d.captureType)
+	if err != nil {
+		return err
+	}
+	// The single- and multi-planar formats start with the same fields.
+	pix := *(*PixFormat)(unsafe.Pointer(&format.RawData[0]))
+	if d.pixFormat != 0 {
+		pix.PixFormat = d.pixFormat
+	}
+	width, height, sizes, err := negotiateFormat(d.fd, d.captureType, pix.PixFormat, pix.Width, pix.Height)
+	if err != nil {
+		return err
+	}
+	count := d.bufCount
+	if control, err := GetControl(d.fd, CidMinBuffersForCapture); err == nil {
+		count = max(count, uint32(control.Value))
+	}
+	capture := newM2MQueue(d.device, d.captureType, sizes)
+	if err := capture.allocate(count); err != nil {
+		return err
+	}
+	if err := capture.enqueueAll(); err != nil {
+		return errors.Join(err, capture.release())
+	}
+	if err := StreamOn(d.fd, d.captureType); err != nil {
+		return errors.Join(err, capture.release())
+	}
+	d.capture = capture
+	d.formatMutex.Lock()
+	d.format = PixFormat{Width: width, Height: height, PixFormat: pix.PixFormat}
+	d.formatMutex.Unlock()
+	return nil
+}
+
+// Drain makes the decoder decode every packet queued so far, after which
+// NextFrame returns the remaining frames followed by io.EOF. Flush resumes
+// decoding afterwards.
+func (d *decoder) Drain() error {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	return DecoderCommand(d.fd, DecCmdStop, 0)
+}
+
+// Flush discards the packets queued and the frames decoded but not yet
+// returned, as seeking requires. The next packet should be a keyframe.
+func (d *decoder) Flush() error {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	d.captureMutex.Lock()
+	defer d.captureMutex.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	if err := StreamOff(d.fd, d.output.bufType); err != nil {
+		return err
+	}
+	d.output.reset()
+	if err := StreamOn(d.fd, d.output.bufType); err != nil {
+		return err
+	}
+	if d.capture == nil {
+		return nil
+	}
+	if d.changed {
+		return d.configureCapture()
+	}
+	if err := StreamOff(d.fd, d.captureType); err != nil {
+		return err
+	}
+	d.capture.reset()
+	d.last = false
+	if err := d.capture.enqueueAll(); err != nil {
+		return err
+	}
+	return StreamOn(d.fd, d.captureType)
+}
+
+// Close stops streaming, releases the buffers and closes the device.
+func (d *decoder) Close() error {
+	d.closeOnce.Do(func() {
+		d.outputMutex.Lock()
+		defer d.outputMutex.Unlock()
+		d.captureMutex.Lock()
+		defer d.captureMutex.Unlock()
+		d.closed = true
+		d.closeErr = d.teardown()
+	})
+	return d.closeErr
+}
+
+// teardown stops streaming, releases whatever queues were allocated and
+// closes the device.
+func (d *decoder) teardown() error {
+	var errs []error
+	for _, queue := range []*m2mQueue{d.output, d.capture} {
+		if queue == nil {
+			continue
+		}
+		errs = append(errs, StreamOff(d.fd, queue.bufType), queue.release())
+	}
+	errs = append(errs, d.device.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func testDecoderConfig() *FakeConfig {
+	return &FakeConfig{
+		Driver:       "fake",
+		Card:         "Fake Decoder",
+		BusInfo:      "platform:fake",
+		Capabilities: CapVideoM2MMPlane | CapStreaming,
+		Formats: []FakeFormat{{
+			PixFormat:   PixFmtNV12M,
+			Description: "Y/UV 4:2:0 (N-C)",
+			FrameSizes:  []FrameSizeDiscrete{{Width: 1920, Height: 1080}},
+		}},
+		OutputFormats: []FakeFormat{{
+			PixFormat:   PixFmtH264,
+			Description: "H.264",
+			Flags:       FmtFlagCompressed | FmtFlagDynResolution,
+			FrameSizes:  []FrameSizeDiscrete{{Width: 1920, Height: 1080}},
+		}},
+		Controls: []FakeControl{
+			{ID: CidMinBuffersForCapture, Type: CtrlTypeInteger, Name: "Min Number of Capture Buffers", Minimum: 1, Maximum: 32, Step: 1, DefaultValue: 3, Value: 3, Flags: CtrlFlagReadOnly},
+		},
+	}
+}
+
+// testPacket returns a packet in the format the fake encoder produces.
+func testPacket(width uint32, height uint32, keyFrame bool, value byte) []byte {
+	packet := make([]byte, fakePacketHeader+1)
+	binary.LittleEndian.PutUint32(packet[0:], width)
+	binary.LittleEndian.PutUint32(packet[4:], height)
+	if keyFrame {
+		binary.LittleEndian.PutUint32(packet[8:], 1)
+	}
+	packet[fakePacketHeader] = value
+	return packet
+}
+
+func TestDecoder(t *testing.T) {
+	fake, err := NewFakeDevice(testDecoderConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	decoder, err := NewDecoder(&DecoderConfig{
+		Device:      fake,
+		CodedFormat: PixFmtH264,
+		BufCount:    2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new decoder")
+	}
+	defer decoder.Close()
+	if decoder.Width() != 0 || decoder.Height() != 0 {
+		t.Fatal("resolution known before decoding")
+	}
+	next := func(value byte, size int) *Frame {
+		frame, err := decoder.NextFrame(time.Second)
+		if err != nil {
+			t.Fatal("unable to get frame")
+		}
+		if !bytes.Equal(frame.Data, bytes.Repeat([]byte{value}, size)) {
+			t.Fatal("incorrect frame returned")
+		}
+		return frame
+	}
+	if err := decoder.Decode(testPacket(320, 240, true, 1), 40*time.Millisecond); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	frame := next(1, 320*240)
+	if decoder.Width() != 320 || decoder.Height() != 240 || decoder.PixFormat() != PixFmtNV12M {
+		t.Fatal("incorrect format after source change")
+	}
+	if frame.Timestamp != 40*time.Millisecond || frame.Flags&BufFlagTimestampCopy == 0 || frame.Flags&BufFlagKeyFrame == 0 {
+		t.Fatal("incorrect frame metadata")
+	}
+	if _, err := QueryBufferMPlane(fake.Fd(), 2, BufTypeVideCaptureMPlane, MemoryMmap); err != nil {
+		t.Fatal("decoder minimum capture buffers not allocated")
+	}
+	if err := decoder.Decode(testPacket(320, 240, false, 2), 0); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	if frame := next(2, 320*240); frame.Flags&BufFlagPFrame == 0 {
+		t.Fatal("incorrect frame flags")
+	}
+	if err := decoder.Decode(testPacket(640, 480, true, 3), 0); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	next(3, 640*480)
+	if decoder.Width() != 640 || decoder.Height() != 480 {
+		t.Fatal("resolution change not handled")
+	}
+	if err := decoder.Decode(testPacket(640, 480, false, 4), 0); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	if err := decoder.Flush(); err != nil {
+		t.Fatal("unable to flush decoder")
+	}
+	if err := decoder.Decode(testPacket(640, 480, true, 5), 0); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	next(5, 640*480)
+	if err := decoder.Decode(testPacket(640, 480, false, 6), 0); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	if err := decoder.Drain(); err != nil {
+		t.Fatal("unable to drain decoder")
+	}
+	next(6, 640*480)
+	for i := 0; i < 2; i++ {
+		if _, err := decoder.NextFrame(time.Second); !errors.Is(err, io.EOF) {
+			t.Fatal("drain not completed")
+		}
+	}
+	if err := decoder.Flush(); err != nil {
+		t.Fatal("unable to flush decoder")
+	}
+	if err := decoder.Decode(testPacket(640, 480, true, 7), 0); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	next(7, 640*480)
+	if _, err := decoder.NextFrame(10 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatal("frame returned without packet")
+	}
+	if err := decoder.Close(); err != nil {
+		t.Fatal("unable to close decoder")
+	}
+	if _, err := decoder.NextFrame(time.Second); !errors.Is(err, ErrClosed) {
+		t.Fatal("frame returned after close")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"io"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Device is the low-level I/O interface of a V4L2 device.
+// All functions in this package that take a file descriptor route their
+// system calls through the Device registered for that descriptor, falling
+// back to plain system calls when none is registered.
+type Device interface {
+	io.Closer
+	// Fd returns the file descriptor identifying the device.
+	Fd() int
+	// Ioctl performs the ioctl request with arg pointing at the request struct.
+	Ioctl(request uint32, arg unsafe.Pointer) error
+	// Read reads a frame using read() I/O.
+	Read(p []byte) (int, error)
+	// Mmap maps length bytes of device memory at offset. The mapping must be
+	// releasable with unix.Munmap.
+	Mmap(offset int64, length int) ([]byte, error)
+	// Poll waits up to timeout for any of the poll events to become ready and
+	// returns the events that are ready; zero means the timeout expired.
+	Poll(events int16, timeout time.Duration) (int16, error)
+}
+
+var (
+	devicesMutex sync.RWMutex
+	devices      = make(map[int]Device)
+	paths        = make(map[int]string) // Device paths by file descriptor, for errors.
+)
+
+// RegisterDevice makes device the target of all calls made with its file descriptor.
+func RegisterDevice(device Device) {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+	devices[device.Fd()] = device
+}
+
+// UnregisterDevice removes a device previously registered with RegisterDevice.
+func UnregisterDevice(device Device) {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+	if devices[device.Fd()] == device {
+		delete(devices, device.Fd())
+	}
+}
+
+// OpenDevice opens the device at path using plain system calls.
+func OpenDevice(path string) (Device, error) {
+	fd, err := unix.Open(path, unix.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	setDevicePath(fd, path)
+	return sysDevice(fd), nil
+}
+
+// openDevice returns device, or the device opened from path when device is
+// nil. The path of a given device is used in errors until it is closed.
+func openDevice(device Device, path string) (Device, error) {
+	if device == nil {
+		return OpenDevice(path)
+	}
+	if path == "" {
+		return device, nil
+	}
+	setDevicePath(device.Fd(), path)
+	return namedDevice{device}, nil
+}
+
+// setDevicePath records the path of the device identified by fd, an empty
+// path forgets it.
+func setDevicePath(fd int, path string) {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+	if path == "" {
+		delete(paths, fd)
+	} else {
+		paths[fd] = path
+	}
+}
+
+// devicePath returns the path the device identified by fd was opened from,
+// empty if unknown.
+func devicePath(fd int) string {
+	devicesMutex.RLock()
+	defer devicesMutex.RUnlock()
+	return paths[fd]
+}
+
+// namedDevice forgets the path of a device when it is closed.
+type namedDevice struct {
+	Device
+}
+
+func (d namedDevice) Close() error {
+	setDevicePath(d.Fd(), "")
+	return d.Device.Close()
+}
+
+// lookupDevice returns the device registered for fd, or a system call device.
+func lookupDevice(fd int) Device {
+	devicesMutex.RLock()
+	defer devicesMutex.RUnlock()
+	if device, ok := devices[fd]; ok {
+		return device
+	}
+	return sysDevice(fd)
+}
+
+// ioctl performs the ioctl request on the device identified by fd.
+// Failures are returned as *IoctlError.
+func ioctl(fd int, request uint32, arg unsafe.Pointer) error {
+	if err := lookupDevice(fd).Ioctl(request, arg); err != nil {
+		return newIoctlError(fd, ioctlName(request), request, err)
+	}
+	return nil
+}
+
+// poll waits for events on a device like Device.Poll.
+// Failures are returned as *IoctlError.
+func poll(device Device, events int16, timeout time.Duration) (int16, error) {
+	revents, err := device.Poll(events, timeout)
+	if err != nil {
+		return 0, newIoctlError(device.Fd(), "poll", 0, err)
+	}
+	return revents, nil
+}
+
+// sysDevice is a Device backed by plain system calls on a file descriptor.
+type sysDevice int
+
+func (d sysDevice) Close() error {
+	setDevicePath(int(d), "")
+	return unix.Close(int(d))
+}
+
+func (d sysDevice) Fd() int {
+	return int(d)
+}
+
+func (d sysDevice) Ioctl(request uint32, arg unsafe.Pointer) error {
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(d), uintptr(request), uintptr(arg)); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (d sysDevice) Read(p []byte) (int, error) {
+	for {
+		n, err := unix.Read(int(d), p)
+		if err == unix.EINTR {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (d sysDevice) Mmap(offset int64, length int) ([]byte, error) {
+	return unix.Mmap(int(d), offset, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+func (d sysDevice) Poll(events int16, timeout time.Duration) (int16, error) {
+	fds := []unix.PollFd{{Fd: int32(d), Events: events}}
+	for {
+		n, err := unix.Poll(fds, int(timeout/time.Millisecond))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || n == 0 {
+			return 0, err
+		}
+		return fds[0].Revents, nil
+	}
+}
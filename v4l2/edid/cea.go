@@ -0,0 +1,302 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package edid
+
+// ceaTag identifies a CEA-861 extension block.
+const ceaTag = 0x02
+
+// The CEA-861 data block tags.
+const (
+	blockAudio             = 1
+	blockVideo             = 2
+	blockVendorSpecific    = 3
+	blockSpeakerAllocation = 4
+)
+
+// hdmiOUI is the IEEE OUI of the HDMI Licensing vendor specific data block.
+const hdmiOUI = 0x000c03
+
+// CEAExtension is a parsed CEA-861 extension block.
+type CEAExtension struct {
+	Revision          uint8
+	Underscan         bool
+	BasicAudio        bool
+	YCbCr444          bool
+	YCbCr422          bool
+	NativeDTDs        uint8 // Number of native formats among the detailed timings.
+	VideoModes        []ShortVideoDescriptor
+	AudioDescriptors  []ShortAudioDescriptor
+	SpeakerAllocation SpeakerAllocation
+	HDMI              *HDMIVendorBlock
+	OtherBlocks       []DataBlock // Data blocks not parsed above.
+	DetailedTimings   []DetailedTiming
+}
+
+// ShortVideoDescriptor is a mode in the video data block.
+type ShortVideoDescriptor struct {
+	VIC    VIC
+	Native bool
+}
+
+// AudioFormat is the audio format code type.
+type AudioFormat uint8
+
+// The audio format codes.
+const (
+	AudioFormatLPCM   AudioFormat = 1
+	AudioFormatAC3    AudioFormat = 2
+	AudioFormatMPEG1  AudioFormat = 3
+	AudioFormatMP3    AudioFormat = 4
+	AudioFormatMPEG2  AudioFormat = 5
+	AudioFormatAAC    AudioFormat = 6
+	AudioFormatDTS    AudioFormat = 7
+	AudioFormatATRAC  AudioFormat = 8
+	AudioFormatDSD    AudioFormat = 9
+	AudioFormatEAC3   AudioFormat = 10
+	AudioFormatDTSHD  AudioFormat = 11
+	AudioFormatMLP    AudioFormat = 12
+	AudioFormatDST    AudioFormat = 13
+	AudioFormatWMAPro AudioFormat = 14
+)
+
+// SampleRate is the audio sample rate bitmask type.
+type SampleRate uint8
+
+// The audio sample rates.
+const (
+	SampleRate32kHz SampleRate = 1 << iota
+	SampleRate44kHz            // 44.1 kHz
+	SampleRate48kHz
+	SampleRate88kHz // 88.2 kHz
+	SampleRate96kHz
+	SampleRate176kHz // 176.4 kHz
+	SampleRate192kHz
+)
+
+// The LPCM bit depths.
+const (
+	BitDepth16 uint8 = 1 << iota
+	BitDepth20
+	BitDepth24
+)
+
+// ShortAudioDescriptor is an entry of the audio data block.
+type ShortAudioDescriptor struct {
+	Format      AudioFormat
+	Channels    uint8
+	SampleRates SampleRate
+	Detail      uint8 // Bit depths for LPCM, maximum bitrate / 8 kbps for AC-3 to ATRAC.
+}
+
+// MaxBitrate returns the maximum bitrate in kbps of formats AC-3 to ATRAC.
+func (d *ShortAudioDescriptor) MaxBitrate() int {
+	if d.Format < AudioFormatAC3 || d.Format > AudioFormatATRAC {
+		return 0
+	}
+	return int(d.Detail) * 8
+}
+
+// SpeakerAllocation is the speaker allocation bitmask type.
+type SpeakerAllocation uint8
+
+// The speaker allocations.
+const (
+	SpeakerFLFR SpeakerAllocation = 1 << iota
+	SpeakerLFE
+	SpeakerFC
+	SpeakerRLRR
+	SpeakerRC
+	SpeakerFLCFRC
+	SpeakerRLCRRC
+)
+
+// HDMIVendorBlock is the HDMI 1.4 vendor specific data block.
+type HDMIVendorBlock struct {
+	PhysicalAddress uint16 // A.B.C.D packed into nibbles.
+	Extra           []byte // The payload following the physical address.
+}
+
+// DataBlock is a raw data block.
+type DataBlock struct {
+	Tag  uint8
+	Data []byte
+}
+
+// parseCEA parses a CEA-861 extension block.
+func parseCEA(block []byte) (*CEAExtension, error) {
+	cea := &CEAExtension{
+		Revision:   block[1],
+		Underscan:  block[3]&0x80 != 0,
+		BasicAudio: block[3]&0x40 != 0,
+		YCbCr444:   block[3]&0x20 != 0,
+		YCbCr422:   block[3]&0x10 != 0,
+		NativeDTDs: block[3] & 0x0f,
+	}
+	offset := int(block[2])
+	if offset == 0 {
+		return cea, nil
+	}
+	if offset < 4 || offset > 127 {
+		return nil, ErrInvalidValue
+	}
+	for i := 4; i < offset; {
+		tag := block[i] >> 5
+		length := int(block[i] & 0x1f)
+		if i+1+length > offset {
+			return nil, ErrInvalidValue
+		}
+		data := block[i+1 : i+1+length]
+		i += 1 + length
+		switch {
+		case tag == blockVideo:
+			for _, svd := range data {
+				cea.VideoModes = append(cea.VideoModes, parseSVD(svd))
+			}
+		case tag == blockAudio:
+			for j := 0; j+3 <= len(data); j += 3 {
+				cea.AudioDescriptors = append(cea.AudioDescriptors, ShortAudioDescriptor{
+					Format:      AudioFormat(data[j] >> 3 & 0x0f),
+					Channels:    data[j]&0x07 + 1,
+					SampleRates: SampleRate(data[j+1] & 0x7f),
+					Detail:      data[j+2],
+				})
+			}
+		case tag == blockSpeakerAllocation && length >= 1:
+			cea.SpeakerAllocation = SpeakerAllocation(data[0])
+		case tag == blockVendorSpecific && length >= 5 && oui(data) == hdmiOUI:
+			cea.HDMI = &HDMIVendorBlock{
+				PhysicalAddress: uint16(data[3])<<8 | uint16(data[4]),
+				Extra:           append([]byte(nil), data[5:]...),
+			}
+		default:
+			cea.OtherBlocks = append(cea.OtherBlocks, DataBlock{Tag: tag, Data: append([]byte(nil), data...)})
+		}
+	}
+	for i := offset; i+18 <= 127; i += 18 {
+		if block[i] == 0 && block[i+1] == 0 {
+			break
+		}
+		cea.DetailedTimings = append(cea.DetailedTimings, parseDetailedTiming(block[i:i+18]))
+	}
+	return cea, nil
+}
+
+// parseSVD parses a short video descriptor, where codes 129 to 192 mark VICs
+// 1 to 64 as native.
+func parseSVD(svd byte) ShortVideoDescriptor {
+	if svd >= 129 && svd <= 192 {
+		return ShortVideoDescriptor{VIC: VIC(svd & 0x7f), Native: true}
+	}
+	return ShortVideoDescriptor{VIC: VIC(svd)}
+}
+
+// oui returns the little-endian IEEE OUI starting a vendor specific block.
+func oui(data []byte) uint32 {
+	return uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+}
+
+// marshal encodes the extension block.
+func (cea *CEAExtension) marshal() ([]byte, error) {
+	block := make([]byte, BlockSize)
+	block[0] = ceaTag
+	block[1] = cea.Revision
+	if cea.NativeDTDs > 0x0f {
+		return nil, ErrInvalidValue
+	}
+	block[3] = cea.NativeDTDs
+	for _, flag := range []struct {
+		set  bool
+		mask byte
+	}{{cea.Underscan, 0x80}, {cea.BasicAudio, 0x40}, {cea.YCbCr444, 0x20}, {cea.YCbCr422, 0x10}} {
+		if flag.set {
+			block[3] |= flag.mask
+		}
+	}
+	var blocks []DataBlock
+	if len(cea.VideoModes) > 0 {
+		data := make([]byte, 0, len(cea.VideoModes))
+		for _, svd := range cea.VideoModes {
+			code, err := svd.marshal()
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, code)
+		}
+		blocks = append(blocks, DataBlock{Tag: blockVideo, Data: data})
+	}
+	if len(cea.AudioDescriptors) > 0 {
+		data := make([]byte, 0, 3*len(cea.AudioDescriptors))
+		for _, sad := range cea.AudioDescriptors {
+			if sad.Format > 0x0f || sad.Channels < 1 || sad.Channels > 8 {
+				return nil, ErrInvalidValue
+			}
+			data = append(data, byte(sad.Format)<<3|(sad.Channels-1), byte(sad.SampleRates&0x7f), sad.Detail)
+		}
+		blocks = append(blocks, DataBlock{Tag: blockAudio, Data: data})
+	}
+	if cea.SpeakerAllocation != 0 {
+		blocks = append(blocks, DataBlock{Tag: blockSpeakerAllocation, Data: []byte{byte(cea.SpeakerAllocation), 0, 0}})
+	}
+	if cea.HDMI != nil {
+		data := []byte{byte(hdmiOUI & 0xff), byte(hdmiOUI >> 8 & 0xff), byte(hdmiOUI >> 16), byte(cea.HDMI.PhysicalAddress >> 8), byte(cea.HDMI.PhysicalAddress)}
+		blocks = append(blocks, DataBlock{Tag: blockVendorSpecific, Data: append(data, cea.HDMI.Extra...)})
+	}
+	blocks = append(blocks, cea.OtherBlocks...)
+	offset := 4
+	for _, dataBlock := range blocks {
+		if len(dataBlock.Data) > 0x1f || dataBlock.Tag > 0x07 {
+			return nil, ErrInvalidValue
+		}
+		if offset+1+len(dataBlock.Data) > 127 {
+			return nil, ErrBlockFull
+		}
+		block[offset] = dataBlock.Tag<<5 | byte(len(dataBlock.Data))
+		copy(block[offset+1:], dataBlock.Data)
+		offset += 1 + len(dataBlock.Data)
+	}
+	block[2] = byte(offset)
+	for i := range cea.DetailedTimings {
+		descriptor, err := cea.DetailedTimings[i].marshal()
+		if err != nil {
+			return nil, err
+		}
+		if offset+18 > 127 {
+			return nil, ErrBlockFull
+		}
+		copy(block[offset:], descriptor)
+		offset += 18
+	}
+	block[127] = -checksum(block[:127])
+	return block, nil
+}
+
+// marshal encodes the short video descriptor.
+func (svd ShortVideoDescriptor) marshal() (byte, error) {
+	switch {
+	case svd.VIC == 0 || svd.VIC > 127 && svd.VIC < 193:
+		return 0, ErrInvalidValue
+	case svd.Native && svd.VIC <= 64:
+		return byte(svd.VIC) | 0x80, nil
+	case svd.Native:
+		return 0, ErrInvalidValue
+	}
+	return byte(svd.VIC), nil
+}
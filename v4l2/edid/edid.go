@@ -0,0 +1,492 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package edid parses and builds VESA E-EDID data with CEA-861 extensions, as
+// read from and written to HDMI receivers with the v4l2 EDID ioctls.
+package edid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+)
+
+// BlockSize is the size of an EDID block.
+const BlockSize = 128
+
+var (
+	ErrTruncated     = errors.New("edid: data is not a whole number of blocks")
+	ErrInvalidHeader = errors.New("edid: invalid header")
+	ErrChecksum      = errors.New("edid: block checksum mismatch")
+	ErrInvalidValue  = errors.New("edid: value cannot be encoded")
+	ErrBlockFull     = errors.New("edid: too much data for a block")
+)
+
+// header starts every base block.
+var header = []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}
+
+// EDID is a parsed base block along with its CEA-861 extension, if any.
+type EDID struct {
+	Manufacturer     string // Three letter PNP ID.
+	ProductCode      uint16
+	SerialNumber     uint32
+	Week             uint8
+	Year             int
+	Version          uint8
+	Revision         uint8
+	Digital          bool
+	WidthCM          uint8
+	HeightCM         uint8
+	Gamma            float64 // Zero if not given in the base block.
+	Features         uint8
+	Chromaticity     [10]byte
+	EstablishedModes []Mode
+	StandardModes    []Mode
+	DetailedTimings  []DetailedTiming // The first is the preferred timing.
+	Name             string
+	SerialString     string
+	RangeLimits      *RangeLimits
+	CEA              *CEAExtension // Only the first CEA-861 extension is parsed.
+}
+
+// Mode is a video mode.
+type Mode struct {
+	Width       int
+	Height      int
+	RefreshRate int
+	Interlaced  bool
+}
+
+// DetailedTiming is an 18 byte detailed timing descriptor. Vertical values
+// are per field for interlaced timings.
+type DetailedTiming struct {
+	PixelClock    uint64 // Hz, a multiple of 10 kHz.
+	HActive       uint16
+	HBlank        uint16
+	HFrontPorch   uint16
+	HSync         uint16
+	VActive       uint16
+	VBlank        uint16
+	VFrontPorch   uint16
+	VSync         uint16
+	HImageSize    uint16 // mm
+	VImageSize    uint16 // mm
+	HBorder       uint8
+	VBorder       uint8
+	Interlaced    bool
+	HSyncPositive bool
+	VSyncPositive bool
+}
+
+// HTotal returns the total line length in pixels.
+func (t *DetailedTiming) HTotal() int {
+	return int(t.HActive) + int(t.HBlank)
+}
+
+// VTotal returns the total number of lines per field.
+func (t *DetailedTiming) VTotal() int {
+	return int(t.VActive) + int(t.VBlank)
+}
+
+// RefreshRate returns the vertical refresh rate in Hz, which is the field
+// rate for interlaced timings.
+func (t *DetailedTiming) RefreshRate() float64 {
+	total := t.HTotal() * t.VTotal()
+	if total == 0 {
+		return 0
+	}
+	return float64(t.PixelClock) / float64(total)
+}
+
+// Mode returns the video mode of the timing.
+func (t *DetailedTiming) Mode() Mode {
+	mode := Mode{
+		Width:       int(t.HActive),
+		Height:      int(t.VActive),
+		RefreshRate: int(math.Round(t.RefreshRate())),
+		Interlaced:  t.Interlaced,
+	}
+	if t.Interlaced {
+		mode.Height *= 2
+	}
+	return mode
+}
+
+// RangeLimits is a display range limits descriptor.
+type RangeLimits struct {
+	MinVRate      uint8  // Hz
+	MaxVRate      uint8  // Hz
+	MinHRate      uint8  // kHz
+	MaxHRate      uint8  // kHz
+	MaxPixelClock uint16 // MHz, a multiple of 10.
+}
+
+// The display descriptor tags.
+const (
+	tagSerialString = 0xff
+	tagText         = 0xfe
+	tagRangeLimits  = 0xfd
+	tagName         = 0xfc
+)
+
+// establishedModes are the modes of the established timings bitmap, most
+// significant bit of byte 35 first.
+var establishedModes = []Mode{
+	{720, 400, 70, false}, {720, 400, 88, false}, {640, 480, 60, false}, {640, 480, 67, false},
+	{640, 480, 72, false}, {640, 480, 75, false}, {800, 600, 56, false}, {800, 600, 60, false},
+	{800, 600, 72, false}, {800, 600, 75, false}, {832, 624, 75, false}, {1024, 768, 87, true},
+	{1024, 768, 60, false}, {1024, 768, 70, false}, {1024, 768, 75, false}, {1280, 1024, 75, false},
+	{1152, 870, 75, false},
+}
+
+// aspectRatios are the standard timing aspect ratios, indexed by their code.
+var aspectRatios = [4][2]int{{16, 10}, {4, 3}, {5, 4}, {16, 9}}
+
+// Parse parses EDID data consisting of a base block and its extension blocks.
+func Parse(data []byte) (*EDID, error) {
+	if len(data) < BlockSize || len(data)%BlockSize != 0 {
+		return nil, ErrTruncated
+	}
+	if !bytes.Equal(data[:len(header)], header) {
+		return nil, ErrInvalidHeader
+	}
+	blocks := 1 + int(data[126])
+	if len(data) < blocks*BlockSize {
+		return nil, ErrTruncated
+	}
+	for i := 0; i < blocks; i++ {
+		if checksum(data[i*BlockSize:(i+1)*BlockSize]) != 0 {
+			return nil, ErrChecksum
+		}
+	}
+	e := &EDID{}
+	e.parseBase(data[:BlockSize])
+	for i := 1; i < blocks; i++ {
+		block := data[i*BlockSize : (i+1)*BlockSize]
+		if block[0] == ceaTag && e.CEA == nil {
+			cea, err := parseCEA(block)
+			if err != nil {
+				return nil, err
+			}
+			e.CEA = cea
+		}
+	}
+	return e, nil
+}
+
+func (e *EDID) parseBase(block []byte) {
+	id := binary.BigEndian.Uint16(block[8:10])
+	e.Manufacturer = string([]byte{'@' + byte(id>>10&0x1f), '@' + byte(id>>5&0x1f), '@' + byte(id&0x1f)})
+	e.ProductCode = binary.LittleEndian.Uint16(block[10:12])
+	e.SerialNumber = binary.LittleEndian.Uint32(block[12:16])
+	e.Week = block[16]
+	e.Year = 1990 + int(block[17])
+	e.Version = block[18]
+	e.Revision = block[19]
+	e.Digital = block[20]&0x80 != 0
+	e.WidthCM = block[21]
+	e.HeightCM = block[22]
+	if block[23] != 0xff {
+		e.Gamma = float64(int(block[23])+100) / 100
+	}
+	e.Features = block[24]
+	copy(e.Chromaticity[:], block[25:35])
+	for i, mode := range establishedModes {
+		if block[35+i/8]&(0x80>>(i%8)) != 0 {
+			e.EstablishedModes = append(e.EstablishedModes, mode)
+		}
+	}
+	for i := 38; i < 54; i += 2 {
+		if block[i] == 0x01 && block[i+1] == 0x01 || block[i] == 0x00 {
+			continue
+		}
+		width := (int(block[i]) + 31) * 8
+		aspect := aspectRatios[block[i+1]>>6]
+		if aspect[0] == 16 && aspect[1] == 10 && e.Version == 1 && e.Revision < 3 {
+			aspect = [2]int{1, 1}
+		}
+		e.StandardModes = append(e.StandardModes, Mode{
+			Width:       width,
+			Height:      width * aspect[1] / aspect[0],
+			RefreshRate: int(block[i+1]&0x3f) + 60,
+		})
+	}
+	for i := 54; i < 126; i += 18 {
+		descriptor := block[i : i+18]
+		if descriptor[0] != 0 || descriptor[1] != 0 {
+			e.DetailedTimings = append(e.DetailedTimings, parseDetailedTiming(descriptor))
+			continue
+		}
+		switch descriptor[3] {
+		case tagName:
+			e.Name = parseText(descriptor[5:])
+		case tagSerialString:
+			e.SerialString = parseText(descriptor[5:])
+		case tagRangeLimits:
+			e.RangeLimits = &RangeLimits{
+				MinVRate:      descriptor[5],
+				MaxVRate:      descriptor[6],
+				MinHRate:      descriptor[7],
+				MaxHRate:      descriptor[8],
+				MaxPixelClock: uint16(descriptor[9]) * 10,
+			}
+		}
+	}
+}
+
+// parseDetailedTiming parses a detailed timing descriptor.
+func parseDetailedTiming(d []byte) DetailedTiming {
+	t := DetailedTiming{
+		PixelClock:  uint64(binary.LittleEndian.Uint16(d[0:2])) * 10000,
+		HActive:     uint16(d[2]) | uint16(d[4]>>4)<<8,
+		HBlank:      uint16(d[3]) | uint16(d[4]&0x0f)<<8,
+		VActive:     uint16(d[5]) | uint16(d[7]>>4)<<8,
+		VBlank:      uint16(d[6]) | uint16(d[7]&0x0f)<<8,
+		HFrontPorch: uint16(d[8]) | uint16(d[11]>>6)<<8,
+		HSync:       uint16(d[9]) | uint16(d[11]>>4&0x03)<<8,
+		VFrontPorch: uint16(d[10]>>4) | uint16(d[11]>>2&0x03)<<4,
+		VSync:       uint16(d[10]&0x0f) | uint16(d[11]&0x03)<<4,
+		HImageSize:  uint16(d[12]) | uint16(d[14]>>4)<<8,
+		VImageSize:  uint16(d[13]) | uint16(d[14]&0x0f)<<8,
+		HBorder:     d[15],
+		VBorder:     d[16],
+		Interlaced:  d[17]&0x80 != 0,
+	}
+	if d[17]&0x18 == 0x18 {
+		t.VSyncPositive = d[17]&0x04 != 0
+		t.HSyncPositive = d[17]&0x02 != 0
+	}
+	return t
+}
+
+// parseText parses the 13 characters of a text descriptor.
+func parseText(data []byte) string {
+	if n := bytes.IndexByte(data, 0x0a); n >= 0 {
+		data = data[:n]
+	}
+	return strings.TrimRight(string(data), " ")
+}
+
+// Marshal encodes the EDID as a base block followed by a CEA-861 extension
+// block if CEA is set. The detailed timings, name, serial string and range
+// limits share the four descriptors of the base block.
+func (e *EDID) Marshal() ([]byte, error) {
+	block := make([]byte, BlockSize)
+	copy(block, header)
+	if len(e.Manufacturer) != 3 {
+		return nil, ErrInvalidValue
+	}
+	var id uint16
+	for _, c := range []byte(e.Manufacturer) {
+		if c < 'A' || c > 'Z' {
+			return nil, ErrInvalidValue
+		}
+		id = id<<5 | uint16(c-'@')
+	}
+	binary.BigEndian.PutUint16(block[8:10], id)
+	binary.LittleEndian.PutUint16(block[10:12], e.ProductCode)
+	binary.LittleEndian.PutUint32(block[12:16], e.SerialNumber)
+	block[16] = e.Week
+	if e.Year < 1990 || e.Year > 1990+255 {
+		return nil, ErrInvalidValue
+	}
+	block[17] = byte(e.Year - 1990)
+	block[18] = e.Version
+	block[19] = e.Revision
+	if e.Digital {
+		block[20] = 0x80
+	}
+	block[21] = e.WidthCM
+	block[22] = e.HeightCM
+	block[23] = 0xff
+	if e.Gamma != 0 {
+		if e.Gamma < 1 || e.Gamma > 3.54 {
+			return nil, ErrInvalidValue
+		}
+		block[23] = byte(math.Round(e.Gamma*100) - 100)
+	}
+	block[24] = e.Features
+	copy(block[25:35], e.Chromaticity[:])
+	for _, mode := range e.EstablishedModes {
+		i := indexMode(establishedModes, mode)
+		if i < 0 {
+			return nil, ErrInvalidValue
+		}
+		block[35+i/8] |= 0x80 >> (i % 8)
+	}
+	if len(e.StandardModes) > 8 {
+		return nil, ErrBlockFull
+	}
+	for i := 38; i < 54; i++ {
+		block[i] = 0x01
+	}
+	for i, mode := range e.StandardModes {
+		code, err := standardTiming(mode)
+		if err != nil {
+			return nil, err
+		}
+		copy(block[38+i*2:], code[:])
+	}
+	descriptors := make([][]byte, 0, 4)
+	for i := range e.DetailedTimings {
+		descriptor, err := e.DetailedTimings[i].marshal()
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	if e.RangeLimits != nil {
+		descriptor := displayDescriptor(tagRangeLimits)
+		descriptor[5] = e.RangeLimits.MinVRate
+		descriptor[6] = e.RangeLimits.MaxVRate
+		descriptor[7] = e.RangeLimits.MinHRate
+		descriptor[8] = e.RangeLimits.MaxHRate
+		descriptor[9] = byte((e.RangeLimits.MaxPixelClock + 9) / 10)
+		copy(descriptor[10:], []byte{0x00, 0x0a, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20})
+		descriptors = append(descriptors, descriptor)
+	}
+	for _, text := range []struct {
+		tag   byte
+		value string
+	}{{tagName, e.Name}, {tagSerialString, e.SerialString}} {
+		if text.value == "" {
+			continue
+		}
+		descriptor, err := textDescriptor(text.tag, text.value)
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	if len(descriptors) > 4 {
+		return nil, ErrBlockFull
+	}
+	for len(descriptors) < 4 {
+		descriptors = append(descriptors, displayDescriptor(0x10))
+	}
+	for i, descriptor := range descriptors {
+		copy(block[54+i*18:], descriptor)
+	}
+	var extension []byte
+	if e.CEA != nil {
+		var err error
+		if extension, err = e.CEA.marshal(); err != nil {
+			return nil, err
+		}
+		block[126] = 1
+	}
+	block[127] = -checksum(block[:127])
+	return append(block, extension...), nil
+}
+
+// marshal encodes the timing as a detailed timing descriptor.
+func (t *DetailedTiming) marshal() ([]byte, error) {
+	if t.PixelClock%10000 != 0 || t.PixelClock == 0 || t.PixelClock/10000 > math.MaxUint16 ||
+		t.HActive > 0xfff || t.HBlank > 0xfff || t.VActive > 0xfff || t.VBlank > 0xfff ||
+		t.HFrontPorch > 0x3ff || t.HSync > 0x3ff || t.VFrontPorch > 0x3f || t.VSync > 0x3f ||
+		t.HImageSize > 0xfff || t.VImageSize > 0xfff {
+		return nil, ErrInvalidValue
+	}
+	d := make([]byte, 18)
+	binary.LittleEndian.PutUint16(d[0:2], uint16(t.PixelClock/10000))
+	d[2] = byte(t.HActive)
+	d[3] = byte(t.HBlank)
+	d[4] = byte(t.HActive>>8)<<4 | byte(t.HBlank>>8)
+	d[5] = byte(t.VActive)
+	d[6] = byte(t.VBlank)
+	d[7] = byte(t.VActive>>8)<<4 | byte(t.VBlank>>8)
+	d[8] = byte(t.HFrontPorch)
+	d[9] = byte(t.HSync)
+	d[10] = byte(t.VFrontPorch&0x0f)<<4 | byte(t.VSync&0x0f)
+	d[11] = byte(t.HFrontPorch>>8)<<6 | byte(t.HSync>>8)<<4 | byte(t.VFrontPorch>>4)<<2 | byte(t.VSync>>4)
+	d[12] = byte(t.HImageSize)
+	d[13] = byte(t.VImageSize)
+	d[14] = byte(t.HImageSize>>8)<<4 | byte(t.VImageSize>>8)
+	d[15] = t.HBorder
+	d[16] = t.VBorder
+	d[17] = 0x18
+	if t.Interlaced {
+		d[17] |= 0x80
+	}
+	if t.VSyncPositive {
+		d[17] |= 0x04
+	}
+	if t.HSyncPositive {
+		d[17] |= 0x02
+	}
+	return d, nil
+}
+
+// standardTiming encodes a mode as a standard timing.
+func standardTiming(mode Mode) ([2]byte, error) {
+	if mode.Interlaced || mode.Width < 256 || mode.Width > 2288 || mode.Width%8 != 0 || mode.RefreshRate < 60 || mode.RefreshRate > 123 {
+		return [2]byte{}, ErrInvalidValue
+	}
+	for code, aspect := range aspectRatios {
+		if mode.Width*aspect[1] == mode.Height*aspect[0] {
+			return [2]byte{byte(mode.Width/8 - 31), byte(code)<<6 | byte(mode.RefreshRate-60)}, nil
+		}
+	}
+	return [2]byte{}, ErrInvalidValue
+}
+
+// displayDescriptor returns an empty display descriptor with the tag.
+func displayDescriptor(tag byte) []byte {
+	descriptor := make([]byte, 18)
+	descriptor[3] = tag
+	return descriptor
+}
+
+// textDescriptor returns a display descriptor holding up to 13 characters.
+func textDescriptor(tag byte, text string) ([]byte, error) {
+	if len(text) > 13 {
+		return nil, ErrInvalidValue
+	}
+	descriptor := displayDescriptor(tag)
+	copy(descriptor[5:], text)
+	if len(text) < 13 {
+		descriptor[5+len(text)] = 0x0a
+		for i := 6 + len(text); i < 18; i++ {
+			descriptor[i] = 0x20
+		}
+	}
+	return descriptor, nil
+}
+
+// indexMode returns the index of the mode in modes, or -1.
+func indexMode(modes []Mode, mode Mode) int {
+	for i, m := range modes {
+		if m == mode {
+			return i
+		}
+	}
+	return -1
+}
+
+// checksum returns the sum of the bytes, which is zero for a valid block.
+func checksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return sum
+}
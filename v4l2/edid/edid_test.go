@@ -0,0 +1,190 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package edid
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// testEDID is a TV with a 1080p60 preferred timing and a CEA-861 extension
+// holding video, audio, speaker allocation, HDMI and colorimetry blocks.
+const testEDID = "00ffffffffffff001e6d095b01010101011d0103804627780aee91a3544c9926" +
+	"0f505421080081c0d1c0818001010101010101010101023a801871382d40582c" +
+	"4500ba882100001e000000fd00384b1e530f000a202020202020000000fc004c" +
+	"472054560a20202020202020000000ff003132334142430a20202020202001e1" +
+	"020321f14790041f0302016126090707150750830f000066030c00100080e205" +
+	"40011d007251d01e206e285500ba882100001e00000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" +
+	"00000000000000000000000000000000000000000000000000000000000000c6"
+
+func testData(t *testing.T) []byte {
+	data, err := hex.DecodeString(testEDID)
+	if err != nil {
+		t.Fatal("unable to decode test EDID")
+	}
+	return data
+}
+
+func TestParse(t *testing.T) {
+	e, err := Parse(testData(t))
+	if err != nil {
+		t.Fatal("unable to parse EDID")
+	}
+	if e.Manufacturer != "GSM" || e.ProductCode != 0x5b09 || e.Year != 2019 || e.Version != 1 || e.Revision != 3 || !e.Digital {
+		t.Fatal("incorrect vendor and product information")
+	}
+	if e.Name != "LG TV" || e.SerialString != "123ABC" || e.Gamma != 2.2 {
+		t.Fatal("incorrect descriptors")
+	}
+	if len(e.EstablishedModes) != 3 || e.EstablishedModes[2] != (Mode{1024, 768, 60, false}) {
+		t.Fatal("incorrect established modes")
+	}
+	if len(e.StandardModes) != 3 || e.StandardModes[1] != (Mode{1920, 1080, 60, false}) || e.StandardModes[2] != (Mode{1280, 1024, 60, false}) {
+		t.Fatal("incorrect standard modes")
+	}
+	if len(e.DetailedTimings) != 1 {
+		t.Fatal("incorrect number of detailed timings")
+	}
+	preferred := e.DetailedTimings[0]
+	if vic16, _ := VIC(16).Timing(); preferred.PixelClock != vic16.PixelClock || preferred.HBlank != vic16.HBlank || preferred.VFrontPorch != vic16.VFrontPorch {
+		t.Fatal("incorrect preferred timing")
+	}
+	if preferred.HImageSize != 698 || preferred.VImageSize != 392 || !preferred.HSyncPositive || preferred.RefreshRate() != 60 {
+		t.Fatal("incorrect preferred timing details")
+	}
+	if e.RangeLimits == nil || e.RangeLimits.MaxVRate != 75 || e.RangeLimits.MaxPixelClock != 150 {
+		t.Fatal("incorrect range limits")
+	}
+	cea := e.CEA
+	if cea == nil || !cea.Underscan || !cea.BasicAudio || cea.NativeDTDs != 1 {
+		t.Fatal("incorrect CEA-861 extension")
+	}
+	if len(cea.VideoModes) != 7 || cea.VideoModes[0] != (ShortVideoDescriptor{VIC: 16, Native: true}) || cea.VideoModes[6].VIC != 97 {
+		t.Fatal("incorrect video data block")
+	}
+	modes := cea.Modes()
+	if len(modes) != 6 || modes[5] != (Mode{3840, 2160, 60, false}) || modes[1] != (Mode{1280, 720, 60, false}) {
+		t.Fatal("incorrect supported modes")
+	}
+	if len(cea.AudioDescriptors) != 2 {
+		t.Fatal("incorrect audio data block")
+	}
+	lpcm, ac3 := cea.AudioDescriptors[0], cea.AudioDescriptors[1]
+	if lpcm.Format != AudioFormatLPCM || lpcm.Channels != 2 || lpcm.SampleRates != SampleRate32kHz|SampleRate44kHz|SampleRate48kHz || lpcm.Detail != BitDepth16|BitDepth20|BitDepth24 {
+		t.Fatal("incorrect LPCM audio descriptor")
+	}
+	if ac3.Format != AudioFormatAC3 || ac3.Channels != 6 || ac3.MaxBitrate() != 640 {
+		t.Fatal("incorrect AC-3 audio descriptor")
+	}
+	if cea.SpeakerAllocation != SpeakerFLFR|SpeakerLFE|SpeakerFC|SpeakerRLRR {
+		t.Fatal("incorrect speaker allocation")
+	}
+	if cea.HDMI == nil || cea.HDMI.PhysicalAddress != 0x1000 || !bytes.Equal(cea.HDMI.Extra, []byte{0x80}) {
+		t.Fatal("incorrect HDMI vendor specific data block")
+	}
+	if len(cea.OtherBlocks) != 1 || cea.OtherBlocks[0].Tag != 7 {
+		t.Fatal("incorrect other data blocks")
+	}
+	if len(cea.DetailedTimings) != 1 || cea.DetailedTimings[0].Mode() != (Mode{1280, 720, 60, false}) {
+		t.Fatal("incorrect extension detailed timings")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	data := testData(t)
+	if _, err := Parse(data[:200]); !errors.Is(err, ErrTruncated) {
+		t.Fatal("truncated data not rejected")
+	}
+	if _, err := Parse(data[:BlockSize]); !errors.Is(err, ErrTruncated) {
+		t.Fatal("missing extension not rejected")
+	}
+	corrupt := bytes.Clone(data)
+	corrupt[BlockSize+10]++
+	if _, err := Parse(corrupt); !errors.Is(err, ErrChecksum) {
+		t.Fatal("checksum mismatch not rejected")
+	}
+	corrupt = bytes.Clone(data)
+	corrupt[0] = 0xff
+	if _, err := Parse(corrupt); !errors.Is(err, ErrInvalidHeader) {
+		t.Fatal("invalid header not rejected")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	data := testData(t)
+	e, err := Parse(data)
+	if err != nil {
+		t.Fatal("unable to parse EDID")
+	}
+	marshalled, err := e.Marshal()
+	if err != nil {
+		t.Fatal("unable to marshal EDID")
+	}
+	if !bytes.Equal(marshalled, data) {
+		t.Fatal("marshalled EDID differs from the parsed one")
+	}
+	e.Name = "A name that is too long"
+	if _, err := e.Marshal(); !errors.Is(err, ErrInvalidValue) {
+		t.Fatal("overlong name accepted")
+	}
+	e.Name = ""
+	e.DetailedTimings = append(e.DetailedTimings, e.DetailedTimings[0], e.DetailedTimings[0])
+	if _, err := e.Marshal(); !errors.Is(err, ErrBlockFull) {
+		t.Fatal("too many descriptors accepted")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("ABC", 1, "Capture", 200); !errors.Is(err, ErrInvalidValue) {
+		t.Fatal("unknown preferred VIC accepted")
+	}
+	e, err := New("ABC", 1, "Capture", 16, 4, 31, 97)
+	if err != nil {
+		t.Fatal("unable to create EDID")
+	}
+	data, err := e.Marshal()
+	if err != nil {
+		t.Fatal("unable to marshal EDID")
+	}
+	if len(data) != 2*BlockSize {
+		t.Fatal("incorrect number of blocks")
+	}
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatal("unable to parse created EDID")
+	}
+	if parsed.Manufacturer != "ABC" || parsed.Name != "Capture" || parsed.DetailedTimings[0].Mode() != (Mode{1920, 1080, 60, false}) {
+		t.Fatal("incorrect base block")
+	}
+	if parsed.RangeLimits.MinVRate != 50 || parsed.RangeLimits.MaxVRate != 60 || parsed.RangeLimits.MaxPixelClock != 600 {
+		t.Fatal("incorrect range limits")
+	}
+	modes := parsed.CEA.Modes()
+	if len(modes) != 4 || modes[2] != (Mode{1920, 1080, 50, false}) || !parsed.CEA.VideoModes[0].Native || parsed.CEA.VideoModes[1].Native {
+		t.Fatal("incorrect advertised modes")
+	}
+	if parsed.CEA.HDMI == nil || parsed.CEA.HDMI.PhysicalAddress != 0x1000 {
+		t.Fatal("HDMI vendor specific data block missing")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package edid
+
+// VIC is the CEA-861 video identification code type.
+type VIC uint8
+
+// cea861Timings are the timings of the VICs known to this package.
+var cea861Timings = map[VIC]DetailedTiming{
+	1:  {PixelClock: 25175000, HActive: 640, HBlank: 160, HFrontPorch: 16, HSync: 96, VActive: 480, VBlank: 45, VFrontPorch: 10, VSync: 2},
+	2:  {PixelClock: 27000000, HActive: 720, HBlank: 138, HFrontPorch: 16, HSync: 62, VActive: 480, VBlank: 45, VFrontPorch: 9, VSync: 6},
+	3:  {PixelClock: 27000000, HActive: 720, HBlank: 138, HFrontPorch: 16, HSync: 62, VActive: 480, VBlank: 45, VFrontPorch: 9, VSync: 6},
+	4:  {PixelClock: 74250000, HActive: 1280, HBlank: 370, HFrontPorch: 110, HSync: 40, VActive: 720, VBlank: 30, VFrontPorch: 5, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	5:  {PixelClock: 74250000, HActive: 1920, HBlank: 280, HFrontPorch: 88, HSync: 44, VActive: 540, VBlank: 22, VFrontPorch: 2, VSync: 5, Interlaced: true, HSyncPositive: true, VSyncPositive: true},
+	16: {PixelClock: 148500000, HActive: 1920, HBlank: 280, HFrontPorch: 88, HSync: 44, VActive: 1080, VBlank: 45, VFrontPorch: 4, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	17: {PixelClock: 27000000, HActive: 720, HBlank: 144, HFrontPorch: 12, HSync: 64, VActive: 576, VBlank: 49, VFrontPorch: 5, VSync: 5},
+	18: {PixelClock: 27000000, HActive: 720, HBlank: 144, HFrontPorch: 12, HSync: 64, VActive: 576, VBlank: 49, VFrontPorch: 5, VSync: 5},
+	19: {PixelClock: 74250000, HActive: 1280, HBlank: 700, HFrontPorch: 440, HSync: 40, VActive: 720, VBlank: 30, VFrontPorch: 5, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	20: {PixelClock: 74250000, HActive: 1920, HBlank: 720, HFrontPorch: 528, HSync: 44, VActive: 540, VBlank: 22, VFrontPorch: 2, VSync: 5, Interlaced: true, HSyncPositive: true, VSyncPositive: true},
+	31: {PixelClock: 148500000, HActive: 1920, HBlank: 720, HFrontPorch: 528, HSync: 44, VActive: 1080, VBlank: 45, VFrontPorch: 4, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	32: {PixelClock: 74250000, HActive: 1920, HBlank: 830, HFrontPorch: 638, HSync: 44, VActive: 1080, VBlank: 45, VFrontPorch: 4, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	33: {PixelClock: 74250000, HActive: 1920, HBlank: 720, HFrontPorch: 528, HSync: 44, VActive: 1080, VBlank: 45, VFrontPorch: 4, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	34: {PixelClock: 74250000, HActive: 1920, HBlank: 280, HFrontPorch: 88, HSync: 44, VActive: 1080, VBlank: 45, VFrontPorch: 4, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	60: {PixelClock: 59400000, HActive: 1280, HBlank: 2020, HFrontPorch: 1760, HSync: 40, VActive: 720, VBlank: 30, VFrontPorch: 5, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	61: {PixelClock: 74250000, HActive: 1280, HBlank: 2680, HFrontPorch: 2420, HSync: 40, VActive: 720, VBlank: 30, VFrontPorch: 5, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	62: {PixelClock: 74250000, HActive: 1280, HBlank: 2020, HFrontPorch: 1760, HSync: 40, VActive: 720, VBlank: 30, VFrontPorch: 5, VSync: 5, HSyncPositive: true, VSyncPositive: true},
+	93: {PixelClock: 297000000, HActive: 3840, HBlank: 1660, HFrontPorch: 1276, HSync: 88, VActive: 2160, VBlank: 90, VFrontPorch: 8, VSync: 10, HSyncPositive: true, VSyncPositive: true},
+	94: {PixelClock: 297000000, HActive: 3840, HBlank: 1440, HFrontPorch: 1056, HSync: 88, VActive: 2160, VBlank: 90, VFrontPorch: 8, VSync: 10, HSyncPositive: true, VSyncPositive: true},
+	95: {PixelClock: 297000000, HActive: 3840, HBlank: 560, HFrontPorch: 176, HSync: 88, VActive: 2160, VBlank: 90, VFrontPorch: 8, VSync: 10, HSyncPositive: true, VSyncPositive: true},
+	96: {PixelClock: 594000000, HActive: 3840, HBlank: 1440, HFrontPorch: 1056, HSync: 88, VActive: 2160, VBlank: 90, VFrontPorch: 8, VSync: 10, HSyncPositive: true, VSyncPositive: true},
+	97: {PixelClock: 594000000, HActive: 3840, HBlank: 560, HFrontPorch: 176, HSync: 88, VActive: 2160, VBlank: 90, VFrontPorch: 8, VSync: 10, HSyncPositive: true, VSyncPositive: true},
+}
+
+// Timing returns the timing of the VIC, if known to this package.
+func (v VIC) Timing() (DetailedTiming, bool) {
+	timing, ok := cea861Timings[v]
+	return timing, ok
+}
+
+// Mode returns the video mode of the VIC, if known to this package.
+func (v VIC) Mode() (Mode, bool) {
+	timing, ok := cea861Timings[v]
+	if !ok {
+		return Mode{}, false
+	}
+	return timing.Mode(), true
+}
+
+// Modes returns the video modes of the VICs known to this package.
+func (cea *CEAExtension) Modes() []Mode {
+	modes := make([]Mode, 0, len(cea.VideoModes))
+	for _, svd := range cea.VideoModes {
+		if mode, ok := svd.VIC.Mode(); ok && indexMode(modes, mode) < 0 {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+// sRGB is the chromaticity of the sRGB color space.
+var sRGB = [10]byte{0xee, 0x91, 0xa3, 0x54, 0x4c, 0x99, 0x26, 0x0f, 0x50, 0x54}
+
+// New returns an EDID 1.3 for an HDMI receiver advertising the VICs, the
+// first of which is the preferred mode and must be known to this package.
+// Basic stereo LPCM audio is advertised along with HDMI physical address 1.0.0.0.
+func New(manufacturer string, productCode uint16, name string, vics ...VIC) (*EDID, error) {
+	if len(vics) == 0 {
+		return nil, ErrInvalidValue
+	}
+	preferred, ok := vics[0].Timing()
+	if !ok {
+		return nil, ErrInvalidValue
+	}
+	e := &EDID{
+		Manufacturer:    manufacturer,
+		ProductCode:     productCode,
+		Year:            2024,
+		Version:         1,
+		Revision:        3,
+		Digital:         true,
+		Gamma:           2.2,
+		Features:        0x0a,
+		Chromaticity:    sRGB,
+		DetailedTimings: []DetailedTiming{preferred},
+		Name:            name,
+		CEA: &CEAExtension{
+			Revision:   3,
+			BasicAudio: true,
+			YCbCr444:   true,
+			YCbCr422:   true,
+			NativeDTDs: 1,
+			AudioDescriptors: []ShortAudioDescriptor{
+				{Format: AudioFormatLPCM, Channels: 2, SampleRates: SampleRate32kHz | SampleRate44kHz | SampleRate48kHz, Detail: BitDepth16 | BitDepth20 | BitDepth24},
+			},
+			SpeakerAllocation: SpeakerFLFR,
+			HDMI:              &HDMIVendorBlock{PhysicalAddress: 0x1000},
+		},
+	}
+	minRate, maxRate := preferred.Mode().RefreshRate, preferred.Mode().RefreshRate
+	var maxPixelClock uint64
+	for i, vic := range vics {
+		timing, ok := vic.Timing()
+		if ok {
+			mode := timing.Mode()
+			minRate = min(minRate, mode.RefreshRate)
+			maxRate = max(maxRate, mode.RefreshRate)
+			maxPixelClock = max(maxPixelClock, timing.PixelClock)
+		}
+		e.CEA.VideoModes = append(e.CEA.VideoModes, ShortVideoDescriptor{VIC: vic, Native: i == 0 && vic <= 64})
+	}
+	if maxPixelClock > 0 {
+		e.RangeLimits = &RangeLimits{
+			MinVRate:      uint8(minRate),
+			MaxVRate:      uint8(maxRate),
+			MinHRate:      15,
+			MaxHRate:      135,
+			MaxPixelClock: uint16((maxPixelClock/1000000 + 9) / 10 * 10),
+		}
+	}
+	return e, nil
+}
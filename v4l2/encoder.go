@@ -0,0 +1,306 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Encoder is a stateful memory-to-memory hardware encoder. Raw frames are fed
+// with Encode and the resulting packets taken with NextPacket, which may run
+// in separate goroutines.
+type Encoder interface {
+	Width() uint32
+	Height() uint32
+	Encode(data []byte, timestamp time.Duration) error
+	NextPacket(timeout time.Duration) (*Packet, error)
+	ForceKeyFrame() error
+	SetBitrate(bitrate uint32) error
+	Drain() error
+	Close() error
+}
+
+// EncoderConfig is the configuration of an Encoder.
+type EncoderConfig struct {
+	Path        string
+	Device      Device // Optional, opened from Path when nil.
+	PixFormat   PixFmt // Format of the raw frames.
+	Width       uint32
+	Height      uint32
+	CodedFormat PixFmt // Format of the packets, such as PixFmtH264.
+	FrameRate   uint32 // Frames per second, zero leaves the driver default in place.
+	Bitrate     uint32 // Bits per second, zero leaves the driver default in place.
+	GOPSize     uint32 // Frames from one keyframe to the next, zero leaves the driver default in place.
+	Profile     string // Profile menu item name such as "High", empty leaves the driver default in place.
+	Level       string // Level menu item name such as "4.1", empty leaves the driver default in place.
+	BufCount    uint32 // Buffers per queue.
+}
+
+type encoder struct {
+	device       Device
+	fd           int
+	width        uint32
+	height       uint32
+	output       *m2mQueue
+	capture      *m2mQueue
+	outputMutex  sync.Mutex // Guards the OUTPUT queue.
+	captureMutex sync.Mutex // Guards the CAPTURE queue.
+	closed       bool       // Written with both mutexes held.
+	closeOnce    sync.Once
+	closeErr     error
+}
+
+// NewEncoder configures both queues of an encoder and starts streaming.
+func NewEncoder(config *EncoderConfig) (Encoder, error) {
+	var err error
+	device, err := openDevice(config.Device, config.Path)
+	if err != nil {
+		return nil, err
+	}
+	e := &encoder{device: device, fd: device.Fd()}
+	defer func() {
+		if err != nil {
+			e.teardown()
+		}
+	}()
+	capabilities, err := QueryCapabilities(e.fd)
+	if err != nil {
+		return nil, err
+	}
+	outputType, captureType, err := m2mBufTypes(capabilities)
+	if err != nil {
+		return nil, err
+	}
+	var outputSizes, captureSizes []uint32
+	if _, _, captureSizes, err = negotiateFormat(e.fd, captureType, config.CodedFormat, config.Width, config.Height); err != nil {
+		return nil, err
+	}
+	if e.width, e.height, outputSizes, err = negotiateFormat(e.fd, outputType, config.PixFormat, config.Width, config.Height); err != nil {
+		return nil, err
+	}
+	if config.FrameRate != 0 {
+		if _, err = SetTimePerFrame(e.fd, outputType, Fract{Numerator: 1, Denominator: config.FrameRate}); err != nil {
+			return nil, err
+		}
+	}
+	if err = applyEncoderControls(e.fd, config); err != nil {
+		return nil, err
+	}
+	e.output = newM2MQueue(device, outputType, outputSizes)
+	if err = e.output.allocate(config.BufCount); err != nil {
+		return nil, err
+	}
+	e.capture = newM2MQueue(device, captureType, captureSizes)
+	if err = e.capture.allocate(config.BufCount); err != nil {
+		return nil, err
+	}
+	if err = e.capture.enqueueAll(); err != nil {
+		return nil, err
+	}
+	if err = StreamOn(e.fd, outputType); err != nil {
+		return nil, err
+	}
+	if err = StreamOn(e.fd, captureType); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// applyEncoderControls sets the rate control, GOP, profile and level controls
+// that are configured.
+func applyEncoderControls(fd int, config *EncoderConfig) error {
+	var controls []*ExtControlValue
+	if config.Bitrate != 0 {
+		controls = append(controls, &ExtControlValue{ID: CidMPEGVideoBitrate, Value: int64(config.Bitrate)})
+	}
+	if config.GOPSize != 0 {
+		controls = append(controls, &ExtControlValue{ID: CidMPEGVideoGOPSize, Value: int64(config.GOPSize)})
+	}
+	profileID, levelID := profileControls(config.CodedFormat)
+	for _, menu := range []struct {
+		id   CtrlID
+		name string
+	}{{profileID, config.Profile}, {levelID, config.Level}} {
+		if menu.name == "" {
+			continue
+		}
+		value, err := menuValue(fd, menu.id, menu.name)
+		if err != nil {
+			return err
+		}
+		controls = append(controls, &ExtControlValue{ID: menu.id, Value: value})
+	}
+	if len(controls) == 0 {
+		return nil
+	}
+	return SetExtControls(fd, CtrlWhichCurVal, 0, controls)
+}
+
+// profileControls returns the profile and level menu controls of a coded
+// format, zero for those it lacks.
+func profileControls(codedFormat PixFmt) (CtrlID, CtrlID) {
+	switch codedFormat {
+	case PixFmtH264:
+		return CidMPEGVideoH264Profile, CidMPEGVideoH264Level
+	case PixFmtHEVC:
+		return CidMPEGVideoHEVCProfile, CidMPEGVideoHEVCLevel
+	case PixFmtVP8:
+		return CidMPEGVideoVP8Profile, 0
+	case PixFmtVP9:
+		return CidMPEGVideoVP9Profile, CidMPEGVideoVP9Level
+	}
+	return 0, 0
+}
+
+// menuValue returns the value of the menu item with the given name.
+func menuValue(fd int, id CtrlID, name string) (int64, error) {
+	if id != 0 {
+		menus, err := QueryMenus(fd, id)
+		if err != nil {
+			return 0, err
+		}
+		for _, menu := range menus {
+			if BytesToString(menu.Name[:]) == name {
+				return int64(menu.Index), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: no menu item %q for control 0x%08x", ErrUnsupported, name, uint32(id))
+}
+
+func (e *encoder) Width() uint32 {
+	return e.width
+}
+
+func (e *encoder) Height() uint32 {
+	return e.height
+}
+
+// Encode queues a raw frame, spread across the planes in order, waiting for
+// the encoder to free an OUTPUT buffer if necessary.
+func (e *encoder) Encode(data []byte, timestamp time.Duration) error {
+	e.outputMutex.Lock()
+	defer e.outputMutex.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	index, err := e.output.acquire(m2mTimeout)
+	if err != nil {
+		return err
+	}
+	if err := e.output.enqueue(index, data, 0, timestamp); err != nil {
+		e.output.free = append(e.output.free, index)
+		return err
+	}
+	return nil
+}
+
+// NextPacket waits up to timeout for an encoded packet. Once a drain has
+// completed it returns io.EOF.
+func (e *encoder) NextPacket(timeout time.Duration) (*Packet, error) {
+	e.captureMutex.Lock()
+	defer e.captureMutex.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+	buffer, err := e.capture.dequeue(timeout)
+	if err != nil {
+		return nil, err
+	}
+	if buffer == nil {
+		return nil, ErrTimeout
+	}
+	frame := newFrame(buffer, e.capture.buffers[buffer.Index], true)
+	if err := e.capture.enqueue(buffer.Index, nil, 0, 0); err != nil {
+		return nil, err
+	}
+	if buffer.Flags&BufFlagLast != 0 && len(frame.Data) == 0 {
+		return nil, io.EOF
+	}
+	packet := &Packet{
+		Data:      frame.Data,
+		Timestamp: frame.Timestamp,
+		Sequence:  frame.Sequence,
+		Flags:     frame.Flags,
+	}
+	return packet, nil
+}
+
+// ForceKeyFrame makes the encoder encode the next frame queued as a keyframe.
+func (e *encoder) ForceKeyFrame() error {
+	e.outputMutex.Lock()
+	defer e.outputMutex.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	return SetControl(e.fd, &Control{ID: CidMPEGVideoForceKeyFrame, Value: 1})
+}
+
+func (e *encoder) SetBitrate(bitrate uint32) error {
+	e.outputMutex.Lock()
+	defer e.outputMutex.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	return SetControl(e.fd, &Control{ID: CidMPEGVideoBitrate, Value: int32(bitrate)})
+}
+
+// Drain makes the encoder encode every frame queued so far, after which
+// NextPacket returns the remaining packets followed by io.EOF.
+func (e *encoder) Drain() error {
+	e.outputMutex.Lock()
+	defer e.outputMutex.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	return EncoderCommand(e.fd, EncCmdStop, 0)
+}
+
+// Close stops streaming, releases the buffers and closes the device.
+func (e *encoder) Close() error {
+	e.closeOnce.Do(func() {
+		e.outputMutex.Lock()
+		defer e.outputMutex.Unlock()
+		e.captureMutex.Lock()
+		defer e.captureMutex.Unlock()
+		e.closed = true
+		e.closeErr = e.teardown()
+	})
+	return e.closeErr
+}
+
+// teardown stops streaming, releases whatever queues were allocated and
+// closes the device.
+func (e *encoder) teardown() error {
+	var errs []error
+	for _, queue := range []*m2mQueue{e.output, e.capture} {
+		if queue == nil {
+			continue
+		}
+		errs = append(errs, StreamOff(e.fd, queue.bufType), queue.release())
+	}
+	errs = append(errs, e.device.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testEncoderConfig() *FakeConfig {
+	return &FakeConfig{
+		Driver:       "fake",
+		Card:         "Fake Encoder",
+		BusInfo:      "platform:fake",
+		Capabilities: CapVideoM2MMPlane | CapStreaming,
+		Formats: []FakeFormat{{
+			PixFormat:   PixFmtH264,
+			Description: "H.264",
+			Flags:       FmtFlagCompressed,
+			FrameSizes:  []FrameSizeDiscrete{{Width: 1920, Height: 1080}},
+		}},
+		OutputFormats: []FakeFormat{{
+			PixFormat:      PixFmtNV12M,
+			Description:    "Y/UV 4:2:0 (N-C)",
+			FrameSizes:     []FrameSizeDiscrete{{Width: 640, Height: 480}, {Width: 1280, Height: 720}},
+			FrameIntervals: []Fract{{Numerator: 1, Denominator: 30}},
+		}},
+		Controls: []FakeControl{
+			{ID: CidMPEGVideoBitrate, Type: CtrlTypeInteger, Name: "Video Bitrate", Minimum: 1000, Maximum: 20000000, Step: 1, DefaultValue: 1000000, Value: 1000000},
+			{ID: CidMPEGVideoGOPSize, Type: CtrlTypeInteger, Name: "Video GOP Size", Minimum: 0, Maximum: 300, Step: 1, DefaultValue: 12, Value: 12},
+			{ID: CidMPEGVideoForceKeyFrame, Type: CtrlTypeButton, Name: "Force Key Frame", Maximum: 1, Step: 1, Flags: CtrlFlagWriteOnly},
+			{ID: CidMPEGVideoH264Profile, Type: CtrlTypeMenu, Name: "H264 Profile", Maximum: 2, Step: 1, Menu: []string{"Baseline", "Main", "High"}},
+		},
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	fake, err := NewFakeDevice(testEncoderConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	encoder, err := NewEncoder(&EncoderConfig{
+		Device:      fake,
+		PixFormat:   PixFmtNV12M,
+		Width:       640,
+		Height:      480,
+		CodedFormat: PixFmtH264,
+		FrameRate:   30,
+		Bitrate:     4000000,
+		GOPSize:     3,
+		Profile:     "High",
+		BufCount:    2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new encoder")
+	}
+	defer encoder.Close()
+	if encoder.Width() != 640 || encoder.Height() != 480 {
+		t.Fatal("incorrect size negotiated")
+	}
+	if control, err := GetControl(fake.Fd(), CidMPEGVideoH264Profile); err != nil || control.Value != 2 {
+		t.Fatal("profile not applied")
+	}
+	if control, err := GetControl(fake.Fd(), CidMPEGVideoBitrate); err != nil || control.Value != 4000000 {
+		t.Fatal("bitrate not applied")
+	}
+	frame := make([]byte, 640*480*3/2)
+	var keyFrames []bool
+	for i := 0; i < 5; i++ {
+		frame[0] = byte(i)
+		if i == 4 {
+			if err := encoder.ForceKeyFrame(); err != nil {
+				t.Fatal("unable to force keyframe")
+			}
+		}
+		if err := encoder.Encode(frame, time.Duration(i)*40*time.Millisecond); err != nil {
+			t.Fatal("unable to encode frame")
+		}
+		packet, err := encoder.NextPacket(time.Second)
+		if err != nil {
+			t.Fatal("unable to get packet")
+		}
+		if packet.Timestamp != time.Duration(i)*40*time.Millisecond {
+			t.Fatal("timestamp not copied")
+		}
+		if len(packet.Data) != fakePacketHeader+1 || packet.Data[fakePacketHeader] != byte(i) {
+			t.Fatal("incorrect packet returned")
+		}
+		if binary.LittleEndian.Uint32(packet.Data) != 640 || packet.KeyFrame() != (packet.Flags&BufFlagPFrame == 0) {
+			t.Fatal("incorrect packet header")
+		}
+		keyFrames = append(keyFrames, packet.KeyFrame())
+	}
+	if !slices.Equal(keyFrames, []bool{true, false, false, true, true}) {
+		t.Fatal("incorrect keyframes")
+	}
+	if err := encoder.Encode(make([]byte, len(frame)+1), 0); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatal("oversized frame accepted")
+	}
+	if err := encoder.Encode(bytes.Repeat([]byte{9}, len(frame)), 0); err != nil {
+		t.Fatal("unable to encode frame")
+	}
+	if err := encoder.Drain(); err != nil {
+		t.Fatal("unable to drain encoder")
+	}
+	if packet, err := encoder.NextPacket(time.Second); err != nil || packet.Data[fakePacketHeader] != 9 {
+		t.Fatal("queued frame not encoded before drain")
+	}
+	if _, err := encoder.NextPacket(time.Second); !errors.Is(err, io.EOF) {
+		t.Fatal("drain not completed")
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal("unable to close encoder")
+	}
+	if err := encoder.Encode(frame, 0); !errors.Is(err, ErrClosed) {
+		t.Fatal("frame accepted after close")
+	}
+}
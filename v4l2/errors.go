@@ -0,0 +1,196 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"syscall"
+)
+
+// Sentinel errors matched by the errors returned from this package using errors.Is.
+var (
+	ErrTimeout     = errors.New("v4l2: timed out waiting for the device")
+	ErrDeviceGone  = errors.New("v4l2: device is gone")
+	ErrBusy        = errors.New("v4l2: device is busy")
+	ErrUnsupported = errors.New("v4l2: operation not supported by the device")
+	ErrClosed      = errors.New("v4l2: camera is closed")
+)
+
+// IoctlError is returned when a system call on a device fails.
+// It unwraps to the underlying syscall.Errno.
+type IoctlError struct {
+	Name    string // The ioctl name, or the system call name for read() and mmap().
+	Request uint32 // The ioctl request code, zero for other system calls.
+	Path    string // The device path, empty if unknown.
+	Errno   syscall.Errno
+}
+
+func (e *IoctlError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("v4l2: %s: %v", e.Name, e.Errno)
+	}
+	return fmt.Sprintf("v4l2: %s %s: %v", e.Name, e.Path, e.Errno)
+}
+
+func (e *IoctlError) Unwrap() error {
+	return e.Errno
+}
+
+// Is reports whether the error matches one of the sentinel errors.
+func (e *IoctlError) Is(target error) bool {
+	switch target {
+	case ErrTimeout:
+		return e.Errno == syscall.ETIMEDOUT
+	case ErrDeviceGone:
+		return e.Errno == syscall.ENODEV || e.Errno == syscall.ENXIO
+	case ErrBusy:
+		return e.Errno == syscall.EBUSY
+	case ErrUnsupported:
+		return e.Errno == syscall.ENOTTY || e.Errno == syscall.EOPNOTSUPP
+	}
+	return false
+}
+
+// ExtControlError is returned when an extended control request fails because
+// of one control in the batch.
+type ExtControlError struct {
+	Index int    // The index of the failing control in the batch.
+	ID    CtrlID // The ID of the failing control.
+	Err   error
+}
+
+func (e *ExtControlError) Error() string {
+	return fmt.Sprintf("v4l2: control 0x%08x: %v", uint32(e.ID), e.Err)
+}
+
+func (e *ExtControlError) Unwrap() error {
+	return e.Err
+}
+
+// ioctlNames maps the video and media request ioctl values to their names.
+var ioctlNames = map[uint32]string{
+	VidIocQueryCap:           "VIDIOC_QUERYCAP",
+	VidIocReserved:           "VIDIOC_RESERVED",
+	VidIocEnumFmt:            "VIDIOC_ENUM_FMT",
+	VidIocGFmt:               "VIDIOC_G_FMT",
+	VidIocSFmt:               "VIDIOC_S_FMT",
+	VidIocReqBufs:            "VIDIOC_REQBUFS",
+	VidIocQueryBuf:           "VIDIOC_QUERYBUF",
+	VidIocGFBuf:              "VIDIOC_G_FBUF",
+	VidIocSFBuf:              "VIDIOC_S_FBUF",
+	VidIocOverlay:            "VIDIOC_OVERLAY",
+	VidIocQBuf:               "VIDIOC_QBUF",
+	VidIocExpBuf:             "VIDIOC_EXPBUF",
+	VidIocDQBuf:              "VIDIOC_DQBUF",
+	VidIocStreamOn:           "VIDIOC_STREAMON",
+	VidIocStreamOff:          "VIDIOC_STREAMOFF",
+	VidIocGParm:              "VIDIOC_G_PARM",
+	VidIocSParm:              "VIDIOC_S_PARM",
+	VidIocGStd:               "VIDIOC_G_STD",
+	VidIocSStd:               "VIDIOC_S_STD",
+	VidIocEnumStd:            "VIDIOC_ENUMSTD",
+	VidIocEnumInput:          "VIDIOC_ENUMINPUT",
+	VidIocGCtrl:              "VIDIOC_G_CTRL",
+	VidIocSCtrl:              "VIDIOC_S_CTRL",
+	VidIocGTuner:             "VIDIOC_G_TUNER",
+	VidIocSTuner:             "VIDIOC_S_TUNER",
+	VidIocGAudio:             "VIDIOC_G_AUDIO",
+	VidIocSAudio:             "VIDIOC_S_AUDIO",
+	VidIocQueryCtrl:          "VIDIOC_QUERYCTRL",
+	VidIocQueryMenu:          "VIDIOC_QUERYMENU",
+	VidIocGInput:             "VIDIOC_G_INPUT",
+	VidIocSInput:             "VIDIOC_S_INPUT",
+	VidIocGEDID:              "VIDIOC_G_EDID",
+	VidIocSEDID:              "VIDIOC_S_EDID",
+	VidIocGOutput:            "VIDIOC_G_OUTPUT",
+	VidIocSOutput:            "VIDIOC_S_OUTPUT",
+	VidIocEnumOutput:         "VIDIOC_ENUMOUTPUT",
+	VidIocGAudOut:            "VIDIOC_G_AUDOUT",
+	VidIocSAudOut:            "VIDIOC_S_AUDOUT",
+	VidIocGModulator:         "VIDIOC_G_MODULATOR",
+	VidIocSModulator:         "VIDIOC_S_MODULATOR",
+	VidIocGFrequency:         "VIDIOC_G_FREQUENCY",
+	VidIocSFrequency:         "VIDIOC_S_FREQUENCY",
+	VidIocCropCap:            "VIDIOC_CROPCAP",
+	VidIocGCrop:              "VIDIOC_G_CROP",
+	VidIocSCrop:              "VIDIOC_S_CROP",
+	VidIocGJpegComp:          "VIDIOC_G_JPEGCOMP",
+	VidIocSJpegComp:          "VIDIOC_S_JPEGCOMP",
+	VidIocQueryStd:           "VIDIOC_QUERYSTD",
+	VidIocTryFmt:             "VIDIOC_TRY_FMT",
+	VidIocEnumAudio:          "VIDIOC_ENUMAUDIO",
+	VidIocEnumAudOut:         "VIDIOC_ENUMAUDOUT",
+	VidIocGPriority:          "VIDIOC_G_PRIORITY",
+	VidIocSPriority:          "VIDIOC_S_PRIORITY",
+	VidIocGSlicedVBICap:      "VIDIOC_G_SLICED_VBI_CAP",
+	VidIocLogStatus:          "VIDIOC_LOG_STATUS",
+	VidIocGExtCtrls:          "VIDIOC_G_EXT_CTRLS",
+	VidIocSExtCtrls:          "VIDIOC_S_EXT_CTRLS",
+	VidIocTryExtCtrls:        "VIDIOC_TRY_EXT_CTRLS",
+	VidIocEnumFrameSizes:     "VIDIOC_ENUM_FRAMESIZES",
+	VidIocEnumFrameIntervals: "VIDIOC_ENUM_FRAMEINTERVALS",
+	VidIocGEncIndex:          "VIDIOC_G_ENC_INDEX",
+	VidIocEncoderCmd:         "VIDIOC_ENCODER_CMD",
+	VidIocTryEncoderCmd:      "VIDIOC_TRY_ENCODER_CMD",
+	VidIocSHWFreqSeek:        "VIDIOC_S_HW_FREQ_SEEK",
+	VidIocDQEvent:            "VIDIOC_DQEVENT",
+	VidIocSubscribeEvent:     "VIDIOC_SUBSCRIBE_EVENT",
+	VidIocUnsubscribeEvent:   "VIDIOC_UNSUBSCRIBE_EVENT",
+	VidIocSDVTimings:         "VIDIOC_S_DV_TIMINGS",
+	VidIocGDVTimings:         "VIDIOC_G_DV_TIMINGS",
+	VidIocGSelection:         "VIDIOC_G_SELECTION",
+	VidIocSSelection:         "VIDIOC_S_SELECTION",
+	VidIocEnumDVTimings:      "VIDIOC_ENUM_DV_TIMINGS",
+	VidIocQueryDVTimings:     "VIDIOC_QUERY_DV_TIMINGS",
+	VidIocDVTimingsCap:       "VIDIOC_DV_TIMINGS_CAP",
+	VidIocEnumFreqBands:      "VIDIOC_ENUM_FREQ_BANDS",
+	VidIocDecoderCmd:         "VIDIOC_DECODER_CMD",
+	VidIocTryDecoderCmd:      "VIDIOC_TRY_DECODER_CMD",
+	VidIocQueryExtCtrl:       "VIDIOC_QUERY_EXT_CTRL",
+	MediaIocRequestAlloc:     "MEDIA_IOC_REQUEST_ALLOC",
+	MediaRequestIocQueue:     "MEDIA_REQUEST_IOC_QUEUE",
+	MediaRequestIocReinit:    "MEDIA_REQUEST_IOC_REINIT",
+}
+
+// ioctlName returns the name of an ioctl request.
+func ioctlName(request uint32) string {
+	if name, ok := ioctlNames[request]; ok {
+		return name
+	}
+	return "ioctl 0x" + strconv.FormatUint(uint64(request), 16)
+}
+
+// newIoctlError wraps an errno returned by a system call on the device
+// identified by fd. Other errors are returned unchanged.
+func newIoctlError(fd int, name string, request uint32, err error) error {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return err
+	}
+	return &IoctlError{
+		Name:    name,
+		Request: request,
+		Path:    devicePath(fd),
+		Errno:   errno,
+	}
+}
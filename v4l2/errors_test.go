@@ -0,0 +1,76 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestIoctlError(t *testing.T) {
+	fake, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	device, err := openDevice(fake, "/dev/video9")
+	if err != nil {
+		t.Fatal("unable to name fake device")
+	}
+	defer device.Close()
+	fd := device.Fd()
+	_, err = RequestDriverBuffers(fd, 4, BufTypeVideoOutput, MemoryMmap)
+	var ioctlError *IoctlError
+	if !errors.As(err, &ioctlError) {
+		t.Fatal("ioctl failure not returned as IoctlError")
+	}
+	if ioctlError.Name != "VIDIOC_REQBUFS" || ioctlError.Request != VidIocReqBufs || ioctlError.Path != "/dev/video9" {
+		t.Fatal("IoctlError has incorrect details")
+	}
+	if !errors.Is(err, syscall.EINVAL) || errors.Is(err, ErrDeviceGone) {
+		t.Fatal("IoctlError does not match its errno")
+	}
+	if _, err := RequestDriverBuffers(fd, 4, BufTypeVideoCapture, MemoryMmap); err != nil {
+		t.Fatal("unable to request driver buffers")
+	}
+	if err := StreamOn(fd, BufTypeVideoCapture); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	if _, err := RequestDriverBuffers(fd, 4, BufTypeVideoCapture, MemoryMmap); !errors.Is(err, ErrBusy) {
+		t.Fatal("busy device not reported as ErrBusy")
+	}
+	if err := ioctl(fd, VidIocLogStatus, nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatal("unsupported ioctl not reported as ErrUnsupported")
+	}
+	fake.Unplug()
+	if _, err := QueryCapabilities(fd); !errors.Is(err, ErrDeviceGone) {
+		t.Fatal("unplugged device not reported as ErrDeviceGone")
+	}
+	if err := pollError(fd, unix.POLLERR|unix.POLLHUP); !errors.Is(err, ErrDeviceGone) || !errors.As(err, &ioctlError) || ioctlError.Name != "poll" {
+		t.Fatal("hung up device not reported as ErrDeviceGone")
+	}
+	device.Close()
+	if devicePath(fd) != "" {
+		t.Fatal("device path kept after close")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrWatching is returned when a camera is asked for events while it is already delivering them.
+var ErrWatching = errors.New("v4l2: camera is already delivering events")
+
+func (c *camera) SubscribeEvent(eventType EventType, id uint32, flags EventSubFlag) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	return SubscribeEvent(c.fd, eventType, id, flags)
+}
+
+func (c *camera) UnsubscribeEvent(eventType EventType, id uint32) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	return UnsubscribeEvent(c.fd, eventType, id)
+}
+
+func (c *camera) Events(ctx context.Context) (<-chan *Event, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.watching {
+		return nil, ErrWatching
+	}
+	c.watching = true
+	events := make(chan *Event, eventQueueSize)
+	c.capturing.Add(1)
+	go c.watch(ctx, events)
+	return events, nil
+}
+
+// eventQueueSize is how many dequeued events the Events channel holds.
+const eventQueueSize = 16
+
+// watch delivers events until ctx is cancelled, the camera is closed or the
+// device fails. It polls for POLLPRI only, so it runs alongside capture.
+func (c *camera) watch(ctx context.Context, events chan<- *Event) {
+	defer c.capturing.Done()
+	defer close(events)
+	defer func() {
+		c.mutex.Lock()
+		c.watching = false
+		c.mutex.Unlock()
+	}()
+	for !c.isClosing() && ctx.Err() == nil {
+		revents, err := poll(c.device, unix.POLLPRI, streamPollInterval)
+		if err != nil {
+			c.reportError(err)
+			return
+		}
+		if revents&unix.POLLPRI == 0 {
+			if err := pollError(c.fd, revents); err != nil {
+				c.reportError(err)
+				return
+			}
+			continue
+		}
+		for {
+			event, err := DequeueEvent(c.fd)
+			if errors.Is(err, syscall.ENOENT) {
+				break
+			}
+			if err != nil {
+				c.reportError(err)
+				return
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			case <-c.closing:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import "syscall"
+
+// FakeAudio is an audio input or output offered by a FakeDevice.
+type FakeAudio struct {
+	Name       string
+	Capability AudCap
+}
+
+// followAudio selects the first audio input associated with the current video
+// input, unless the selected one already is.
+func (f *FakeDevice) followAudio() {
+	audioSet := f.inputs[f.input].AudioSet
+	if indexes := audioSet.Indexes(); len(indexes) > 0 && !audioSet.Contains(f.audio) {
+		f.audio = indexes[0]
+	}
+}
+
+// followAudioOut is followAudio for the audio outputs of the current video output.
+func (f *FakeDevice) followAudioOut() {
+	if len(f.config.Outputs) == 0 {
+		return
+	}
+	audioSet := f.config.Outputs[f.output].AudioSet
+	if indexes := audioSet.Indexes(); len(indexes) > 0 && !audioSet.Contains(f.audioOut) {
+		f.audioOut = indexes[0]
+	}
+}
+
+// audioIoctl handles the audio input ioctls, which need configured audio inputs.
+func (f *FakeDevice) audioIoctl(request uint32, audio *Audio) error {
+	if len(f.config.Audio) == 0 {
+		return syscall.ENOTTY
+	}
+	switch request {
+	case VidIocEnumAudio:
+		if audio.Index >= uint32(len(f.config.Audio)) {
+			return syscall.EINVAL
+		}
+		*audio = Audio{Index: audio.Index, Capability: f.config.Audio[audio.Index].Capability}
+		copy(audio.Name[:len(audio.Name)-1], f.config.Audio[audio.Index].Name)
+	case VidIocGAudio:
+		*audio = Audio{Index: f.audio, Capability: f.config.Audio[f.audio].Capability, Mode: f.audioMode}
+		copy(audio.Name[:len(audio.Name)-1], f.config.Audio[f.audio].Name)
+	case VidIocSAudio:
+		if !f.inputs[f.input].AudioSet.Contains(audio.Index) || audio.Index >= uint32(len(f.config.Audio)) {
+			return syscall.EINVAL
+		}
+		if audio.Mode&AudModeAVL != 0 && f.config.Audio[audio.Index].Capability&AudCapAVL == 0 {
+			return syscall.EINVAL
+		}
+		f.audio = audio.Index
+		f.audioMode = audio.Mode
+	}
+	return nil
+}
+
+// audioOutIoctl handles the audio output ioctls, which need configured audio outputs.
+func (f *FakeDevice) audioOutIoctl(request uint32, audioOut *AudioOut) error {
+	if len(f.config.AudioOuts) == 0 {
+		return syscall.ENOTTY
+	}
+	switch request {
+	case VidIocEnumAudOut:
+		if audioOut.Index >= uint32(len(f.config.AudioOuts)) {
+			return syscall.EINVAL
+		}
+		*audioOut = AudioOut{Index: audioOut.Index, Capability: f.config.AudioOuts[audioOut.Index].Capability}
+		copy(audioOut.Name[:len(audioOut.Name)-1], f.config.AudioOuts[audioOut.Index].Name)
+	case VidIocGAudOut:
+		*audioOut = AudioOut{Index: f.audioOut, Capability: f.config.AudioOuts[f.audioOut].Capability}
+		copy(audioOut.Name[:len(audioOut.Name)-1], f.config.AudioOuts[f.audioOut].Name)
+	case VidIocSAudOut:
+		if len(f.config.Outputs) == 0 || !f.config.Outputs[f.output].AudioSet.Contains(audioOut.Index) || audioOut.Index >= uint32(len(f.config.AudioOuts)) {
+			return syscall.EINVAL
+		}
+		f.audioOut = audioOut.Index
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"encoding/binary"
+	"syscall"
+	"unsafe"
+)
+
+// hasPayload reports whether the control value is passed by pointer.
+func (c *FakeControl) hasPayload() bool {
+	return c.Type == CtrlTypeString || c.Type >= CtrlCompundTypes
+}
+
+// nextControl finds the control following id when id carries the next
+// control or next compound flags, or the control with that id otherwise.
+func (f *FakeDevice) nextControl(id CtrlID) *FakeControl {
+	flags := CtrlFlag(id) & (CtrlFlagNextCtrl | CtrlFlagNextCompound)
+	if flags == 0 {
+		return f.findControl(id)
+	}
+	id &^= CtrlID(CtrlFlagNextCtrl | CtrlFlagNextCompound)
+	var control *FakeControl
+	for i := range f.controls {
+		candidate := &f.controls[i]
+		if candidate.hasPayload() && flags&CtrlFlagNextCompound == 0 {
+			continue
+		}
+		if !candidate.hasPayload() && flags&CtrlFlagNextCtrl == 0 {
+			continue
+		}
+		if candidate.ID > id && (control == nil || candidate.ID < control.ID) {
+			control = candidate
+		}
+	}
+	return control
+}
+
+func (f *FakeDevice) queryExtCtrl(queryExtCtrl *QueryExtCtrl) error {
+	control := f.nextControl(queryExtCtrl.ID)
+	if control == nil {
+		return syscall.EINVAL
+	}
+	*queryExtCtrl = QueryExtCtrl{
+		ID:           control.ID,
+		Type:         control.Type,
+		Minimum:      control.Minimum,
+		Maximum:      control.Maximum,
+		Step:         uint64(control.Step),
+		DefaultValue: control.DefaultValue,
+		Flags:        uint32(control.Flags),
+		ElemSize:     4,
+		Elems:        1,
+	}
+	if control.Type == CtrlTypeInteger64 {
+		queryExtCtrl.ElemSize = 8
+	}
+	if control.hasPayload() {
+		queryExtCtrl.Flags |= uint32(CtrlFlagHasPayload)
+		queryExtCtrl.ElemSize = control.ElemSize
+		queryExtCtrl.Elems = control.Elems
+		if control.Elems > 1 {
+			queryExtCtrl.NrOfDims = 1
+			queryExtCtrl.Dims[0] = control.Elems
+		}
+	}
+	copy(queryExtCtrl.Name[:len(queryExtCtrl.Name)-1], control.Name)
+	return nil
+}
+
+// extCtrls validates every control in the batch before touching any, so that
+// a request either succeeds as a whole or changes nothing.
+func (f *FakeDevice) extCtrls(request uint32, extControls *ExtControls) error {
+	if extControls.Count == 0 {
+		return nil
+	}
+	controlsPtr := *(*unsafe.Pointer)(unsafe.Pointer(&extControls.Controls))
+	controls := unsafe.Slice((*ExtControl)(controlsPtr), extControls.Count)
+	which := extControls.Which
+	var staged *fakeRequest
+	if which == CtrlWhichRequestVal {
+		if staged = f.lookupRequest(int(extControls.RequestFD)); staged == nil {
+			return syscall.EINVAL
+		}
+		if request == VidIocGExtCtrls && staged.state != fakeRequestComplete {
+			return syscall.EACCES
+		}
+		if request != VidIocGExtCtrls && staged.state != fakeRequestIdle {
+			return syscall.EBUSY
+		}
+	}
+	for i := range controls {
+		if err := f.checkExtCtrl(request, which, &controls[i]); err != nil {
+			extControls.ErrorIdx = uint32(i)
+			return err
+		}
+	}
+	for i := range controls {
+		control := &controls[i]
+		fakeControl := f.findControl(control.ID)
+		var payload []byte
+		if fakeControl.hasPayload() {
+			var ptr unsafe.Pointer
+			copy((*[8]byte)(unsafe.Pointer(&ptr))[:], control.Value[:])
+			payload = unsafe.Slice((*byte)(ptr), control.Size)
+		}
+		if staged != nil {
+			if stagedControl, ok := staged.controls[control.ID]; ok {
+				fakeControl = &stagedControl
+			}
+		}
+		switch request {
+		case VidIocGExtCtrls:
+			value := fakeControl.Value
+			if which == CtrlWhichDefVal {
+				value = fakeControl.DefaultValue
+			}
+			if payload == nil {
+				fakePutValue(control, fakeControl.Type, value)
+			} else if which == CtrlWhichDefVal {
+				clear(payload)
+			} else {
+				copy(payload, fakeControl.Payload)
+			}
+		case VidIocSExtCtrls:
+			if staged != nil {
+				staged.stage(fakeControl, fakeValue(control, fakeControl.Type), payload)
+				continue
+			}
+			if payload == nil {
+				fakeControl.Value = fakeValue(control, fakeControl.Type)
+			} else {
+				clear(fakeControl.Payload)
+				copy(fakeControl.Payload, payload)
+			}
+			f.controlEvent(fakeControl, EventCtrlChValue, true)
+		}
+	}
+	return nil
+}
+
+// checkExtCtrl validates one control of an extended control request.
+func (f *FakeDevice) checkExtCtrl(request uint32, which CtrlWhich, control *ExtControl) error {
+	fakeControl := f.findControl(control.ID)
+	if fakeControl == nil {
+		return syscall.EINVAL
+	}
+	switch which {
+	case CtrlWhichCurVal:
+	case CtrlWhichDefVal:
+		if request != VidIocGExtCtrls {
+			return syscall.EINVAL
+		}
+	case CtrlWhichRequestVal:
+	default:
+		if CtrlClass(control.ID)&0x0fff0000 != CtrlClass(which) {
+			return syscall.EINVAL
+		}
+	}
+	if request == VidIocGExtCtrls && fakeControl.Flags&CtrlFlagWriteOnly != 0 {
+		return syscall.EACCES
+	}
+	if request != VidIocGExtCtrls && fakeControl.Flags&CtrlFlagReadOnly != 0 {
+		return syscall.EACCES
+	}
+	if fakeControl.hasPayload() {
+		size := uint32(len(fakeControl.Payload))
+		if control.Size < size && (request == VidIocGExtCtrls || fakeControl.Type != CtrlTypeString) {
+			control.Size = size
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+	if request != VidIocGExtCtrls {
+		value := fakeValue(control, fakeControl.Type)
+		if value < fakeControl.Minimum || value > fakeControl.Maximum {
+			return syscall.ERANGE
+		}
+	}
+	return nil
+}
+
+// fakeValue returns the value of a control that is not passed by pointer.
+func fakeValue(control *ExtControl, ctrlType CtrlType) int64 {
+	if ctrlType == CtrlTypeInteger64 {
+		return int64(binary.NativeEndian.Uint64(control.Value[:]))
+	}
+	return int64(int32(binary.NativeEndian.Uint32(control.Value[:4])))
+}
+
+// fakePutValue stores the value of a control that is not passed by pointer.
+func fakePutValue(control *ExtControl, ctrlType CtrlType, value int64) {
+	if ctrlType == CtrlTypeInteger64 {
+		binary.NativeEndian.PutUint64(control.Value[:], uint64(value))
+		return
+	}
+	binary.NativeEndian.PutUint32(control.Value[:4], uint32(int32(value)))
+}
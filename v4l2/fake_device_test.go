@@ -0,0 +1,1215 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"io"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FakeFormat is a pixel format offered by a FakeDevice.
+type FakeFormat struct {
+	PixFormat      PixFmt
+	Description    string
+	Flags          FmtFlag
+	FrameSizes     []FrameSizeDiscrete
+	FrameIntervals []Fract
+}
+
+// FakeControl is a control offered by a FakeDevice.
+// String, array and compound controls hold their value in Payload, which is
+// ElemSize times Elems bytes long and defaults to all zeroes.
+type FakeControl struct {
+	ID           CtrlID
+	Type         CtrlType
+	Name         string
+	Minimum      int64
+	Maximum      int64
+	Step         int64
+	DefaultValue int64
+	Flags        CtrlFlag
+	Menu         []string
+	Value        int64
+	ElemSize     uint32
+	Elems        uint32
+	Payload      []byte
+}
+
+// FakeFrameFunc returns the content of the frame with the given sequence number.
+type FakeFrameFunc func(sequence uint32, format *PixFormat) []byte
+
+// FakeConfig is the configuration of a FakeDevice.
+type FakeConfig struct {
+	Driver        string
+	Card          string
+	BusInfo       string
+	Capabilities  Cap
+	Formats       []FakeFormat
+	OutputFormats []FakeFormat // Formats of the OUTPUT queue of memory-to-memory devices.
+	Controls      []FakeControl
+	Frame         FakeFrameFunc
+	FixedRate     bool        // The frame interval cannot be set, ParmCapTimePerFrame is not reported.
+	LegacyCrop    bool        // Only the crop ioctls are offered, not the selection API.
+	Inputs        []FakeInput // A single camera input when empty, none on radio devices.
+	Outputs       []FakeOutput
+	Standards     []FakeStandard  // The standard ioctls are unsupported when empty.
+	Detected      StdID           // Reported by QUERYSTD.
+	DVTimings     []BTTimings     // The DV ioctls are unsupported when empty, the first is sensed initially.
+	EDIDBlocks    uint32          // EDID capacity of pad 0, the EDID ioctls are unsupported when zero.
+	Tuners        []FakeTuner     // The tuner ioctls are unsupported when empty.
+	Modulators    []FakeModulator // The modulator ioctls are unsupported when empty.
+	Audio         []FakeAudio     // The audio input ioctls are unsupported when empty.
+	AudioOuts     []FakeAudio     // The audio output ioctls are unsupported when empty.
+	Requests      bool            // The OUTPUT queue requires requests, which the device allocates as its own media device.
+}
+
+// FakeDevice is an in-memory Device emulating a V4L2 capture or memory-to-memory device.
+// It is registered on creation, so its file descriptor can be passed to every
+// function in this package as well as used through CameraConfig.Device.
+type FakeDevice struct {
+	mutex        sync.Mutex
+	fd           int
+	config       FakeConfig
+	controls     []FakeControl
+	format       PixFormat
+	planes       []PlanePixFormat
+	outFormat    PixFormat
+	outPlanes    []PlanePixFormat
+	codec        fakeCodec
+	timePerFrame Fract
+	queues       map[BufType]*fakeQueue
+	wake         chan struct{}
+	start        time.Time
+	readSequence uint32
+	crop         Rect
+	inputs       []FakeInput
+	input        uint32
+	output       uint32
+	std          StdID
+	dvTimings    BTTimings
+	signal       *BTTimings
+	edid         []byte
+	tuning       []fakeTuning
+	modulation   []fakeModulation
+	audio        uint32
+	audioMode    AudMode
+	audioOut     uint32
+	subscribed   map[fakeSubscription]EventSubFlag
+	events       []Event
+	eventSeq     uint32
+	unplugged    bool
+}
+
+type fakeQueue struct {
+	memory    Memory
+	buffers   []*fakeBuffer
+	queued    []uint32
+	done      []uint32 // Processed buffers of memory-to-memory devices, in order.
+	streaming bool
+	sequence  uint32
+}
+
+type fakeBuffer struct {
+	buffer  Buffer
+	planes  []*fakePlane
+	request *fakeRequest // The request the buffer is bound to until it is processed.
+}
+
+type fakePlane struct {
+	memfd     int
+	data      []byte
+	bytesUsed uint32
+	imported  bool // The memory belongs to the caller.
+}
+
+// NewFakeDevice creates and registers a fake device.
+func NewFakeDevice(config *FakeConfig) (*FakeDevice, error) {
+	fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeDevice{
+		fd:         fd,
+		config:     *config,
+		controls:   make([]FakeControl, len(config.Controls)),
+		queues:     make(map[BufType]*fakeQueue),
+		wake:       make(chan struct{}),
+		start:      time.Now(),
+		subscribed: make(map[fakeSubscription]EventSubFlag),
+	}
+	for i, control := range config.Controls {
+		control.Payload = append([]byte(nil), control.Payload...)
+		if control.hasPayload() && len(control.Payload) == 0 {
+			control.Payload = make([]byte, control.ElemSize*control.Elems)
+		}
+		f.controls[i] = control
+	}
+	if len(config.Formats) > 0 {
+		format := &config.Formats[0]
+		f.format.PixFormat = format.PixFormat
+		if len(format.FrameSizes) > 0 {
+			f.format.Width = format.FrameSizes[0].Width
+			f.format.Height = format.FrameSizes[0].Height
+		}
+		if len(format.FrameIntervals) > 0 {
+			f.timePerFrame = format.FrameIntervals[0]
+		}
+	}
+	f.format.Field = FieldNone
+	f.planes = fakeSizeImage(&f.format)
+	if len(config.OutputFormats) > 0 {
+		format := &config.OutputFormats[0]
+		f.outFormat.PixFormat = format.PixFormat
+		if len(format.FrameSizes) > 0 {
+			f.outFormat.Width = format.FrameSizes[0].Width
+			f.outFormat.Height = format.FrameSizes[0].Height
+		}
+	}
+	f.outFormat.Field = FieldNone
+	f.outPlanes = fakeSizeImage(&f.outFormat)
+	f.crop = f.cropBounds()
+	f.inputs = append([]FakeInput(nil), config.Inputs...)
+	if len(f.inputs) == 0 {
+		f.inputs = []FakeInput{{Name: "Camera", Type: InputTypeCamera}}
+	}
+	if len(config.Standards) > 0 {
+		f.std = config.Standards[0].ID
+	}
+	f.followAudio()
+	f.followAudioOut()
+	for _, tuner := range config.Tuners {
+		f.tuning = append(f.tuning, fakeTuning{frequency: tuner.RangeLow, audMode: TunerModeStereo})
+	}
+	for _, modulator := range config.Modulators {
+		f.modulation = append(f.modulation, fakeModulation{frequency: modulator.RangeLow, txSubChans: TunerSubStereo})
+	}
+	if len(config.DVTimings) > 0 {
+		f.dvTimings = config.DVTimings[0]
+		signal := f.dvTimings
+		f.signal = &signal
+	}
+	RegisterDevice(f)
+	return f, nil
+}
+
+// Close unregisters the device and releases its resources.
+func (f *FakeDevice) Close() error {
+	UnregisterDevice(f)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, queue := range f.queues {
+		f.freeBuffers(queue)
+	}
+	return unix.Close(f.fd)
+}
+
+// Fd returns the file descriptor identifying the device.
+func (f *FakeDevice) Fd() int {
+	return f.fd
+}
+
+// Ioctl performs the ioctl request against the in-memory device state.
+func (f *FakeDevice) Ioctl(request uint32, arg unsafe.Pointer) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.unplugged {
+		return syscall.ENODEV
+	}
+	switch request {
+	case VidIocQueryCap:
+		return f.queryCap((*Capability)(arg))
+	case VidIocEnumFmt:
+		return f.enumFmt((*FmtDesc)(arg))
+	case VidIocEnumFrameSizes:
+		return f.enumFrameSizes((*FrameSizeEnum)(arg))
+	case VidIocEnumFrameIntervals:
+		return f.enumFrameIntervals((*FrameIntervalEnum)(arg))
+	case VidIocGFmt:
+		return f.getFmt((*Format)(arg))
+	case VidIocSFmt, VidIocTryFmt:
+		return f.setFmt((*Format)(arg), request == VidIocSFmt)
+	case VidIocGParm:
+		return f.getParm((*StreamParm)(arg))
+	case VidIocSParm:
+		return f.setParm((*StreamParm)(arg))
+	case VidIocReqBufs:
+		return f.reqBufs((*RequestBuffers)(arg))
+	case VidIocQueryBuf:
+		return f.queryBuf((*Buffer)(arg))
+	case VidIocQBuf:
+		return f.qBuf((*Buffer)(arg))
+	case VidIocExpBuf:
+		return f.expBuf((*ExportBuf)(arg))
+	case VidIocDQBuf:
+		return f.dqBuf((*Buffer)(arg))
+	case VidIocStreamOn:
+		return f.streamOn(*(*BufType)(arg))
+	case VidIocStreamOff:
+		return f.streamOff(*(*BufType)(arg))
+	case VidIocQueryCtrl:
+		return f.queryCtrl((*QueryCtrl)(arg))
+	case VidIocQueryMenu:
+		return f.queryMenu((*QueryMenu)(arg))
+	case VidIocGCtrl:
+		return f.getCtrl((*Control)(arg))
+	case VidIocSCtrl:
+		return f.setCtrl((*Control)(arg))
+	case VidIocQueryExtCtrl:
+		return f.queryExtCtrl((*QueryExtCtrl)(arg))
+	case VidIocGExtCtrls, VidIocSExtCtrls, VidIocTryExtCtrls:
+		return f.extCtrls(request, (*ExtControls)(arg))
+	case VidIocEnumInput, VidIocGInput, VidIocSInput:
+		return f.inputIoctl(request, arg)
+	case VidIocEnumOutput:
+		return f.enumOutput((*Output)(arg))
+	case VidIocGOutput:
+		if len(f.config.Outputs) == 0 {
+			return syscall.ENOTTY
+		}
+		*(*uint32)(arg) = f.output
+		return nil
+	case VidIocSOutput:
+		return f.setOutput(*(*uint32)(arg))
+	case VidIocEnumStd, VidIocGStd, VidIocSStd, VidIocQueryStd:
+		return f.standard(request, arg)
+	case VidIocQueryDVTimings, VidIocGDVTimings, VidIocSDVTimings, VidIocEnumDVTimings, VidIocDVTimingsCap:
+		return f.dvTimingsIoctl(request, arg)
+	case VidIocGEDID:
+		return f.getEDID((*EDID)(arg))
+	case VidIocSEDID:
+		return f.setEDID((*EDID)(arg))
+	case VidIocGTuner, VidIocSTuner, VidIocGFrequency, VidIocSFrequency, VidIocEnumFreqBands, VidIocSHWFreqSeek:
+		return f.tunerIoctl(request, arg)
+	case VidIocGModulator, VidIocSModulator:
+		return f.modulatorIoctl(request, arg)
+	case VidIocEnumAudio, VidIocGAudio, VidIocSAudio:
+		return f.audioIoctl(request, (*Audio)(arg))
+	case VidIocEnumAudOut, VidIocGAudOut, VidIocSAudOut:
+		return f.audioOutIoctl(request, (*AudioOut)(arg))
+	case VidIocCropCap:
+		return f.cropCap((*CropCap)(arg))
+	case VidIocGCrop:
+		return f.getCrop((*Crop)(arg))
+	case VidIocSCrop:
+		return f.setCrop((*Crop)(arg))
+	case VidIocGSelection:
+		if f.config.LegacyCrop {
+			return syscall.ENOTTY
+		}
+		return f.getSelection((*Selection)(arg))
+	case VidIocSSelection:
+		if f.config.LegacyCrop {
+			return syscall.ENOTTY
+		}
+		return f.setSelection((*Selection)(arg))
+	case VidIocSubscribeEvent:
+		return f.subscribeEvent((*EventSubscription)(arg))
+	case VidIocUnsubscribeEvent:
+		return f.unsubscribeEvent((*EventSubscription)(arg))
+	case VidIocDQEvent:
+		return f.dqEvent((*Event)(arg))
+	case VidIocEncoderCmd, VidIocTryEncoderCmd:
+		return f.encoderCmd((*EncoderCmd)(arg), request == VidIocEncoderCmd)
+	case VidIocDecoderCmd, VidIocTryDecoderCmd:
+		return f.decoderCmd((*DecoderCmd)(arg), request == VidIocDecoderCmd)
+	case MediaIocRequestAlloc:
+		return f.allocRequest((*int32)(arg))
+	}
+	return syscall.ENOTTY
+}
+
+// Read reads the next frame if the device supports read() I/O.
+func (f *FakeDevice) Read(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.unplugged {
+		return 0, syscall.ENODEV
+	}
+	if f.config.Capabilities&CapReadWrite == 0 {
+		return 0, syscall.EINVAL
+	}
+	if f.buffersAllocated() {
+		return 0, syscall.EBUSY
+	}
+	data := f.frame(f.readSequence)
+	f.readSequence++
+	return copy(p, data), nil
+}
+
+// Mmap maps the buffer whose offset was reported by QUERYBUF.
+func (f *FakeDevice) Mmap(offset int64, length int) ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for bufType, queue := range f.queues {
+		if queue.memory != MemoryMmap {
+			continue
+		}
+		for index, buffer := range queue.buffers {
+			for i, plane := range buffer.planes {
+				if fakeOffset(bufType, uint32(index), uint32(i)) == offset {
+					if length > len(plane.data) {
+						return nil, syscall.EINVAL
+					}
+					return unix.Mmap(plane.memfd, 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+				}
+			}
+		}
+	}
+	return nil, syscall.EINVAL
+}
+
+// Poll waits for a buffer to become available for dequeueing or an event to
+// become pending.
+func (f *FakeDevice) Poll(events int16, timeout time.Duration) (int16, error) {
+	return f.wait(func() int16 {
+		return f.pollEvents(events)
+	}, events, timeout), nil
+}
+
+// wait waits up to timeout for ready, called with the mutex held, to return
+// any of the poll events, POLLERR or POLLHUP.
+func (f *FakeDevice) wait(ready func() int16, events int16, timeout time.Duration) int16 {
+	deadline := time.Now().Add(timeout)
+	for {
+		f.mutex.Lock()
+		revents := ready() & (events | unix.POLLERR | unix.POLLHUP)
+		wake := f.wake
+		f.mutex.Unlock()
+		remaining := time.Until(deadline)
+		if revents != 0 || remaining <= 0 {
+			return revents
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Unplug simulates the device being disconnected: every subsequent ioctl
+// fails with ENODEV and polling reports an error.
+func (f *FakeDevice) Unplug() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.unplugged = true
+	f.notify()
+}
+
+// pollEvents returns the currently ready poll events. Like vb2, buffer state
+// is only reported when POLLIN or POLLOUT is requested.
+func (f *FakeDevice) pollEvents(events int16) int16 {
+	if f.unplugged {
+		return unix.POLLERR | unix.POLLHUP
+	}
+	var revents int16
+	if len(f.events) > 0 {
+		revents |= unix.POLLPRI
+	}
+	if events&(unix.POLLIN|unix.POLLOUT) == 0 {
+		return revents
+	}
+	if f.isM2M() {
+		return revents | f.pollM2M()
+	}
+	streaming := false
+	for _, queue := range f.queues {
+		if !queue.streaming {
+			continue
+		}
+		streaming = true
+		if len(queue.queued) > 0 {
+			revents |= unix.POLLIN
+		}
+	}
+	if !streaming {
+		if f.config.Capabilities&CapReadWrite != 0 && !f.buffersAllocated() {
+			revents |= unix.POLLIN
+		} else {
+			revents |= unix.POLLERR
+		}
+	}
+	return revents
+}
+
+// buffersAllocated reports whether any queue has buffers, which rules out read() I/O.
+func (f *FakeDevice) buffersAllocated() bool {
+	for _, queue := range f.queues {
+		if len(queue.buffers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// notify wakes up all pollers.
+func (f *FakeDevice) notify() {
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+func (f *FakeDevice) queryCap(capability *Capability) error {
+	*capability = Capability{}
+	copy(capability.Driver[:len(capability.Driver)-1], f.config.Driver)
+	copy(capability.Card[:len(capability.Card)-1], f.config.Card)
+	copy(capability.BusInfo[:len(capability.BusInfo)-1], f.config.BusInfo)
+	capability.Version = 0x00060100
+	capability.Capabilities = f.config.Capabilities | CapDeviceCaps
+	capability.DeviceCaps = f.config.Capabilities
+	return nil
+}
+
+func (f *FakeDevice) findFormat(pixFormat PixFmt) *FakeFormat {
+	return fakeFindFormat(f.config.Formats, pixFormat)
+}
+
+// formats returns the formats offered on the queue of the buffer type.
+func (f *FakeDevice) formats(bufType BufType) []FakeFormat {
+	if IsOutput(bufType) {
+		return f.config.OutputFormats
+	}
+	return f.config.Formats
+}
+
+// queueFormat returns the format of the queue of the buffer type, which is
+// separate for the OUTPUT queue of memory-to-memory devices.
+func (f *FakeDevice) queueFormat(bufType BufType) (*PixFormat, *[]PlanePixFormat) {
+	if IsOutput(bufType) {
+		return &f.outFormat, &f.outPlanes
+	}
+	return &f.format, &f.planes
+}
+
+// supports reports whether the device offers the buffer type.
+func (f *FakeDevice) supports(bufType BufType) bool {
+	switch bufType {
+	case BufTypeVideoCapture:
+		return f.config.Capabilities&(CapVideoCapture|CapVideoM2M) != 0
+	case BufTypeVideCaptureMPlane:
+		return f.config.Capabilities&(CapVideoCaptureMPlane|CapVideoM2MMPlane) != 0
+	case BufTypeVideoOutput:
+		return f.config.Capabilities&(CapVideoOutput|CapVideoM2M) != 0
+	case BufTypeVideOutputMPlane:
+		return f.config.Capabilities&(CapVideoOutputMPlane|CapVideoM2MMPlane) != 0
+	}
+	return false
+}
+
+func (f *FakeDevice) enumFmt(fmtDesc *FmtDesc) error {
+	formats := f.formats(fmtDesc.Type)
+	if !f.supports(fmtDesc.Type) || fmtDesc.Index >= uint32(len(formats)) {
+		return syscall.EINVAL
+	}
+	format := &formats[fmtDesc.Index]
+	fmtDesc.Flags = format.Flags
+	fmtDesc.PixFormat = format.PixFormat
+	fmtDesc.Description = [32]byte{}
+	copy(fmtDesc.Description[:len(fmtDesc.Description)-1], format.Description)
+	return nil
+}
+
+func (f *FakeDevice) enumFrameSizes(frameSizeEnum *FrameSizeEnum) error {
+	format := f.findFormat(frameSizeEnum.PixFormat)
+	if format == nil || frameSizeEnum.Index >= uint32(len(format.FrameSizes)) {
+		return syscall.EINVAL
+	}
+	frameSizeEnum.Type = FrmSizeTypeDiscrete
+	*(*FrameSizeDiscrete)(unsafe.Pointer(&frameSizeEnum.M)) = format.FrameSizes[frameSizeEnum.Index]
+	return nil
+}
+
+func (f *FakeDevice) enumFrameIntervals(frameIntervalEnum *FrameIntervalEnum) error {
+	format := f.findFormat(frameIntervalEnum.PixFormat)
+	if format == nil || frameIntervalEnum.Index >= uint32(len(format.FrameIntervals)) {
+		return syscall.EINVAL
+	}
+	found := false
+	for _, frameSize := range format.FrameSizes {
+		if frameSize.Width == frameIntervalEnum.Width && frameSize.Height == frameIntervalEnum.Height {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return syscall.EINVAL
+	}
+	frameIntervalEnum.Type = FrmIvalTypeDiscrete
+	*(*Fract)(unsafe.Pointer(&frameIntervalEnum.M)) = format.FrameIntervals[frameIntervalEnum.Index]
+	return nil
+}
+
+func (f *FakeDevice) getFmt(format *Format) error {
+	if !f.supports(format.Type) {
+		return syscall.EINVAL
+	}
+	pix, planes := f.queueFormat(format.Type)
+	if IsMultiPlanar(format.Type) {
+		*(*PixFormatMPlane)(unsafe.Pointer(&format.RawData[0])) = fakeFormatMPlane(pix, *planes)
+	} else {
+		*(*PixFormat)(unsafe.Pointer(&format.RawData[0])) = *pix
+	}
+	return nil
+}
+
+func (f *FakeDevice) setFmt(format *Format, apply bool) error {
+	if !f.supports(format.Type) {
+		return syscall.EINVAL
+	}
+	if queue := f.queues[format.Type]; apply && queue != nil && len(queue.buffers) > 0 {
+		return syscall.EBUSY
+	}
+	pix := &PixFormat{}
+	if IsMultiPlanar(format.Type) {
+		pixMPlane := (*PixFormatMPlane)(unsafe.Pointer(&format.RawData[0]))
+		pix.Width = pixMPlane.Width
+		pix.Height = pixMPlane.Height
+		pix.PixFormat = pixMPlane.PixFormat
+	} else {
+		pix = (*PixFormat)(unsafe.Pointer(&format.RawData[0]))
+	}
+	formats := f.formats(format.Type)
+	fakeFormat := fakeFindFormat(formats, pix.PixFormat)
+	if fakeFormat == nil {
+		if len(formats) == 0 {
+			return syscall.EINVAL
+		}
+		fakeFormat = &formats[0]
+		pix.PixFormat = fakeFormat.PixFormat
+	}
+	if f.isDecoder() && !IsOutput(format.Type) && f.codec.width != 0 {
+		// Decoded frames have the resolution of the stream.
+		pix.Width = f.codec.width
+		pix.Height = f.codec.height
+	} else if len(fakeFormat.FrameSizes) > 0 {
+		best := fakeFormat.FrameSizes[0]
+		bestDistance := fakeDistance(best, pix.Width, pix.Height)
+		for _, frameSize := range fakeFormat.FrameSizes[1:] {
+			if distance := fakeDistance(frameSize, pix.Width, pix.Height); distance < bestDistance {
+				best = frameSize
+				bestDistance = distance
+			}
+		}
+		pix.Width = best.Width
+		pix.Height = best.Height
+	}
+	pix.Field = FieldNone
+	planes := fakeSizeImage(pix)
+	if IsMultiPlanar(format.Type) {
+		*(*PixFormatMPlane)(unsafe.Pointer(&format.RawData[0])) = fakeFormatMPlane(pix, planes)
+	}
+	if apply {
+		queuePix, queuePlanes := f.queueFormat(format.Type)
+		*queuePix = *pix
+		*queuePlanes = planes
+	}
+	return nil
+}
+
+func (f *FakeDevice) getParm(streamParm *StreamParm) error {
+	if streamParm.Type != BufTypeVideoCapture && !(IsOutput(streamParm.Type) && f.supports(streamParm.Type)) {
+		return syscall.EINVAL
+	}
+	streamParm.RawData = [200]byte{}
+	if IsOutput(streamParm.Type) {
+		outputParm := (*OutputParm)(unsafe.Pointer(&streamParm.RawData[0]))
+		outputParm.Capability = ParmCapTimePerFrame
+		outputParm.TimePerFrame = f.timePerFrame
+		return nil
+	}
+	captureParm := (*CaptureParm)(unsafe.Pointer(&streamParm.RawData[0]))
+	if !f.config.FixedRate {
+		captureParm.Capability = ParmCapTimePerFrame
+	}
+	captureParm.TimePerFrame = f.timePerFrame
+	return nil
+}
+
+func (f *FakeDevice) setParm(streamParm *StreamParm) error {
+	if streamParm.Type != BufTypeVideoCapture && !(IsOutput(streamParm.Type) && f.supports(streamParm.Type)) {
+		return syscall.EINVAL
+	}
+	if streamParm.Type == BufTypeVideoCapture && f.config.FixedRate {
+		return syscall.EINVAL
+	}
+	requested := (*CaptureParm)(unsafe.Pointer(&streamParm.RawData[0])).TimePerFrame
+	if IsOutput(streamParm.Type) {
+		requested = (*OutputParm)(unsafe.Pointer(&streamParm.RawData[0])).TimePerFrame
+	}
+	if format := f.findFormat(f.format.PixFormat); format != nil && len(format.FrameIntervals) > 0 && requested.Denominator != 0 {
+		best := format.FrameIntervals[0]
+		for _, interval := range format.FrameIntervals[1:] {
+			if fakeIntervalDistance(interval, requested) < fakeIntervalDistance(best, requested) {
+				best = interval
+			}
+		}
+		f.timePerFrame = best
+	} else if requested.Numerator != 0 && requested.Denominator != 0 {
+		f.timePerFrame = requested
+	}
+	return f.getParm(streamParm)
+}
+
+func (f *FakeDevice) reqBufs(requestBuffers *RequestBuffers) error {
+	if !f.supports(requestBuffers.Type) || requestBuffers.Memory > MemoryDMABuf {
+		return syscall.EINVAL
+	}
+	queue := f.queues[requestBuffers.Type]
+	if queue == nil {
+		queue = &fakeQueue{}
+		f.queues[requestBuffers.Type] = queue
+	}
+	if queue.streaming {
+		return syscall.EBUSY
+	}
+	if err := f.freeBuffers(queue); err != nil {
+		return err
+	}
+	queue.memory = requestBuffers.Memory
+	count := requestBuffers.Count
+	if count > 32 {
+		count = 32
+	}
+	pix, planes := f.queueFormat(requestBuffers.Type)
+	sizes := []uint32{pix.SizeImage}
+	if IsMultiPlanar(requestBuffers.Type) {
+		sizes = sizes[:0]
+		for _, plane := range *planes {
+			sizes = append(sizes, plane.SizeImage)
+		}
+	}
+	for index := uint32(0); index < count; index++ {
+		buffer := &fakeBuffer{}
+		buffer.buffer.Index = index
+		buffer.buffer.Type = requestBuffers.Type
+		buffer.buffer.Memory = requestBuffers.Memory
+		queue.buffers = append(queue.buffers, buffer)
+		for _, size := range sizes {
+			if queue.memory != MemoryMmap {
+				buffer.planes = append(buffer.planes, &fakePlane{memfd: -1, imported: true})
+				continue
+			}
+			plane, err := newFakePlane(fakePageAlign(int(size)))
+			if err != nil {
+				return err
+			}
+			buffer.planes = append(buffer.planes, plane)
+		}
+	}
+	requestBuffers.Count = count
+	requestBuffers.Capabilities = Cap(BufCapSupportsMMap | BufCapSupportsUserPtr | BufCapSupportsDMABuf)
+	if f.config.Requests && IsOutput(requestBuffers.Type) {
+		requestBuffers.Capabilities |= Cap(BufCapSupportsRequests)
+	}
+	return nil
+}
+
+// newFakePlane allocates the shared memory backing a buffer plane.
+func newFakePlane(length int) (*fakePlane, error) {
+	memfd, err := unix.MemfdCreate("v4l2-fake", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Ftruncate(memfd, int64(length)); err != nil {
+		unix.Close(memfd)
+		return nil, err
+	}
+	data, err := unix.Mmap(memfd, 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		unix.Close(memfd)
+		return nil, err
+	}
+	return &fakePlane{memfd: memfd, data: data}, nil
+}
+
+func (f *FakeDevice) freeBuffers(queue *fakeQueue) error {
+	for _, buffer := range queue.buffers {
+		for _, plane := range buffer.planes {
+			if plane.data != nil && queue.memory != MemoryUserPtr {
+				if err := unix.Munmap(plane.data); err != nil {
+					return err
+				}
+			}
+			if !plane.imported {
+				if err := unix.Close(plane.memfd); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	queue.buffers = nil
+	queue.queued = nil
+	queue.done = nil
+	return nil
+}
+
+func (f *FakeDevice) lookupBuffer(bufType BufType, index uint32) (*fakeQueue, *fakeBuffer, error) {
+	queue := f.queues[bufType]
+	if queue == nil || index >= uint32(len(queue.buffers)) {
+		return nil, nil, syscall.EINVAL
+	}
+	return queue, queue.buffers[index], nil
+}
+
+// export copies the state of a buffer into the caller's buffer struct and, for
+// multi-planar buffers, into the plane array it points at.
+func (f *FakeDevice) export(fakeBuffer *fakeBuffer, buffer *Buffer) error {
+	if !IsMultiPlanar(buffer.Type) {
+		*buffer = fakeBuffer.buffer
+		buffer.Length = uint32(len(fakeBuffer.planes[0].data))
+		buffer.BytesUsed = fakeBuffer.planes[0].bytesUsed
+		buffer.M = fakeBuffer.m(0)
+		return nil
+	}
+	planes, err := fakePlanes(buffer, len(fakeBuffer.planes))
+	if err != nil {
+		return err
+	}
+	m := buffer.M
+	*buffer = fakeBuffer.buffer
+	buffer.M = m
+	buffer.Length = uint32(len(fakeBuffer.planes))
+	for i, plane := range fakeBuffer.planes {
+		planes[i] = Plane{
+			BytesUsed: plane.bytesUsed,
+			Length:    uint32(len(plane.data)),
+			M:         fakeBuffer.m(i),
+		}
+	}
+	return nil
+}
+
+// m returns the memory union value of a buffer plane, which is the mmap offset
+// of driver buffers, the file descriptor of DMABUF buffers and the address of
+// user pointer buffers.
+func (b *fakeBuffer) m(plane int) uintptr {
+	switch b.buffer.Memory {
+	case MemoryDMABuf:
+		return uintptr(uint32(int32(b.planes[plane].memfd)))
+	case MemoryUserPtr:
+		if len(b.planes[plane].data) == 0 {
+			return 0
+		}
+		return uintptr(unsafe.Pointer(&b.planes[plane].data[0]))
+	}
+	return uintptr(fakeOffset(b.buffer.Type, b.buffer.Index, uint32(plane)))
+}
+
+func (f *FakeDevice) queryBuf(buffer *Buffer) error {
+	_, fakeBuffer, err := f.lookupBuffer(buffer.Type, buffer.Index)
+	if err != nil {
+		return err
+	}
+	return f.export(fakeBuffer, buffer)
+}
+
+func (f *FakeDevice) qBuf(buffer *Buffer) error {
+	queue, fakeBuffer, err := f.lookupBuffer(buffer.Type, buffer.Index)
+	if err != nil {
+		return err
+	}
+	if buffer.Memory != queue.memory || fakeBuffer.buffer.Flags&(BufFlagQueued|BufFlagInRequest) != 0 {
+		return syscall.EINVAL
+	}
+	if slices.Contains(queue.done, buffer.Index) {
+		return syscall.EINVAL
+	}
+	request, err := f.bufferRequest(buffer)
+	if err != nil {
+		return err
+	}
+	pix, pixPlanes := f.queueFormat(buffer.Type)
+	if IsMultiPlanar(buffer.Type) {
+		planes, err := fakePlanes(buffer, len(fakeBuffer.planes))
+		if err != nil {
+			return err
+		}
+		for i, plane := range fakeBuffer.planes {
+			if err := plane.attach(queue.memory, &planes[i].M, planes[i].Length, (*pixPlanes)[i].SizeImage); err != nil {
+				return err
+			}
+			if IsOutput(buffer.Type) {
+				plane.bytesUsed = min(planes[i].BytesUsed, uint32(len(plane.data)))
+			}
+		}
+	} else {
+		plane := fakeBuffer.planes[0]
+		if err := plane.attach(queue.memory, &buffer.M, buffer.Length, pix.SizeImage); err != nil {
+			return err
+		}
+		if IsOutput(buffer.Type) {
+			plane.bytesUsed = min(buffer.BytesUsed, uint32(len(plane.data)))
+		}
+	}
+	if IsOutput(buffer.Type) {
+		fakeBuffer.buffer.Timestamp = buffer.Timestamp
+	}
+	if request != nil {
+		request.bind(fakeBuffer)
+		return f.export(fakeBuffer, buffer)
+	}
+	fakeBuffer.buffer.Flags = (fakeBuffer.buffer.Flags | BufFlagQueued) &^ BufFlagDone
+	queue.queued = append(queue.queued, buffer.Index)
+	if f.isM2M() {
+		f.runJobs()
+	}
+	f.notify()
+	return f.export(fakeBuffer, buffer)
+}
+
+// attach makes the caller's memory queued for a plane the plane data. The
+// memory must hold at least size bytes.
+func (p *fakePlane) attach(memory Memory, m *uintptr, length uint32, size uint32) error {
+	switch memory {
+	case MemoryDMABuf:
+		return p.attachDMABuf(int(int32(*m)), length, size)
+	case MemoryUserPtr:
+		userPtr := *(*unsafe.Pointer)(unsafe.Pointer(m))
+		if userPtr == nil || length < size {
+			return syscall.EINVAL
+		}
+		p.data = unsafe.Slice((*byte)(userPtr), length)
+	}
+	return nil
+}
+
+// attachDMABuf maps the DMABUF fd queued for a plane. A length of zero uses
+// the whole DMABUF.
+func (p *fakePlane) attachDMABuf(fd int, length uint32, size uint32) error {
+	end, err := unix.Seek(fd, 0, io.SeekEnd)
+	if err != nil {
+		return syscall.EINVAL
+	}
+	if length == 0 || int64(length) > end {
+		length = uint32(end)
+	}
+	if length < size {
+		return syscall.EINVAL
+	}
+	data, err := unix.Mmap(fd, 0, int(length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		// Memory the CPU may not write, such as a write sealed memfd, is
+		// written privately, the way a device would.
+		if data, err = unix.Mmap(fd, 0, int(length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE); err != nil {
+			return syscall.EINVAL
+		}
+	}
+	if p.data != nil {
+		unix.Munmap(p.data)
+	}
+	p.memfd = fd
+	p.data = data
+	return nil
+}
+
+func (f *FakeDevice) expBuf(exportBuf *ExportBuf) error {
+	queue, fakeBuffer, err := f.lookupBuffer(exportBuf.Type, exportBuf.Index)
+	if err != nil {
+		return err
+	}
+	if queue.memory != MemoryMmap || exportBuf.Plane >= uint32(len(fakeBuffer.planes)) {
+		return syscall.EINVAL
+	}
+	flags := unix.F_DUPFD
+	if exportBuf.Flags&unix.O_CLOEXEC != 0 {
+		flags = unix.F_DUPFD_CLOEXEC
+	}
+	fd, err := unix.FcntlInt(uintptr(fakeBuffer.planes[exportBuf.Plane].memfd), flags, 0)
+	if err != nil {
+		return err
+	}
+	exportBuf.FD = int32(fd)
+	return nil
+}
+
+func (f *FakeDevice) dqBuf(buffer *Buffer) error {
+	queue := f.queues[buffer.Type]
+	if queue == nil || !queue.streaming {
+		return syscall.EINVAL
+	}
+	if f.isM2M() {
+		return f.dqBufM2M(queue, buffer)
+	}
+	if len(queue.queued) == 0 {
+		return syscall.EAGAIN
+	}
+	index := queue.queued[0]
+	fakeBuffer := queue.buffers[index]
+	if IsMultiPlanar(buffer.Type) {
+		if _, err := fakePlanes(buffer, len(fakeBuffer.planes)); err != nil {
+			return err
+		}
+	}
+	queue.queued = queue.queued[1:]
+	f.fill(fakeBuffer, queue.sequence)
+	fakeBuffer.buffer.Flags = (fakeBuffer.buffer.Flags &^ BufFlagQueued) | BufFlagDone | BufFlagTimestampMonotonic
+	fakeBuffer.buffer.Field = FieldNone
+	fakeBuffer.buffer.Sequence = queue.sequence
+	fakeBuffer.buffer.Timestamp = syscall.NsecToTimeval(time.Since(f.start).Nanoseconds())
+	queue.sequence++
+	buffer.Index = index
+	return f.export(fakeBuffer, buffer)
+}
+
+// fill writes the content of the frame with the given sequence number into
+// the buffer, spreading it across the planes in order.
+func (f *FakeDevice) fill(fakeBuffer *fakeBuffer, sequence uint32) {
+	data := f.frame(sequence)
+	for i, plane := range fakeBuffer.planes {
+		size := len(plane.data)
+		if len(fakeBuffer.planes) > 1 && int(f.planes[i].SizeImage) < size {
+			size = int(f.planes[i].SizeImage)
+		}
+		if i == len(fakeBuffer.planes)-1 || size > len(data) {
+			size = len(data)
+		}
+		plane.bytesUsed = uint32(copy(plane.data, data[:size]))
+		data = data[size:]
+	}
+}
+
+// frame returns the content of the frame with the given sequence number.
+func (f *FakeDevice) frame(sequence uint32) []byte {
+	if f.config.Frame != nil {
+		format := f.format
+		return f.config.Frame(sequence, &format)
+	}
+	data := make([]byte, f.format.SizeImage)
+	for i := range data {
+		data[i] = byte(sequence)
+	}
+	return data
+}
+
+func (f *FakeDevice) streamOn(bufType BufType) error {
+	queue := f.queues[bufType]
+	if queue == nil || len(queue.buffers) == 0 {
+		return syscall.EINVAL
+	}
+	queue.streaming = true
+	if f.isM2M() {
+		if !IsOutput(bufType) {
+			f.codec.resolving = false
+		}
+		f.runJobs()
+	}
+	f.notify()
+	return nil
+}
+
+func (f *FakeDevice) streamOff(bufType BufType) error {
+	queue := f.queues[bufType]
+	if queue == nil {
+		return syscall.EINVAL
+	}
+	queue.streaming = false
+	queue.queued = nil
+	queue.done = nil
+	queue.sequence = 0
+	for _, buffer := range queue.buffers {
+		buffer.buffer.Flags &^= BufFlagQueued | BufFlagDone
+		if request := buffer.request; request != nil && request.state == fakeRequestQueued {
+			request.complete(buffer)
+		}
+	}
+	if f.isM2M() {
+		f.codec.restart()
+	}
+	f.notify()
+	return nil
+}
+
+func (f *FakeDevice) findControl(id CtrlID) *FakeControl {
+	for i := range f.controls {
+		if f.controls[i].ID == id {
+			return &f.controls[i]
+		}
+	}
+	return nil
+}
+
+func (f *FakeDevice) queryCtrl(queryCtrl *QueryCtrl) error {
+	control := f.nextControl(queryCtrl.ID &^ CtrlID(CtrlFlagNextCompound))
+	if control == nil || control.hasPayload() {
+		return syscall.EINVAL
+	}
+	*queryCtrl = QueryCtrl{
+		ID:           control.ID,
+		Type:         control.Type,
+		Minimum:      int32(control.Minimum),
+		Maximum:      int32(control.Maximum),
+		Step:         int32(control.Step),
+		DefaultValue: int32(control.DefaultValue),
+		Flags:        uint32(control.Flags),
+	}
+	copy(queryCtrl.Name[:len(queryCtrl.Name)-1], control.Name)
+	return nil
+}
+
+func (f *FakeDevice) queryMenu(queryMenu *QueryMenu) error {
+	control := f.findControl(queryMenu.ID)
+	if control == nil || queryMenu.Index >= uint32(len(control.Menu)) {
+		return syscall.EINVAL
+	}
+	queryMenu.Name = [32]byte{}
+	copy(queryMenu.Name[:len(queryMenu.Name)-1], control.Menu[queryMenu.Index])
+	return nil
+}
+
+func (f *FakeDevice) getCtrl(control *Control) error {
+	fakeControl := f.findControl(control.ID)
+	if fakeControl == nil {
+		return syscall.EINVAL
+	}
+	if fakeControl.Flags&CtrlFlagWriteOnly != 0 {
+		return syscall.EACCES
+	}
+	if fakeControl.Type == CtrlTypeInteger64 || fakeControl.hasPayload() {
+		return syscall.EINVAL
+	}
+	control.Value = int32(fakeControl.Value)
+	return nil
+}
+
+func (f *FakeDevice) setCtrl(control *Control) error {
+	fakeControl := f.findControl(control.ID)
+	if fakeControl == nil {
+		return syscall.EINVAL
+	}
+	if fakeControl.Flags&CtrlFlagReadOnly != 0 {
+		return syscall.EACCES
+	}
+	if fakeControl.Type == CtrlTypeInteger64 || fakeControl.hasPayload() {
+		return syscall.EINVAL
+	}
+	if int64(control.Value) < fakeControl.Minimum || int64(control.Value) > fakeControl.Maximum {
+		return syscall.ERANGE
+	}
+	fakeControl.Value = int64(control.Value)
+	f.controlEvent(fakeControl, EventCtrlChValue, true)
+	return nil
+}
+
+// fakeOffset returns the mmap offset of a buffer plane.
+func fakeOffset(bufType BufType, index uint32, plane uint32) int64 {
+	return int64(uint32(bufType)<<16|plane<<8|index) * int64(unix.Getpagesize())
+}
+
+// fakeFindFormat returns the format with the pixel format, or nil.
+func fakeFindFormat(formats []FakeFormat, pixFormat PixFmt) *FakeFormat {
+	for i := range formats {
+		if formats[i].PixFormat == pixFormat {
+			return &formats[i]
+		}
+	}
+	return nil
+}
+
+// fakePlanes returns the plane array a multi-planar buffer points at, which
+// must have room for at least count planes.
+func fakePlanes(buffer *Buffer, count int) ([]Plane, error) {
+	if buffer.Length < uint32(count) || buffer.Length > VideoMaxPlanes || buffer.M == 0 {
+		return nil, syscall.EINVAL
+	}
+	planes := *(*unsafe.Pointer)(unsafe.Pointer(&buffer.M))
+	return unsafe.Slice((*Plane)(planes), buffer.Length), nil
+}
+
+// fakeFormatMPlane returns the multi-planar view of a format.
+func fakeFormatMPlane(pix *PixFormat, planes []PlanePixFormat) PixFormatMPlane {
+	pixMPlane := PixFormatMPlane{
+		Width:      pix.Width,
+		Height:     pix.Height,
+		PixFormat:  pix.PixFormat,
+		Field:      pix.Field,
+		ColorSpace: pix.ColorSpace,
+		NumPlanes:  uint8(len(planes)),
+	}
+	copy(pixMPlane.PlaneFmt[:], planes)
+	return pixMPlane
+}
+
+// fakePageAlign rounds size up to a whole number of pages.
+func fakePageAlign(size int) int {
+	pageSize := unix.Getpagesize()
+	if size == 0 {
+		return pageSize
+	}
+	return (size + pageSize - 1) / pageSize * pageSize
+}
+
+// fakeDistance returns how far a frame size is from the requested size.
+func fakeDistance(frameSize FrameSizeDiscrete, width uint32, height uint32) int64 {
+	dw := int64(frameSize.Width) - int64(width)
+	dh := int64(frameSize.Height) - int64(height)
+	return dw*dw + dh*dh
+}
+
+// fakeIntervalDistance returns how far an interval is from the requested interval.
+func fakeIntervalDistance(interval Fract, requested Fract) float64 {
+	d := float64(interval.Numerator)/float64(interval.Denominator) - float64(requested.Numerator)/float64(requested.Denominator)
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// fakeSizeImage fills in the line and image sizes of a pix format and returns
+// the layout of its planes when stored multi-planar.
+func fakeSizeImage(pix *PixFormat) []PlanePixFormat {
+	luma := pix.Width * pix.Height
+	switch pix.PixFormat {
+	case PixFmtNV12M, PixFmtNV21M:
+		pix.BytesPerLine = pix.Width
+		pix.SizeImage = luma * 3 / 2
+		return []PlanePixFormat{{SizeImage: luma, BytesPerLine: pix.Width}, {SizeImage: luma / 2, BytesPerLine: pix.Width}}
+	case PixFmtNV16M, PixFmtNV61M:
+		pix.BytesPerLine = pix.Width
+		pix.SizeImage = luma * 2
+		return []PlanePixFormat{{SizeImage: luma, BytesPerLine: pix.Width}, {SizeImage: luma, BytesPerLine: pix.Width}}
+	case PixFmtYUV420M, PixFmtYVU420M:
+		pix.BytesPerLine = pix.Width
+		pix.SizeImage = luma * 3 / 2
+		return []PlanePixFormat{{SizeImage: luma, BytesPerLine: pix.Width}, {SizeImage: luma / 4, BytesPerLine: pix.Width / 2}, {SizeImage: luma / 4, BytesPerLine: pix.Width / 2}}
+	case PixFmtGrey:
+		pix.BytesPerLine = pix.Width
+		pix.SizeImage = pix.Width * pix.Height
+	case PixFmtNV12, PixFmtNV21, PixFmtYUV420, PixFmtYVU420:
+		pix.BytesPerLine = pix.Width
+		pix.SizeImage = pix.Width * pix.Height * 3 / 2
+	case PixFmtRGB24, PixFmtBGR24:
+		pix.BytesPerLine = pix.Width * 3
+		pix.SizeImage = pix.BytesPerLine * pix.Height
+	case PixFmtYUYV, PixFmtUYVY, PixFmtYVYU, PixFmtVYUY, PixFmtRGB565:
+		pix.BytesPerLine = pix.Width * 2
+		pix.SizeImage = pix.BytesPerLine * pix.Height
+	default:
+		pix.BytesPerLine = 0
+		pix.SizeImage = pix.Width * pix.Height * 2
+	}
+	return []PlanePixFormat{{SizeImage: pix.SizeImage, BytesPerLine: pix.BytesPerLine}}
+}
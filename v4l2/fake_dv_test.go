@@ -0,0 +1,120 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// SetSignal simulates the DV signal on the input changing, or being lost if
+// bt is nil, and raises a source change event.
+func (f *FakeDevice) SetSignal(bt *BTTimings) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.signal = nil
+	if bt != nil {
+		signal := *bt
+		f.signal = &signal
+	}
+	event := Event{Type: EventTypeSourceChange}
+	event.SrcChange().Changes = EventSrcChResolution
+	f.queueEvent(event)
+}
+
+// dvTimingsIoctl handles the DV timings ioctls, which need configured timings.
+func (f *FakeDevice) dvTimingsIoctl(request uint32, arg unsafe.Pointer) error {
+	if len(f.config.DVTimings) == 0 {
+		return syscall.ENOTTY
+	}
+	switch request {
+	case VidIocQueryDVTimings:
+		if f.signal == nil {
+			return syscall.ENOLINK
+		}
+		(*DVTimings)(arg).SetBT(f.signal)
+	case VidIocGDVTimings:
+		(*DVTimings)(arg).SetBT(&f.dvTimings)
+	case VidIocSDVTimings:
+		return f.setDVTimings((*DVTimings)(arg))
+	case VidIocEnumDVTimings:
+		enum := (*DVTimingsEnum)(arg)
+		if enum.Pad != 0 || enum.Index >= uint32(len(f.config.DVTimings)) {
+			return syscall.EINVAL
+		}
+		enum.Timings.SetBT(&f.config.DVTimings[enum.Index])
+	case VidIocDVTimingsCap:
+		return f.dvTimingsCap((*DVTimingsCap)(arg))
+	}
+	return nil
+}
+
+func (f *FakeDevice) setDVTimings(timings *DVTimings) error {
+	if timings.Type != DVTypeBT6561120 {
+		return syscall.EINVAL
+	}
+	bt, err := timings.BT()
+	if err != nil {
+		return syscall.EINVAL
+	}
+	for _, supported := range f.config.DVTimings {
+		if supported.Width != bt.Width || supported.Height != bt.Height || supported.PixelClock != bt.PixelClock || supported.Interlaced != bt.Interlaced {
+			continue
+		}
+		if supported != f.dvTimings && f.buffersAllocated() {
+			return syscall.EBUSY
+		}
+		f.dvTimings = supported
+		f.format.Width = supported.Width
+		f.format.Height = supported.Height
+		f.planes = fakeSizeImage(&f.format)
+		timings.SetBT(&supported)
+		return nil
+	}
+	return syscall.EINVAL
+}
+
+func (f *FakeDevice) dvTimingsCap(timingsCap *DVTimingsCap) error {
+	if timingsCap.Pad != 0 {
+		return syscall.EINVAL
+	}
+	first := &f.config.DVTimings[0]
+	bt := &BTTimingsCap{
+		MinWidth:      first.Width,
+		MaxWidth:      first.Width,
+		MinHeight:     first.Height,
+		MaxHeight:     first.Height,
+		MinPixelClock: first.PixelClock,
+		MaxPixelClock: first.PixelClock,
+		Standards:     DVBTStdCEA861,
+		Capabilities:  DVBTCapProgressive,
+	}
+	for _, timings := range f.config.DVTimings[1:] {
+		bt.MinWidth = min(bt.MinWidth, timings.Width)
+		bt.MaxWidth = max(bt.MaxWidth, timings.Width)
+		bt.MinHeight = min(bt.MinHeight, timings.Height)
+		bt.MaxHeight = max(bt.MaxHeight, timings.Height)
+		bt.MinPixelClock = min(bt.MinPixelClock, timings.PixelClock)
+		bt.MaxPixelClock = max(bt.MaxPixelClock, timings.PixelClock)
+	}
+	timingsCap.SetBT(bt)
+	return nil
+}
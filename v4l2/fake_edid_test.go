@@ -0,0 +1,70 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"bytes"
+	"syscall"
+	"unsafe"
+)
+
+func (f *FakeDevice) getEDID(edid *EDID) error {
+	if f.config.EDIDBlocks == 0 {
+		return syscall.ENOTTY
+	}
+	blocks := uint32(len(f.edid) / EDIDBlockSize)
+	if edid.Pad != 0 {
+		return syscall.EINVAL
+	}
+	if edid.StartBlock == 0 && edid.Blocks == 0 {
+		edid.Blocks = blocks
+		return nil
+	}
+	if blocks == 0 {
+		return syscall.ENODATA
+	}
+	if edid.StartBlock >= blocks {
+		return syscall.EINVAL
+	}
+	edid.Blocks = min(edid.Blocks, blocks-edid.StartBlock)
+	ptr := *(*unsafe.Pointer)(unsafe.Pointer(&edid.EDID))
+	copy(unsafe.Slice((*byte)(ptr), edid.Blocks*EDIDBlockSize), f.edid[edid.StartBlock*EDIDBlockSize:])
+	return nil
+}
+
+func (f *FakeDevice) setEDID(edid *EDID) error {
+	if f.config.EDIDBlocks == 0 {
+		return syscall.ENOTTY
+	}
+	if edid.Pad != 0 || edid.StartBlock != 0 {
+		return syscall.EINVAL
+	}
+	if edid.Blocks > f.config.EDIDBlocks {
+		edid.Blocks = f.config.EDIDBlocks
+		return syscall.E2BIG
+	}
+	f.edid = nil
+	if edid.Blocks > 0 {
+		ptr := *(*unsafe.Pointer)(unsafe.Pointer(&edid.EDID))
+		f.edid = bytes.Clone(unsafe.Slice((*byte)(ptr), edid.Blocks*EDIDBlockSize))
+	}
+	return nil
+}
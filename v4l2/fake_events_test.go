@@ -0,0 +1,143 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+type fakeSubscription struct {
+	eventType EventType
+	id        uint32
+}
+
+// QueueEvent simulates the driver raising an event. Like the kernel, it is
+// dropped unless its type and id have been subscribed to.
+func (f *FakeDevice) QueueEvent(event Event) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.queueEvent(event)
+}
+
+// ChangeControl simulates another process setting a control, which raises a
+// control event regardless of EventSubFlAllowFeedback.
+func (f *FakeDevice) ChangeControl(id CtrlID, value int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	control := f.findControl(id)
+	if control == nil {
+		return syscall.EINVAL
+	}
+	if value < control.Minimum || value > control.Maximum {
+		return syscall.ERANGE
+	}
+	control.Value = value
+	f.controlEvent(control, EventCtrlChValue, false)
+	return nil
+}
+
+func (f *FakeDevice) subscribeEvent(subscription *EventSubscription) error {
+	switch subscription.Type {
+	case EventTypeCtrl:
+		control := f.findControl(CtrlID(subscription.ID))
+		if control == nil {
+			return syscall.EINVAL
+		}
+		f.subscribed[fakeSubscription{subscription.Type, subscription.ID}] = subscription.Flags
+		if subscription.Flags&EventSubFlSendInitial != 0 {
+			changes := EventCtrlChFlags
+			if control.Flags&CtrlFlagWriteOnly == 0 {
+				changes |= EventCtrlChValue
+			}
+			f.controlEvent(control, changes, false)
+		}
+	case EventTypeVSync, EventTypeEOS, EventTypeFrameSync, EventTypeSourceChange, EventTypeMotionDet:
+		f.subscribed[fakeSubscription{subscription.Type, subscription.ID}] = subscription.Flags
+	default:
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// unsubscribeEvent removes a subscription along with its pending events.
+func (f *FakeDevice) unsubscribeEvent(subscription *EventSubscription) error {
+	key := fakeSubscription{subscription.Type, subscription.ID}
+	if subscription.Type == EventTypeAll {
+		clear(f.subscribed)
+	} else {
+		delete(f.subscribed, key)
+	}
+	events := f.events[:0]
+	for _, event := range f.events {
+		if _, ok := f.subscribed[fakeSubscription{event.Type, event.ID}]; ok {
+			events = append(events, event)
+		}
+	}
+	f.events = events
+	return nil
+}
+
+func (f *FakeDevice) dqEvent(event *Event) error {
+	if len(f.events) == 0 {
+		return syscall.ENOENT
+	}
+	*event = f.events[0]
+	f.events = f.events[1:]
+	event.Pending = uint32(len(f.events))
+	return nil
+}
+
+// queueEvent stamps and queues an event if it has been subscribed to.
+func (f *FakeDevice) queueEvent(event Event) {
+	if _, ok := f.subscribed[fakeSubscription{event.Type, event.ID}]; !ok {
+		return
+	}
+	var timestamp unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &timestamp)
+	event.Sequence = f.eventSeq
+	event.Timestamp = syscall.NsecToTimespec(timestamp.Nano())
+	f.eventSeq++
+	f.events = append(f.events, event)
+	f.notify()
+}
+
+// controlEvent queues a control event. Changes made through the device
+// itself are only reported with EventSubFlAllowFeedback.
+func (f *FakeDevice) controlEvent(control *FakeControl, changes EventCtrlChange, feedback bool) {
+	flags, ok := f.subscribed[fakeSubscription{EventTypeCtrl, uint32(control.ID)}]
+	if !ok || feedback && flags&EventSubFlAllowFeedback == 0 {
+		return
+	}
+	event := Event{Type: EventTypeCtrl, ID: uint32(control.ID)}
+	*event.Ctrl() = EventCtrl{
+		Changes:      changes,
+		Type:         control.Type,
+		Value:        control.Value,
+		Flags:        uint32(control.Flags),
+		Minimum:      int32(control.Minimum),
+		Maximum:      int32(control.Maximum),
+		Step:         int32(control.Step),
+		DefaultValue: int32(control.DefaultValue),
+	}
+	f.queueEvent(event)
+}
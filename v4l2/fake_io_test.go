@@ -0,0 +1,131 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// FakeInput is a video input offered by a FakeDevice.
+type FakeInput struct {
+	Name         string
+	Type         InputType
+	Status       InputStatus
+	Capabilities InputCap
+	Tuner        uint32   // Index into FakeConfig.Tuners for tuner inputs.
+	AudioSet     AudioSet // Indexes into FakeConfig.Audio.
+}
+
+// FakeOutput is a video output offered by a FakeDevice.
+type FakeOutput struct {
+	Name         string
+	Type         OutputType
+	Capabilities OutputCap
+	Modulator    uint32   // Index into FakeConfig.Modulators for modulator outputs.
+	AudioSet     AudioSet // Indexes into FakeConfig.AudioOuts.
+}
+
+// SetInputStatus simulates the status of an input changing, for example
+// when its signal is lost.
+func (f *FakeDevice) SetInputStatus(index uint32, status InputStatus) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if index >= uint32(len(f.inputs)) {
+		return syscall.EINVAL
+	}
+	f.inputs[index].Status = status
+	return nil
+}
+
+// inputIoctl handles the input ioctls, which radio devices without configured
+// inputs do not offer.
+func (f *FakeDevice) inputIoctl(request uint32, arg unsafe.Pointer) error {
+	if len(f.config.Inputs) == 0 && f.config.Capabilities&CapRadio != 0 {
+		return syscall.ENOTTY
+	}
+	switch request {
+	case VidIocEnumInput:
+		return f.enumInput((*Input)(arg))
+	case VidIocGInput:
+		*(*uint32)(arg) = f.input
+	case VidIocSInput:
+		return f.setInput(*(*uint32)(arg))
+	}
+	return nil
+}
+
+func (f *FakeDevice) enumInput(input *Input) error {
+	if input.Index >= uint32(len(f.inputs)) {
+		return syscall.EINVAL
+	}
+	fakeInput := &f.inputs[input.Index]
+	*input = Input{
+		Index:        input.Index,
+		Type:         fakeInput.Type,
+		AudioSet:     fakeInput.AudioSet,
+		Tuner:        fakeInput.Tuner,
+		Status:       fakeInput.Status,
+		Capabilities: fakeInput.Capabilities,
+	}
+	copy(input.Name[:len(input.Name)-1], fakeInput.Name)
+	return nil
+}
+
+func (f *FakeDevice) setInput(index uint32) error {
+	if index >= uint32(len(f.inputs)) {
+		return syscall.EINVAL
+	}
+	if index != f.input && f.buffersAllocated() {
+		return syscall.EBUSY
+	}
+	f.input = index
+	f.followAudio()
+	return nil
+}
+
+func (f *FakeDevice) enumOutput(output *Output) error {
+	if output.Index >= uint32(len(f.config.Outputs)) {
+		return syscall.EINVAL
+	}
+	fakeOutput := &f.config.Outputs[output.Index]
+	*output = Output{
+		Index:        output.Index,
+		Type:         fakeOutput.Type,
+		AudioSet:     fakeOutput.AudioSet,
+		Modulator:    fakeOutput.Modulator,
+		Capabilities: fakeOutput.Capabilities,
+	}
+	copy(output.Name[:len(output.Name)-1], fakeOutput.Name)
+	return nil
+}
+
+func (f *FakeDevice) setOutput(index uint32) error {
+	if len(f.config.Outputs) == 0 {
+		return syscall.ENOTTY
+	}
+	if index >= uint32(len(f.config.Outputs)) {
+		return syscall.EINVAL
+	}
+	f.output = index
+	f.followAudioOut()
+	return nil
+}
@@ -0,0 +1,365 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakePacketHeader is the size of the header of the packets a fake encoder
+// produces: the width, the height and a keyframe flag, each as a little-endian
+// uint32. The header is followed by the first byte of the raw frame.
+const fakePacketHeader = 12
+
+// fakeCodec is the state of the codec of a memory-to-memory FakeDevice.
+type fakeCodec struct {
+	frames    uint32 // Frames encoded since the last keyframe.
+	draining  bool   // A STOP command is pending.
+	stopped   bool   // The last buffer has been produced.
+	drained   bool   // The last buffer has been dequeued.
+	width     uint32 // Resolution of the decoded stream, zero until known.
+	height    uint32
+	resolving bool // The CAPTURE queue must be reconfigured before decoding resumes.
+}
+
+// restart ends a drain, as restarting either queue does.
+func (c *fakeCodec) restart() {
+	c.frames = 0
+	c.draining = false
+	c.stopped = false
+	c.drained = false
+}
+
+// isM2M reports whether the device is a memory-to-memory device.
+func (f *FakeDevice) isM2M() bool {
+	return f.config.Capabilities&(CapVideoM2M|CapVideoM2MMPlane) != 0
+}
+
+// isEncoder reports whether the device is a memory-to-memory device producing
+// compressed data.
+func (f *FakeDevice) isEncoder() bool {
+	if !f.isM2M() {
+		return false
+	}
+	format := f.findFormat(f.format.PixFormat)
+	return format != nil && format.Flags&FmtFlagCompressed != 0
+}
+
+// isDecoder reports whether the device is a memory-to-memory device consuming
+// compressed data.
+func (f *FakeDevice) isDecoder() bool {
+	if !f.isM2M() {
+		return false
+	}
+	format := fakeFindFormat(f.config.OutputFormats, f.outFormat.PixFormat)
+	return format != nil && format.Flags&FmtFlagCompressed != 0
+}
+
+// m2mQueues returns the OUTPUT and CAPTURE queues, nil for those not allocated.
+func (f *FakeDevice) m2mQueues() (*fakeQueue, *fakeQueue) {
+	if f.config.Capabilities&CapVideoM2MMPlane != 0 {
+		return f.queues[BufTypeVideOutputMPlane], f.queues[BufTypeVideCaptureMPlane]
+	}
+	return f.queues[BufTypeVideoOutput], f.queues[BufTypeVideoCapture]
+}
+
+// runJobs processes queued OUTPUT buffers into queued CAPTURE buffers for as
+// long as both queues stream and have buffers, then completes a pending drain.
+// Stateful decoders parse the stream header first, which only needs the
+// OUTPUT queue, and stop at a resolution change until the CAPTURE queue is
+// restarted. Stateless decoders take the stream parameters from the controls
+// of the request each OUTPUT buffer is queued with.
+func (f *FakeDevice) runJobs() {
+	output, capture := f.m2mQueues()
+	if output == nil || !output.streaming {
+		return
+	}
+	capturing := capture != nil && capture.streaming
+	for len(output.queued) > 0 && !f.codec.resolving {
+		src := output.buffers[output.queued[0]]
+		if f.isDecoder() && !f.config.Requests {
+			width, height, _, ok := fakeParsePacket(src)
+			if !ok {
+				output.queued = output.queued[1:]
+				f.complete(output, src)
+				continue
+			}
+			if width != f.codec.width || height != f.codec.height {
+				f.changeResolution(width, height)
+				break
+			}
+		}
+		if !capturing || len(capture.queued) == 0 {
+			break
+		}
+		dst := capture.buffers[capture.queued[0]]
+		output.queued = output.queued[1:]
+		capture.queued = capture.queued[1:]
+		switch {
+		case f.isEncoder():
+			f.encode(src, dst)
+		case f.config.Requests:
+			f.decodeRequest(src, dst)
+		default:
+			f.decode(src, dst)
+		}
+		dst.buffer.Sequence = capture.sequence
+		capture.sequence++
+		f.complete(output, src)
+		f.complete(capture, dst)
+		if request := src.request; request != nil {
+			request.complete(src)
+		}
+	}
+	last := f.codec.resolving || (f.codec.draining && len(output.queued) == 0)
+	if last && capturing && !f.codec.stopped && len(capture.queued) > 0 {
+		dst := capture.buffers[capture.queued[0]]
+		capture.queued = capture.queued[1:]
+		for _, plane := range dst.planes {
+			plane.bytesUsed = 0
+		}
+		dst.buffer.Flags = dst.buffer.Flags&^(BufFlagKeyFrame|BufFlagPFrame) | BufFlagLast
+		dst.buffer.Sequence = capture.sequence
+		capture.sequence++
+		f.complete(capture, dst)
+		f.codec.draining = false
+		f.codec.stopped = true
+	}
+}
+
+// changeResolution switches the CAPTURE format of a decoder to the resolution
+// of the stream and signals the change.
+func (f *FakeDevice) changeResolution(width uint32, height uint32) {
+	f.codec.width = width
+	f.codec.height = height
+	f.codec.resolving = true
+	f.format.Width = width
+	f.format.Height = height
+	f.planes = fakeSizeImage(&f.format)
+	f.crop = Rect{Width: width, Height: height}
+	event := Event{Type: EventTypeSourceChange}
+	event.SrcChange().Changes = EventSrcChResolution
+	f.queueEvent(event)
+}
+
+// encode writes the packet of the raw frame in src into dst.
+func (f *FakeDevice) encode(src *fakeBuffer, dst *fakeBuffer) {
+	gopSize := uint32(0)
+	if control := f.findControl(CidMPEGVideoGOPSize); control != nil {
+		gopSize = uint32(control.Value)
+	}
+	keyFrame := f.codec.frames == 0 || (gopSize != 0 && f.codec.frames >= gopSize)
+	if control := f.findControl(CidMPEGVideoForceKeyFrame); control != nil && control.Value != 0 {
+		keyFrame = true
+		control.Value = 0
+	}
+	if keyFrame {
+		f.codec.frames = 0
+	}
+	f.codec.frames++
+	packet := make([]byte, fakePacketHeader+1)
+	binary.LittleEndian.PutUint32(packet[0:], f.outFormat.Width)
+	binary.LittleEndian.PutUint32(packet[4:], f.outFormat.Height)
+	flags := BufFlagPFrame
+	if keyFrame {
+		binary.LittleEndian.PutUint32(packet[8:], 1)
+		flags = BufFlagKeyFrame
+	}
+	if raw := src.planes[0]; raw.bytesUsed > 0 {
+		packet[fakePacketHeader] = raw.data[0]
+	}
+	for i, plane := range dst.planes {
+		plane.bytesUsed = 0
+		if i == 0 {
+			plane.bytesUsed = uint32(copy(plane.data, packet))
+		}
+	}
+	dst.buffer.Flags = dst.buffer.Flags&^(BufFlagKeyFrame|BufFlagPFrame|BufFlagLast) | flags
+	dst.buffer.Timestamp = src.buffer.Timestamp
+}
+
+// decode writes the frame of the packet in src into dst, filling it with the
+// byte following the packet header.
+func (f *FakeDevice) decode(src *fakeBuffer, dst *fakeBuffer) {
+	_, _, keyFrame, _ := fakeParsePacket(src)
+	value := byte(0)
+	if packet := src.planes[0]; packet.bytesUsed > fakePacketHeader {
+		value = packet.data[fakePacketHeader]
+	}
+	flags := BufFlagPFrame
+	if keyFrame {
+		flags = BufFlagKeyFrame
+	}
+	f.paint(dst, value, flags)
+	dst.buffer.Timestamp = src.buffer.Timestamp
+}
+
+// decodeRequest applies the controls of the request src is queued with and
+// writes the frame of the slice data in src into dst, filling it with the
+// first byte of the data.
+func (f *FakeDevice) decodeRequest(src *fakeBuffer, dst *fakeBuffer) {
+	src.request.apply()
+	value := byte(0)
+	if data := src.planes[0]; data.bytesUsed > 0 {
+		value = data.data[0]
+	}
+	f.paint(dst, value, 0)
+	dst.buffer.Timestamp = src.buffer.Timestamp
+}
+
+// paint fills the decoded frame in dst with value.
+func (f *FakeDevice) paint(dst *fakeBuffer, value byte, flags BufFlag) {
+	for i, plane := range dst.planes {
+		size := f.format.SizeImage
+		if len(dst.planes) > 1 {
+			size = f.planes[i].SizeImage
+		}
+		size = min(size, uint32(len(plane.data)))
+		for j := range plane.data[:size] {
+			plane.data[j] = value
+		}
+		plane.bytesUsed = size
+	}
+	dst.buffer.Flags = dst.buffer.Flags&^(BufFlagKeyFrame|BufFlagPFrame|BufFlagLast) | flags
+}
+
+// fakeParsePacket returns the resolution and keyframe flag in the header of
+// the packet in a buffer, with ok false if the header is incomplete.
+func fakeParsePacket(fakeBuffer *fakeBuffer) (width uint32, height uint32, keyFrame bool, ok bool) {
+	plane := fakeBuffer.planes[0]
+	if plane.bytesUsed < fakePacketHeader {
+		return 0, 0, false, false
+	}
+	packet := plane.data[:plane.bytesUsed]
+	width = binary.LittleEndian.Uint32(packet[0:])
+	height = binary.LittleEndian.Uint32(packet[4:])
+	keyFrame = binary.LittleEndian.Uint32(packet[8:]) != 0
+	return width, height, keyFrame, width != 0 && height != 0
+}
+
+// complete hands a processed buffer back to the application.
+func (f *FakeDevice) complete(queue *fakeQueue, fakeBuffer *fakeBuffer) {
+	fakeBuffer.buffer.Flags = fakeBuffer.buffer.Flags&^BufFlagQueued | BufFlagDone | BufFlagTimestampCopy
+	fakeBuffer.buffer.Field = FieldNone
+	queue.done = append(queue.done, fakeBuffer.buffer.Index)
+}
+
+// dqBufM2M dequeues the oldest processed buffer of a memory-to-memory queue.
+func (f *FakeDevice) dqBufM2M(queue *fakeQueue, buffer *Buffer) error {
+	if len(queue.done) == 0 {
+		if !IsOutput(buffer.Type) && f.codec.drained {
+			return syscall.EPIPE
+		}
+		return syscall.EAGAIN
+	}
+	index := queue.done[0]
+	fakeBuffer := queue.buffers[index]
+	if IsMultiPlanar(buffer.Type) {
+		if _, err := fakePlanes(buffer, len(fakeBuffer.planes)); err != nil {
+			return err
+		}
+	}
+	queue.done = queue.done[1:]
+	fakeBuffer.buffer.Flags &^= BufFlagDone
+	if !IsOutput(buffer.Type) && fakeBuffer.buffer.Flags&BufFlagLast != 0 {
+		f.codec.drained = true
+	}
+	buffer.Index = index
+	return f.export(fakeBuffer, buffer)
+}
+
+// pollM2M returns the poll events of a memory-to-memory device.
+func (f *FakeDevice) pollM2M() int16 {
+	output, capture := f.m2mQueues()
+	streaming := false
+	var revents int16
+	if output != nil && output.streaming {
+		streaming = true
+		if len(output.done) > 0 {
+			revents |= unix.POLLOUT
+		}
+	}
+	if capture != nil && capture.streaming {
+		streaming = true
+		if len(capture.done) > 0 || f.codec.drained {
+			revents |= unix.POLLIN
+		}
+	}
+	if !streaming {
+		revents |= unix.POLLERR
+	}
+	return revents
+}
+
+func (f *FakeDevice) encoderCmd(encoderCmd *EncoderCmd, apply bool) error {
+	if !f.isEncoder() {
+		return syscall.ENOTTY
+	}
+	switch encoderCmd.Cmd {
+	case EncCmdStart:
+		encoderCmd.Flags = 0
+		if apply {
+			f.codec.restart()
+			f.runJobs()
+			f.notify()
+		}
+	case EncCmdStop:
+		encoderCmd.Flags &= EncCmdStopAtGOPEnd
+		if apply && !f.codec.stopped {
+			f.codec.draining = true
+			f.runJobs()
+			f.notify()
+		}
+	default:
+		return syscall.EINVAL
+	}
+	encoderCmd.Data = [8]uint32{}
+	return nil
+}
+
+func (f *FakeDevice) decoderCmd(decoderCmd *DecoderCmd, apply bool) error {
+	if !f.isDecoder() {
+		return syscall.ENOTTY
+	}
+	switch decoderCmd.Cmd {
+	case DecCmdStart:
+		decoderCmd.Flags = 0
+		if apply {
+			f.codec.restart()
+			f.runJobs()
+			f.notify()
+		}
+	case DecCmdStop:
+		decoderCmd.Flags = 0
+		if apply && !f.codec.stopped {
+			f.codec.draining = true
+			f.runJobs()
+			f.notify()
+		}
+	default:
+		return syscall.EINVAL
+	}
+	decoderCmd.Data = [16]uint32{}
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeRequestState is the state of a fake request.
+type fakeRequestState int
+
+const (
+	fakeRequestIdle fakeRequestState = iota
+	fakeRequestQueued
+	fakeRequestComplete
+)
+
+// fakeRequest is a request allocated by a FakeDevice acting as its own media
+// device. It is registered like the device, so that its file descriptor can be
+// used with the request functions of this package.
+type fakeRequest struct {
+	fd       int
+	device   *FakeDevice
+	state    fakeRequestState
+	controls map[CtrlID]FakeControl // Values set in the request.
+	buffers  []*fakeBuffer
+}
+
+func (f *FakeDevice) allocRequest(requestFD *int32) error {
+	if !f.config.Requests {
+		return syscall.ENOTTY
+	}
+	fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	RegisterDevice(&fakeRequest{fd: fd, device: f, controls: make(map[CtrlID]FakeControl)})
+	*requestFD = int32(fd)
+	return nil
+}
+
+// lookupRequest returns the request of the device with the file descriptor, or nil.
+func (f *FakeDevice) lookupRequest(fd int) *fakeRequest {
+	request, ok := lookupDevice(fd).(*fakeRequest)
+	if !ok || request.device != f {
+		return nil
+	}
+	return request
+}
+
+// bufferRequest returns the request a buffer is queued to, nil if it is queued
+// directly, failing if the queue requires a request or does not support them.
+func (f *FakeDevice) bufferRequest(buffer *Buffer) (*fakeRequest, error) {
+	requests := f.config.Requests && IsOutput(buffer.Type)
+	if buffer.Flags&BufFlagRequestFD == 0 {
+		if requests {
+			return nil, syscall.EBADR
+		}
+		return nil, nil
+	}
+	if !requests {
+		return nil, syscall.EBADR
+	}
+	request := f.lookupRequest(int(int32(buffer.RequestFD)))
+	if request == nil {
+		return nil, syscall.EINVAL
+	}
+	if request.state != fakeRequestIdle {
+		return nil, syscall.EBUSY
+	}
+	return request, nil
+}
+
+// bind adds a buffer to the request, which queues it along with itself.
+func (r *fakeRequest) bind(fakeBuffer *fakeBuffer) {
+	fakeBuffer.buffer.Flags = (fakeBuffer.buffer.Flags | BufFlagInRequest | BufFlagRequestFD) &^ BufFlagDone
+	fakeBuffer.buffer.RequestFD = uint32(r.fd)
+	fakeBuffer.request = r
+	r.buffers = append(r.buffers, fakeBuffer)
+}
+
+// unbind returns the buffers still bound to the request to the application.
+func (r *fakeRequest) unbind() {
+	for _, fakeBuffer := range r.buffers {
+		if fakeBuffer.request == r {
+			fakeBuffer.buffer.Flags &^= BufFlagInRequest | BufFlagRequestFD
+			fakeBuffer.request = nil
+		}
+	}
+	r.buffers = nil
+}
+
+// apply sets the controls of the request on the device.
+func (r *fakeRequest) apply() {
+	for id, control := range r.controls {
+		fakeControl := r.device.findControl(id)
+		fakeControl.Value = control.Value
+		copy(fakeControl.Payload, control.Payload)
+		r.device.controlEvent(fakeControl, EventCtrlChValue, true)
+	}
+}
+
+// complete marks the request complete once none of its buffers is pending.
+func (r *fakeRequest) complete(fakeBuffer *fakeBuffer) {
+	fakeBuffer.request = nil
+	for _, buffer := range r.buffers {
+		if buffer.request == r {
+			return
+		}
+	}
+	r.state = fakeRequestComplete
+	r.device.notify()
+}
+
+// stage sets a control value in the request.
+func (r *fakeRequest) stage(fakeControl *FakeControl, value int64, payload []byte) {
+	control := *fakeControl
+	control.Value = value
+	if payload != nil {
+		control.Payload = make([]byte, len(fakeControl.Payload))
+		copy(control.Payload, payload)
+	}
+	r.controls[control.ID] = control
+}
+
+func (r *fakeRequest) Close() error {
+	UnregisterDevice(r)
+	r.device.mutex.Lock()
+	defer r.device.mutex.Unlock()
+	if r.state == fakeRequestIdle {
+		r.unbind()
+	}
+	return unix.Close(r.fd)
+}
+
+func (r *fakeRequest) Fd() int {
+	return r.fd
+}
+
+func (r *fakeRequest) Ioctl(request uint32, arg unsafe.Pointer) error {
+	f := r.device
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch request {
+	case MediaRequestIocQueue:
+		if r.state != fakeRequestIdle {
+			return syscall.EBUSY
+		}
+		if len(r.buffers) == 0 {
+			return syscall.ENOENT
+		}
+		r.state = fakeRequestQueued
+		for _, fakeBuffer := range r.buffers {
+			queue := f.queues[fakeBuffer.buffer.Type]
+			fakeBuffer.buffer.Flags = (fakeBuffer.buffer.Flags | BufFlagQueued) &^ BufFlagInRequest
+			queue.queued = append(queue.queued, fakeBuffer.buffer.Index)
+		}
+		f.runJobs()
+		f.notify()
+		return nil
+	case MediaRequestIocReinit:
+		if r.state == fakeRequestQueued {
+			return syscall.EBUSY
+		}
+		r.unbind()
+		clear(r.controls)
+		r.state = fakeRequestIdle
+		return nil
+	}
+	return syscall.ENOTTY
+}
+
+func (r *fakeRequest) Read(p []byte) (int, error) {
+	return 0, syscall.EINVAL
+}
+
+func (r *fakeRequest) Mmap(offset int64, length int) ([]byte, error) {
+	return nil, syscall.ENODEV
+}
+
+// Poll reports POLLPRI once the request has completed.
+func (r *fakeRequest) Poll(events int16, timeout time.Duration) (int16, error) {
+	return r.device.wait(func() int16 {
+		if r.state == fakeRequestIdle {
+			return unix.POLLERR
+		}
+		if r.state == fakeRequestComplete {
+			return unix.POLLPRI
+		}
+		return 0
+	}, events, timeout), nil
+}
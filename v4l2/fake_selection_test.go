@@ -0,0 +1,126 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import "syscall"
+
+// cropBounds returns the sensor area, which is the largest frame size offered.
+func (f *FakeDevice) cropBounds() Rect {
+	bounds := Rect{Width: f.format.Width, Height: f.format.Height}
+	for _, format := range f.config.Formats {
+		for _, frameSize := range format.FrameSizes {
+			if frameSize.Width*frameSize.Height > bounds.Width*bounds.Height {
+				bounds.Width = frameSize.Width
+				bounds.Height = frameSize.Height
+			}
+		}
+	}
+	return bounds
+}
+
+func (f *FakeDevice) cropCap(cropCap *CropCap) error {
+	if !f.supports(cropCap.Type) {
+		return syscall.EINVAL
+	}
+	cropCap.Bounds = f.cropBounds()
+	cropCap.DefRect = cropCap.Bounds
+	cropCap.PixelAspect = Fract{Numerator: 1, Denominator: 1}
+	return nil
+}
+
+func (f *FakeDevice) getCrop(crop *Crop) error {
+	if !f.supports(crop.Type) {
+		return syscall.EINVAL
+	}
+	crop.C = f.crop
+	return nil
+}
+
+func (f *FakeDevice) setCrop(crop *Crop) error {
+	if !f.supports(crop.Type) {
+		return syscall.EINVAL
+	}
+	rect, err := f.adjustCrop(crop.C, 0)
+	if err != nil {
+		return err
+	}
+	f.crop = rect
+	return nil
+}
+
+func (f *FakeDevice) getSelection(selection *Selection) error {
+	if !f.supports(selection.Type) {
+		return syscall.EINVAL
+	}
+	switch selection.Target {
+	case SelTgtCrop:
+		selection.R = f.crop
+	case SelTgtCropDefault, SelTgtCropBounds:
+		selection.R = f.cropBounds()
+	case SelTgtCompose, SelTgtComposeDefault, SelTgtComposeBounds, SelTgtComposePadded:
+		selection.R = Rect{Width: f.format.Width, Height: f.format.Height}
+	default:
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+func (f *FakeDevice) setSelection(selection *Selection) error {
+	if !f.supports(selection.Type) || selection.Target != SelTgtCrop {
+		return syscall.EINVAL
+	}
+	rect, err := f.adjustCrop(selection.R, selection.Flags)
+	if err != nil {
+		return err
+	}
+	f.crop = rect
+	selection.R = rect
+	return nil
+}
+
+// adjustCrop fits a crop rectangle to even sizes within the crop bounds,
+// failing with ERANGE if that violates the constraint flags.
+func (f *FakeDevice) adjustCrop(rect Rect, flags SelFlag) (Rect, error) {
+	bounds := f.cropBounds()
+	var err error
+	if rect.Width, err = fakeCropSize(rect.Width, bounds.Width, flags); err != nil {
+		return Rect{}, err
+	}
+	if rect.Height, err = fakeCropSize(rect.Height, bounds.Height, flags); err != nil {
+		return Rect{}, err
+	}
+	rect.Left = min(max(rect.Left, bounds.Left), bounds.Left+int32(bounds.Width-rect.Width))
+	rect.Top = min(max(rect.Top, bounds.Top), bounds.Top+int32(bounds.Height-rect.Height))
+	return rect, nil
+}
+
+// fakeCropSize rounds a crop size to an even number between 2 and limit.
+func fakeCropSize(size uint32, limit uint32, flags SelFlag) (uint32, error) {
+	adjusted := size &^ 1
+	if flags&SelFlagGE != 0 && adjusted < size {
+		adjusted += 2
+	}
+	adjusted = min(max(adjusted, 2), limit&^1)
+	if flags&SelFlagGE != 0 && adjusted < size || flags&SelFlagLE != 0 && adjusted > size {
+		return 0, syscall.ERANGE
+	}
+	return adjusted, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// FakeStandard is a video standard offered by a FakeDevice.
+type FakeStandard struct {
+	ID   StdID
+	Name string
+}
+
+// standard handles the standard ioctls, which need a configured standard.
+func (f *FakeDevice) standard(request uint32, arg unsafe.Pointer) error {
+	if len(f.config.Standards) == 0 {
+		return syscall.ENOTTY
+	}
+	switch request {
+	case VidIocEnumStd:
+		return f.enumStd((*Standard)(arg))
+	case VidIocGStd:
+		*(*StdID)(arg) = f.std
+	case VidIocSStd:
+		return f.setStd(*(*StdID)(arg))
+	case VidIocQueryStd:
+		*(*StdID)(arg) = f.config.Detected
+	}
+	return nil
+}
+
+func (f *FakeDevice) enumStd(standard *Standard) error {
+	if standard.Index >= uint32(len(f.config.Standards)) {
+		return syscall.EINVAL
+	}
+	fakeStandard := &f.config.Standards[standard.Index]
+	*standard = Standard{
+		Index:       standard.Index,
+		ID:          fakeStandard.ID,
+		FramePeriod: Fract{Numerator: 1, Denominator: 25},
+		FrameLines:  625,
+	}
+	if fakeStandard.ID&Std525_60 != 0 {
+		standard.FramePeriod = Fract{Numerator: 1001, Denominator: 30000}
+		standard.FrameLines = 525
+	}
+	copy(standard.Name[:len(standard.Name)-1], fakeStandard.Name)
+	return nil
+}
+
+func (f *FakeDevice) setStd(id StdID) error {
+	for _, standard := range f.config.Standards {
+		if standard.ID&id == 0 {
+			continue
+		}
+		if standard.ID != f.std && f.buffersAllocated() {
+			return syscall.EBUSY
+		}
+		f.std = standard.ID
+		return nil
+	}
+	return syscall.EINVAL
+}
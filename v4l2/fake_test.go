@@ -0,0 +1,221 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFakeDeviceFrames(t *testing.T) {
+	config := testFakeConfig()
+	config.Formats = config.Formats[2:]
+	config.Frame = nil
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	if _, _, err := SetFormat(fd, BufTypeVideoCapture, PixFmtYUYV, 640, 480); err != nil {
+		t.Fatal("unable to set format")
+	}
+	count, err := RequestDriverBuffers(fd, 2, BufTypeVideoCapture, MemoryMmap)
+	if err != nil {
+		t.Fatal("unable to request driver buffers")
+	}
+	buffers, err := MmapBuffers(fd, count, BufTypeVideoCapture)
+	if err != nil {
+		t.Fatal("unable to mmap buffers")
+	}
+	defer MunmapBuffers(buffers)
+	if err := StreamOn(fd, BufTypeVideoCapture); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer StreamOff(fd, BufTypeVideoCapture)
+	for sequence := 0; sequence < 4; sequence++ {
+		frame, err := GrabFrame(fd, BufTypeVideoCapture, MemoryMmap, buffers)
+		if err != nil {
+			t.Fatal("unable to grab frame")
+		}
+		if len(frame) != 640*480*2 {
+			t.Fatal("frame has incorrect size")
+		}
+		if frame[0] != byte(sequence) || frame[len(frame)-1] != byte(sequence) {
+			t.Fatal("frame has incorrect content")
+		}
+	}
+}
+
+func TestFakeDeviceControlRange(t *testing.T) {
+	fake, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	if err := SetControl(fake.Fd(), &Control{ID: CidBrightness, Value: 256}); !errors.Is(err, syscall.ERANGE) {
+		t.Fatal("out of range value accepted")
+	}
+	menus, err := QueryMenus(fake.Fd(), CidPowerLineFrequency)
+	if err != nil {
+		t.Fatal("unable to query menus")
+	}
+	if len(menus) != 3 || BytesToString(menus[1].Name[:]) != "50 Hz" {
+		t.Fatal("incorrect menus returned")
+	}
+}
+
+func TestFakeDeviceMPlane(t *testing.T) {
+	config := testFakeConfig()
+	config.Capabilities = CapVideoCaptureMPlane | CapStreaming
+	config.Formats = []FakeFormat{{PixFormat: PixFmtNV12M, Description: "Y/CbCr 4:2:0 (N-C)", FrameSizes: config.Formats[0].FrameSizes}}
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	if _, _, err := SetFormat(fd, BufTypeVideoCapture, PixFmtNV12M, 640, 480); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("single-planar format accepted by multi-planar device")
+	}
+	pix, err := SetFormatMPlane(fd, BufTypeVideCaptureMPlane, PixFmtNV12M, 640, 480)
+	if err != nil {
+		t.Fatal("unable to set multi-planar format")
+	}
+	if pix.NumPlanes != 2 || pix.PlaneFmt[0].SizeImage != 640*480 || pix.PlaneFmt[1].SizeImage != 640*480/2 {
+		t.Fatal("multi-planar format has incorrect planes")
+	}
+	count, err := RequestDriverBuffers(fd, 2, BufTypeVideCaptureMPlane, MemoryMmap)
+	if err != nil {
+		t.Fatal("unable to request driver buffers")
+	}
+	buffers, err := MmapBuffersMPlane(fd, count, BufTypeVideCaptureMPlane)
+	if err != nil {
+		t.Fatal("unable to mmap buffers")
+	}
+	defer MunmapBuffersMPlane(buffers)
+	if len(buffers[0]) != 2 {
+		t.Fatal("buffer has incorrect number of planes")
+	}
+	if err := StreamOn(fd, BufTypeVideCaptureMPlane); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer StreamOff(fd, BufTypeVideCaptureMPlane)
+	buffer, err := DequeueBufferMPlane(fd, BufTypeVideCaptureMPlane, MemoryMmap)
+	if err != nil {
+		t.Fatal("unable to dequeue buffer")
+	}
+	if buffer.Length != 2 || buffer.Planes[0].BytesUsed != 640*480 || buffer.Planes[1].BytesUsed != 640*480/2 {
+		t.Fatal("dequeued buffer has incorrect planes")
+	}
+}
+
+func TestFakeDeviceExportBuffer(t *testing.T) {
+	config := testFakeConfig()
+	config.Formats = config.Formats[2:]
+	config.Frame = nil
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	count, err := RequestDriverBuffers(fd, 2, BufTypeVideoCapture, MemoryMmap)
+	if err != nil {
+		t.Fatal("unable to request driver buffers")
+	}
+	buffers, err := MmapBuffers(fd, count, BufTypeVideoCapture)
+	if err != nil {
+		t.Fatal("unable to mmap buffers")
+	}
+	defer MunmapBuffers(buffers)
+	dmabufFD, err := ExportBuffer(fd, BufTypeVideoCapture, 1, 0, unix.O_CLOEXEC|unix.O_RDWR)
+	if err != nil {
+		t.Fatal("unable to export buffer")
+	}
+	defer unix.Close(dmabufFD)
+	dmabuf, err := unix.Mmap(dmabufFD, 0, len(buffers[1]), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal("unable to mmap exported buffer")
+	}
+	defer unix.Munmap(dmabuf)
+	if err := StreamOn(fd, BufTypeVideoCapture); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer StreamOff(fd, BufTypeVideoCapture)
+	for sequence := 0; sequence < 2; sequence++ {
+		if _, err := DequeueBuffer(fd, BufTypeVideoCapture, MemoryMmap); err != nil {
+			t.Fatal("unable to dequeue buffer")
+		}
+	}
+	if dmabuf[0] != 1 || dmabuf[640*480*2-1] != 1 {
+		t.Fatal("exported buffer has incorrect content")
+	}
+	if _, err := ExportBuffer(fd, BufTypeVideoCapture, count, 0, unix.O_CLOEXEC); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("export of invalid buffer not rejected")
+	}
+}
+
+func TestFakeDeviceUserPtr(t *testing.T) {
+	config := testFakeConfig()
+	config.Formats = config.Formats[2:]
+	config.Frame = nil
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	count, err := RequestDriverBuffers(fd, 2, BufTypeVideoCapture, MemoryUserPtr)
+	if err != nil {
+		t.Fatal("unable to request driver buffers")
+	}
+	buffers, err := AllocateUserPtrBuffers(count, []uint32{640 * 480 * 2})
+	if err != nil {
+		t.Fatal("unable to allocate buffers")
+	}
+	defer MunmapBuffersMPlane(buffers)
+	if err := EnqueueUserPtr(fd, BufTypeVideoCapture, 0, [][]byte{buffers[0][0][:16]}); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("undersized buffer not rejected")
+	}
+	for index, planes := range buffers {
+		if err := EnqueueUserPtr(fd, BufTypeVideoCapture, uint32(index), planes); err != nil {
+			t.Fatal("unable to enqueue buffer")
+		}
+	}
+	if err := StreamOn(fd, BufTypeVideoCapture); err != nil {
+		t.Fatal("unable to turn on streaming")
+	}
+	defer StreamOff(fd, BufTypeVideoCapture)
+	for sequence := 0; sequence < 2; sequence++ {
+		buffer, err := DequeueBuffer(fd, BufTypeVideoCapture, MemoryUserPtr)
+		if err != nil {
+			t.Fatal("unable to dequeue buffer")
+		}
+		data := buffers[buffer.Index][0]
+		if buffer.BytesUsed != 640*480*2 || data[0] != byte(sequence) || data[len(data)-1] != byte(sequence) {
+			t.Fatal("dequeued buffer has incorrect content")
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"slices"
+	"syscall"
+	"unsafe"
+)
+
+// FakeTuner is a tuner offered by a FakeDevice. Frequencies are in the units
+// given by Capability.
+type FakeTuner struct {
+	Name       string
+	Type       TunerType
+	Capability TunerCap
+	RangeLow   uint32
+	RangeHigh  uint32
+	Bands      []FrequencyBand // A single band covering the range when empty.
+	Stations   []uint32        // Frequencies carrying a signal, found by hardware seek.
+}
+
+// FakeModulator is a modulator offered by a FakeDevice. Frequencies are in
+// the units given by Capability.
+type FakeModulator struct {
+	Name       string
+	Type       TunerType
+	Capability TunerCap
+	RangeLow   uint32
+	RangeHigh  uint32
+}
+
+type fakeTuning struct {
+	frequency uint32
+	audMode   TunerMode
+}
+
+type fakeModulation struct {
+	frequency  uint32
+	txSubChans TunerSub
+}
+
+// tunerIoctl handles the tuner ioctls, which need a configured tuner. The
+// frequency ioctls of devices without tuners address their modulators.
+func (f *FakeDevice) tunerIoctl(request uint32, arg unsafe.Pointer) error {
+	if len(f.config.Tuners) == 0 {
+		if request == VidIocGFrequency || request == VidIocSFrequency {
+			return f.modulatorIoctl(request, arg)
+		}
+		return syscall.ENOTTY
+	}
+	switch request {
+	case VidIocGTuner:
+		return f.getTuner((*Tuner)(arg))
+	case VidIocSTuner:
+		tuner := (*Tuner)(arg)
+		if tuner.Index >= uint32(len(f.tuning)) || tuner.AudMode > TunerModeLang1Lang2 {
+			return syscall.EINVAL
+		}
+		f.tuning[tuner.Index].audMode = tuner.AudMode
+	case VidIocGFrequency:
+		frequency := (*Frequency)(arg)
+		if frequency.Tuner >= uint32(len(f.tuning)) {
+			return syscall.EINVAL
+		}
+		frequency.Type = f.config.Tuners[frequency.Tuner].Type
+		frequency.Frequency = f.tuning[frequency.Tuner].frequency
+	case VidIocSFrequency:
+		frequency := (*Frequency)(arg)
+		if !f.validTuner(frequency.Tuner, frequency.Type) {
+			return syscall.EINVAL
+		}
+		tuner := &f.config.Tuners[frequency.Tuner]
+		f.tuning[frequency.Tuner].frequency = min(max(frequency.Frequency, tuner.RangeLow), tuner.RangeHigh)
+	case VidIocEnumFreqBands:
+		return f.enumFreqBand((*FrequencyBand)(arg))
+	case VidIocSHWFreqSeek:
+		return f.seek((*HWFreqSeek)(arg))
+	}
+	return nil
+}
+
+func (f *FakeDevice) validTuner(index uint32, tunerType TunerType) bool {
+	return index < uint32(len(f.config.Tuners)) && f.config.Tuners[index].Type == tunerType
+}
+
+func (f *FakeDevice) getTuner(tuner *Tuner) error {
+	if tuner.Index >= uint32(len(f.tuning)) {
+		return syscall.EINVAL
+	}
+	fakeTuner := &f.config.Tuners[tuner.Index]
+	tuning := &f.tuning[tuner.Index]
+	*tuner = Tuner{
+		Index:      tuner.Index,
+		Type:       fakeTuner.Type,
+		Capability: fakeTuner.Capability,
+		RangeLow:   fakeTuner.RangeLow,
+		RangeHigh:  fakeTuner.RangeHigh,
+		AudMode:    tuning.audMode,
+	}
+	copy(tuner.Name[:len(tuner.Name)-1], fakeTuner.Name)
+	if slices.Contains(fakeTuner.Stations, tuning.frequency) {
+		tuner.RXSubChans = TunerSubMono | TunerSubStereo
+		tuner.Signal = 0xffff
+	}
+	return nil
+}
+
+// modulatorIoctl handles the modulator ioctls, which need a configured modulator.
+func (f *FakeDevice) modulatorIoctl(request uint32, arg unsafe.Pointer) error {
+	if len(f.config.Modulators) == 0 {
+		return syscall.ENOTTY
+	}
+	switch request {
+	case VidIocGModulator:
+		return f.getModulator((*Modulator)(arg))
+	case VidIocSModulator:
+		modulator := (*Modulator)(arg)
+		if modulator.Index >= uint32(len(f.modulation)) {
+			return syscall.EINVAL
+		}
+		supported := TunerSubMono | TunerSubStereo
+		if f.config.Modulators[modulator.Index].Capability&TunerCapRDS != 0 {
+			supported |= TunerSubRDS
+		}
+		f.modulation[modulator.Index].txSubChans = modulator.TXSubChans & supported
+	case VidIocGFrequency:
+		frequency := (*Frequency)(arg)
+		if frequency.Tuner >= uint32(len(f.modulation)) {
+			return syscall.EINVAL
+		}
+		frequency.Type = f.config.Modulators[frequency.Tuner].Type
+		frequency.Frequency = f.modulation[frequency.Tuner].frequency
+	case VidIocSFrequency:
+		frequency := (*Frequency)(arg)
+		if !f.validModulator(frequency.Tuner, frequency.Type) {
+			return syscall.EINVAL
+		}
+		modulator := &f.config.Modulators[frequency.Tuner]
+		f.modulation[frequency.Tuner].frequency = min(max(frequency.Frequency, modulator.RangeLow), modulator.RangeHigh)
+	}
+	return nil
+}
+
+func (f *FakeDevice) validModulator(index uint32, tunerType TunerType) bool {
+	return index < uint32(len(f.config.Modulators)) && f.config.Modulators[index].Type == tunerType
+}
+
+func (f *FakeDevice) getModulator(modulator *Modulator) error {
+	if modulator.Index >= uint32(len(f.modulation)) {
+		return syscall.EINVAL
+	}
+	fakeModulator := &f.config.Modulators[modulator.Index]
+	*modulator = Modulator{
+		Index:      modulator.Index,
+		Type:       fakeModulator.Type,
+		Capability: fakeModulator.Capability,
+		RangeLow:   fakeModulator.RangeLow,
+		RangeHigh:  fakeModulator.RangeHigh,
+		TXSubChans: f.modulation[modulator.Index].txSubChans,
+	}
+	copy(modulator.Name[:len(modulator.Name)-1], fakeModulator.Name)
+	return nil
+}
+
+func (f *FakeDevice) enumFreqBand(band *FrequencyBand) error {
+	if !f.validTuner(band.Tuner, band.Type) {
+		return syscall.EINVAL
+	}
+	fakeTuner := &f.config.Tuners[band.Tuner]
+	bands := fakeTuner.Bands
+	if len(bands) == 0 {
+		modulation := BandModulationVSB
+		if fakeTuner.Type == TunerTypeRadio {
+			modulation = BandModulationFM
+		}
+		bands = []FrequencyBand{{RangeLow: fakeTuner.RangeLow, RangeHigh: fakeTuner.RangeHigh, Modulation: modulation}}
+	}
+	if band.Index >= uint32(len(bands)) {
+		return syscall.EINVAL
+	}
+	*band = FrequencyBand{
+		Tuner:      band.Tuner,
+		Type:       band.Type,
+		Index:      band.Index,
+		Capability: fakeTuner.Capability,
+		RangeLow:   bands[band.Index].RangeLow,
+		RangeHigh:  bands[band.Index].RangeHigh,
+		Modulation: bands[band.Index].Modulation,
+	}
+	return nil
+}
+
+// seek tunes to the nearest station in the seek direction, or the first one
+// from the other end of the range when wrapping around.
+func (f *FakeDevice) seek(seek *HWFreqSeek) error {
+	if !f.validTuner(seek.Tuner, seek.Type) {
+		return syscall.EINVAL
+	}
+	fakeTuner := &f.config.Tuners[seek.Tuner]
+	if seek.WrapAround != 0 && fakeTuner.Capability&TunerCapHWSeekWrap == 0 {
+		return syscall.EINVAL
+	}
+	low, high := fakeTuner.RangeLow, fakeTuner.RangeHigh
+	if seek.RangeLow != 0 || seek.RangeHigh != 0 {
+		if fakeTuner.Capability&TunerCapHWSeekProgLim == 0 {
+			return syscall.EINVAL
+		}
+		low, high = seek.RangeLow, seek.RangeHigh
+	}
+	current := f.tuning[seek.Tuner].frequency
+	var found, wrapped *uint32
+	for i := range fakeTuner.Stations {
+		station := &fakeTuner.Stations[i]
+		if *station < low || *station > high {
+			continue
+		}
+		if seek.SeekUpward != 0 {
+			if *station > current && (found == nil || *station < *found) {
+				found = station
+			}
+			if wrapped == nil || *station < *wrapped {
+				wrapped = station
+			}
+		} else {
+			if *station < current && (found == nil || *station > *found) {
+				found = station
+			}
+			if wrapped == nil || *station > *wrapped {
+				wrapped = station
+			}
+		}
+	}
+	if found == nil && seek.WrapAround != 0 {
+		found = wrapped
+	}
+	if found == nil {
+		return syscall.ENODATA
+	}
+	f.tuning[seek.Tuner].frequency = *found
+	return nil
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrFrameReleased is returned when a frame is released more than once.
+var ErrFrameReleased = errors.New("v4l2: frame already released")
+
+// minQueuedBuffers is the number of buffers always left with the driver while frames are leased.
+const minQueuedBuffers = 1
+
+// grabTimeout is how long a single frame grab waits for the driver.
+const grabTimeout = 2 * time.Second
+
+// FramePlane is one plane of a captured frame.
+type FramePlane struct {
+	Data       []byte // The plane payload, starting at DataOffset.
+	BytesUsed  uint32
+	DataOffset uint32
+}
+
+// Frame is a captured frame.
+//
+// Data and BytesUsed describe the first plane, which is the whole frame for
+// single-planar formats; Planes describes every plane.
+// Frames returned by DequeueFrame may reference the driver buffer directly, in
+// which case the data is only valid until Release is called. Planes and Data
+// are nil for imported DMABUF buffers that cannot be mapped.
+type Frame struct {
+	Data      []byte
+	Planes    []FramePlane
+	Index     uint32
+	Sequence  uint32
+	Timestamp time.Duration
+	Flags     BufFlag
+	BytesUsed uint32
+	mutex     sync.Mutex
+	released  bool
+	release   func() error
+}
+
+// newFrame returns a frame describing a dequeued buffer whose planes are mapped
+// at mappings, either referencing or copying the plane data.
+func newFrame(buffer *BufferMPlane, mappings [][]byte, copyData bool) *Frame {
+	frame := &Frame{
+		Index:     buffer.Index,
+		Sequence:  buffer.Sequence,
+		Timestamp: time.Duration(buffer.Timestamp.Nano()),
+		Flags:     buffer.Flags,
+		BytesUsed: buffer.Planes[0].BytesUsed,
+	}
+	if len(mappings) > 0 {
+		frame.Planes = make([]FramePlane, len(mappings))
+	}
+	for i, mapping := range mappings {
+		plane := &buffer.Planes[i]
+		end := int(plane.BytesUsed)
+		if end > len(mapping) {
+			end = len(mapping)
+		}
+		start := int(plane.DataOffset)
+		if start > end {
+			start = end
+		}
+		data := mapping[start:end]
+		if copyData {
+			data = append([]byte(nil), data...)
+		}
+		frame.Planes[i] = FramePlane{
+			Data:       data,
+			BytesUsed:  plane.BytesUsed,
+			DataOffset: plane.DataOffset,
+		}
+	}
+	if len(frame.Planes) > 0 {
+		frame.Data = frame.Planes[0].Data
+	}
+	return frame
+}
+
+// Copy returns a copy of the first plane data that remains valid after Release.
+func (f *Frame) Copy() []byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	data := make([]byte, len(f.Data))
+	copy(data, f.Data)
+	return data
+}
+
+// Release hands the frame buffer back to the driver.
+// Releasing a frame that does not reference a driver buffer is a no-op.
+func (f *Frame) Release() error {
+	f.mutex.Lock()
+	if f.release == nil {
+		f.mutex.Unlock()
+		return nil
+	}
+	if f.released {
+		f.mutex.Unlock()
+		return ErrFrameReleased
+	}
+	f.released = true
+	f.Data = nil
+	f.Planes = nil
+	release := f.release
+	f.mutex.Unlock()
+	return release()
+}
+
+// detach replaces the data of an unreleased frame with a copy, so that it
+// remains valid once the driver buffer is unmapped. Releasing the frame
+// afterwards is a no-op.
+func (f *Frame) detach() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.released {
+		return
+	}
+	for i := range f.Planes {
+		f.Planes[i].Data = append([]byte(nil), f.Planes[i].Data...)
+	}
+	if len(f.Planes) > 0 {
+		f.Data = f.Planes[0].Data
+	}
+	f.release = func() error { return nil }
+}
+
+func (c *camera) DequeueFrame() (*Frame, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	if c.isStreaming() {
+		return nil, ErrStreaming
+	}
+	if c.ioMethod == IOMethodReadWrite {
+		frame, err := c.readFrame(grabTimeout)
+		if err == nil && frame == nil {
+			err = ErrTimeout
+		}
+		return frame, err
+	}
+	buffer, err := c.dequeue(grabTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if buffer == nil {
+		return nil, ErrTimeout
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.buffers)-len(c.leased)-1 < minQueuedBuffers {
+		// Leasing would starve the driver, so fall back to copying.
+		frame := newFrame(buffer, c.buffers[buffer.Index], true)
+		frame.release = func() error { return nil }
+		if err := c.enqueue(buffer); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+	frame := newFrame(buffer, c.buffers[buffer.Index], false)
+	frame.release = func() error {
+		return c.releaseBuffer(buffer)
+	}
+	c.leased[buffer.Index] = frame
+	return frame, nil
+}
+
+func (c *camera) Leases() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.leased)
+}
+
+// releaseBuffer re-enqueues a leased buffer.
+func (c *camera) releaseBuffer(buffer *BufferMPlane) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.leased, buffer.Index)
+	return c.enqueue(buffer)
+}
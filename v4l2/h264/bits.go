@@ -0,0 +1,119 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package h264
+
+import "github.com/peterhagelund/go-v4l2/v4l2/internal/bits"
+
+// unescape removes the emulation prevention bytes from a NAL unit, returning
+// its raw byte sequence payload with the NAL unit header still in place.
+func unescape(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// bitReader reads the syntax elements of a raw byte sequence payload. Reading
+// past the end records ErrTruncated and returns zeros from then on.
+type bitReader struct {
+	bits.Reader
+}
+
+// newBitReader returns a reader of rbsp, starting at bit pos.
+func newBitReader(rbsp []byte, pos int) *bitReader {
+	return &bitReader{bits.Reader{Data: rbsp, Pos: pos, EOF: ErrTruncated}}
+}
+
+// ue reads an unsigned Exp-Golomb coded integer.
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.Err == nil && r.U(1) == 0 {
+		zeros++
+		if zeros > 31 {
+			r.Err = ErrInvalidValue
+		}
+	}
+	if r.Err != nil {
+		return 0
+	}
+	return uint32(1<<zeros - 1 + uint64(r.U(zeros)))
+}
+
+// se reads a signed Exp-Golomb coded integer.
+func (r *bitReader) se() int32 {
+	value := r.ue()
+	if value&1 == 1 {
+		return int32(value/2 + 1)
+	}
+	return -int32(value / 2)
+}
+
+// ueMax reads an unsigned Exp-Golomb coded integer, failing when it is larger
+// than max.
+func (r *bitReader) ueMax(max uint32) uint32 {
+	value := r.ue()
+	if value > max {
+		r.Fail(ErrInvalidValue)
+		return 0
+	}
+	return value
+}
+
+// seRange reads a signed Exp-Golomb coded integer, failing when it is outside
+// [min, max].
+func (r *bitReader) seRange(min, max int32) int32 {
+	value := r.se()
+	if value < min || value > max {
+		r.Fail(ErrInvalidValue)
+		return 0
+	}
+	return value
+}
+
+// moreRBSPData reports whether there is data before the RBSP trailing bits.
+func (r *bitReader) moreRBSPData() bool {
+	if r.Err != nil {
+		return false
+	}
+	last := len(r.Data) - 1
+	for last >= 0 && r.Data[last] == 0 {
+		last--
+	}
+	if last < 0 {
+		return false
+	}
+	stop := last*8 + 7
+	for r.Data[last]>>(7-stop&7)&1 == 0 {
+		stop--
+	}
+	return r.Pos < stop
+}
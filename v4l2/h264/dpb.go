@@ -0,0 +1,416 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package h264
+
+import (
+	"github.com/peterhagelund/go-v4l2/v4l2"
+)
+
+// frameStore is a frame, complementary field pair or non-paired field of the
+// decoded picture buffer. Fields are tracked with the H264Fields bits.
+type frameStore struct {
+	referenceTS      uint64
+	frameNum         uint16
+	longTermFrameIdx uint32
+	poc              [2]int32 // Top and bottom field order counts.
+	decoded          v4l2.H264Fields
+	shortTerm        v4l2.H264Fields
+	longTerm         v4l2.H264Fields
+	field            bool // Coded as fields.
+	nonExisting      bool // Inferred for a gap in frame_num.
+}
+
+// reference returns the fields used for reference.
+func (f *frameStore) reference() v4l2.H264Fields {
+	return f.shortTerm | f.longTerm
+}
+
+// frameNumWrap returns FrameNumWrap relative to the current frame_num.
+func (f *frameStore) frameNumWrap(frameNum uint16, maxFrameNum uint32) int32 {
+	if f.frameNum > frameNum {
+		return int32(f.frameNum) - int32(maxFrameNum)
+	}
+	return int32(f.frameNum)
+}
+
+// picOrderCnt returns PicOrderCnt of the fields used for reference, or of the
+// whole frame store when none are.
+func (f *frameStore) picOrderCnt() int32 {
+	fields := f.reference()
+	if fields == 0 {
+		fields = f.decoded
+	}
+	switch fields {
+	case v4l2.H264TopFieldRef:
+		return f.poc[0]
+	case v4l2.H264BottomFieldRef:
+		return f.poc[1]
+	}
+	return min(f.poc[0], f.poc[1])
+}
+
+// parity returns the field the slice codes, or H264FrameRef for frames.
+func parity(h *SliceHeader) v4l2.H264Fields {
+	switch {
+	case !h.FieldPic:
+		return v4l2.H264FrameRef
+	case h.BottomField:
+		return v4l2.H264BottomFieldRef
+	}
+	return v4l2.H264TopFieldRef
+}
+
+// picOrder is the result of the picture order count decoding process.
+type picOrder struct {
+	top            int32
+	bottom         int32
+	msb            int32 // PicOrderCntMsb for pic_order_cnt_type 0.
+	frameNumOffset int32 // FrameNumOffset for pic_order_cnt_type 1 and 2.
+}
+
+// picOrderCnt runs the decoding process for picture order count of 8.2.1.
+func (p *Parser) picOrderCnt(h *SliceHeader, sps *SPS) picOrder {
+	order := picOrder{}
+	if sps.PicOrderCntType == 0 {
+		prevMsb, prevLSB := p.prevPicOrderCntMsb, p.prevPicOrderCntLSB
+		if h.IDR {
+			prevMsb, prevLSB = 0, 0
+		}
+		max := int32(sps.MaxPicOrderCntLSB())
+		lsb := int32(h.PicOrderCntLSB)
+		switch {
+		case lsb < prevLSB && prevLSB-lsb >= max/2:
+			order.msb = prevMsb + max
+		case lsb > prevLSB && lsb-prevLSB > max/2:
+			order.msb = prevMsb - max
+		default:
+			order.msb = prevMsb
+		}
+		order.top = order.msb + lsb
+		order.bottom = order.top + h.DeltaPicOrderCntBottom
+		if h.BottomField {
+			order.bottom = order.msb + lsb
+		}
+		return order
+	}
+	switch {
+	case h.IDR:
+		order.frameNumOffset = 0
+	case p.prevFrameNum > h.FrameNum:
+		order.frameNumOffset = p.prevFrameNumOffset + int32(sps.MaxFrameNum())
+	default:
+		order.frameNumOffset = p.prevFrameNumOffset
+	}
+	if sps.PicOrderCntType == 2 {
+		poc := 2 * (order.frameNumOffset + int32(h.FrameNum))
+		if h.IDR {
+			poc = 0
+		} else if h.NALRefIDC == 0 {
+			poc--
+		}
+		order.top, order.bottom = poc, poc
+		return order
+	}
+	cycle := int32(len(sps.OffsetForRefFrame))
+	absFrameNum := int32(0)
+	if cycle != 0 {
+		absFrameNum = order.frameNumOffset + int32(h.FrameNum)
+	}
+	if h.NALRefIDC == 0 && absFrameNum > 0 {
+		absFrameNum--
+	}
+	expected := int32(0)
+	if absFrameNum > 0 {
+		deltaPerCycle := int32(0)
+		for _, offset := range sps.OffsetForRefFrame {
+			deltaPerCycle += offset
+		}
+		expected = (absFrameNum - 1) / cycle * deltaPerCycle
+		for i := int32(0); i <= (absFrameNum-1)%cycle; i++ {
+			expected += sps.OffsetForRefFrame[i]
+		}
+	}
+	if h.NALRefIDC == 0 {
+		expected += sps.OffsetForNonRefPic
+	}
+	switch {
+	case !h.FieldPic:
+		order.top = expected + h.DeltaPicOrderCnt[0]
+		order.bottom = order.top + sps.OffsetForTopToBottomField + h.DeltaPicOrderCnt[1]
+	case !h.BottomField:
+		order.top = expected + h.DeltaPicOrderCnt[0]
+	default:
+		order.bottom = expected + sps.OffsetForTopToBottomField + h.DeltaPicOrderCnt[0]
+	}
+	return order
+}
+
+// fillFrameNumGap infers the frames missing between the previous reference
+// frame and the current one, as described in 8.2.5.2.
+func (p *Parser) fillFrameNumGap(h *SliceHeader, sps *SPS) {
+	maxFrameNum := sps.MaxFrameNum()
+	frameNum := uint16((uint32(p.prevRefFrameNum) + 1) % maxFrameNum)
+	for frameNum != h.FrameNum {
+		p.slidingWindow(frameNum, maxFrameNum, max(int(sps.MaxNumRefFrames), 1))
+		p.dpb = append(p.dpb, &frameStore{
+			frameNum:    frameNum,
+			decoded:     v4l2.H264FrameRef,
+			shortTerm:   v4l2.H264FrameRef,
+			nonExisting: true,
+		})
+		if p.prevFrameNum > frameNum {
+			p.prevFrameNumOffset += int32(maxFrameNum)
+		}
+		p.prevFrameNum = frameNum
+		p.prevRefFrameNum = frameNum
+		frameNum = uint16((uint32(frameNum) + 1) % maxFrameNum)
+	}
+}
+
+// slidingWindow runs the sliding window marking process of 8.2.5.3, dropping
+// the oldest short-term reference frames until fewer than limit remain.
+func (p *Parser) slidingWindow(frameNum uint16, maxFrameNum uint32, limit int) {
+	for len(p.dpb) >= limit {
+		var oldest *frameStore
+		for _, f := range p.dpb {
+			if f.shortTerm == 0 {
+				continue
+			}
+			if oldest == nil || f.frameNumWrap(frameNum, maxFrameNum) < oldest.frameNumWrap(frameNum, maxFrameNum) {
+				oldest = f
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		oldest.shortTerm = 0
+		p.prune()
+	}
+}
+
+// prune drops the frame stores no longer used for reference.
+func (p *Parser) prune() {
+	dpb := p.dpb[:0]
+	for _, f := range p.dpb {
+		if f.reference() != 0 {
+			dpb = append(dpb, f)
+		}
+	}
+	clear(p.dpb[len(dpb):])
+	p.dpb = dpb
+}
+
+// picNum returns the PicNum of the short-term fields of f, or of the frame
+// when decoding a frame, relative to the current picture.
+func picNum(f *frameStore, fields v4l2.H264Fields, h *SliceHeader, maxFrameNum uint32) int32 {
+	wrap := f.frameNumWrap(h.FrameNum, maxFrameNum)
+	if !h.FieldPic {
+		return wrap
+	}
+	if fields == parity(h) {
+		return 2*wrap + 1
+	}
+	return 2 * wrap
+}
+
+// longTermPicNum returns the LongTermPicNum of the long-term fields of f, or
+// of the frame when decoding a frame, relative to the current picture.
+func longTermPicNum(f *frameStore, fields v4l2.H264Fields, h *SliceHeader) int32 {
+	idx := int32(f.longTermFrameIdx)
+	if !h.FieldPic {
+		return idx
+	}
+	if fields == parity(h) {
+		return 2*idx + 1
+	}
+	return 2 * idx
+}
+
+// currPicNum returns CurrPicNum.
+func currPicNum(h *SliceHeader) int32 {
+	if h.FieldPic {
+		return 2*int32(h.FrameNum) + 1
+	}
+	return int32(h.FrameNum)
+}
+
+// findShortTerm returns the short-term reference frame or field with PicNum
+// num, skipping the frames inferred for frame_num gaps.
+func (p *Parser) findShortTerm(num int32, h *SliceHeader, maxFrameNum uint32) (*frameStore, v4l2.H264Fields) {
+	for _, f := range p.dpb {
+		for _, fields := range candidates(f.shortTerm, h) {
+			if picNum(f, fields, h, maxFrameNum) == num {
+				return f, fields
+			}
+		}
+	}
+	return nil, 0
+}
+
+// findLongTerm returns the long-term reference frame or field with
+// LongTermPicNum num.
+func (p *Parser) findLongTerm(num int32, h *SliceHeader) (*frameStore, v4l2.H264Fields) {
+	for _, f := range p.dpb {
+		for _, fields := range candidates(f.longTerm, h) {
+			if longTermPicNum(f, fields, h) == num {
+				return f, fields
+			}
+		}
+	}
+	return nil, 0
+}
+
+// candidates returns the pictures marked fields hold: the whole frame when
+// decoding a frame and both fields are marked, or each marked field when
+// decoding a field.
+func candidates(fields v4l2.H264Fields, h *SliceHeader) []v4l2.H264Fields {
+	if !h.FieldPic {
+		if fields == v4l2.H264FrameRef {
+			return []v4l2.H264Fields{v4l2.H264FrameRef}
+		}
+		return nil
+	}
+	var result []v4l2.H264Fields
+	for _, field := range []v4l2.H264Fields{v4l2.H264TopFieldRef, v4l2.H264BottomFieldRef} {
+		if fields&field != 0 {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+// mark runs the decoded reference picture marking process of 8.2.5 for the
+// current picture, held by current. It reports whether an MMCO 5 was run.
+func (p *Parser) mark(h *SliceHeader, sps *SPS, current *frameStore, secondField bool) bool {
+	fields := parity(h)
+	if h.IDR {
+		p.dpb = nil
+		p.maxLongTermFrameIdx = -1
+		if h.LongTermReference {
+			current.longTerm |= fields
+			current.longTermFrameIdx = 0
+			p.maxLongTermFrameIdx = 0
+		} else {
+			current.shortTerm |= fields
+		}
+		p.store(current)
+		return false
+	}
+	mmco5 := false
+	longTerm := false
+	maxFrameNum := sps.MaxFrameNum()
+	if h.AdaptiveRefPicMarking {
+		for _, mmco := range h.MMCOs {
+			switch mmco.Op {
+			case 1:
+				num := currPicNum(h) - int32(mmco.DifferenceOfPicNumsMinus1+1)
+				if f, fields := p.findShortTerm(num, h, maxFrameNum); f != nil {
+					f.shortTerm &^= fields
+				}
+			case 2:
+				if f, fields := p.findLongTerm(int32(mmco.LongTermPicNum), h); f != nil {
+					f.longTerm &^= fields
+				}
+			case 3:
+				num := currPicNum(h) - int32(mmco.DifferenceOfPicNumsMinus1+1)
+				if f, fields := p.findShortTerm(num, h, maxFrameNum); f != nil {
+					p.releaseLongTermFrameIdx(mmco.LongTermFrameIdx, f)
+					f.shortTerm &^= fields
+					f.longTerm |= fields
+					f.longTermFrameIdx = mmco.LongTermFrameIdx
+				}
+			case 4:
+				p.maxLongTermFrameIdx = int32(mmco.MaxLongTermFrameIdxPlus1) - 1
+				for _, f := range p.dpb {
+					if f.longTerm != 0 && int32(f.longTermFrameIdx) > p.maxLongTermFrameIdx {
+						f.longTerm = 0
+					}
+				}
+			case 5:
+				for _, f := range p.dpb {
+					f.shortTerm, f.longTerm = 0, 0
+				}
+				p.maxLongTermFrameIdx = -1
+				mmco5 = true
+			case 6:
+				p.releaseLongTermFrameIdx(mmco.LongTermFrameIdx, current)
+				current.longTerm |= fields
+				current.longTermFrameIdx = mmco.LongTermFrameIdx
+				longTerm = true
+			}
+		}
+		p.prune()
+	} else if !secondField || current.shortTerm == 0 {
+		p.slidingWindow(h.FrameNum, maxFrameNum, max(int(sps.MaxNumRefFrames), 1))
+	}
+	if !longTerm {
+		current.shortTerm |= fields
+	}
+	if mmco5 {
+		current.frameNum = 0
+		temp := min(current.poc[0], current.poc[1])
+		switch fields {
+		case v4l2.H264TopFieldRef:
+			temp = current.poc[0]
+		case v4l2.H264BottomFieldRef:
+			temp = current.poc[1]
+		}
+		if fields&v4l2.H264TopFieldRef != 0 {
+			current.poc[0] -= temp
+		}
+		if fields&v4l2.H264BottomFieldRef != 0 {
+			current.poc[1] -= temp
+		}
+	}
+	if !p.contains(current) {
+		p.slidingWindow(h.FrameNum, maxFrameNum, v4l2.H264NumDPBEntries)
+	}
+	p.store(current)
+	return mmco5
+}
+
+// releaseLongTermFrameIdx marks the long-term reference frame store with
+// LongTermFrameIdx idx unused, unless it is keep.
+func (p *Parser) releaseLongTermFrameIdx(idx uint32, keep *frameStore) {
+	for _, f := range p.dpb {
+		if f != keep && f.longTerm != 0 && f.longTermFrameIdx == idx {
+			f.longTerm = 0
+		}
+	}
+	p.prune()
+}
+
+// contains reports whether f is in the DPB.
+func (p *Parser) contains(f *frameStore) bool {
+	for _, stored := range p.dpb {
+		if stored == f {
+			return true
+		}
+	}
+	return false
+}
+
+// store adds f to the DPB unless it is already there.
+func (p *Parser) store(f *frameStore) {
+	if !p.contains(f) {
+		p.dpb = append(p.dpb, f)
+	}
+}
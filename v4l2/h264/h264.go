@@ -0,0 +1,124 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package h264 parses H.264 Annex B byte streams into the controls of the v4l2
+// stateless H.264 decoder API. It splits access units into NAL units, parses
+// parameter sets and slice headers, and keeps the decoded picture buffer and
+// picture order count state needed to fill CtrlH264DecodeParams.
+package h264
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	ErrTruncated           = errors.New("h264: unexpected end of data")
+	ErrInvalidValue        = errors.New("h264: invalid syntax element value")
+	ErrUnsupported         = errors.New("h264: unsupported bitstream feature")
+	ErrMissingParameterSet = errors.New("h264: slice refers to a missing parameter set")
+	ErrNoSlices            = errors.New("h264: access unit holds no slices")
+)
+
+// NALType is the NAL unit type.
+type NALType uint8
+
+// NAL unit types.
+const (
+	NALTypeSlice          NALType = 1
+	NALTypeSliceDataA     NALType = 2
+	NALTypeSliceDataB     NALType = 3
+	NALTypeSliceDataC     NALType = 4
+	NALTypeIDRSlice       NALType = 5
+	NALTypeSEI            NALType = 6
+	NALTypeSPS            NALType = 7
+	NALTypePPS            NALType = 8
+	NALTypeAUD            NALType = 9
+	NALTypeEndOfSequence  NALType = 10
+	NALTypeEndOfStream    NALType = 11
+	NALTypeFiller         NALType = 12
+	NALTypeSPSExtension   NALType = 13
+	NALTypePrefix         NALType = 14
+	NALTypeSubsetSPS      NALType = 15
+	NALTypeAuxiliarySlice NALType = 19
+	NALTypeSliceExtension NALType = 20
+)
+
+// StartCode is the Annex B start code prefix.
+var StartCode = []byte{0x00, 0x00, 0x01}
+
+// NALUnit is a NAL unit.
+type NALUnit struct {
+	RefIDC uint8
+	Type   NALType
+	Data   []byte // The whole NAL unit, header and emulation prevention bytes included.
+}
+
+// ParseNALUnit parses the header of a NAL unit without start code.
+func ParseNALUnit(data []byte) (*NALUnit, error) {
+	if len(data) == 0 {
+		return nil, ErrTruncated
+	}
+	if data[0]&0x80 != 0 {
+		return nil, ErrInvalidValue
+	}
+	return &NALUnit{
+		RefIDC: data[0] >> 5 & 0x03,
+		Type:   NALType(data[0] & 0x1f),
+		Data:   data,
+	}, nil
+}
+
+// IsSlice reports whether the NAL unit is a coded slice of a primary picture
+// that the stateless API decodes.
+func (n *NALUnit) IsSlice() bool {
+	return n.Type == NALTypeSlice || n.Type == NALTypeIDRSlice
+}
+
+// SplitAnnexB splits an Annex B byte stream into NAL units, dropping the start
+// codes and any zero bytes trailing a NAL unit. Data before the first start
+// code is ignored.
+func SplitAnnexB(stream []byte) [][]byte {
+	var units [][]byte
+	start := bytes.Index(stream, StartCode)
+	for start >= 0 {
+		start += len(StartCode)
+		end := bytes.Index(stream[start:], StartCode)
+		next := -1
+		if end < 0 {
+			end = len(stream)
+		} else {
+			end += start
+			next = end
+		}
+		unit := bytes.TrimRight(stream[start:end], "\x00")
+		if len(unit) > 0 {
+			units = append(units, unit)
+		}
+		start = next
+	}
+	return units
+}
+
+// AppendAnnexB appends a NAL unit preceded by a start code to stream.
+func AppendAnnexB(stream []byte, unit []byte) []byte {
+	stream = append(stream, StartCode...)
+	return append(stream, unit...)
+}
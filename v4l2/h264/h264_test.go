@@ -0,0 +1,670 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package h264
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/peterhagelund/go-v4l2/v4l2"
+	"github.com/peterhagelund/go-v4l2/v4l2/internal/bitstest"
+)
+
+// bitWriter writes the syntax elements of the test bitstreams.
+type bitWriter struct {
+	bitstest.Writer
+}
+
+func (w *bitWriter) ue(value uint32) {
+	bits := 0
+	for (value+1)>>bits > 1 {
+		bits++
+	}
+	w.U(bits, 0)
+	w.U(bits+1, value+1)
+}
+
+func (w *bitWriter) se(value int32) {
+	if value > 0 {
+		w.ue(uint32(2*value - 1))
+	} else {
+		w.ue(uint32(-2 * value))
+	}
+}
+
+// nal ends the RBSP and returns it as an escaped NAL unit.
+func (w *bitWriter) nal() []byte {
+	w.U(1, 1)
+	for w.Bits%8 != 0 {
+		w.U(1, 0)
+	}
+	var nal []byte
+	zeros := 0
+	for _, b := range w.Data {
+		if zeros >= 2 && b <= 0x03 {
+			nal = append(nal, 0x03)
+			zeros = 0
+		}
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		nal = append(nal, b)
+	}
+	return nal
+}
+
+// testStream describes the parameter sets of a test stream.
+type testStream struct {
+	fields          bool
+	picOrderCntType uint32
+	scaling         bool
+}
+
+// sps returns a 1920x1080 High profile SPS with 16 frame numbers and two
+// reference frames.
+func (s *testStream) sps() []byte {
+	w := &bitWriter{}
+	w.U(8, uint32(NALTypeSPS)|3<<5)
+	w.U(8, 100)
+	w.U(8, 0x0c)
+	w.U(8, 40)
+	w.ue(0)
+	w.ue(1)
+	w.ue(0)
+	w.ue(0)
+	w.Flag(false)
+	w.Flag(s.scaling)
+	if s.scaling {
+		for i := 0; i < 8; i++ {
+			switch i {
+			case 0:
+				w.Flag(true)
+				for j := 0; j < 16; j++ {
+					w.se(1)
+				}
+			case 6:
+				w.Flag(true)
+				w.se(-8)
+			default:
+				w.Flag(false)
+			}
+		}
+	}
+	w.ue(0)
+	w.ue(s.picOrderCntType)
+	switch s.picOrderCntType {
+	case 0:
+		w.ue(2)
+	case 1:
+		w.Flag(false)
+		w.se(-1)
+		w.se(1)
+		w.ue(2)
+		w.se(2)
+		w.se(4)
+	}
+	w.ue(2)
+	w.Flag(true)
+	w.ue(119)
+	if s.fields {
+		w.ue(33)
+		w.Flag(false)
+		w.Flag(false)
+	} else {
+		w.ue(67)
+		w.Flag(true)
+	}
+	w.Flag(true)
+	w.Flag(true)
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	if s.fields {
+		w.ue(2)
+	} else {
+		w.ue(4)
+	}
+	w.Flag(false)
+	return w.nal()
+}
+
+// pps returns a CABAC PPS with weighted prediction of P slices, 8x8
+// transforms and a single default reference.
+func (s *testStream) pps() []byte {
+	w := &bitWriter{}
+	w.U(8, uint32(NALTypePPS)|3<<5)
+	w.ue(0)
+	w.ue(0)
+	w.Flag(true)
+	w.Flag(true)
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.Flag(true)
+	w.U(2, 0)
+	w.se(0)
+	w.se(0)
+	w.se(-2)
+	w.Flag(true)
+	w.Flag(false)
+	w.Flag(false)
+	w.Flag(true)
+	w.Flag(s.scaling)
+	if s.scaling {
+		for i := 0; i < 8; i++ {
+			w.Flag(false)
+		}
+	}
+	w.se(3)
+	return w.nal()
+}
+
+// slice returns a slice NAL unit with h as its header, and the bit size of
+// the header.
+func (s *testStream) slice(h *SliceHeader) ([]byte, uint32) {
+	w := &bitWriter{}
+	nalType := NALTypeSlice
+	if h.IDR {
+		nalType = NALTypeIDRSlice
+	}
+	w.U(8, uint32(nalType)|uint32(h.NALRefIDC)<<5)
+	w.ue(h.FirstMBInSlice)
+	w.ue(uint32(h.SliceType) + 5)
+	w.ue(0)
+	w.U(4, uint32(h.FrameNum))
+	if s.fields {
+		w.Flag(h.FieldPic)
+		if h.FieldPic {
+			w.Flag(h.BottomField)
+		}
+	}
+	if h.IDR {
+		w.ue(uint32(h.IDRPicID))
+	}
+	switch s.picOrderCntType {
+	case 0:
+		w.U(6, uint32(h.PicOrderCntLSB))
+		if !h.FieldPic {
+			w.se(h.DeltaPicOrderCntBottom)
+		}
+	case 1:
+		w.se(h.DeltaPicOrderCnt[0])
+		if !h.FieldPic {
+			w.se(h.DeltaPicOrderCnt[1])
+		}
+	}
+	if h.SliceType == v4l2.H264SliceTypeB {
+		w.Flag(h.DirectSpatialMVPred)
+	}
+	if h.IsInter() {
+		w.Flag(true)
+		w.ue(uint32(h.NumRefIdxL0ActiveMinus1))
+		if h.SliceType == v4l2.H264SliceTypeB {
+			w.ue(uint32(h.NumRefIdxL1ActiveMinus1))
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if h.NumRefIdxActive(i) == 0 {
+			continue
+		}
+		w.Flag(h.RefPicListModifications[i] != nil)
+		if h.RefPicListModifications[i] != nil {
+			for _, modification := range h.RefPicListModifications[i] {
+				w.ue(uint32(modification.IDC))
+				w.ue(modification.Value)
+			}
+			w.ue(3)
+		}
+	}
+	if h.SliceType == v4l2.H264SliceTypeP {
+		table := h.PredWeightTable
+		w.ue(uint32(table.LumaLog2WeightDenom))
+		w.ue(uint32(table.ChromaLog2WeightDenom))
+		for i := 0; i < h.NumRefIdxActive(0); i++ {
+			factors := &table.Weightfactors[0]
+			explicit := factors.LumaWeight[i] != 1<<table.LumaLog2WeightDenom || factors.LumaOffset[i] != 0
+			w.Flag(explicit)
+			if explicit {
+				w.se(int32(factors.LumaWeight[i]))
+				w.se(int32(factors.LumaOffset[i]))
+			}
+			w.Flag(false)
+		}
+	}
+	if h.NALRefIDC != 0 {
+		if h.IDR {
+			w.Flag(h.NoOutputOfPriorPics)
+			w.Flag(h.LongTermReference)
+		} else {
+			w.Flag(h.AdaptiveRefPicMarking)
+			for _, mmco := range h.MMCOs {
+				w.ue(uint32(mmco.Op))
+				switch mmco.Op {
+				case 1:
+					w.ue(mmco.DifferenceOfPicNumsMinus1)
+				case 2:
+					w.ue(mmco.LongTermPicNum)
+				case 4:
+					w.ue(mmco.MaxLongTermFrameIdxPlus1)
+				case 6:
+					w.ue(mmco.LongTermFrameIdx)
+				}
+			}
+			if h.AdaptiveRefPicMarking {
+				w.ue(0)
+			}
+		}
+	}
+	if h.IsInter() {
+		w.ue(uint32(h.CABACInitIDC))
+	}
+	w.se(int32(h.SliceQPDelta))
+	w.ue(uint32(h.DisableDeblockingFilterIDC))
+	if h.DisableDeblockingFilterIDC != 1 {
+		w.se(int32(h.SliceAlphaC0OffsetDiv2))
+		w.se(int32(h.SliceBetaOffsetDiv2))
+	}
+	bits := uint32(w.Bits)
+	for w.Bits%8 != 0 {
+		w.U(1, 1)
+	}
+	for _, b := range []byte{0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x42} {
+		w.U(8, uint32(b))
+	}
+	return w.nal(), bits
+}
+
+// weights returns a prediction weight table with default factors for count
+// references.
+func weights(count int) *v4l2.H264PredWeightTable {
+	table := &v4l2.H264PredWeightTable{LumaLog2WeightDenom: 5, ChromaLog2WeightDenom: 2}
+	for i := 0; i < count; i++ {
+		table.Weightfactors[0].LumaWeight[i] = 32
+		table.Weightfactors[0].ChromaWeight[i] = [2]int16{4, 4}
+	}
+	return table
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	stream := []byte{0xff, 0x00, 0x00, 0x00, 0x01, 0x09, 0xf0, 0x00, 0x00, 0x01, 0x67, 0x00, 0x00, 0x03, 0x01, 0x00, 0x00, 0x00, 0x01, 0x68, 0xce, 0x00}
+	units := SplitAnnexB(stream)
+	if len(units) != 3 || !bytes.Equal(units[0], []byte{0x09, 0xf0}) || !bytes.Equal(units[1], []byte{0x67, 0x00, 0x00, 0x03, 0x01}) || !bytes.Equal(units[2], []byte{0x68, 0xce}) {
+		t.Fatal("incorrect NAL units")
+	}
+	if !bytes.Equal(unescape(units[1]), []byte{0x67, 0x00, 0x00, 0x01}) {
+		t.Fatal("incorrect emulation prevention byte removal")
+	}
+	unit, err := ParseNALUnit(units[1])
+	if err != nil || unit.Type != NALTypeSPS || unit.RefIDC != 3 || unit.IsSlice() {
+		t.Fatal("incorrect NAL unit header")
+	}
+	if _, err := ParseNALUnit([]byte{0x80}); err != ErrInvalidValue {
+		t.Fatal("forbidden zero bit accepted")
+	}
+	w := &bitWriter{}
+	for _, value := range []int32{0, 1, -1, 7, -64, 1000} {
+		w.se(value)
+	}
+	w.ue(0xfffffffe)
+	r := newBitReader(unescape(w.nal()), 0)
+	for _, value := range []int32{0, 1, -1, 7, -64, 1000} {
+		if r.se() != value {
+			t.Fatal("incorrect Exp-Golomb value")
+		}
+	}
+	if r.ue() != 0xfffffffe || r.Err != nil || r.moreRBSPData() {
+		t.Fatal("incorrect long Exp-Golomb value")
+	}
+	if r.U(8); r.Err != ErrTruncated {
+		t.Fatal("reading past the end not detected")
+	}
+}
+
+func TestParameterSets(t *testing.T) {
+	s := &testStream{scaling: true}
+	sets := &ParameterSets{}
+	if _, err := sets.ParsePPS(s.pps()); err != ErrMissingParameterSet {
+		t.Fatal("PPS without SPS accepted")
+	}
+	sps, err := sets.ParseSPS(s.sps())
+	if err != nil {
+		t.Fatal("unable to parse SPS")
+	}
+	if sps.ProfileIDC != 100 || sps.LevelIDC != 40 || sps.ConstraintSetFlags != v4l2.H264SPSConstraintSet4|v4l2.H264SPSConstraintSet5 {
+		t.Fatal("incorrect profile and level")
+	}
+	if sps.Width() != 1920 || sps.Height() != 1080 || sps.CodedWidth() != 1920 || sps.CodedHeight() != 1088 || sps.MaxFrameNum() != 16 || sps.MaxPicOrderCntLSB() != 64 {
+		t.Fatal("incorrect SPS")
+	}
+	control := sps.Control()
+	if control.ChromaFormatIDC != 1 || control.MaxNumRefFrames != 2 || control.PicWidthInMBSMinus1 != 119 || control.PicHeightInMapUnitsMinus1 != 67 {
+		t.Fatal("incorrect SPS control")
+	}
+	if control.Flags != v4l2.H264SPSFlagGapsInFrameNumValueAllowed|v4l2.H264SPSFlagFrameMBSOnly|v4l2.H264SPSFlagDirect8x8Inference {
+		t.Fatal("incorrect SPS control flags")
+	}
+	pps, err := sets.ParsePPS(s.pps())
+	if err != nil {
+		t.Fatal("unable to parse PPS")
+	}
+	if sets.PPS[0] != pps || !pps.Transform8x8Mode || pps.ChromaQPIndexOffset != -2 || pps.SecondChromaQPIndexOffset != 3 {
+		t.Fatal("incorrect PPS")
+	}
+	ppsControl := pps.Control(sps)
+	if ppsControl.Flags != v4l2.H264PPSFlagEntropyCodingMode|v4l2.H264PPSFlagBottomFieldPicOrderInFramePresent|
+		v4l2.H264PPSFlagWeightedPred|v4l2.H264PPSFlagDeblockingFilterControlPresent|v4l2.H264PPSFlagTransform8x8Mode|v4l2.H264PPSFlagScalingMatrixPresent {
+		t.Fatal("incorrect PPS control flags")
+	}
+	matrix := ScalingMatrix(sps, pps)
+	if matrix.ScalingList4x4[0][0] != 9 || matrix.ScalingList4x4[0][1] != 10 || matrix.ScalingList4x4[0][4] != 11 || matrix.ScalingList4x4[0][15] != 24 {
+		t.Fatal("incorrect explicit scaling list")
+	}
+	if matrix.ScalingList4x4[2] != matrix.ScalingList4x4[0] || matrix.ScalingList4x4[3][0] != 10 || matrix.ScalingList4x4[5][15] != 34 {
+		t.Fatal("incorrect 4x4 scaling list fall-back")
+	}
+	if matrix.ScalingList8x8[0][1] != 10 || matrix.ScalingList8x8[0][8] != 10 || matrix.ScalingList8x8[0][63] != 42 || matrix.ScalingList8x8[1][0] != 9 || matrix.ScalingList8x8[5] != matrix.ScalingList8x8[1] {
+		t.Fatal("incorrect 8x8 scaling lists")
+	}
+	if flat := ScalingMatrix(&SPS{}, &PPS{}); flat.ScalingList4x4[4][7] != 16 || flat.ScalingList8x8[3][60] != 16 {
+		t.Fatal("incorrect flat scaling matrix")
+	}
+	if _, err := ParseSPS(s.sps()[:8]); err != ErrTruncated {
+		t.Fatal("truncated SPS accepted")
+	}
+}
+
+func TestParser(t *testing.T) {
+	s := &testStream{}
+	p := NewParser()
+	headers := []*SliceHeader{
+		{NALRefIDC: 3, IDR: true, SliceType: v4l2.H264SliceTypeI, IDRPicID: 1},
+		{NALRefIDC: 2, SliceType: v4l2.H264SliceTypeP, FrameNum: 1, PicOrderCntLSB: 8, DeltaPicOrderCntBottom: 1, PredWeightTable: weights(1)},
+		{SliceType: v4l2.H264SliceTypeB, FrameNum: 2, PicOrderCntLSB: 4, DirectSpatialMVPred: true},
+		{NALRefIDC: 2, SliceType: v4l2.H264SliceTypeP, FrameNum: 2, PicOrderCntLSB: 16, NumRefIdxL0ActiveMinus1: 1, PredWeightTable: weights(2),
+			RefPicListModifications: [2][]RefPicListModification{{{IDC: 0, Value: 1}}}},
+		{NALRefIDC: 2, SliceType: v4l2.H264SliceTypeP, FrameNum: 4, PicOrderCntLSB: 24, PredWeightTable: weights(1)},
+		{NALRefIDC: 2, SliceType: v4l2.H264SliceTypeP, FrameNum: 5, PicOrderCntLSB: 32, PredWeightTable: weights(1), AdaptiveRefPicMarking: true,
+			MMCOs: []MMCO{{Op: 4, MaxLongTermFrameIdxPlus1: 1}, {Op: 1}, {Op: 6}}},
+		{NALRefIDC: 2, SliceType: v4l2.H264SliceTypeP, FrameNum: 6, PicOrderCntLSB: 48, PredWeightTable: weights(1), AdaptiveRefPicMarking: true,
+			MMCOs: []MMCO{{Op: 5}}},
+		{NALRefIDC: 2, SliceType: v4l2.H264SliceTypeP, FrameNum: 1, PicOrderCntLSB: 8, PredWeightTable: weights(1)},
+	}
+	headers[1].PredWeightTable.Weightfactors[0].LumaWeight[0] = 3
+	headers[1].PredWeightTable.Weightfactors[0].LumaOffset[0] = -1
+	headers[2].NumRefIdxL1ActiveMinus1 = 0
+	var pictures []*Picture
+	for i, h := range headers {
+		au := AppendAnnexB(nil, []byte{byte(NALTypeAUD), 0xf0})
+		if i == 0 {
+			au = AppendAnnexB(AppendAnnexB(au, s.sps()), s.pps())
+		}
+		nal, bits := s.slice(h)
+		au = AppendAnnexB(au, nal)
+		picture, err := p.Parse(au, time.Duration(i)*40*time.Millisecond)
+		if err != nil {
+			t.Fatal("unable to parse access unit")
+		}
+		if len(picture.Slices) != 1 || picture.Slices[0].Params.HeaderBitSize != bits || !bytes.Equal(picture.Bitstream(), AppendAnnexB(nil, nal)) {
+			t.Fatal("incorrect slice")
+		}
+		pictures = append(pictures, picture)
+	}
+	if picture, err := p.Parse(AppendAnnexB(nil, s.pps()), 0); picture != nil || err != nil {
+		t.Fatal("access unit without slices not skipped")
+	}
+	ts := func(i int) uint64 {
+		return uint64(time.Duration(i) * 40 * time.Millisecond)
+	}
+	idr := pictures[0]
+	if idr.Width != 1920 || idr.Height != 1088 || idr.SPS.MaxNumRefFrames != 2 || idr.PPS.SecondChromaQPIndexOffset != 3 || idr.ScalingMatrix.ScalingList8x8[5][63] != 16 {
+		t.Fatal("incorrect IDR picture controls")
+	}
+	params := idr.DecodeParams
+	if params.Flags != v4l2.H264DecodeParamFlagIDRPic || params.NALRefIDC != 3 || params.IDRPicID != 1 || params.DPD[0].Flags != 0 || params.PicOrderCntBitSize != 7 || params.DecRefPicMarkingBitSize != 2 {
+		t.Fatal("incorrect IDR decode parameters")
+	}
+	params = pictures[1].DecodeParams
+	if params.Flags != v4l2.H264DecodeParamFlagPFrame || params.TopFieldOrderCnt != 8 || params.BottomFieldOrderCnt != 9 {
+		t.Fatal("incorrect P decode parameters")
+	}
+	entry := params.DPD[0]
+	if entry.ReferenceTS != ts(0) || entry.Fields != v4l2.H264FrameRef || entry.Flags != v4l2.H264DPBEntryFlagValid|v4l2.H264DPBEntryFlagActive || params.DPD[1].Flags != 0 {
+		t.Fatal("incorrect P DPB")
+	}
+	slice := pictures[1].Slices[0]
+	if slice.Params.SliceType != v4l2.H264SliceTypeP || slice.Params.RefPicList0[0] != (v4l2.H264Reference{Fields: v4l2.H264FrameRef, Index: 0}) {
+		t.Fatal("incorrect P slice parameters")
+	}
+	if slice.PredWeights.LumaLog2WeightDenom != 5 || slice.PredWeights.Weightfactors[0].LumaWeight[0] != 3 || slice.PredWeights.Weightfactors[0].LumaOffset[0] != -1 || slice.PredWeights.Weightfactors[0].ChromaWeight[0] != [2]int16{4, 4} {
+		t.Fatal("incorrect prediction weights")
+	}
+	b := pictures[2]
+	params = b.DecodeParams
+	if params.Flags != v4l2.H264DecodeParamFlagBFrame || params.NALRefIDC != 0 || params.TopFieldOrderCnt != 4 || params.DPD[1].ReferenceTS != ts(1) || params.DPD[1].TopFieldOrderCnt != 8 {
+		t.Fatal("incorrect B decode parameters")
+	}
+	slice = b.Slices[0]
+	if slice.Params.Flags != v4l2.H264SliceFlagDirectSpatialMVPred || slice.Params.RefPicList0[0].Index != 0 || slice.Params.RefPicList1[0].Index != 1 {
+		t.Fatal("incorrect B reference lists")
+	}
+	if controls, err := b.Controls(); err != nil || len(controls) != 4 || controls[0].ID != v4l2.CidStatelessH264SPS || len(controls[0].Payload) != 1048 || len(controls[3].Payload) != 560 {
+		t.Fatal("incorrect picture controls")
+	}
+	if controls, err := slice.Controls(); err != nil || len(controls) != 1 || len(controls[0].Payload) != 152 {
+		t.Fatal("incorrect B slice controls")
+	}
+	if controls, err := pictures[1].Slices[0].Controls(); err != nil || len(controls) != 2 || controls[1].ID != v4l2.CidStatelessH264PredWeights || len(controls[1].Payload) != 772 {
+		t.Fatal("incorrect P slice controls")
+	}
+	slice = pictures[3].Slices[0]
+	if slice.Params.RefPicList0[0].Index != 0 || slice.Params.RefPicList0[1].Index != 1 || pictures[3].DecodeParams.DPD[1].PicNum != 1 {
+		t.Fatal("incorrect modified reference list")
+	}
+	params = pictures[4].DecodeParams
+	if params.DPD[0].ReferenceTS != ts(3) || params.DPD[0].FrameNum != 2 || params.DPD[1].Flags != 0 || pictures[4].Slices[0].Params.RefPicList0[0].Index != 0 {
+		t.Fatal("incorrect DPB after a frame number gap")
+	}
+	params = pictures[6].DecodeParams
+	entry = params.DPD[0]
+	if entry.ReferenceTS != ts(5) || entry.Flags&v4l2.H264DPBEntryFlagLongTerm == 0 || entry.PicNum != 0 || params.DPD[1].Flags != 0 || params.TopFieldOrderCnt != 48 {
+		t.Fatal("incorrect DPB after memory management control operations")
+	}
+	params = pictures[7].DecodeParams
+	entry = params.DPD[0]
+	if entry.ReferenceTS != ts(6) || entry.FrameNum != 0 || entry.TopFieldOrderCnt != 0 || params.TopFieldOrderCnt != 8 || params.DPD[1].Flags != 0 {
+		t.Fatal("incorrect DPB after a memory management reset")
+	}
+	if _, err := NewParser().Parse(AppendAnnexB(nil, func() []byte { nal, _ := s.slice(headers[1]); return nal }()), 0); err != ErrMissingParameterSet {
+		t.Fatal("slice without parameter sets accepted")
+	}
+}
+
+func TestParserFields(t *testing.T) {
+	s := &testStream{fields: true, picOrderCntType: 1}
+	p := NewParser()
+	if _, err := p.ParseSPS(s.sps()); err != nil {
+		t.Fatal("unable to parse SPS")
+	}
+	if _, err := p.ParsePPS(s.pps()); err != nil {
+		t.Fatal("unable to parse PPS")
+	}
+	if p.SPS[0].Height() != 1080 || p.SPS[0].CodedHeight() != 1088 {
+		t.Fatal("incorrect field SPS")
+	}
+	headers := []*SliceHeader{
+		{NALRefIDC: 3, IDR: true, SliceType: v4l2.H264SliceTypeI, FieldPic: true},
+		{NALRefIDC: 3, SliceType: v4l2.H264SliceTypeP, FieldPic: true, BottomField: true, PredWeightTable: weights(1)},
+		{NALRefIDC: 3, SliceType: v4l2.H264SliceTypeP, FrameNum: 1, FieldPic: true, NumRefIdxL0ActiveMinus1: 1, PredWeightTable: weights(2)},
+		{NALRefIDC: 3, SliceType: v4l2.H264SliceTypeP, FrameNum: 1, FieldPic: true, BottomField: true, NumRefIdxL0ActiveMinus1: 2, PredWeightTable: weights(3)},
+		{SliceType: v4l2.H264SliceTypeB, FrameNum: 2, FieldPic: true, NumRefIdxL0ActiveMinus1: 3, NumRefIdxL1ActiveMinus1: 3},
+	}
+	var pictures []*Picture
+	for i, h := range headers {
+		nal, _ := s.slice(h)
+		picture, err := p.Parse(AppendAnnexB(nil, nal), time.Duration(i/2)*40*time.Millisecond)
+		if err != nil {
+			t.Fatal("unable to parse field")
+		}
+		pictures = append(pictures, picture)
+	}
+	params := pictures[0].DecodeParams
+	if params.Flags != v4l2.H264DecodeParamFlagIDRPic|v4l2.H264DecodeParamFlagFieldPic || params.TopFieldOrderCnt != 0 {
+		t.Fatal("incorrect first field decode parameters")
+	}
+	params = pictures[1].DecodeParams
+	if params.Flags != v4l2.H264DecodeParamFlagFieldPic|v4l2.H264DecodeParamFlagBottomField|v4l2.H264DecodeParamFlagPFrame || params.BottomFieldOrderCnt != 1 {
+		t.Fatal("incorrect second field decode parameters")
+	}
+	entry := params.DPD[0]
+	if entry.Fields != v4l2.H264TopFieldRef || entry.Flags != v4l2.H264DPBEntryFlagValid|v4l2.H264DPBEntryFlagActive|v4l2.H264DPBEntryFlagField {
+		t.Fatal("incorrect first field DPB entry")
+	}
+	if pictures[1].Slices[0].Params.RefPicList0[0] != (v4l2.H264Reference{Fields: v4l2.H264TopFieldRef, Index: 0}) {
+		t.Fatal("incorrect second field reference list")
+	}
+	params = pictures[2].DecodeParams
+	if params.DPD[0].Fields != v4l2.H264FrameRef || params.DPD[0].BottomFieldOrderCnt != 1 || params.TopFieldOrderCnt != 2 {
+		t.Fatal("incorrect field pair DPB entry")
+	}
+	list := pictures[2].Slices[0].Params.RefPicList0
+	if list[0] != (v4l2.H264Reference{Fields: v4l2.H264TopFieldRef, Index: 0}) || list[1] != (v4l2.H264Reference{Fields: v4l2.H264BottomFieldRef, Index: 0}) {
+		t.Fatal("incorrect top field reference list")
+	}
+	params = pictures[3].DecodeParams
+	if params.DPD[1].ReferenceTS != uint64(40*time.Millisecond) || params.DPD[1].Fields != v4l2.H264TopFieldRef || params.BottomFieldOrderCnt != 3 {
+		t.Fatal("incorrect second field DPB")
+	}
+	list = pictures[3].Slices[0].Params.RefPicList0
+	if list[0] != (v4l2.H264Reference{Fields: v4l2.H264BottomFieldRef, Index: 0}) || list[1] != (v4l2.H264Reference{Fields: v4l2.H264TopFieldRef, Index: 1}) ||
+		list[2] != (v4l2.H264Reference{Fields: v4l2.H264TopFieldRef, Index: 0}) {
+		t.Fatal("incorrect bottom field reference list")
+	}
+	params = pictures[4].DecodeParams
+	if params.TopFieldOrderCnt != 1 || params.Flags != v4l2.H264DecodeParamFlagFieldPic|v4l2.H264DecodeParamFlagBFrame {
+		t.Fatal("incorrect B field decode parameters")
+	}
+	top := func(index uint8) v4l2.H264Reference {
+		return v4l2.H264Reference{Fields: v4l2.H264TopFieldRef, Index: index}
+	}
+	bottom := func(index uint8) v4l2.H264Reference {
+		return v4l2.H264Reference{Fields: v4l2.H264BottomFieldRef, Index: index}
+	}
+	slice := pictures[4].Slices[0]
+	if slice.Params.RefPicList0[0] != top(0) || slice.Params.RefPicList0[1] != bottom(0) || slice.Params.RefPicList0[2] != top(1) || slice.Params.RefPicList0[3] != bottom(1) {
+		t.Fatal("incorrect B field list 0")
+	}
+	if slice.Params.RefPicList1[0] != top(1) || slice.Params.RefPicList1[1] != bottom(1) || slice.Params.RefPicList1[2] != top(0) || slice.Params.RefPicList1[3] != bottom(0) {
+		t.Fatal("incorrect B field list 1")
+	}
+}
+
+// accessUnits splits a stream of single slice pictures without access unit
+// delimiters into access units.
+func accessUnits(stream []byte) [][]byte {
+	var units [][]byte
+	var unit []byte
+	slice := false
+	for _, nal := range SplitAnnexB(stream) {
+		switch NALType(nal[0] & 0x1f) {
+		case NALTypeSlice, NALTypeIDRSlice:
+			if slice {
+				units = append(units, unit)
+				unit = nil
+			}
+			slice = true
+		}
+		unit = AppendAnnexB(unit, nal)
+	}
+	return append(units, unit)
+}
+
+func TestParserX264(t *testing.T) {
+	stream, err := os.ReadFile("testdata/x264.264")
+	if err != nil {
+		t.Fatal("unable to read x264 stream")
+	}
+	p := NewParser()
+	var pictures []*Picture
+	for i, au := range accessUnits(stream) {
+		picture, err := p.Parse(au, time.Duration(i)*time.Millisecond)
+		if err != nil || picture == nil {
+			t.Fatal("unable to parse x264 access unit")
+		}
+		pictures = append(pictures, picture)
+	}
+	if len(pictures) != 32 {
+		t.Fatal("incorrect number of x264 pictures")
+	}
+	sps, pps := p.SPS[0], p.PPS[0]
+	if sps.ProfileIDC != 100 || sps.LevelIDC != 30 || sps.ChromaFormatIDC != 1 || sps.MaxNumRefFrames != 4 || sps.Log2MaxFrameNumMinus4 != 0 || sps.PicOrderCntType != 0 || sps.Log2MaxPicOrderCntLSBMinus4 != 2 || !sps.Direct8x8Inference || !sps.VUIParametersPresent {
+		t.Fatal("incorrect x264 SPS")
+	}
+	if sps.FrameCropBottomOffset != 4 || pictures[0].Width != 640 || pictures[0].Height != 368 {
+		t.Fatal("incorrect x264 picture size")
+	}
+	if !pps.EntropyCodingMode || !pps.WeightedPred || pps.WeightedBipredIDC != 2 || pps.NumRefIdxL0DefaultActiveMinus1 != 2 || pps.ChromaQPIndexOffset != -2 || pps.SecondChromaQPIndexOffset != -2 || !pps.Transform8x8Mode {
+		t.Fatal("incorrect x264 PPS")
+	}
+	for _, i := range []int{0, 30} {
+		if params := pictures[i].DecodeParams; params.Flags != v4l2.H264DecodeParamFlagIDRPic || params.DPD[0].Flags != 0 {
+			t.Fatal("incorrect x264 IDR picture")
+		}
+	}
+	// x264 duplicates the reference of its weighted P slices by modifying
+	// the list.
+	slice := pictures[2].Slices[0]
+	if len(slice.Header.RefPicListModifications[0]) != 3 || slice.Header.PredWeightTable == nil {
+		t.Fatal("incorrect x264 P slice header")
+	}
+	if slice.Params.RefPicList0[0].Index != 1 || slice.Params.RefPicList0[1].Index != 1 || slice.Params.RefPicList0[2].Index != 0 {
+		t.Fatal("incorrect x264 P reference list")
+	}
+	// The B reference picture removes the two oldest frames by MMCO 1.
+	b := pictures[4]
+	if b.DecodeParams.NALRefIDC != 2 || b.DecodeParams.TopFieldOrderCnt != 8 || len(b.Slices[0].Header.MMCOs) != 2 || b.Slices[0].Header.MMCOs[0].DifferenceOfPicNumsMinus1 != 3 {
+		t.Fatal("incorrect x264 B reference picture")
+	}
+	b = pictures[5]
+	params := b.DecodeParams
+	if params.Flags != v4l2.H264DecodeParamFlagBFrame || params.NALRefIDC != 0 || params.TopFieldOrderCnt != 6 || params.DPD[0].FrameNum != 2 || params.DPD[2].FrameNum != 4 || params.DPD[3].Flags != 0 {
+		t.Fatal("incorrect x264 B decode parameters")
+	}
+	slice = b.Slices[0]
+	if slice.Params.RefPicList0[0].Index != 0 || slice.Params.RefPicList1[0].Index != 2 || slice.Params.RefPicList1[1].Index != 1 {
+		t.Fatal("incorrect x264 B reference lists")
+	}
+	// frame_num wraps at 16, leaving the earlier references with negative
+	// picture numbers.
+	params = pictures[26].DecodeParams
+	if params.FrameNum != 0 || int32(params.DPD[0].PicNum) != -4 || params.DPD[0].FrameNum != 12 || params.DPD[0].ReferenceTS != v4l2.ReferenceTS(20*time.Millisecond) {
+		t.Fatal("incorrect x264 frame_num wrap")
+	}
+	if controls, err := pictures[31].Controls(); err != nil || len(controls) != 4 {
+		t.Fatal("incorrect x264 picture controls")
+	}
+	if controls, err := pictures[31].Slices[0].Controls(); err != nil || len(controls) != 2 {
+		t.Fatal("incorrect x264 slice controls")
+	}
+}
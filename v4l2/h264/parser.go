@@ -0,0 +1,491 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package h264
+
+import (
+	"slices"
+	"time"
+
+	"github.com/peterhagelund/go-v4l2/v4l2"
+)
+
+// Parser turns the access units of an H.264 stream into pictures ready to be
+// queued to a stateless decoder, keeping the parameter sets, the reference
+// picture marking and the picture order count state between them.
+type Parser struct {
+	ParameterSets
+	dpb                 []*frameStore // The frame stores used for reference.
+	firstField          *frameStore   // The first field of a frame, until its second field is parsed.
+	maxLongTermFrameIdx int32         // -1 for no long-term frame indices.
+	prevPicOrderCntMsb  int32
+	prevPicOrderCntLSB  int32
+	prevFrameNumOffset  int32
+	prevFrameNum        uint16
+	prevRefFrameNum     uint16
+}
+
+// NewParser returns a parser for a new stream.
+func NewParser() *Parser {
+	return &Parser{maxLongTermFrameIdx: -1}
+}
+
+// Picture is a coded frame or field along with the controls describing it.
+// Slices and Bitstream hold only the slices of the primary coded picture.
+type Picture struct {
+	SPS           v4l2.CtrlH264SPS
+	PPS           v4l2.CtrlH264PPS
+	ScalingMatrix v4l2.CtrlH264ScalingMatrix
+	DecodeParams  v4l2.CtrlH264DecodeParams
+	Slices        []*Slice
+	Width         uint32 // Coded size in luma samples.
+	Height        uint32
+}
+
+// Slice is a coded slice along with the controls describing it.
+type Slice struct {
+	Header      *SliceHeader
+	Params      v4l2.CtrlH264SliceParams
+	PredWeights v4l2.H264PredWeightTable
+	Data        []byte // The NAL unit without start code.
+}
+
+// Parse parses an access unit holding one coded frame or field, along with
+// any parameter sets preceding it. The timestamp is that of the OUTPUT buffer
+// the picture is queued in, which the decoder copies to the CAPTURE buffer
+// the picture is decoded to; a second field is decoded to the buffer of the
+// first and is referenced by its timestamp. Parse returns a nil picture when
+// the access unit holds no slices.
+func (p *Parser) Parse(accessUnit []byte, timestamp time.Duration) (*Picture, error) {
+	var slices []*Slice
+	for _, data := range SplitAnnexB(accessUnit) {
+		unit, err := ParseNALUnit(data)
+		if err != nil {
+			return nil, err
+		}
+		switch unit.Type {
+		case NALTypeSPS:
+			_, err = p.ParseSPS(data)
+		case NALTypePPS:
+			_, err = p.ParsePPS(data)
+		case NALTypeSlice, NALTypeIDRSlice:
+			var header *SliceHeader
+			if header, err = p.ParseSliceHeader(data); err == nil && header.RedundantPicCnt == 0 {
+				slices = append(slices, &Slice{Header: header, Data: data})
+			}
+		case NALTypeSliceDataA, NALTypeSliceDataB, NALTypeSliceDataC, NALTypeSliceExtension:
+			err = ErrUnsupported
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(slices) == 0 {
+		return nil, nil
+	}
+	return p.decode(slices, v4l2.ReferenceTS(timestamp))
+}
+
+// decode runs the picture level decoding processes for the slices of a
+// picture, filling in its controls.
+func (p *Parser) decode(slices []*Slice, referenceTS uint64) (*Picture, error) {
+	h := slices[0].Header
+	pps := p.PPS[h.PPSID]
+	sps := p.SPS[pps.SPSID]
+	for _, slice := range slices[1:] {
+		if slice.Header.PPSID != h.PPSID || slice.Header.FrameNum != h.FrameNum || parity(slice.Header) != parity(h) {
+			return nil, ErrInvalidValue
+		}
+	}
+	fields := parity(h)
+	secondField := p.firstField != nil && h.FieldPic && !h.IDR &&
+		p.firstField.decoded&fields == 0 && p.firstField.frameNum == h.FrameNum &&
+		(p.firstField.reference() != 0) == (h.NALRefIDC != 0)
+	if h.IDR {
+		p.dpb = nil
+		p.prevRefFrameNum = 0
+	} else if !secondField && h.FrameNum != p.prevRefFrameNum &&
+		uint32(h.FrameNum) != (uint32(p.prevRefFrameNum)+1)%sps.MaxFrameNum() {
+		p.fillFrameNumGap(h, sps)
+	}
+	order := p.picOrderCnt(h, sps)
+	current := p.firstField
+	if !secondField {
+		current = &frameStore{referenceTS: referenceTS, frameNum: h.FrameNum, field: h.FieldPic}
+	}
+	if fields&v4l2.H264TopFieldRef != 0 {
+		current.poc[0] = order.top
+	}
+	if fields&v4l2.H264BottomFieldRef != 0 {
+		current.poc[1] = order.bottom
+	}
+	current.decoded |= fields
+	picture := &Picture{
+		SPS:           sps.Control(),
+		PPS:           pps.Control(sps),
+		ScalingMatrix: ScalingMatrix(sps, pps),
+		Slices:        slices,
+		Width:         sps.CodedWidth(),
+		Height:        sps.CodedHeight(),
+	}
+	picture.DecodeParams = p.decodeParams(h, current)
+	for _, slice := range slices {
+		if slice.Header.SliceType == v4l2.H264SliceTypeB {
+			picture.DecodeParams.Flags |= v4l2.H264DecodeParamFlagBFrame
+		} else if slice.Header.IsInter() && picture.DecodeParams.Flags&v4l2.H264DecodeParamFlagBFrame == 0 {
+			picture.DecodeParams.Flags |= v4l2.H264DecodeParamFlagPFrame
+		}
+		if err := p.fillSlice(slice, sps, current); err != nil {
+			return nil, err
+		}
+	}
+	if picture.DecodeParams.Flags&v4l2.H264DecodeParamFlagBFrame != 0 {
+		picture.DecodeParams.Flags &^= v4l2.H264DecodeParamFlagPFrame
+	}
+	mmco5 := false
+	if h.NALRefIDC != 0 {
+		mmco5 = p.mark(h, sps, current, secondField)
+		p.prevRefFrameNum = current.frameNum
+		p.prevPicOrderCntMsb = order.msb
+		p.prevPicOrderCntLSB = int32(h.PicOrderCntLSB)
+		if mmco5 {
+			p.prevPicOrderCntMsb = 0
+			p.prevPicOrderCntLSB = 0
+			if !h.BottomField {
+				p.prevPicOrderCntLSB = current.poc[0]
+			}
+		}
+	}
+	p.prevFrameNum = current.frameNum
+	p.prevFrameNumOffset = order.frameNumOffset
+	if mmco5 {
+		p.prevFrameNumOffset = 0
+	}
+	p.firstField = nil
+	if h.FieldPic && !secondField {
+		p.firstField = current
+	}
+	return picture, nil
+}
+
+// decodeParams returns the decode parameters of the picture that h starts,
+// with the DPB as it is before the picture is decoded.
+func (p *Parser) decodeParams(h *SliceHeader, current *frameStore) v4l2.CtrlH264DecodeParams {
+	params := v4l2.CtrlH264DecodeParams{
+		NALRefIDC:               uint16(h.NALRefIDC),
+		FrameNum:                h.FrameNum,
+		TopFieldOrderCnt:        current.poc[0],
+		BottomFieldOrderCnt:     current.poc[1],
+		IDRPicID:                h.IDRPicID,
+		PicOrderCntLSB:          h.PicOrderCntLSB,
+		DeltaPicOrderCntBottom:  h.DeltaPicOrderCntBottom,
+		DeltaPicOrderCnt0:       h.DeltaPicOrderCnt[0],
+		DeltaPicOrderCnt1:       h.DeltaPicOrderCnt[1],
+		DecRefPicMarkingBitSize: h.DecRefPicMarkingBitSize,
+		PicOrderCntBitSize:      h.PicOrderCntBitSize,
+		SliceGroupChangeCycle:   h.SliceGroupChangeCycle,
+	}
+	if h.IDR {
+		params.Flags |= v4l2.H264DecodeParamFlagIDRPic
+	}
+	if h.FieldPic {
+		params.Flags |= v4l2.H264DecodeParamFlagFieldPic
+	}
+	if h.BottomField {
+		params.Flags |= v4l2.H264DecodeParamFlagBottomField
+	}
+	sps := p.SPS[p.PPS[h.PPSID].SPSID]
+	for i, f := range p.entries() {
+		entry := &params.DPD[i]
+		entry.ReferenceTS = f.referenceTS
+		entry.FrameNum = f.frameNum
+		entry.PicNum = uint32(f.frameNumWrap(h.FrameNum, sps.MaxFrameNum()))
+		entry.Fields = f.reference()
+		entry.TopFieldOrderCnt = f.poc[0]
+		entry.BottomFieldOrderCnt = f.poc[1]
+		entry.Flags = v4l2.H264DPBEntryFlagValid | v4l2.H264DPBEntryFlagActive
+		if f.longTerm != 0 {
+			entry.FrameNum = uint16(f.longTermFrameIdx)
+			entry.PicNum = f.longTermFrameIdx
+			entry.Flags |= v4l2.H264DPBEntryFlagLongTerm
+		}
+		if f.field {
+			entry.Flags |= v4l2.H264DPBEntryFlagField
+		}
+	}
+	return params
+}
+
+// entries returns the frame stores passed in the DPB of the decode parameters,
+// which leaves out the frames inferred for frame_num gaps.
+func (p *Parser) entries() []*frameStore {
+	var entries []*frameStore
+	for _, f := range p.dpb {
+		if !f.nonExisting {
+			entries = append(entries, f)
+		}
+	}
+	return entries
+}
+
+// fillSlice fills in the controls of a slice, including its reference picture
+// lists.
+func (p *Parser) fillSlice(slice *Slice, sps *SPS, current *frameStore) error {
+	h := slice.Header
+	slice.Params = h.sliceParams()
+	if h.PredWeightTable != nil {
+		slice.PredWeights = *h.PredWeightTable
+	}
+	entries := p.entries()
+	lists := [2]*[v4l2.H264RefListLen]v4l2.H264Reference{&slice.Params.RefPicList0, &slice.Params.RefPicList1}
+	initial := p.initialRefLists(h, sps, current)
+	for i := 0; i < 2; i++ {
+		count := h.NumRefIdxActive(i)
+		if count == 0 {
+			continue
+		}
+		list := initial[i]
+		if len(list) > count {
+			list = list[:count]
+		}
+		list, err := p.modifyRefList(list, count, h.RefPicListModifications[i], h, sps)
+		if err != nil {
+			return err
+		}
+		for j, ref := range list {
+			if ref.store == nil {
+				continue
+			}
+			lists[i][j] = v4l2.H264Reference{Fields: ref.fields, Index: uint8(slices.Index(entries, ref.store))}
+		}
+	}
+	return nil
+}
+
+// ref is an entry of a reference picture list.
+type ref struct {
+	store  *frameStore
+	fields v4l2.H264Fields
+}
+
+// initialRefLists returns the initial reference picture lists of 8.2.4.2.
+func (p *Parser) initialRefLists(h *SliceHeader, sps *SPS, current *frameStore) [2][]ref {
+	maxFrameNum := sps.MaxFrameNum()
+	var shortTerm, longTerm []*frameStore
+	for _, f := range p.entries() {
+		if f == current && !h.FieldPic {
+			continue
+		}
+		if (!h.FieldPic && f.shortTerm == v4l2.H264FrameRef) || (h.FieldPic && f.shortTerm != 0) {
+			shortTerm = append(shortTerm, f)
+		}
+		if (!h.FieldPic && f.longTerm == v4l2.H264FrameRef) || (h.FieldPic && f.longTerm != 0) {
+			longTerm = append(longTerm, f)
+		}
+	}
+	slices.SortStableFunc(longTerm, func(a, b *frameStore) int {
+		return int(a.longTermFrameIdx) - int(b.longTermFrameIdx)
+	})
+	var lists [2][]ref
+	switch h.SliceType {
+	case v4l2.H264SliceTypeP, v4l2.H264SliceTypeSP:
+		slices.SortStableFunc(shortTerm, func(a, b *frameStore) int {
+			return int(b.frameNumWrap(h.FrameNum, maxFrameNum) - a.frameNumWrap(h.FrameNum, maxFrameNum))
+		})
+		lists[0] = p.refList(h, shortTerm, longTerm)
+	case v4l2.H264SliceTypeB:
+		poc := current.poc[0]
+		switch parity(h) {
+		case v4l2.H264FrameRef:
+			poc = min(current.poc[0], current.poc[1])
+		case v4l2.H264BottomFieldRef:
+			poc = current.poc[1]
+		}
+		var before, after []*frameStore
+		for _, f := range shortTerm {
+			if f.picOrderCnt() < poc || (h.FieldPic && f.picOrderCnt() == poc) {
+				before = append(before, f)
+			} else {
+				after = append(after, f)
+			}
+		}
+		slices.SortStableFunc(before, func(a, b *frameStore) int {
+			return int(b.picOrderCnt() - a.picOrderCnt())
+		})
+		slices.SortStableFunc(after, func(a, b *frameStore) int {
+			return int(a.picOrderCnt() - b.picOrderCnt())
+		})
+		lists[0] = p.refList(h, append(slices.Clone(before), after...), longTerm)
+		lists[1] = p.refList(h, append(slices.Clone(after), before...), longTerm)
+		if len(lists[1]) > 1 && slices.Equal(lists[0], lists[1]) {
+			lists[1][0], lists[1][1] = lists[1][1], lists[1][0]
+		}
+	}
+	return lists
+}
+
+// refList returns the reference picture list made of the ordered short-term
+// and long-term frame stores, which for fields alternate in parity as
+// described in 8.2.4.2.5.
+func (p *Parser) refList(h *SliceHeader, shortTerm, longTerm []*frameStore) []ref {
+	var list []ref
+	if !h.FieldPic {
+		for _, f := range shortTerm {
+			list = append(list, ref{f, v4l2.H264FrameRef})
+		}
+		for _, f := range longTerm {
+			list = append(list, ref{f, v4l2.H264FrameRef})
+		}
+		return list
+	}
+	list = alternate(shortTerm, parity(h), func(f *frameStore) v4l2.H264Fields { return f.shortTerm })
+	return append(list, alternate(longTerm, parity(h), func(f *frameStore) v4l2.H264Fields { return f.longTerm })...)
+}
+
+// alternate returns the fields of the frame stores, starting with the same
+// parity as the current field and alternating while both parities last.
+func alternate(stores []*frameStore, same v4l2.H264Fields, marked func(*frameStore) v4l2.H264Fields) []ref {
+	var list []ref
+	parities := [2]v4l2.H264Fields{same, v4l2.H264FrameRef &^ same}
+	next := [2]int{}
+	for turn := 0; ; turn = 1 - turn {
+		i := next[turn]
+		for i < len(stores) && marked(stores[i])&parities[turn] == 0 {
+			i++
+		}
+		if i == len(stores) {
+			other := 1 - turn
+			for _, f := range stores[next[other]:] {
+				if marked(f)&parities[other] != 0 {
+					list = append(list, ref{f, parities[other]})
+				}
+			}
+			return list
+		}
+		list = append(list, ref{stores[i], parities[turn]})
+		next[turn] = i + 1
+	}
+}
+
+// modifyRefList runs the modification process for reference picture lists of
+// 8.2.4.3 on a list truncated to count entries.
+func (p *Parser) modifyRefList(list []ref, count int, modifications []RefPicListModification, h *SliceHeader, sps *SPS) ([]ref, error) {
+	list = append(slices.Clone(list), make([]ref, count-len(list))...)
+	maxPicNum := int32(sps.MaxFrameNum())
+	if h.FieldPic {
+		maxPicNum *= 2
+	}
+	pred := currPicNum(h)
+	for refIdx, modification := range modifications {
+		if refIdx >= count {
+			return nil, ErrInvalidValue
+		}
+		var target ref
+		switch modification.IDC {
+		case 0, 1:
+			diff := int32(modification.Value) + 1
+			if diff > maxPicNum {
+				return nil, ErrInvalidValue
+			}
+			if modification.IDC == 0 {
+				pred -= diff
+				if pred < 0 {
+					pred += maxPicNum
+				}
+			} else {
+				pred += diff
+				if pred >= maxPicNum {
+					pred -= maxPicNum
+				}
+			}
+			num := pred
+			if num > currPicNum(h) {
+				num -= maxPicNum
+			}
+			target.store, target.fields = p.findShortTerm(num, h, sps.MaxFrameNum())
+		case 2:
+			target.store, target.fields = p.findLongTerm(int32(modification.Value), h)
+		}
+		if target.store == nil || target.store.nonExisting {
+			return nil, ErrInvalidValue
+		}
+		modified := append(slices.Clone(list[:refIdx]), target)
+		for _, entry := range list[refIdx:] {
+			if entry != target {
+				modified = append(modified, entry)
+			}
+		}
+		list = modified[:count]
+	}
+	return list, nil
+}
+
+// Bitstream returns the slices of the picture, each preceded by a start code,
+// as queued with H264StartCodeAnnexB.
+func (p *Picture) Bitstream() []byte {
+	var stream []byte
+	for _, slice := range p.Slices {
+		stream = AppendAnnexB(stream, slice.Data)
+	}
+	return stream
+}
+
+// Controls returns the picture level controls: the SPS, PPS, scaling matrix
+// and decode parameters. Those are all the controls needed in
+// H264DecodeModeFrameBased.
+func (p *Picture) Controls() ([]*v4l2.ExtControlValue, error) {
+	values := []struct {
+		id    v4l2.CtrlID
+		value any
+	}{
+		{v4l2.CidStatelessH264SPS, &p.SPS},
+		{v4l2.CidStatelessH264PPS, &p.PPS},
+		{v4l2.CidStatelessH264ScalingMatrix, &p.ScalingMatrix},
+		{v4l2.CidStatelessH264DecodeParams, &p.DecodeParams},
+	}
+	controls := make([]*v4l2.ExtControlValue, len(values))
+	for i, value := range values {
+		control, err := v4l2.CompoundControl(value.id, value.value)
+		if err != nil {
+			return nil, err
+		}
+		controls[i] = control
+	}
+	return controls, nil
+}
+
+// Controls returns the slice level controls needed in
+// H264DecodeModeSliceBased: the slice parameters and, when the slice uses
+// explicit weighted prediction, the prediction weights.
+func (s *Slice) Controls() ([]*v4l2.ExtControlValue, error) {
+	params, err := v4l2.CompoundControl(v4l2.CidStatelessH264SliceParams, &s.Params)
+	if err != nil {
+		return nil, err
+	}
+	controls := []*v4l2.ExtControlValue{params}
+	if s.Header.PredWeightTable != nil {
+		weights, err := v4l2.CompoundControl(v4l2.CidStatelessH264PredWeights, &s.PredWeights)
+		if err != nil {
+			return nil, err
+		}
+		controls = append(controls, weights)
+	}
+	return controls, nil
+}
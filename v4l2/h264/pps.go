@@ -0,0 +1,194 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package h264
+
+import "github.com/peterhagelund/go-v4l2/v4l2"
+
+// PPS is a picture parameter set. The slice group map of flexible macroblock
+// ordering is skipped, as v4l2 has no way to pass it on.
+type PPS struct {
+	ID                                uint8
+	SPSID                             uint8
+	EntropyCodingMode                 bool
+	BottomFieldPicOrderInFramePresent bool
+	NumSliceGroupsMinus1              uint8
+	SliceGroupMapType                 uint8
+	SliceGroupChangeRateMinus1        uint32
+	NumRefIdxL0DefaultActiveMinus1    uint8
+	NumRefIdxL1DefaultActiveMinus1    uint8
+	WeightedPred                      bool
+	WeightedBipredIDC                 uint8
+	PicInitQPMinus26                  int8
+	PicInitQSMinus26                  int8
+	ChromaQPIndexOffset               int8
+	DeblockingFilterControlPresent    bool
+	ConstrainedIntraPred              bool
+	RedundantPicCntPresent            bool
+	Transform8x8Mode                  bool
+	ScalingLists                      *ScalingLists // Nil unless pic_scaling_matrix_present_flag is set.
+	SecondChromaQPIndexOffset         int8
+}
+
+// ParameterSets holds the parameter sets of a stream by id.
+type ParameterSets struct {
+	SPS [32]*SPS
+	PPS [256]*PPS
+}
+
+// ParseSPS parses a sequence parameter set NAL unit and stores it.
+func (p *ParameterSets) ParseSPS(nal []byte) (*SPS, error) {
+	sps, err := ParseSPS(nal)
+	if err != nil {
+		return nil, err
+	}
+	p.SPS[sps.ID] = sps
+	return sps, nil
+}
+
+// ParsePPS parses a picture parameter set NAL unit, which must refer to a
+// stored SPS, and stores it.
+func (p *ParameterSets) ParsePPS(nal []byte) (*PPS, error) {
+	unit, err := ParseNALUnit(nal)
+	if err != nil {
+		return nil, err
+	}
+	if unit.Type != NALTypePPS {
+		return nil, ErrInvalidValue
+	}
+	r := newBitReader(unescape(nal)[1:], 0)
+	pps := &PPS{}
+	pps.ID = uint8(r.ueMax(255))
+	pps.SPSID = uint8(r.ueMax(31))
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	sps := p.SPS[pps.SPSID]
+	if sps == nil {
+		return nil, ErrMissingParameterSet
+	}
+	pps.EntropyCodingMode = r.Flag()
+	pps.BottomFieldPicOrderInFramePresent = r.Flag()
+	pps.NumSliceGroupsMinus1 = uint8(r.ueMax(7))
+	if pps.NumSliceGroupsMinus1 > 0 {
+		skipSliceGroupMap(r, pps, sps)
+	}
+	pps.NumRefIdxL0DefaultActiveMinus1 = uint8(r.ueMax(31))
+	pps.NumRefIdxL1DefaultActiveMinus1 = uint8(r.ueMax(31))
+	pps.WeightedPred = r.Flag()
+	pps.WeightedBipredIDC = uint8(r.U(2))
+	pps.PicInitQPMinus26 = int8(r.seRange(-26-6*int32(sps.BitDepthLumaMinus8), 25))
+	pps.PicInitQSMinus26 = int8(r.seRange(-26, 25))
+	pps.ChromaQPIndexOffset = int8(r.seRange(-12, 12))
+	pps.DeblockingFilterControlPresent = r.Flag()
+	pps.ConstrainedIntraPred = r.Flag()
+	pps.RedundantPicCntPresent = r.Flag()
+	pps.SecondChromaQPIndexOffset = pps.ChromaQPIndexOffset
+	if r.moreRBSPData() {
+		pps.Transform8x8Mode = r.Flag()
+		if r.Flag() {
+			count := 6
+			if pps.Transform8x8Mode {
+				count += 2
+				if sps.ChromaFormatIDC == 3 {
+					count += 4
+				}
+			}
+			pps.ScalingLists = parseScalingLists(r, count)
+		}
+		pps.SecondChromaQPIndexOffset = int8(r.seRange(-12, 12))
+	}
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	p.PPS[pps.ID] = pps
+	return pps, nil
+}
+
+// skipSliceGroupMap reads the slice group map of a PPS, keeping only what is
+// needed to parse slice headers.
+func skipSliceGroupMap(r *bitReader, pps *PPS, sps *SPS) {
+	pps.SliceGroupMapType = uint8(r.ueMax(6))
+	switch pps.SliceGroupMapType {
+	case 0:
+		for i := 0; i <= int(pps.NumSliceGroupsMinus1); i++ {
+			r.ue()
+		}
+	case 2:
+		for i := 0; i < int(pps.NumSliceGroupsMinus1); i++ {
+			r.ue()
+			r.ue()
+		}
+	case 3, 4, 5:
+		r.Flag()
+		pps.SliceGroupChangeRateMinus1 = r.ueMax(sps.PicSizeInMapUnits() - 1)
+	case 6:
+		size := r.ueMax(sps.PicSizeInMapUnits() - 1)
+		bits := ceilLog2(uint32(pps.NumSliceGroupsMinus1) + 1)
+		for i := uint32(0); i <= size && r.Err == nil; i++ {
+			r.U(bits)
+		}
+	}
+}
+
+// ceilLog2 returns Ceil(Log2(value)).
+func ceilLog2(value uint32) int {
+	bits := 0
+	for uint64(1)<<bits < uint64(value) {
+		bits++
+	}
+	return bits
+}
+
+// Control returns the PPS as a CtrlH264PPS. The scaling matrix flag is set
+// when either the PPS or sps, the SPS it refers to, has a scaling matrix.
+func (p *PPS) Control(sps *SPS) v4l2.CtrlH264PPS {
+	control := v4l2.CtrlH264PPS{
+		PicParameterSetID:              p.ID,
+		SeqParameterSetID:              p.SPSID,
+		NumSliceGroupsMinus1:           p.NumSliceGroupsMinus1,
+		NumRefIdxL0DefaultActiveMinus1: p.NumRefIdxL0DefaultActiveMinus1,
+		NumRefIdxL1DefaultActiveMinus1: p.NumRefIdxL1DefaultActiveMinus1,
+		WeightedBipredIDC:              p.WeightedBipredIDC,
+		PicInitQPMinus26:               p.PicInitQPMinus26,
+		PicInitQSMinus26:               p.PicInitQSMinus26,
+		ChromaQPIndexOffset:            p.ChromaQPIndexOffset,
+		SecondChromaQPIndexOffset:      p.SecondChromaQPIndexOffset,
+	}
+	flags := []struct {
+		set  bool
+		flag v4l2.H264PPSFlag
+	}{
+		{p.EntropyCodingMode, v4l2.H264PPSFlagEntropyCodingMode},
+		{p.BottomFieldPicOrderInFramePresent, v4l2.H264PPSFlagBottomFieldPicOrderInFramePresent},
+		{p.WeightedPred, v4l2.H264PPSFlagWeightedPred},
+		{p.DeblockingFilterControlPresent, v4l2.H264PPSFlagDeblockingFilterControlPresent},
+		{p.ConstrainedIntraPred, v4l2.H264PPSFlagConstrainedIntraPred},
+		{p.RedundantPicCntPresent, v4l2.H264PPSFlagRedundantPicCntPresent},
+		{p.Transform8x8Mode, v4l2.H264PPSFlagTransform8x8Mode},
+		{p.ScalingLists != nil || sps.ScalingLists != nil, v4l2.H264PPSFlagScalingMatrixPresent},
+	}
+	for _, f := range flags {
+		if f.set {
+			control.Flags |= f.flag
+		}
+	}
+	return control
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package h264
+
+import "github.com/peterhagelund/go-v4l2/v4l2"
+
+// The default scaling lists of tables 7-3 and 7-4, in zig-zag order.
+var (
+	default4x4Intra = []uint8{6, 13, 13, 20, 20, 20, 28, 28, 28, 28, 32, 32, 32, 37, 37, 42}
+	default4x4Inter = []uint8{10, 14, 14, 20, 20, 20, 24, 24, 24, 24, 27, 27, 27, 30, 30, 34}
+	default8x8Intra = []uint8{
+		6, 10, 10, 13, 11, 13, 16, 16, 16, 16, 18, 18, 18, 18, 18, 23,
+		23, 23, 23, 23, 23, 25, 25, 25, 25, 25, 25, 25, 27, 27, 27, 27,
+		27, 27, 27, 27, 29, 29, 29, 29, 29, 29, 29, 31, 31, 31, 31, 31,
+		31, 33, 33, 33, 33, 33, 36, 36, 36, 36, 38, 38, 38, 40, 40, 42,
+	}
+	default8x8Inter = []uint8{
+		9, 13, 13, 15, 13, 15, 17, 17, 17, 17, 19, 19, 19, 19, 19, 21,
+		21, 21, 21, 21, 21, 22, 22, 22, 22, 22, 22, 22, 24, 24, 24, 24,
+		24, 24, 24, 24, 25, 25, 25, 25, 25, 25, 25, 27, 27, 27, 27, 27,
+		27, 28, 28, 28, 28, 28, 30, 30, 30, 30, 32, 32, 32, 33, 33, 35,
+	}
+)
+
+// The raster scan positions of the zig-zag scanned coefficients.
+var (
+	zigzag4x4 = [16]int{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+	zigzag8x8 = [64]int{
+		0, 1, 8, 16, 9, 2, 3, 10, 17, 24, 32, 25, 18, 11, 4, 5,
+		12, 19, 26, 33, 40, 48, 41, 34, 27, 20, 13, 6, 7, 14, 21, 28,
+		35, 42, 49, 56, 57, 50, 43, 36, 29, 22, 15, 23, 30, 37, 44, 51,
+		58, 59, 52, 45, 38, 31, 39, 46, 53, 60, 61, 54, 47, 55, 62, 63,
+	}
+)
+
+// ScalingLists are the scaling lists of a parameter set in zig-zag order. A
+// nil list was not present and falls back to a default or previous list.
+type ScalingLists struct {
+	List4x4 [6][]uint8
+	List8x8 [6][]uint8
+}
+
+// parseScalingLists parses count scaling lists as coded in an SPS or PPS.
+func parseScalingLists(r *bitReader, count int) *ScalingLists {
+	lists := &ScalingLists{}
+	for i := 0; i < count; i++ {
+		if !r.Flag() {
+			continue
+		}
+		if i < 6 {
+			lists.List4x4[i] = parseScalingList(r, 16, i)
+		} else {
+			lists.List8x8[i-6] = parseScalingList(r, 64, i)
+		}
+	}
+	return lists
+}
+
+// parseScalingList parses scaling_list(), returning the default list when
+// the coded list says to use it.
+func parseScalingList(r *bitReader, size, index int) []uint8 {
+	list := make([]uint8, size)
+	last, next := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			delta := r.seRange(-128, 127)
+			next = (last + delta + 256) % 256
+			if j == 0 && next == 0 {
+				return defaultScalingList(index)
+			}
+		}
+		if next != 0 {
+			last = next
+		}
+		list[j] = uint8(last)
+	}
+	return list
+}
+
+// defaultScalingList returns the default list of scaling list index.
+func defaultScalingList(index int) []uint8 {
+	switch {
+	case index < 3:
+		return default4x4Intra
+	case index < 6:
+		return default4x4Inter
+	case index%2 == 0:
+		return default8x8Intra
+	default:
+		return default8x8Inter
+	}
+}
+
+// resolve fills in the lists that are not present using fall-back rule A or,
+// when fallback is not nil, fall-back rule B with fallback as the sequence
+// level lists.
+func (l *ScalingLists) resolve(fallback *ScalingLists) *ScalingLists {
+	resolved := &ScalingLists{}
+	for i := 0; i < 12; i++ {
+		list := l.list(i)
+		if list == nil {
+			switch {
+			case i == 0 || i == 3 || i == 6 || i == 7:
+				if fallback != nil {
+					list = fallback.list(i)
+				} else {
+					list = defaultScalingList(i)
+				}
+			case i < 6:
+				list = resolved.list(i - 1)
+			default:
+				list = resolved.list(i - 2)
+			}
+		}
+		if i < 6 {
+			resolved.List4x4[i] = list
+		} else {
+			resolved.List8x8[i-6] = list
+		}
+	}
+	return resolved
+}
+
+// list returns scaling list index, counting the 4x4 lists first.
+func (l *ScalingLists) list(index int) []uint8 {
+	if index < 6 {
+		return l.List4x4[index]
+	}
+	return l.List8x8[index-6]
+}
+
+// ScalingMatrix returns the scaling matrix in effect for pictures using the
+// parameter sets, in the raster scan order of CtrlH264ScalingMatrix.
+func ScalingMatrix(sps *SPS, pps *PPS) v4l2.CtrlH264ScalingMatrix {
+	var lists *ScalingLists
+	if sps.ScalingLists != nil {
+		lists = sps.ScalingLists.resolve(nil)
+	}
+	if pps.ScalingLists != nil {
+		lists = pps.ScalingLists.resolve(lists)
+	}
+	matrix := v4l2.CtrlH264ScalingMatrix{}
+	for i := range matrix.ScalingList4x4 {
+		for j, pos := range zigzag4x4 {
+			matrix.ScalingList4x4[i][pos] = 16
+			if lists != nil {
+				matrix.ScalingList4x4[i][pos] = lists.List4x4[i][j]
+			}
+		}
+	}
+	for i := range matrix.ScalingList8x8 {
+		for j, pos := range zigzag8x8 {
+			matrix.ScalingList8x8[i][pos] = 16
+			if lists != nil {
+				matrix.ScalingList8x8[i][pos] = lists.List8x8[i][j]
+			}
+		}
+	}
+	return matrix
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package h264
+
+import "github.com/peterhagelund/go-v4l2/v4l2"
+
+// SliceHeader is a slice header.
+type SliceHeader struct {
+	NALRefIDC                  uint8
+	IDR                        bool
+	FirstMBInSlice             uint32
+	SliceType                  v4l2.H264SliceType // slice_type modulo 5.
+	PPSID                      uint8
+	ColourPlaneID              uint8
+	FrameNum                   uint16
+	FieldPic                   bool
+	BottomField                bool
+	IDRPicID                   uint16
+	PicOrderCntLSB             uint16
+	DeltaPicOrderCntBottom     int32
+	DeltaPicOrderCnt           [2]int32
+	RedundantPicCnt            uint8
+	DirectSpatialMVPred        bool
+	NumRefIdxL0ActiveMinus1    uint8
+	NumRefIdxL1ActiveMinus1    uint8
+	RefPicListModifications    [2][]RefPicListModification
+	PredWeightTable            *v4l2.H264PredWeightTable // Nil unless explicit weighted prediction is used.
+	NoOutputOfPriorPics        bool
+	LongTermReference          bool
+	AdaptiveRefPicMarking      bool
+	MMCOs                      []MMCO
+	CABACInitIDC               uint8
+	SliceQPDelta               int8
+	SPForSwitch                bool
+	SliceQSDelta               int8
+	DisableDeblockingFilterIDC uint8
+	SliceAlphaC0OffsetDiv2     int8
+	SliceBetaOffsetDiv2        int8
+	SliceGroupChangeCycle      uint32
+	HeaderBitSize              uint32 // Bits from the start of the NAL unit to slice_data(), emulation prevention bytes excluded.
+	DecRefPicMarkingBitSize    uint32
+	PicOrderCntBitSize         uint32
+}
+
+// RefPicListModification is a reference picture list modification.
+type RefPicListModification struct {
+	IDC   uint8  // modification_of_pic_nums_idc.
+	Value uint32 // abs_diff_pic_num_minus1 or long_term_pic_num.
+}
+
+// MMCO is a memory management control operation.
+type MMCO struct {
+	Op                        uint8
+	DifferenceOfPicNumsMinus1 uint32
+	LongTermPicNum            uint32
+	LongTermFrameIdx          uint32
+	MaxLongTermFrameIdxPlus1  uint32
+}
+
+// IsInter reports whether the slice uses inter prediction.
+func (h *SliceHeader) IsInter() bool {
+	return h.SliceType != v4l2.H264SliceTypeI && h.SliceType != v4l2.H264SliceTypeSI
+}
+
+// NumRefIdxActive returns the number of active entries of reference list
+// index.
+func (h *SliceHeader) NumRefIdxActive(index int) int {
+	switch {
+	case index == 0 && h.IsInter():
+		return int(h.NumRefIdxL0ActiveMinus1) + 1
+	case index == 1 && h.SliceType == v4l2.H264SliceTypeB:
+		return int(h.NumRefIdxL1ActiveMinus1) + 1
+	}
+	return 0
+}
+
+// hasMMCO5 reports whether the slice resets the reference pictures with
+// memory_management_control_operation 5.
+func (h *SliceHeader) hasMMCO5() bool {
+	for _, mmco := range h.MMCOs {
+		if mmco.Op == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSliceHeader parses the header of a coded slice NAL unit, which must
+// refer to stored parameter sets.
+func (p *ParameterSets) ParseSliceHeader(nal []byte) (*SliceHeader, error) {
+	unit, err := ParseNALUnit(nal)
+	if err != nil {
+		return nil, err
+	}
+	if !unit.IsSlice() {
+		return nil, ErrUnsupported
+	}
+	r := newBitReader(unescape(nal), 8)
+	h := &SliceHeader{NALRefIDC: unit.RefIDC, IDR: unit.Type == NALTypeIDRSlice}
+	h.FirstMBInSlice = r.ue()
+	h.SliceType = v4l2.H264SliceType(r.ueMax(9) % 5)
+	h.PPSID = uint8(r.ueMax(255))
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	pps := p.PPS[h.PPSID]
+	if pps == nil || p.SPS[pps.SPSID] == nil {
+		return nil, ErrMissingParameterSet
+	}
+	sps := p.SPS[pps.SPSID]
+	if h.IDR && h.SliceType != v4l2.H264SliceTypeI && h.SliceType != v4l2.H264SliceTypeSI {
+		return nil, ErrInvalidValue
+	}
+	if sps.SeparateColourPlane {
+		h.ColourPlaneID = uint8(r.U(2))
+	}
+	h.FrameNum = uint16(r.U(int(sps.Log2MaxFrameNumMinus4) + 4))
+	if !sps.FrameMBSOnly {
+		h.FieldPic = r.Flag()
+		if h.FieldPic {
+			h.BottomField = r.Flag()
+		}
+	}
+	if h.IDR {
+		h.IDRPicID = uint16(r.ueMax(0xffff))
+	}
+	start := r.Pos
+	if sps.PicOrderCntType == 0 {
+		h.PicOrderCntLSB = uint16(r.U(int(sps.Log2MaxPicOrderCntLSBMinus4) + 4))
+		if pps.BottomFieldPicOrderInFramePresent && !h.FieldPic {
+			h.DeltaPicOrderCntBottom = r.se()
+		}
+	}
+	if sps.PicOrderCntType == 1 && !sps.DeltaPicOrderAlwaysZero {
+		h.DeltaPicOrderCnt[0] = r.se()
+		if pps.BottomFieldPicOrderInFramePresent && !h.FieldPic {
+			h.DeltaPicOrderCnt[1] = r.se()
+		}
+	}
+	h.PicOrderCntBitSize = uint32(r.Pos - start)
+	if pps.RedundantPicCntPresent {
+		h.RedundantPicCnt = uint8(r.ueMax(127))
+	}
+	if h.SliceType == v4l2.H264SliceTypeB {
+		h.DirectSpatialMVPred = r.Flag()
+	}
+	if h.IsInter() {
+		h.NumRefIdxL0ActiveMinus1 = pps.NumRefIdxL0DefaultActiveMinus1
+		if h.SliceType == v4l2.H264SliceTypeB {
+			h.NumRefIdxL1ActiveMinus1 = pps.NumRefIdxL1DefaultActiveMinus1
+		}
+		if r.Flag() {
+			h.NumRefIdxL0ActiveMinus1 = uint8(r.ueMax(31))
+			if h.SliceType == v4l2.H264SliceTypeB {
+				h.NumRefIdxL1ActiveMinus1 = uint8(r.ueMax(31))
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if h.NumRefIdxActive(i) > 0 && r.Flag() {
+			h.RefPicListModifications[i] = parseRefPicListModification(r)
+		}
+	}
+	if (pps.WeightedPred && (h.SliceType == v4l2.H264SliceTypeP || h.SliceType == v4l2.H264SliceTypeSP)) ||
+		(pps.WeightedBipredIDC == 1 && h.SliceType == v4l2.H264SliceTypeB) {
+		h.PredWeightTable = parsePredWeightTable(r, h, sps)
+	}
+	if h.NALRefIDC != 0 {
+		start = r.Pos
+		parseDecRefPicMarking(r, h)
+		h.DecRefPicMarkingBitSize = uint32(r.Pos - start)
+	}
+	if pps.EntropyCodingMode && h.IsInter() {
+		h.CABACInitIDC = uint8(r.ueMax(2))
+	}
+	h.SliceQPDelta = int8(r.seRange(-87, 77))
+	if h.SliceType == v4l2.H264SliceTypeSP || h.SliceType == v4l2.H264SliceTypeSI {
+		if h.SliceType == v4l2.H264SliceTypeSP {
+			h.SPForSwitch = r.Flag()
+		}
+		h.SliceQSDelta = int8(r.seRange(-51, 51))
+	}
+	if pps.DeblockingFilterControlPresent {
+		h.DisableDeblockingFilterIDC = uint8(r.ueMax(2))
+		if h.DisableDeblockingFilterIDC != 1 {
+			h.SliceAlphaC0OffsetDiv2 = int8(r.seRange(-6, 6))
+			h.SliceBetaOffsetDiv2 = int8(r.seRange(-6, 6))
+		}
+	}
+	if pps.NumSliceGroupsMinus1 > 0 && pps.SliceGroupMapType >= 3 && pps.SliceGroupMapType <= 5 {
+		rate := pps.SliceGroupChangeRateMinus1 + 1
+		h.SliceGroupChangeCycle = r.U(ceilLog2(sps.PicSizeInMapUnits()/rate + 1))
+	}
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	h.HeaderBitSize = uint32(r.Pos)
+	return h, nil
+}
+
+// parseRefPicListModification parses the modifications of one reference
+// picture list.
+func parseRefPicListModification(r *bitReader) []RefPicListModification {
+	var modifications []RefPicListModification
+	for r.Err == nil {
+		idc := uint8(r.ueMax(3))
+		if idc == 3 {
+			break
+		}
+		if len(modifications) > v4l2.H264RefListLen {
+			r.Fail(ErrInvalidValue)
+			break
+		}
+		modifications = append(modifications, RefPicListModification{IDC: idc, Value: r.ue()})
+	}
+	return modifications
+}
+
+// parsePredWeightTable parses pred_weight_table(), filling in the default
+// factors of the entries without explicit ones.
+func parsePredWeightTable(r *bitReader, h *SliceHeader, sps *SPS) *v4l2.H264PredWeightTable {
+	table := &v4l2.H264PredWeightTable{}
+	table.LumaLog2WeightDenom = uint16(r.ueMax(7))
+	chroma := sps.ChromaArrayType() != 0
+	if chroma {
+		table.ChromaLog2WeightDenom = uint16(r.ueMax(7))
+	}
+	for list := 0; list < 2; list++ {
+		factors := &table.Weightfactors[list]
+		for i := 0; i < h.NumRefIdxActive(list); i++ {
+			factors.LumaWeight[i] = 1 << table.LumaLog2WeightDenom
+			if r.Flag() {
+				factors.LumaWeight[i] = int16(r.seRange(-128, 127))
+				factors.LumaOffset[i] = int16(r.seRange(-128, 127))
+			}
+			if !chroma {
+				continue
+			}
+			factors.ChromaWeight[i] = [2]int16{1 << table.ChromaLog2WeightDenom, 1 << table.ChromaLog2WeightDenom}
+			if r.Flag() {
+				for j := 0; j < 2; j++ {
+					factors.ChromaWeight[i][j] = int16(r.seRange(-128, 127))
+					factors.ChromaOffset[i][j] = int16(r.seRange(-128, 127))
+				}
+			}
+		}
+	}
+	return table
+}
+
+// parseDecRefPicMarking parses dec_ref_pic_marking().
+func parseDecRefPicMarking(r *bitReader, h *SliceHeader) {
+	if h.IDR {
+		h.NoOutputOfPriorPics = r.Flag()
+		h.LongTermReference = r.Flag()
+		return
+	}
+	h.AdaptiveRefPicMarking = r.Flag()
+	if !h.AdaptiveRefPicMarking {
+		return
+	}
+	for r.Err == nil {
+		mmco := MMCO{Op: uint8(r.ueMax(6))}
+		if mmco.Op == 0 {
+			break
+		}
+		if mmco.Op == 1 || mmco.Op == 3 {
+			mmco.DifferenceOfPicNumsMinus1 = r.ue()
+		}
+		if mmco.Op == 2 {
+			mmco.LongTermPicNum = r.ue()
+		}
+		if mmco.Op == 3 || mmco.Op == 6 {
+			mmco.LongTermFrameIdx = r.ueMax(v4l2.H264NumDPBEntries - 1)
+		}
+		if mmco.Op == 4 {
+			mmco.MaxLongTermFrameIdxPlus1 = r.ueMax(v4l2.H264NumDPBEntries)
+		}
+		if len(h.MMCOs) >= 66 {
+			r.Fail(ErrInvalidValue)
+			break
+		}
+		h.MMCOs = append(h.MMCOs, mmco)
+	}
+}
+
+// sliceParams returns the slice as a CtrlH264SliceParams without reference
+// picture lists.
+func (h *SliceHeader) sliceParams() v4l2.CtrlH264SliceParams {
+	params := v4l2.CtrlH264SliceParams{
+		HeaderBitSize:              h.HeaderBitSize,
+		FirstMBInSlice:             h.FirstMBInSlice,
+		SliceType:                  h.SliceType,
+		ColourPlaneID:              h.ColourPlaneID,
+		RedundantPicCnt:            h.RedundantPicCnt,
+		CABACInitIDC:               h.CABACInitIDC,
+		SliceQPDelta:               h.SliceQPDelta,
+		SliceQSDelta:               h.SliceQSDelta,
+		DisableDeblockingFilterIDC: h.DisableDeblockingFilterIDC,
+		SliceAlphaC0OffsetDiv2:     h.SliceAlphaC0OffsetDiv2,
+		SliceBetaOffsetDiv2:        h.SliceBetaOffsetDiv2,
+		NumRefIdxL0ActiveMinus1:    h.NumRefIdxL0ActiveMinus1,
+		NumRefIdxL1ActiveMinus1:    h.NumRefIdxL1ActiveMinus1,
+	}
+	if h.DirectSpatialMVPred {
+		params.Flags |= v4l2.H264SliceFlagDirectSpatialMVPred
+	}
+	if h.SPForSwitch {
+		params.Flags |= v4l2.H264SliceFlagSPForSwitch
+	}
+	return params
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package h264
+
+import "github.com/peterhagelund/go-v4l2/v4l2"
+
+// SPS is a sequence parameter set.
+type SPS struct {
+	ProfileIDC                  uint8
+	ConstraintSetFlags          v4l2.H264SPSConstraint
+	LevelIDC                    uint8
+	ID                          uint8
+	ChromaFormatIDC             uint8
+	SeparateColourPlane         bool
+	BitDepthLumaMinus8          uint8
+	BitDepthChromaMinus8        uint8
+	QPPrimeYZeroTransformBypass bool
+	ScalingLists                *ScalingLists // Nil unless seq_scaling_matrix_present_flag is set.
+	Log2MaxFrameNumMinus4       uint8
+	PicOrderCntType             uint8
+	Log2MaxPicOrderCntLSBMinus4 uint8
+	DeltaPicOrderAlwaysZero     bool
+	OffsetForNonRefPic          int32
+	OffsetForTopToBottomField   int32
+	OffsetForRefFrame           []int32
+	MaxNumRefFrames             uint8
+	GapsInFrameNumValueAllowed  bool
+	PicWidthInMBSMinus1         uint16
+	PicHeightInMapUnitsMinus1   uint16
+	FrameMBSOnly                bool
+	MBAdaptiveFrameField        bool
+	Direct8x8Inference          bool
+	FrameCropLeftOffset         uint32
+	FrameCropRightOffset        uint32
+	FrameCropTopOffset          uint32
+	FrameCropBottomOffset       uint32
+	VUIParametersPresent        bool
+}
+
+// highProfile reports whether SPSs of profile carry the chroma format, bit
+// depth and scaling matrix.
+func highProfile(profile uint8) bool {
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		return true
+	}
+	return false
+}
+
+// ParseSPS parses a sequence parameter set NAL unit. The VUI parameters are
+// not parsed.
+func ParseSPS(nal []byte) (*SPS, error) {
+	unit, err := ParseNALUnit(nal)
+	if err != nil {
+		return nil, err
+	}
+	if unit.Type != NALTypeSPS {
+		return nil, ErrInvalidValue
+	}
+	r := newBitReader(unescape(nal)[1:], 0)
+	sps := &SPS{}
+	sps.ProfileIDC = uint8(r.U(8))
+	sps.ConstraintSetFlags = v4l2.H264SPSConstraint(reverse6(r.U(8) >> 2))
+	sps.LevelIDC = uint8(r.U(8))
+	sps.ID = uint8(r.ueMax(31))
+	sps.ChromaFormatIDC = 1
+	if highProfile(sps.ProfileIDC) {
+		sps.ChromaFormatIDC = uint8(r.ueMax(3))
+		if sps.ChromaFormatIDC == 3 {
+			sps.SeparateColourPlane = r.Flag()
+		}
+		sps.BitDepthLumaMinus8 = uint8(r.ueMax(6))
+		sps.BitDepthChromaMinus8 = uint8(r.ueMax(6))
+		sps.QPPrimeYZeroTransformBypass = r.Flag()
+		if r.Flag() {
+			count := 8
+			if sps.ChromaFormatIDC == 3 {
+				count = 12
+			}
+			sps.ScalingLists = parseScalingLists(r, count)
+		}
+	}
+	sps.Log2MaxFrameNumMinus4 = uint8(r.ueMax(12))
+	sps.PicOrderCntType = uint8(r.ueMax(2))
+	switch sps.PicOrderCntType {
+	case 0:
+		sps.Log2MaxPicOrderCntLSBMinus4 = uint8(r.ueMax(12))
+	case 1:
+		sps.DeltaPicOrderAlwaysZero = r.Flag()
+		sps.OffsetForNonRefPic = r.se()
+		sps.OffsetForTopToBottomField = r.se()
+		count := r.ueMax(254)
+		sps.OffsetForRefFrame = make([]int32, count)
+		for i := range sps.OffsetForRefFrame {
+			sps.OffsetForRefFrame[i] = r.se()
+		}
+	}
+	sps.MaxNumRefFrames = uint8(r.ueMax(v4l2.H264NumDPBEntries))
+	sps.GapsInFrameNumValueAllowed = r.Flag()
+	sps.PicWidthInMBSMinus1 = uint16(r.ueMax(0xffff))
+	sps.PicHeightInMapUnitsMinus1 = uint16(r.ueMax(0xffff))
+	sps.FrameMBSOnly = r.Flag()
+	if !sps.FrameMBSOnly {
+		sps.MBAdaptiveFrameField = r.Flag()
+	}
+	sps.Direct8x8Inference = r.Flag()
+	if r.Flag() {
+		sps.FrameCropLeftOffset = r.ue()
+		sps.FrameCropRightOffset = r.ue()
+		sps.FrameCropTopOffset = r.ue()
+		sps.FrameCropBottomOffset = r.ue()
+	}
+	sps.VUIParametersPresent = r.Flag()
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	if sps.Width() == 0 || sps.Height() == 0 {
+		return nil, ErrInvalidValue
+	}
+	return sps, nil
+}
+
+// reverse6 maps constraint_set0_flag..constraint_set5_flag, coded most
+// significant bit first, to H264SPSConstraintSet0..H264SPSConstraintSet5.
+func reverse6(bits uint32) uint8 {
+	var flags uint8
+	for i := 0; i < 6; i++ {
+		if bits&(1<<(5-i)) != 0 {
+			flags |= 1 << i
+		}
+	}
+	return flags
+}
+
+// ChromaArrayType returns ChromaArrayType, which is 0 for monochrome and
+// separately coded colour planes.
+func (s *SPS) ChromaArrayType() uint8 {
+	if s.SeparateColourPlane {
+		return 0
+	}
+	return s.ChromaFormatIDC
+}
+
+// MaxFrameNum returns MaxFrameNum.
+func (s *SPS) MaxFrameNum() uint32 {
+	return 1 << (s.Log2MaxFrameNumMinus4 + 4)
+}
+
+// MaxPicOrderCntLSB returns MaxPicOrderCntLsb.
+func (s *SPS) MaxPicOrderCntLSB() uint32 {
+	return 1 << (s.Log2MaxPicOrderCntLSBMinus4 + 4)
+}
+
+// PicSizeInMapUnits returns PicSizeInMapUnits.
+func (s *SPS) PicSizeInMapUnits() uint32 {
+	return (uint32(s.PicWidthInMBSMinus1) + 1) * (uint32(s.PicHeightInMapUnitsMinus1) + 1)
+}
+
+// CodedWidth returns the width in luma samples of the decoded frames.
+func (s *SPS) CodedWidth() uint32 {
+	return (uint32(s.PicWidthInMBSMinus1) + 1) * 16
+}
+
+// CodedHeight returns the height in luma samples of the decoded frames.
+func (s *SPS) CodedHeight() uint32 {
+	height := (uint32(s.PicHeightInMapUnitsMinus1) + 1) * 16
+	if !s.FrameMBSOnly {
+		height *= 2
+	}
+	return height
+}
+
+// cropUnits returns CropUnitX and CropUnitY.
+func (s *SPS) cropUnits() (uint32, uint32) {
+	x, y := uint32(1), uint32(1)
+	switch s.ChromaArrayType() {
+	case 1:
+		x, y = 2, 2
+	case 2:
+		x = 2
+	}
+	if !s.FrameMBSOnly {
+		y *= 2
+	}
+	return x, y
+}
+
+// Width returns the width in luma samples of the frame cropping rectangle.
+func (s *SPS) Width() uint32 {
+	x, _ := s.cropUnits()
+	crop := x * (s.FrameCropLeftOffset + s.FrameCropRightOffset)
+	if crop >= s.CodedWidth() {
+		return 0
+	}
+	return s.CodedWidth() - crop
+}
+
+// Height returns the height in luma samples of the frame cropping rectangle.
+func (s *SPS) Height() uint32 {
+	_, y := s.cropUnits()
+	crop := y * (s.FrameCropTopOffset + s.FrameCropBottomOffset)
+	if crop >= s.CodedHeight() {
+		return 0
+	}
+	return s.CodedHeight() - crop
+}
+
+// Control returns the SPS as a CtrlH264SPS.
+func (s *SPS) Control() v4l2.CtrlH264SPS {
+	control := v4l2.CtrlH264SPS{
+		ProfileIDC:                     s.ProfileIDC,
+		ConstraintSetFlags:             s.ConstraintSetFlags,
+		LevelIDC:                       s.LevelIDC,
+		SeqParameterSetID:              s.ID,
+		ChromaFormatIDC:                s.ChromaFormatIDC,
+		BitDepthLumaMinus8:             s.BitDepthLumaMinus8,
+		BitDepthChromaMinus8:           s.BitDepthChromaMinus8,
+		Log2MaxFrameNumMinus4:          s.Log2MaxFrameNumMinus4,
+		PicOrderCntType:                s.PicOrderCntType,
+		Log2MaxPicOrderCntLSBMinus4:    s.Log2MaxPicOrderCntLSBMinus4,
+		MaxNumRefFrames:                s.MaxNumRefFrames,
+		NumRefFramesInPicOrderCntCycle: uint8(len(s.OffsetForRefFrame)),
+		OffsetForNonRefPic:             s.OffsetForNonRefPic,
+		OffsetForTopToBottomField:      s.OffsetForTopToBottomField,
+		PicWidthInMBSMinus1:            s.PicWidthInMBSMinus1,
+		PicHeightInMapUnitsMinus1:      s.PicHeightInMapUnitsMinus1,
+	}
+	copy(control.OffsetForRefFrame[:], s.OffsetForRefFrame)
+	flags := []struct {
+		set  bool
+		flag v4l2.H264SPSFlag
+	}{
+		{s.SeparateColourPlane, v4l2.H264SPSFlagSeparateColourPlane},
+		{s.QPPrimeYZeroTransformBypass, v4l2.H264SPSFlagQPPrimeYZeroTransformBypass},
+		{s.DeltaPicOrderAlwaysZero, v4l2.H264SPSFlagDeltaPicOrderAlwaysZero},
+		{s.GapsInFrameNumValueAllowed, v4l2.H264SPSFlagGapsInFrameNumValueAllowed},
+		{s.FrameMBSOnly, v4l2.H264SPSFlagFrameMBSOnly},
+		{s.MBAdaptiveFrameField, v4l2.H264SPSFlagMBAdaptiveFrameField},
+		{s.Direct8x8Inference, v4l2.H264SPSFlagDirect8x8Inference},
+	}
+	for _, f := range flags {
+		if f.set {
+			control.Flags |= f.flag
+		}
+	}
+	return control
+}
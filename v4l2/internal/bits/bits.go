@@ -0,0 +1,62 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package bits reads the big-endian bit fields of the codec headers parsed
+// for stateless decoders.
+package bits
+
+// Reader reads the fields of a header. Reading past the end records EOF in
+// Err, after which reads return zeros.
+type Reader struct {
+	Data []byte
+	Pos  int   // In bits.
+	Err  error // The first error recorded.
+	EOF  error // The error recorded when reading past the end.
+}
+
+// U reads an n bit unsigned integer, n <= 32.
+func (r *Reader) U(n int) uint32 {
+	if r.Err != nil {
+		return 0
+	}
+	if r.Pos+n > len(r.Data)*8 {
+		r.Err = r.EOF
+		return 0
+	}
+	var value uint32
+	for i := 0; i < n; i++ {
+		bit := r.Data[r.Pos>>3] >> (7 - r.Pos&7) & 1
+		value = value<<1 | uint32(bit)
+		r.Pos++
+	}
+	return value
+}
+
+// Flag reads a one bit flag.
+func (r *Reader) Flag() bool {
+	return r.U(1) == 1
+}
+
+// Fail records err unless an error has already been recorded.
+func (r *Reader) Fail(err error) {
+	if r.Err == nil {
+		r.Err = err
+	}
+}
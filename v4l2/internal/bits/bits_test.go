@@ -0,0 +1,50 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package bits
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/peterhagelund/go-v4l2/v4l2/internal/bitstest"
+)
+
+func TestReader(t *testing.T) {
+	w := &bitstest.Writer{}
+	w.U(3, 5)
+	w.Flag(true)
+	w.U(12, 0xabc)
+	if w.Bits != 16 || len(w.Data) != 2 || w.Data[0] != 0xba || w.Data[1] != 0xbc {
+		t.Fatal("incorrect data written")
+	}
+	eof := errors.New("eof")
+	r := &Reader{Data: w.Data, EOF: eof}
+	if r.U(3) != 5 || !r.Flag() || r.U(12) != 0xabc || r.Pos != 16 || r.Err != nil {
+		t.Fatal("incorrect data read")
+	}
+	if r.U(1) != 0 || r.Err != eof {
+		t.Fatal("reading past the end not recorded")
+	}
+	r.Fail(errors.New("other"))
+	if r.Err != eof {
+		t.Fatal("first error not kept")
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package bitstest writes the big-endian bit fields of codec headers, for the
+// tests of the parsers reading them.
+package bitstest
+
+// Writer writes the fields of a header.
+type Writer struct {
+	Data []byte
+	Bits int // The number of bits written.
+}
+
+// U writes value as an n bit unsigned integer.
+func (w *Writer) U(n int, value uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.Bits%8 == 0 {
+			w.Data = append(w.Data, 0)
+		}
+		w.Data[len(w.Data)-1] |= byte(value>>i&1) << (7 - w.Bits%8)
+		w.Bits++
+	}
+}
+
+// Flag writes a one bit flag.
+func (w *Writer) Flag(value bool) {
+	if value {
+		w.U(1, 1)
+	} else {
+		w.U(1, 0)
+	}
+}
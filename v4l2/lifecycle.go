@@ -0,0 +1,252 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package v4l2
+
+import (
+	"errors"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// cameraState is the lifecycle state of a camera.
+type cameraState int
+
+const (
+	stateConfigured       cameraState = iota // The format is set, no buffers are allocated.
+	stateBuffersAllocated                    // Buffers are requested, mapped and queued.
+	stateStreaming                           // Streaming is turned on.
+	stateClosed                              // Everything is released.
+)
+
+// Close stops streaming, releases the buffers and closes the device, in that
+// order. Frames still leased from the camera are given a copy of their data
+// first, so they remain valid.
+// Close is idempotent and reports every error encountered while tearing down.
+func (c *camera) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.lifecycle.Lock()
+		defer c.lifecycle.Unlock()
+		c.capturing.Wait()
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.closeErr = c.teardown()
+	})
+	return c.closeErr
+}
+
+// enter guards an operation against a concurrent Close, failing with ErrClosed
+// once the camera is closing. Every successful enter must be paired with leave.
+func (c *camera) enter() error {
+	c.lifecycle.RLock()
+	select {
+	case <-c.closing:
+		c.lifecycle.RUnlock()
+		return ErrClosed
+	default:
+		return nil
+	}
+}
+
+// leave ends an operation started with enter.
+func (c *camera) leave() {
+	c.lifecycle.RUnlock()
+}
+
+// isClosing reports whether Close has been called.
+func (c *camera) isClosing() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// streamOn turns on streaming. The mutex must be held.
+func (c *camera) streamOn() error {
+	if c.ioMethod == IOMethodReadWrite || c.state == stateStreaming {
+		return nil
+	}
+	if err := StreamOn(c.fd, c.bufType); err != nil {
+		return err
+	}
+	c.state = stateStreaming
+	return nil
+}
+
+// streamOff turns off streaming and hands the buffers that are not leased
+// back to the driver, so that streaming can be turned on again. The mutex
+// must be held.
+func (c *camera) streamOff() error {
+	if err := c.halt(); err != nil {
+		return err
+	}
+	for index := range c.buffers {
+		if c.leased[uint32(index)] != nil {
+			continue
+		}
+		buffer, err := c.queryBuffer(uint32(index))
+		if err != nil {
+			return err
+		}
+		if err := c.enqueue(buffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// halt turns off streaming and leaves the buffers dequeued, for callers that
+// free them next. The mutex must be held.
+func (c *camera) halt() error {
+	if c.ioMethod == IOMethodReadWrite {
+		return nil
+	}
+	if err := StreamOff(c.fd, c.bufType); err != nil {
+		return err
+	}
+	if c.state == stateStreaming {
+		c.state = stateBuffersAllocated
+	}
+	return nil
+}
+
+// teardown walks the camera back through its states, releasing what each
+// state acquired, and closes the device. The mutex must be held.
+func (c *camera) teardown() error {
+	var errs []error
+	if c.state == stateStreaming {
+		errs = append(errs, c.halt())
+		c.state = stateBuffersAllocated
+	}
+	errs = append(errs, c.closeExported())
+	if c.state == stateBuffersAllocated {
+		errs = append(errs, c.freeBuffers())
+		c.state = stateConfigured
+	}
+	errs = append(errs, c.device.Close())
+	c.fd = -1
+	c.state = stateClosed
+	return errors.Join(errs...)
+}
+
+// closeExported closes the DMABUF fds exported from the buffers. The mutex
+// must be held.
+func (c *camera) closeExported() error {
+	var errs []error
+	for _, dmabufFD := range c.exported {
+		errs = append(errs, unix.Close(dmabufFD))
+	}
+	c.exported = nil
+	return errors.Join(errs...)
+}
+
+// allocateBuffers requests and maps the buffers and hands them to the driver.
+// On failure everything allocated so far is released again.
+func (c *camera) allocateBuffers(config *CameraConfig, sizes []uint32) error {
+	count := config.BufCount
+	if c.memory == MemoryDMABuf {
+		count = uint32(len(config.DMABufFDs))
+	}
+	count, err := RequestDriverBuffers(c.fd, count, c.bufType, c.memory)
+	if err != nil {
+		return err
+	}
+	c.state = stateBuffersAllocated
+	if err := c.mapBuffers(config, count, sizes); err != nil {
+		return errors.Join(err, c.freeBuffers())
+	}
+	return nil
+}
+
+// mapBuffers maps count buffers and enqueues them.
+func (c *camera) mapBuffers(config *CameraConfig, count uint32, sizes []uint32) error {
+	switch c.memory {
+	case MemoryDMABuf:
+		if count > uint32(len(config.DMABufFDs)) {
+			return syscall.EINVAL
+		}
+		c.dmabufs = config.DMABufFDs[:count]
+		for _, dmabufFDs := range c.dmabufs {
+			// Buffers of other devices often cannot be mapped, the frames
+			// captured into them then come without data.
+			c.buffers = append(c.buffers, mmapDMABuf(dmabufFDs))
+		}
+		for index, dmabufFDs := range c.dmabufs {
+			if err := EnqueueDMABuf(c.fd, c.bufType, uint32(index), dmabufFDs); err != nil {
+				return err
+			}
+		}
+	case MemoryUserPtr:
+		buffers, err := AllocateUserPtrBuffers(count, sizes)
+		if err != nil {
+			return err
+		}
+		c.buffers = buffers
+		for index, planes := range c.buffers {
+			if err := EnqueueUserPtr(c.fd, c.bufType, uint32(index), planes); err != nil {
+				return err
+			}
+		}
+	case MemoryMmap:
+		if IsMultiPlanar(c.bufType) {
+			buffers, err := MmapBuffersMPlane(c.fd, count, c.bufType)
+			if err != nil {
+				return err
+			}
+			c.buffers = buffers
+			break
+		}
+		planes, err := MmapBuffers(c.fd, count, c.bufType)
+		if err != nil {
+			return err
+		}
+		for _, plane := range planes {
+			c.buffers = append(c.buffers, [][]byte{plane})
+		}
+	}
+	return nil
+}
+
+// freeBuffers unmaps the buffers and releases them in the driver, which only
+// succeeds once no mapping or exported DMABUF references them any more.
+// Leased frames are detached from the buffers before they are unmapped.
+func (c *camera) freeBuffers() error {
+	var errs []error
+	for _, frame := range c.leased {
+		frame.detach()
+	}
+	for _, planes := range c.buffers {
+		for _, plane := range planes {
+			if plane != nil {
+				errs = append(errs, unix.Munmap(plane))
+			}
+		}
+	}
+	c.buffers = nil
+	c.dmabufs = nil
+	c.leased = make(map[uint32]*Frame)
+	if _, err := RequestDriverBuffers(c.fd, 0, c.bufType, c.memory); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// m2mTimeout is how long encoders and decoders wait for a buffer by default.
+const m2mTimeout = 2 * time.Second
+
+// Packet is a compressed frame produced by an encoder or consumed by a decoder.
+type Packet struct {
+	Data      []byte
+	Timestamp time.Duration // Copied between the raw frame and the packet.
+	Sequence  uint32
+	Flags     BufFlag
+}
+
+// KeyFrame reports whether the packet can be decoded on its own.
+func (p *Packet) KeyFrame() bool {
+	return p.Flags&BufFlagKeyFrame != 0
+}
+
+// m2mBufTypes returns the OUTPUT and CAPTURE buffer types of a memory-to-memory
+// device, preferring the multi-planar API.
+func m2mBufTypes(capability *Capability) (BufType, BufType, error) {
+	caps := capability.Capabilities
+	if caps&CapDeviceCaps != 0 {
+		caps = capability.DeviceCaps
+	}
+	switch {
+	case caps&CapVideoM2MMPlane != 0:
+		return BufTypeVideOutputMPlane, BufTypeVideCaptureMPlane, nil
+	case caps&CapVideoM2M != 0:
+		return BufTypeVideoOutput, BufTypeVideoCapture, nil
+	}
+	return 0, 0, ErrUnsupported
+}
+
+// m2mQueue is one of the two queues of a memory-to-memory device, backed by
+// mapped driver buffers.
+type m2mQueue struct {
+	device  Device
+	fd      int
+	bufType BufType
+	sizes   []uint32   // Image size of every plane.
+	buffers [][][]byte // Mapped data indexed by buffer and plane.
+	free    []uint32   // Buffers owned by the application.
+}
+
+// newM2MQueue creates a queue of the buffer type whose planes hold sizes bytes.
+func newM2MQueue(device Device, bufType BufType, sizes []uint32) *m2mQueue {
+	return &m2mQueue{device: device, fd: device.Fd(), bufType: bufType, sizes: sizes}
+}
+
+// allocate requests and maps count buffers, all of which are left free.
+// On failure everything allocated so far is released again.
+func (q *m2mQueue) allocate(count uint32) error {
+	count, err := RequestDriverBuffers(q.fd, count, q.bufType, MemoryMmap)
+	if err != nil {
+		return err
+	}
+	for index := uint32(0); index < count; index++ {
+		buffer, err := q.query(index)
+		if err != nil {
+			return errors.Join(err, q.release())
+		}
+		planes := make([][]byte, len(q.sizes))
+		q.buffers = append(q.buffers, planes)
+		for i := range planes {
+			plane := &buffer.Planes[i]
+			data, err := q.device.Mmap(int64(uint32(plane.M)), int(plane.Length))
+			if err != nil {
+				return errors.Join(newIoctlError(q.fd, "mmap", 0, err), q.release())
+			}
+			planes[i] = data
+		}
+		q.free = append(q.free, index)
+	}
+	return nil
+}
+
+// release unmaps the buffers and releases them in the driver.
+func (q *m2mQueue) release() error {
+	var errs []error
+	for _, planes := range q.buffers {
+		for _, plane := range planes {
+			if plane != nil {
+				errs = append(errs, unix.Munmap(plane))
+			}
+		}
+	}
+	q.buffers = nil
+	q.free = nil
+	if _, err := RequestDriverBuffers(q.fd, 0, q.bufType, MemoryMmap); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// query queries a buffer, describing single-planar buffers in Planes[0].
+func (q *m2mQueue) query(index uint32) (*BufferMPlane, error) {
+	if IsMultiPlanar(q.bufType) {
+		return QueryBufferMPlane(q.fd, index, q.bufType, MemoryMmap)
+	}
+	buffer, err := QueryBuffer(q.fd, index, q.bufType, MemoryMmap)
+	if err != nil {
+		return nil, err
+	}
+	bufferMPlane := &BufferMPlane{Buffer: *buffer}
+	bufferMPlane.Planes[0].M = buffer.M
+	bufferMPlane.Planes[0].Length = buffer.Length
+	return bufferMPlane, nil
+}
+
+// enqueueAll hands every free buffer to the driver empty, as CAPTURE queues need.
+func (q *m2mQueue) enqueueAll() error {
+	for _, index := range q.free {
+		if err := q.enqueue(index, nil, 0, 0); err != nil {
+			return err
+		}
+	}
+	q.free = nil
+	return nil
+}
+
+// reset makes every buffer free again, as stopping the stream returns them all.
+func (q *m2mQueue) reset() {
+	q.free = q.free[:0]
+	for index := range q.buffers {
+		q.free = append(q.free, uint32(index))
+	}
+}
+
+// enqueue prepares the buffer with data and hands it to the driver.
+func (q *m2mQueue) enqueue(index uint32, data []byte, flags BufFlag, timestamp time.Duration) error {
+	buffer, err := q.prepare(index, data, flags, timestamp)
+	if err != nil {
+		return err
+	}
+	return q.submit(buffer)
+}
+
+// prepare copies data into the buffer, spreading it across the planes in
+// order, and returns the buffer struct describing it.
+func (q *m2mQueue) prepare(index uint32, data []byte, flags BufFlag, timestamp time.Duration) (*BufferMPlane, error) {
+	buffer := &BufferMPlane{}
+	buffer.Index = index
+	buffer.Type = q.bufType
+	buffer.Memory = MemoryMmap
+	buffer.Flags = flags
+	buffer.Timestamp = syscall.NsecToTimeval(int64(timestamp))
+	buffer.Length = uint32(len(q.sizes))
+	for i, plane := range q.buffers[index] {
+		size := len(plane)
+		if int(q.sizes[i]) < size {
+			size = int(q.sizes[i])
+		}
+		n := copy(plane[:size], data)
+		data = data[n:]
+		buffer.Planes[i].BytesUsed = uint32(n)
+		buffer.Planes[i].Length = uint32(len(plane))
+	}
+	if len(data) > 0 {
+		return nil, syscall.ENOSPC
+	}
+	return buffer, nil
+}
+
+// submit hands a prepared buffer to the driver.
+func (q *m2mQueue) submit(buffer *BufferMPlane) error {
+	if IsMultiPlanar(q.bufType) {
+		return EnqueueBufferMPlane(q.fd, buffer)
+	}
+	single := buffer.Buffer
+	single.BytesUsed = buffer.Planes[0].BytesUsed
+	single.Length = buffer.Planes[0].Length
+	return EnqueueBuffer(q.fd, &single)
+}
+
+// dequeue waits up to timeout for the driver to return a buffer, returning nil
+// if none arrived and io.EOF once the last buffer has been dequeued.
+func (q *m2mQueue) dequeue(timeout time.Duration) (*BufferMPlane, error) {
+	revents, err := q.poll(timeout)
+	if err != nil || revents == 0 {
+		return nil, err
+	}
+	return q.take(revents)
+}
+
+// poll waits up to timeout for the driver to have a buffer to return,
+// returning no events if it timed out.
+func (q *m2mQueue) poll(timeout time.Duration) (int16, error) {
+	events := int16(unix.POLLIN)
+	if IsOutput(q.bufType) {
+		events = unix.POLLOUT
+	}
+	return poll(q.device, events, timeout)
+}
+
+// take dequeues the buffer poll reported with revents, returning nil if there
+// is none and io.EOF once the last buffer has been dequeued.
+func (q *m2mQueue) take(revents int16) (*BufferMPlane, error) {
+	buffer, err := q.dequeueBuffer()
+	switch {
+	case errors.Is(err, syscall.EPIPE):
+		return nil, io.EOF
+	case errors.Is(err, syscall.EAGAIN):
+		return nil, pollError(q.fd, revents)
+	case err != nil:
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// dequeueBuffer dequeues a buffer using the single- or multi-planar API.
+func (q *m2mQueue) dequeueBuffer() (*BufferMPlane, error) {
+	if IsMultiPlanar(q.bufType) {
+		return DequeueBufferMPlane(q.fd, q.bufType, MemoryMmap)
+	}
+	buffer, err := DequeueBuffer(q.fd, q.bufType, MemoryMmap)
+	if err != nil {
+		return nil, err
+	}
+	bufferMPlane := &BufferMPlane{Buffer: *buffer}
+	bufferMPlane.Planes[0].BytesUsed = buffer.BytesUsed
+	bufferMPlane.Planes[0].Length = buffer.Length
+	return bufferMPlane, nil
+}
+
+// acquire returns a free buffer, reclaiming buffers the driver is done with
+// and waiting up to timeout for one if necessary.
+func (q *m2mQueue) acquire(timeout time.Duration) (uint32, error) {
+	deadline := time.Now().Add(timeout)
+	for len(q.free) == 0 {
+		buffer, err := q.dequeue(max(time.Until(deadline), 0))
+		if err != nil {
+			return 0, err
+		}
+		if buffer != nil {
+			q.free = append(q.free, buffer.Index)
+		} else if time.Now().After(deadline) {
+			return 0, ErrTimeout
+		}
+	}
+	index := q.free[0]
+	q.free = q.free[1:]
+	return index, nil
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mpeg2
+
+import "github.com/peterhagelund/go-v4l2/v4l2/internal/bits"
+
+// bitReader reads the syntax elements of a header. Reading past the end
+// records ErrTruncated and returns zeros from then on.
+type bitReader struct {
+	bits.Reader
+}
+
+// newBitReader returns a reader of payload, starting at bit pos.
+func newBitReader(payload []byte, pos int) *bitReader {
+	return &bitReader{bits.Reader{Data: payload, Pos: pos, EOF: ErrTruncated}}
+}
+
+// matrix reads a quantiser matrix, which the stream holds in zigzag scanning
+// order, into each of matrices.
+func (r *bitReader) matrix(matrices ...*[64]uint8) {
+	var matrix [64]uint8
+	for i := range matrix {
+		matrix[i] = uint8(r.U(8))
+		if matrix[i] == 0 {
+			r.Fail(ErrInvalidHeader)
+		}
+	}
+	for _, m := range matrices {
+		*m = matrix
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package mpeg2 parses MPEG-2 video elementary streams into the controls of
+// the v4l2 stateless MPEG-2 decoder API. It splits streams into pictures,
+// parses the sequence, picture and quantiser matrix headers, and keeps the
+// reference pictures that P and B pictures are predicted from. The slices of a
+// picture are queued in a PixFmtMPEG2Slice OUTPUT buffer.
+package mpeg2
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/peterhagelund/go-v4l2/v4l2"
+)
+
+var (
+	ErrTruncated        = errors.New("mpeg2: unexpected end of data")
+	ErrInvalidHeader    = errors.New("mpeg2: invalid header")
+	ErrUnsupported      = errors.New("mpeg2: unsupported bitstream feature")
+	ErrMissingSequence  = errors.New("mpeg2: picture precedes the sequence header")
+	ErrMissingReference = errors.New("mpeg2: picture refers to a missing reference picture")
+	ErrNoSlices         = errors.New("mpeg2: picture holds no slices")
+	ErrTooLarge         = errors.New("mpeg2: picture exceeds the maximum size")
+)
+
+// StartCode is the start code prefix.
+var StartCode = []byte{0x00, 0x00, 0x01}
+
+// The start code values following the prefix.
+const (
+	PictureStartCode   = 0x00
+	SliceStartCodeMin  = 0x01
+	SliceStartCodeMax  = 0xaf
+	UserDataStartCode  = 0xb2
+	SequenceHeaderCode = 0xb3
+	SequenceErrorCode  = 0xb4
+	ExtensionStartCode = 0xb5
+	SequenceEndCode    = 0xb7
+	GroupStartCode     = 0xb8
+)
+
+// The extension start code identifiers.
+const (
+	sequenceExtensionID      = 0x1
+	quantMatrixExtensionID   = 0x3
+	pictureCodingExtensionID = 0x8
+)
+
+// defaultIntraMatrix is the default intra quantiser matrix in zigzag scanning
+// order.
+var defaultIntraMatrix = [64]uint8{
+	8, 16, 16, 19, 16, 19, 22, 22, 22, 22, 22, 22, 26, 24, 26, 27,
+	27, 27, 26, 26, 26, 26, 27, 27, 27, 29, 29, 29, 34, 34, 34, 29,
+	29, 29, 27, 27, 29, 29, 32, 32, 34, 34, 37, 38, 37, 35, 35, 34,
+	35, 38, 38, 40, 40, 40, 48, 48, 46, 46, 56, 56, 58, 69, 69, 83,
+}
+
+// defaultNonIntraValue is every entry of the default non-intra quantiser matrix.
+const defaultNonIntraValue = 16
+
+// Picture is a picture along with the controls describing it. The two fields
+// of a field picture are separate pictures, decoded into the same CAPTURE
+// buffer.
+type Picture struct {
+	Sequence          v4l2.Mpeg2Sequence
+	Picture           v4l2.Mpeg2Picture
+	Quantisation      v4l2.CtrlMpeg2Quantization
+	TemporalReference uint16
+	SecondField       bool   // The picture is the second field of a frame.
+	Data              []byte // The slices, start codes included, as queued to the decoder.
+}
+
+// Reference reports whether later pictures may be predicted from the picture.
+func (p *Picture) Reference() bool {
+	return p.Picture.PictureCodingType != v4l2.Mpeg2PicCodingTypeB
+}
+
+// Controls returns the sequence, picture and quantisation controls.
+func (p *Picture) Controls() ([]*v4l2.ExtControlValue, error) {
+	sequence, err := v4l2.CompoundControl(v4l2.CidStatelessMPEG2Sequence, &p.Sequence)
+	if err != nil {
+		return nil, err
+	}
+	picture, err := v4l2.CompoundControl(v4l2.CidStatelessMPEG2Picture, &p.Picture)
+	if err != nil {
+		return nil, err
+	}
+	quantisation, err := v4l2.CompoundControl(v4l2.CidStatelessMPEG2Quantisation, &p.Quantisation)
+	if err != nil {
+		return nil, err
+	}
+	return []*v4l2.ExtControlValue{sequence, picture, quantisation}, nil
+}
+
+// references are the reference pictures, by the timestamps of their CAPTURE
+// buffers.
+type references struct {
+	count int // How many of older and newer hold a picture.
+	older uint64
+	newer uint64
+}
+
+// Parser turns the pictures of an MPEG-2 stream into pictures ready to be
+// queued to a stateless decoder.
+type Parser struct {
+	sequence     v4l2.Mpeg2Sequence
+	hasSequence  bool
+	hasExtension bool // The sequence header is followed by a sequence extension.
+	quantisation v4l2.CtrlMpeg2Quantization
+	refs         references
+	field        v4l2.Mpeg2PicStructure // The first field awaiting its second field.
+	fieldRefs    references             // The references before the frame of the first field.
+	fieldTS      uint64
+}
+
+// NewParser returns a parser for a new stream.
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+// Parse parses a picture as returned by Reader.ReadPicture, returning nil
+// when data holds no picture. The timestamp is that of the OUTPUT buffer the
+// picture is queued in, by which later pictures refer to it; the second field
+// of a frame refers to the timestamp of the first.
+func (p *Parser) Parse(data []byte, timestamp time.Duration) (*Picture, error) {
+	var picture *Picture
+	coded := false
+	for _, unit := range splitUnits(data) {
+		code := unit[len(StartCode)]
+		payload := unit[len(StartCode)+1:]
+		var err error
+		switch {
+		case code == SequenceHeaderCode:
+			if picture != nil {
+				return nil, ErrInvalidHeader
+			}
+			err = p.parseSequenceHeader(payload)
+		case code == ExtensionStartCode:
+			if len(payload) == 0 {
+				return nil, ErrTruncated
+			}
+			switch payload[0] >> 4 {
+			case sequenceExtensionID:
+				err = p.parseSequenceExtension(payload)
+			case quantMatrixExtensionID:
+				err = p.parseQuantMatrixExtension(payload)
+			case pictureCodingExtensionID:
+				if picture == nil || coded {
+					return nil, ErrInvalidHeader
+				}
+				err = parsePictureCodingExtension(payload, &picture.Picture)
+				coded = true
+			}
+		case code == PictureStartCode:
+			if picture != nil {
+				return nil, ErrInvalidHeader
+			}
+			if !p.hasSequence {
+				return nil, ErrMissingSequence
+			}
+			picture = &Picture{}
+			err = parsePictureHeader(payload, picture)
+		case code >= SliceStartCodeMin && code <= SliceStartCodeMax:
+			if picture == nil {
+				return nil, ErrInvalidHeader
+			}
+			picture.Data = append(picture.Data, unit...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if picture == nil {
+		return nil, nil
+	}
+	if !p.hasExtension || !coded {
+		return nil, ErrUnsupported
+	}
+	if len(picture.Data) == 0 {
+		return nil, ErrNoSlices
+	}
+	picture.Sequence = p.sequence
+	picture.Quantisation = p.quantisation
+	if err := p.reference(picture, v4l2.ReferenceTS(timestamp)); err != nil {
+		return nil, err
+	}
+	return picture, nil
+}
+
+// reference fills the reference timestamps of a picture and makes I and P
+// frames the newer reference picture.
+func (p *Parser) reference(picture *Picture, ts uint64) error {
+	pic := &picture.Picture
+	structure := pic.PictureStructure
+	if p.field != 0 && structure != v4l2.Mpeg2PicFrame && structure != p.field {
+		picture.SecondField = true
+		p.field = 0
+		refs := p.fieldRefs
+		if pic.PictureCodingType == v4l2.Mpeg2PicCodingTypeP && refs.count == 0 {
+			// The first field of an I/P frame is its only reference.
+			pic.ForwardRefTS = p.fieldTS
+			return nil
+		}
+		return refs.fill(pic)
+	}
+	p.field = 0
+	if err := p.refs.fill(pic); err != nil {
+		return err
+	}
+	if structure != v4l2.Mpeg2PicFrame {
+		p.field = structure
+		p.fieldRefs = p.refs
+		p.fieldTS = ts
+	}
+	if picture.Reference() {
+		p.refs.older, p.refs.newer = p.refs.newer, ts
+		p.refs.count = min(p.refs.count+1, 2)
+	}
+	return nil
+}
+
+// fill fills the reference timestamps a picture of its coding type uses.
+func (r *references) fill(pic *v4l2.Mpeg2Picture) error {
+	switch pic.PictureCodingType {
+	case v4l2.Mpeg2PicCodingTypeP:
+		if r.count < 1 {
+			return ErrMissingReference
+		}
+		pic.ForwardRefTS = r.newer
+	case v4l2.Mpeg2PicCodingTypeB:
+		if r.count < 2 {
+			return ErrMissingReference
+		}
+		pic.ForwardRefTS, pic.BackwardRefTS = r.older, r.newer
+	}
+	return nil
+}
+
+// parseSequenceHeader parses a sequence header, which resets the quantiser
+// matrices.
+func (p *Parser) parseSequenceHeader(payload []byte) error {
+	r := newBitReader(payload, 0)
+	width := r.U(12)
+	height := r.U(12)
+	r.U(4)  // aspect_ratio_information
+	r.U(4)  // frame_rate_code
+	r.U(18) // bit_rate_value
+	r.U(1)  // marker_bit
+	vbvBufferSize := r.U(10)
+	r.U(1) // constrained_parameters_flag
+	q := &p.quantisation
+	q.IntraQuantiserMatrix = defaultIntraMatrix
+	q.ChromaIntraQuantiserMatrix = defaultIntraMatrix
+	if r.Flag() {
+		r.matrix(&q.IntraQuantiserMatrix, &q.ChromaIntraQuantiserMatrix)
+	}
+	for i := range q.NonIntraQuantiserMatrix {
+		q.NonIntraQuantiserMatrix[i] = defaultNonIntraValue
+	}
+	q.ChromaNonIntraQuantiserMatrix = q.NonIntraQuantiserMatrix
+	if r.Flag() {
+		r.matrix(&q.NonIntraQuantiserMatrix, &q.ChromaNonIntraQuantiserMatrix)
+	}
+	if r.Err != nil {
+		p.hasSequence = false
+		return r.Err
+	}
+	if width == 0 || height == 0 {
+		p.hasSequence = false
+		return ErrInvalidHeader
+	}
+	p.sequence = v4l2.Mpeg2Sequence{
+		HorizontalSize: uint16(width),
+		VerticalSize:   uint16(height),
+		VBVBufferSize:  vbvBufferSize,
+	}
+	p.hasSequence = true
+	p.hasExtension = false
+	return nil
+}
+
+// parseSequenceExtension parses the sequence extension of an MPEG-2 stream.
+func (p *Parser) parseSequenceExtension(payload []byte) error {
+	if !p.hasSequence {
+		return ErrMissingSequence
+	}
+	r := newBitReader(payload, 4)
+	s := &p.sequence
+	profileAndLevel := r.U(8)
+	progressive := r.Flag()
+	chromaFormat := r.U(2)
+	widthExtension := r.U(2)
+	heightExtension := r.U(2)
+	r.U(12) // bit_rate_extension
+	r.U(1)  // marker_bit
+	vbvBufferSizeExtension := r.U(8)
+	if r.Err != nil {
+		return r.Err
+	}
+	if chromaFormat == 0 {
+		return ErrInvalidHeader
+	}
+	s.ProfileAndLevelIndication = uint16(profileAndLevel)
+	s.ChromaFormat = uint8(chromaFormat)
+	s.HorizontalSize = s.HorizontalSize&0x0fff | uint16(widthExtension)<<12
+	s.VerticalSize = s.VerticalSize&0x0fff | uint16(heightExtension)<<12
+	s.VBVBufferSize = s.VBVBufferSize&0x03ff | vbvBufferSizeExtension<<10
+	s.Flags = 0
+	if progressive {
+		s.Flags |= v4l2.Mpeg2SeqFlagProgressive
+	}
+	p.hasExtension = true
+	return nil
+}
+
+// parseQuantMatrixExtension parses a quant matrix extension. Loading a luma
+// matrix loads the chroma matrix as well.
+func (p *Parser) parseQuantMatrixExtension(payload []byte) error {
+	r := newBitReader(payload, 4)
+	q := p.quantisation
+	if r.Flag() {
+		r.matrix(&q.IntraQuantiserMatrix, &q.ChromaIntraQuantiserMatrix)
+	}
+	if r.Flag() {
+		r.matrix(&q.NonIntraQuantiserMatrix, &q.ChromaNonIntraQuantiserMatrix)
+	}
+	if r.Flag() {
+		r.matrix(&q.ChromaIntraQuantiserMatrix)
+	}
+	if r.Flag() {
+		r.matrix(&q.ChromaNonIntraQuantiserMatrix)
+	}
+	if r.Err != nil {
+		return r.Err
+	}
+	p.quantisation = q
+	return nil
+}
+
+// parsePictureHeader parses a picture header.
+func parsePictureHeader(payload []byte, picture *Picture) error {
+	r := newBitReader(payload, 0)
+	picture.TemporalReference = uint16(r.U(10))
+	codingType := v4l2.Mpeg2PicCodingType(r.U(3))
+	if r.Err != nil {
+		return r.Err
+	}
+	switch codingType {
+	case v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicCodingTypeP, v4l2.Mpeg2PicCodingTypeB:
+	case v4l2.Mpeg2PicCodingTypeD:
+		return ErrUnsupported
+	default:
+		return ErrInvalidHeader
+	}
+	picture.Picture.PictureCodingType = codingType
+	return nil
+}
+
+// parsePictureCodingExtension parses the picture coding extension of an
+// MPEG-2 picture.
+func parsePictureCodingExtension(payload []byte, pic *v4l2.Mpeg2Picture) error {
+	r := newBitReader(payload, 4)
+	for i := range pic.FCode {
+		for j := range pic.FCode[i] {
+			pic.FCode[i][j] = uint8(r.U(4))
+		}
+	}
+	pic.IntraDCPrecision = uint8(r.U(2))
+	pic.PictureStructure = v4l2.Mpeg2PicStructure(r.U(2))
+	for _, flag := range []v4l2.Mpeg2PicFlag{
+		v4l2.Mpeg2PicFlagTopFieldFirst,
+		v4l2.Mpeg2PicFlagFramePredDCT,
+		v4l2.Mpeg2PicFlagConcealmentMV,
+		v4l2.Mpeg2PicFlagQScaleType,
+		v4l2.Mpeg2PicFlagIntraVLC,
+		v4l2.Mpeg2PicFlagAltScan,
+		v4l2.Mpeg2PicFlagRepeatFirst,
+	} {
+		if r.Flag() {
+			pic.Flags |= flag
+		}
+	}
+	r.U(1) // chroma_420_type
+	if r.Flag() {
+		pic.Flags |= v4l2.Mpeg2PicFlagProgressive
+	}
+	if r.Err != nil {
+		return r.Err
+	}
+	if pic.PictureStructure == 0 {
+		return ErrInvalidHeader
+	}
+	return nil
+}
+
+// splitUnits splits data into its start code delimited units, start codes
+// included. Data before the first start code is ignored.
+func splitUnits(data []byte) [][]byte {
+	var units [][]byte
+	start := bytes.Index(data, StartCode)
+	for start >= 0 {
+		end := bytes.Index(data[start+len(StartCode):], StartCode)
+		next := -1
+		if end < 0 {
+			end = len(data)
+		} else {
+			end += start + len(StartCode)
+			next = end
+		}
+		if end > start+len(StartCode) {
+			units = append(units, data[start:end])
+		}
+		start = next
+	}
+	return units
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mpeg2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/peterhagelund/go-v4l2/v4l2"
+	"github.com/peterhagelund/go-v4l2/v4l2/internal/bitstest"
+)
+
+// bitWriter writes the syntax elements of a header.
+type bitWriter struct {
+	bitstest.Writer
+}
+
+// unit returns the written header preceded by its start code.
+func (w *bitWriter) unit(code byte) []byte {
+	return append([]byte{0x00, 0x00, 0x01, code}, w.Data...)
+}
+
+// testMatrix is a quantiser matrix in zigzag scanning order.
+func testMatrix(base uint8) [64]uint8 {
+	var matrix [64]uint8
+	for i := range matrix {
+		matrix[i] = base + uint8(i)
+	}
+	return matrix
+}
+
+func writeMatrix(w *bitWriter, matrix *[64]uint8) {
+	w.Flag(matrix != nil)
+	if matrix != nil {
+		for _, value := range matrix {
+			w.U(8, uint32(value))
+		}
+	}
+}
+
+// sequence returns a 1920x1088 sequence header, with a sequence extension
+// unless mpeg1 is set.
+func sequence(intra *[64]uint8, mpeg1 bool) []byte {
+	w := &bitWriter{}
+	w.U(12, 1920)
+	w.U(12, 1088)
+	w.U(4, 3)
+	w.U(4, 4)
+	w.U(18, 0x3ffff)
+	w.U(1, 1)
+	w.U(10, 0x3ff)
+	w.U(1, 0)
+	writeMatrix(w, intra)
+	writeMatrix(w, nil)
+	data := w.unit(SequenceHeaderCode)
+	if mpeg1 {
+		return data
+	}
+	w = &bitWriter{}
+	w.U(4, sequenceExtensionID)
+	w.U(8, 0x44)
+	w.U(1, 0)
+	w.U(2, 1)
+	w.U(2, 0)
+	w.U(2, 0)
+	w.U(12, 0)
+	w.U(1, 1)
+	w.U(8, 0x02)
+	w.U(1, 0)
+	w.U(2, 0)
+	w.U(5, 0)
+	return append(data, w.unit(ExtensionStartCode)...)
+}
+
+func group() []byte {
+	w := &bitWriter{}
+	w.U(25, 0)
+	w.U(1, 1)
+	w.U(1, 0)
+	return w.unit(GroupStartCode)
+}
+
+func quantMatrixExtension(nonIntra, chromaIntra *[64]uint8) []byte {
+	w := &bitWriter{}
+	w.U(4, quantMatrixExtensionID)
+	writeMatrix(w, nil)
+	writeMatrix(w, nonIntra)
+	writeMatrix(w, chromaIntra)
+	writeMatrix(w, nil)
+	return w.unit(ExtensionStartCode)
+}
+
+// testSlices are the slices of every test picture.
+var testSlices = []byte{0x00, 0x00, 0x01, 0x01, 0x12, 0x34, 0x00, 0x00, 0x01, 0x02, 0x56}
+
+// picture returns a picture header, picture coding extension and slices.
+func picture(temporalReference uint32, codingType v4l2.Mpeg2PicCodingType, structure v4l2.Mpeg2PicStructure) []byte {
+	w := &bitWriter{}
+	w.U(10, temporalReference)
+	w.U(3, uint32(codingType))
+	w.U(16, 0xffff)
+	if codingType == v4l2.Mpeg2PicCodingTypeP || codingType == v4l2.Mpeg2PicCodingTypeB {
+		w.U(4, 0x7)
+	}
+	if codingType == v4l2.Mpeg2PicCodingTypeB {
+		w.U(4, 0x7)
+	}
+	w.U(1, 0)
+	data := w.unit(PictureStartCode)
+	w = &bitWriter{}
+	w.U(4, pictureCodingExtensionID)
+	for _, fCode := range []uint32{1, 2, 3, 4} {
+		w.U(4, fCode)
+	}
+	w.U(2, 2)
+	w.U(2, uint32(structure))
+	w.Flag(true)
+	w.Flag(structure == v4l2.Mpeg2PicFrame)
+	w.Flag(false)
+	w.Flag(true)
+	w.Flag(true)
+	w.Flag(false)
+	w.Flag(false)
+	w.Flag(true)
+	w.Flag(structure == v4l2.Mpeg2PicFrame)
+	w.Flag(false)
+	data = append(data, w.unit(ExtensionStartCode)...)
+	return append(data, testSlices...)
+}
+
+func join(units ...[]byte) []byte {
+	return bytes.Join(units, nil)
+}
+
+func TestReader(t *testing.T) {
+	first := join(sequence(nil, false), group(), picture(0, v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicFrame))
+	second := picture(1, v4l2.Mpeg2PicCodingTypeP, v4l2.Mpeg2PicFrame)
+	third := join(sequence(nil, false), picture(2, v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicFrame), []byte{0x00, 0x00, 0x01, SequenceEndCode})
+	stream := join([]byte{0xff, 0x00}, first, second, third)
+	for _, readSize := range []int{1, 7, len(stream)} {
+		reader := NewReader(&chunkReader{data: stream, size: readSize})
+		for i, expected := range [][]byte{first, second, third} {
+			data, err := reader.ReadPicture()
+			if err != nil || !bytes.Equal(data, expected) {
+				t.Fatal("incorrect picture", i)
+			}
+		}
+		if _, err := reader.ReadPicture(); err != io.EOF {
+			t.Fatal("end of stream not reported")
+		}
+	}
+	reader := NewReader(bytes.NewReader(sequence(nil, false)))
+	if _, err := reader.ReadPicture(); err != io.EOF {
+		t.Fatal("stream without pictures not reported")
+	}
+}
+
+// chunkReader reads its data size bytes at a time.
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.size)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestControls(t *testing.T) {
+	if binary.Size(v4l2.Mpeg2Sequence{}) != 12 || binary.Size(v4l2.Mpeg2Picture{}) != 32 || binary.Size(v4l2.CtrlMpeg2Quantization{}) != 256 {
+		t.Fatal("incorrect control sizes")
+	}
+	p := NewParser()
+	picture, err := p.Parse(join(sequence(nil, false), picture(0, v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicFrame)), 0)
+	if err != nil {
+		t.Fatal("unable to parse picture")
+	}
+	controls, err := picture.Controls()
+	if err != nil || len(controls) != 3 || controls[0].ID != v4l2.CidStatelessMPEG2Sequence || controls[1].ID != v4l2.CidStatelessMPEG2Picture || controls[2].ID != v4l2.CidStatelessMPEG2Quantisation {
+		t.Fatal("incorrect controls")
+	}
+}
+
+func TestParser(t *testing.T) {
+	intra := testMatrix(10)
+	nonIntra := testMatrix(20)
+	chromaIntra := testMatrix(30)
+	p := NewParser()
+	ts := func(i int) time.Duration {
+		return time.Duration(i) * 40 * time.Millisecond
+	}
+	if _, err := p.Parse(picture(0, v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicFrame), 0); err != ErrMissingSequence {
+		t.Fatal("picture accepted before the sequence header")
+	}
+	if picture, err := p.Parse(join(sequence(&intra, false), group()), 0); picture != nil || err != nil {
+		t.Fatal("headers without picture not ignored")
+	}
+	if _, err := p.Parse(picture(1, v4l2.Mpeg2PicCodingTypeP, v4l2.Mpeg2PicFrame), 0); err != ErrMissingReference {
+		t.Fatal("P picture accepted without reference")
+	}
+	i, err := p.Parse(picture(0, v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicFrame), ts(0))
+	if err != nil {
+		t.Fatal("unable to parse I picture")
+	}
+	if i.Sequence != (v4l2.Mpeg2Sequence{HorizontalSize: 1920, VerticalSize: 1088, VBVBufferSize: 0x3ff | 0x02<<10, ProfileAndLevelIndication: 0x44, ChromaFormat: 1}) {
+		t.Fatal("incorrect sequence")
+	}
+	pic := i.Picture
+	if pic.PictureCodingType != v4l2.Mpeg2PicCodingTypeI || pic.PictureStructure != v4l2.Mpeg2PicFrame || pic.FCode != [2][2]uint8{{1, 2}, {3, 4}} || pic.IntraDCPrecision != 2 ||
+		pic.Flags != v4l2.Mpeg2PicFlagTopFieldFirst|v4l2.Mpeg2PicFlagFramePredDCT|v4l2.Mpeg2PicFlagQScaleType|v4l2.Mpeg2PicFlagIntraVLC|v4l2.Mpeg2PicFlagProgressive {
+		t.Fatal("incorrect picture")
+	}
+	q := i.Quantisation
+	if q.IntraQuantiserMatrix != intra || q.ChromaIntraQuantiserMatrix != intra || q.NonIntraQuantiserMatrix[0] != 16 || q.ChromaNonIntraQuantiserMatrix[63] != 16 {
+		t.Fatal("incorrect sequence quantiser matrices")
+	}
+	if !bytes.Equal(i.Data, testSlices) || !i.Reference() || i.SecondField {
+		t.Fatal("incorrect slices")
+	}
+	if _, err := p.Parse(picture(2, v4l2.Mpeg2PicCodingTypeB, v4l2.Mpeg2PicFrame), ts(1)); err != ErrMissingReference {
+		t.Fatal("B picture accepted with a single reference")
+	}
+	pp, err := p.Parse(join(quantMatrixExtension(&nonIntra, &chromaIntra), picture(3, v4l2.Mpeg2PicCodingTypeP, v4l2.Mpeg2PicFrame)), ts(1))
+	if err != nil {
+		t.Fatal("unable to parse P picture")
+	}
+	q = pp.Quantisation
+	if q.IntraQuantiserMatrix != intra || q.NonIntraQuantiserMatrix != nonIntra || q.ChromaNonIntraQuantiserMatrix != nonIntra || q.ChromaIntraQuantiserMatrix != chromaIntra {
+		t.Fatal("incorrect extension quantiser matrices")
+	}
+	if pp.TemporalReference != 3 || pp.Picture.ForwardRefTS != v4l2.ReferenceTS(ts(0)) {
+		t.Fatal("incorrect P picture references")
+	}
+	b, err := p.Parse(picture(1, v4l2.Mpeg2PicCodingTypeB, v4l2.Mpeg2PicFrame), ts(2))
+	if err != nil {
+		t.Fatal("unable to parse B picture")
+	}
+	if b.Reference() || b.Picture.ForwardRefTS != v4l2.ReferenceTS(ts(0)) || b.Picture.BackwardRefTS != v4l2.ReferenceTS(ts(1)) {
+		t.Fatal("incorrect B picture references")
+	}
+	top, err := p.Parse(join(sequence(nil, false), picture(0, v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicTopField)), ts(3))
+	if err != nil {
+		t.Fatal("unable to parse first field")
+	}
+	if top.Quantisation.IntraQuantiserMatrix != defaultIntraMatrix || top.Quantisation.NonIntraQuantiserMatrix == nonIntra || top.SecondField || top.Picture.Flags&v4l2.Mpeg2PicFlagProgressive != 0 {
+		t.Fatal("incorrect first field")
+	}
+	bottom, err := p.Parse(picture(0, v4l2.Mpeg2PicCodingTypeP, v4l2.Mpeg2PicBottomField), ts(4))
+	if err != nil {
+		t.Fatal("unable to parse second field")
+	}
+	if !bottom.SecondField || bottom.Picture.ForwardRefTS != v4l2.ReferenceTS(ts(1)) {
+		t.Fatal("incorrect second field")
+	}
+	b, err = p.Parse(picture(1, v4l2.Mpeg2PicCodingTypeB, v4l2.Mpeg2PicTopField), ts(5))
+	if err != nil || b.SecondField || b.Picture.ForwardRefTS != v4l2.ReferenceTS(ts(1)) || b.Picture.BackwardRefTS != v4l2.ReferenceTS(ts(3)) {
+		t.Fatal("incorrect B field references")
+	}
+	p = NewParser()
+	if _, err := p.Parse(join(sequence(nil, false), picture(0, v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicTopField)), ts(0)); err != nil {
+		t.Fatal("unable to parse first field")
+	}
+	bottom, err = p.Parse(picture(0, v4l2.Mpeg2PicCodingTypeP, v4l2.Mpeg2PicBottomField), ts(1))
+	if err != nil || !bottom.SecondField || bottom.Picture.ForwardRefTS != v4l2.ReferenceTS(ts(0)) {
+		t.Fatal("incorrect I/P field pair")
+	}
+	if _, err := p.Parse(join(sequence(nil, true), picture(0, v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicFrame)), 0); err != ErrUnsupported {
+		t.Fatal("MPEG-1 stream accepted")
+	}
+	data := join(sequence(nil, false), picture(0, v4l2.Mpeg2PicCodingTypeI, v4l2.Mpeg2PicFrame))
+	if _, err := p.Parse(data[:len(data)-len(testSlices)], 0); err != ErrNoSlices {
+		t.Fatal("picture without slices accepted")
+	}
+	if _, err := p.Parse(data[:20], 0); err != ErrTruncated {
+		t.Fatal("truncated sequence header accepted")
+	}
+}
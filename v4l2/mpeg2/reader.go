@@ -0,0 +1,113 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mpeg2
+
+import (
+	"bytes"
+	"io"
+	"slices"
+)
+
+// The size of the reads from the underlying reader, and the largest picture
+// read.
+const (
+	readSize       = 64 << 10
+	maxPictureSize = 64 << 20
+)
+
+// Reader splits an MPEG-2 video elementary stream into pictures.
+type Reader struct {
+	r   io.Reader
+	buf []byte
+	err error // The error that ended reading, io.EOF at the end of the stream.
+}
+
+// NewReader returns a reader of the elementary stream in r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadPicture returns the next picture of the stream: the sequence, group of
+// pictures and extension headers preceding a picture header, the picture
+// header and its slices, start codes included. Data before the first start
+// code and after the last picture is dropped. At the end of the stream
+// ReadPicture returns io.EOF.
+func (r *Reader) ReadPicture() ([]byte, error) {
+	start := -1
+	picture := false
+	pos := 0
+	for {
+		i := bytes.Index(r.buf[pos:], StartCode)
+		if i >= 0 && pos+i+len(StartCode) < len(r.buf) {
+			at := pos + i
+			code := r.buf[at+len(StartCode)]
+			if start < 0 {
+				start = at
+			} else if picture && (code == PictureStartCode || code == SequenceHeaderCode || code == GroupStartCode) {
+				data := r.buf[start:at:at]
+				r.buf = r.buf[at:]
+				return data, nil
+			}
+			if code == PictureStartCode {
+				picture = true
+			}
+			pos = at + len(StartCode) + 1
+			continue
+		}
+		if r.err != nil {
+			if !picture {
+				r.buf = nil
+				return nil, r.err
+			}
+			data := r.buf[start:]
+			r.buf = nil
+			return data, nil
+		}
+		if i >= 0 {
+			pos += i
+		} else {
+			pos = max(pos, len(r.buf)-len(StartCode)+1)
+		}
+		drop := start
+		if start < 0 {
+			drop = pos
+		} else {
+			start = 0
+		}
+		r.buf = r.buf[drop:]
+		pos -= drop
+		if len(r.buf) > maxPictureSize {
+			return nil, ErrTooLarge
+		}
+		r.fill()
+	}
+}
+
+// fill reads more of the stream into buf.
+func (r *Reader) fill() {
+	n := len(r.buf)
+	r.buf = slices.Grow(r.buf, readSize)
+	read, err := r.r.Read(r.buf[n : n+readSize])
+	r.buf = r.buf[:n+read]
+	if err != nil {
+		r.err = err
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// AllocRequest allocates a request on a media device and returns its file
+// descriptor. QueueRequest and ReinitRequest are made on the request file
+// descriptor.
+func AllocRequest(mediaFD int) (int, error) {
+	var requestFD int32
+	if err := ioctl(mediaFD, MediaIocRequestAlloc, unsafe.Pointer(&requestFD)); err != nil {
+		return -1, err
+	}
+	return int(requestFD), nil
+}
+
+// QueueRequest queues a request along with the controls set and the buffers
+// queued with it. The request must hold at least one buffer.
+func QueueRequest(requestFD int) error {
+	return ioctl(requestFD, MediaRequestIocQueue, nil)
+}
+
+// ReinitRequest empties a request that is not queued or has completed, so that
+// it can be used again.
+func ReinitRequest(requestFD int) error {
+	return ioctl(requestFD, MediaRequestIocReinit, nil)
+}
+
+// WaitRequest waits up to timeout for a queued request to complete and reports
+// whether it did.
+func WaitRequest(requestFD int, timeout time.Duration) (bool, error) {
+	revents, err := poll(lookupDevice(requestFD), unix.POLLPRI, timeout)
+	if err != nil {
+		return false, err
+	}
+	if revents&unix.POLLPRI != 0 {
+		return true, nil
+	}
+	return false, pollError(requestFD, revents)
+}
+
+// CloseRequest releases a request.
+func CloseRequest(requestFD int) error {
+	return lookupDevice(requestFD).Close()
+}
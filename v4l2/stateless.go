@@ -0,0 +1,316 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// StatelessDecoder is a stateless memory-to-memory hardware decoder driven
+// through the Media Request API. Every packet is queued in a request together
+// with the per-frame controls parsed from the stream, such as
+// CtrlH264DecodeParams, and the decoded frames are taken with NextFrame.
+type StatelessDecoder interface {
+	Width() uint32
+	Height() uint32
+	PixFormat() PixFmt
+	Decode(data []byte, timestamp time.Duration, controls []*ExtControlValue) error
+	NextFrame(timeout time.Duration) (*Frame, error)
+	Close() error
+}
+
+// StatelessDecoderConfig is the configuration of a StatelessDecoder.
+type StatelessDecoderConfig struct {
+	Path        string
+	Device      Device // Optional, opened from Path when nil.
+	MediaPath   string
+	Media       Device // Optional, opened from MediaPath when nil.
+	CodedFormat PixFmt // Format of the packets, such as PixFmtH264Slice.
+	Width       uint32
+	Height      uint32
+	PixFormat   PixFmt             // Format of the decoded frames, zero for the decoder's choice.
+	Controls    []*ExtControlValue // Stream controls such as CtrlH264SPS, set before the decoded format is negotiated.
+	BufCount    uint32             // Buffers per queue, enough CAPTURE buffers must be requested to hold the reference frames.
+}
+
+// ReferenceTS returns the timestamp by which the controls of later packets,
+// such as the DPB of CtrlH264DecodeParams, refer to the frame decoded from a
+// packet queued with timestamp.
+func ReferenceTS(timestamp time.Duration) uint64 {
+	timeval := syscall.NsecToTimeval(int64(timestamp))
+	return uint64(timeval.Nano())
+}
+
+type statelessDecoder struct {
+	device       Device
+	media        Device
+	fd           int
+	format       PixFormat
+	output       *m2mQueue
+	capture      *m2mQueue
+	requests     []int             // Request file descriptor of every OUTPUT buffer.
+	pending      []bool            // Whether the request of an OUTPUT buffer has been queued since it was last reinitialized.
+	leased       map[uint32]*Frame // Frames referencing CAPTURE buffers, by buffer index.
+	lifecycle    sync.RWMutex      // Read-held by NextFrame while polling, write-held by Close.
+	outputMutex  sync.Mutex        // Guards the OUTPUT queue and the requests.
+	captureMutex sync.Mutex        // Guards the CAPTURE queue and the leased frames.
+	closed       bool              // Written with the lifecycle and both mutexes held.
+	closeOnce    sync.Once
+	closeErr     error
+}
+
+// NewStatelessDecoder configures both queues of a stateless decoder, allocates
+// a request for every OUTPUT buffer and starts streaming.
+func NewStatelessDecoder(config *StatelessDecoderConfig) (StatelessDecoder, error) {
+	var err error
+	device, err := openDevice(config.Device, config.Path)
+	if err != nil {
+		return nil, err
+	}
+	d := &statelessDecoder{device: device, fd: device.Fd(), leased: make(map[uint32]*Frame)}
+	defer func() {
+		if err != nil {
+			d.teardown()
+		}
+	}()
+	d.media = config.Media
+	if d.media == nil {
+		if d.media, err = OpenDevice(config.MediaPath); err != nil {
+			return nil, err
+		}
+	}
+	capabilities, err := QueryCapabilities(d.fd)
+	if err != nil {
+		return nil, err
+	}
+	outputType, captureType, err := m2mBufTypes(capabilities)
+	if err != nil {
+		return nil, err
+	}
+	var width, height uint32
+	var outputSizes, captureSizes []uint32
+	if width, height, outputSizes, err = negotiateFormat(d.fd, outputType, config.CodedFormat, config.Width, config.Height); err != nil {
+		return nil, err
+	}
+	if len(config.Controls) > 0 {
+		if err = SetExtControls(d.fd, CtrlWhichCurVal, 0, config.Controls); err != nil {
+			return nil, err
+		}
+	}
+	pixFormat := config.PixFormat
+	if pixFormat == 0 {
+		var format *Format
+		if format, err = GetFormat(d.fd, captureType); err != nil {
+			return nil, err
+		}
+		// The single- and multi-planar formats start with the same fields.
+		pixFormat = (*PixFormat)(unsafe.Pointer(&format.RawData[0])).PixFormat
+	}
+	if width, height, captureSizes, err = negotiateFormat(d.fd, captureType, pixFormat, width, height); err != nil {
+		return nil, err
+	}
+	d.format = PixFormat{Width: width, Height: height, PixFormat: pixFormat}
+	d.output = newM2MQueue(device, outputType, outputSizes)
+	if err = d.output.allocate(config.BufCount); err != nil {
+		return nil, err
+	}
+	for range d.output.buffers {
+		var requestFD int
+		if requestFD, err = AllocRequest(d.media.Fd()); err != nil {
+			return nil, err
+		}
+		d.requests = append(d.requests, requestFD)
+		d.pending = append(d.pending, false)
+	}
+	d.capture = newM2MQueue(device, captureType, captureSizes)
+	if err = d.capture.allocate(config.BufCount); err != nil {
+		return nil, err
+	}
+	if err = d.capture.enqueueAll(); err != nil {
+		return nil, err
+	}
+	if err = StreamOn(d.fd, outputType); err != nil {
+		return nil, err
+	}
+	if err = StreamOn(d.fd, captureType); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *statelessDecoder) Width() uint32 {
+	return d.format.Width
+}
+
+func (d *statelessDecoder) Height() uint32 {
+	return d.format.Height
+}
+
+func (d *statelessDecoder) PixFormat() PixFmt {
+	return d.format.PixFormat
+}
+
+// Decode queues a packet in a request along with the controls describing it,
+// waiting for the decoder to free an OUTPUT buffer if necessary.
+func (d *statelessDecoder) Decode(data []byte, timestamp time.Duration, controls []*ExtControlValue) error {
+	d.outputMutex.Lock()
+	defer d.outputMutex.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	index, err := d.output.acquire(m2mTimeout)
+	if err != nil {
+		return err
+	}
+	if err := d.queue(index, data, timestamp, controls); err != nil {
+		d.output.free = append(d.output.free, index)
+		return err
+	}
+	return nil
+}
+
+// queue reinitializes the request of an OUTPUT buffer, once it has completed,
+// and queues it with the buffer and the controls.
+func (d *statelessDecoder) queue(index uint32, data []byte, timestamp time.Duration, controls []*ExtControlValue) error {
+	requestFD := d.requests[index]
+	if d.pending[index] {
+		completed, err := WaitRequest(requestFD, m2mTimeout)
+		if err != nil {
+			return err
+		}
+		if !completed {
+			return ErrTimeout
+		}
+		d.pending[index] = false
+	}
+	if err := ReinitRequest(requestFD); err != nil {
+		return err
+	}
+	buffer, err := d.output.prepare(index, data, BufFlagRequestFD, timestamp)
+	if err != nil {
+		return err
+	}
+	buffer.RequestFD = uint32(requestFD)
+	if len(controls) > 0 {
+		if err := SetExtControls(d.fd, CtrlWhichRequestVal, requestFD, controls); err != nil {
+			return err
+		}
+	}
+	if err := d.output.submit(buffer); err != nil {
+		return err
+	}
+	if err := QueueRequest(requestFD); err != nil {
+		return errors.Join(err, ReinitRequest(requestFD))
+	}
+	d.pending[index] = true
+	return nil
+}
+
+// NextFrame waits up to timeout for a decoded frame, whose timestamp is that
+// of the packet it was decoded from. The frame references the CAPTURE buffer,
+// which the decoder may use as a reference frame until the frame is released.
+func (d *statelessDecoder) NextFrame(timeout time.Duration) (*Frame, error) {
+	// Frames are released while the CAPTURE queue is polled, so only Close
+	// is held off until the poll returns.
+	d.lifecycle.RLock()
+	defer d.lifecycle.RUnlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	revents, err := d.capture.poll(timeout)
+	if err != nil {
+		return nil, err
+	}
+	if revents == 0 {
+		return nil, ErrTimeout
+	}
+	d.captureMutex.Lock()
+	defer d.captureMutex.Unlock()
+	buffer, err := d.capture.take(revents)
+	if err != nil {
+		return nil, err
+	}
+	if buffer == nil {
+		return nil, ErrTimeout
+	}
+	frame := newFrame(buffer, d.capture.buffers[buffer.Index], false)
+	frame.release = func() error {
+		return d.releaseBuffer(buffer.Index)
+	}
+	d.leased[buffer.Index] = frame
+	return frame, nil
+}
+
+// releaseBuffer hands a CAPTURE buffer back to the decoder.
+func (d *statelessDecoder) releaseBuffer(index uint32) error {
+	d.captureMutex.Lock()
+	defer d.captureMutex.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	delete(d.leased, index)
+	return d.capture.enqueue(index, nil, 0, 0)
+}
+
+// Close stops streaming, releases the buffers and requests and closes the
+// devices. Frames not yet released are given a copy of their data first, so
+// they remain valid. Close waits for a NextFrame in progress to return.
+func (d *statelessDecoder) Close() error {
+	d.closeOnce.Do(func() {
+		d.lifecycle.Lock()
+		defer d.lifecycle.Unlock()
+		d.outputMutex.Lock()
+		defer d.outputMutex.Unlock()
+		d.captureMutex.Lock()
+		defer d.captureMutex.Unlock()
+		d.closed = true
+		for _, frame := range d.leased {
+			frame.detach()
+		}
+		d.leased = nil
+		d.closeErr = d.teardown()
+	})
+	return d.closeErr
+}
+
+// teardown stops streaming, releases whatever queues and requests were
+// allocated and closes the devices.
+func (d *statelessDecoder) teardown() error {
+	var errs []error
+	for _, queue := range []*m2mQueue{d.output, d.capture} {
+		if queue == nil {
+			continue
+		}
+		errs = append(errs, StreamOff(d.fd, queue.bufType), queue.release())
+	}
+	for _, requestFD := range d.requests {
+		errs = append(errs, CloseRequest(requestFD))
+	}
+	if d.media != nil && d.media != d.device {
+		errs = append(errs, d.media.Close())
+	}
+	errs = append(errs, d.device.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testStatelessConfig() *FakeConfig {
+	return &FakeConfig{
+		Driver:       "fake",
+		Card:         "Fake Stateless Decoder",
+		BusInfo:      "platform:fake",
+		Capabilities: CapVideoM2MMPlane | CapStreaming,
+		Formats: []FakeFormat{{
+			PixFormat:   PixFmtNV12M,
+			Description: "Y/UV 4:2:0 (N-C)",
+			FrameSizes:  []FrameSizeDiscrete{{Width: 320, Height: 240}, {Width: 1280, Height: 720}},
+		}},
+		OutputFormats: []FakeFormat{{
+			PixFormat:   PixFmtH264Slice,
+			Description: "H.264 Parsed Slice Data",
+			Flags:       FmtFlagCompressed,
+			FrameSizes:  []FrameSizeDiscrete{{Width: 320, Height: 240}, {Width: 1280, Height: 720}},
+		}},
+		Controls: []FakeControl{
+			{ID: CidStatelessH264SPS, Type: CtrlTypeH264SPS, Name: "H264 Sequence Parameter Set", Flags: CtrlFlagHasPayload, ElemSize: 16, Elems: 1},
+			{ID: CidStatelessH264DecodeParams, Type: CtrlTypeH264DecordeParams, Name: "H264 Decode Parameters", Flags: CtrlFlagHasPayload, ElemSize: 16, Elems: 1},
+		},
+		Requests: true,
+	}
+}
+
+func TestRequests(t *testing.T) {
+	fake, err := NewFakeDevice(testStatelessConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	if _, err := RequestDriverBuffers(fd, 1, BufTypeVideOutputMPlane, MemoryMmap); err != nil {
+		t.Fatal("unable to request buffers")
+	}
+	if err := StreamOn(fd, BufTypeVideOutputMPlane); err != nil {
+		t.Fatal("unable to start streaming")
+	}
+	requestFD, err := AllocRequest(fd)
+	if err != nil {
+		t.Fatal("unable to allocate request")
+	}
+	defer CloseRequest(requestFD)
+	if err := QueueRequest(requestFD); !errors.Is(err, syscall.ENOENT) {
+		t.Fatal("empty request queued")
+	}
+	params := &ExtControlValue{ID: CidStatelessH264DecodeParams, Payload: bytes.Repeat([]byte{7}, 16)}
+	if err := GetExtControls(fd, CtrlWhichRequestVal, requestFD, []*ExtControlValue{params}); !errors.Is(err, syscall.EACCES) {
+		t.Fatal("values of incomplete request returned")
+	}
+	if err := SetExtControls(fd, CtrlWhichRequestVal, requestFD, []*ExtControlValue{params}); err != nil {
+		t.Fatal("unable to set request controls")
+	}
+	buffer := &BufferMPlane{}
+	buffer.Type = BufTypeVideOutputMPlane
+	buffer.Memory = MemoryMmap
+	buffer.Length = 1
+	if err := EnqueueBufferMPlane(fd, buffer); !errors.Is(err, syscall.EBADR) {
+		t.Fatal("buffer queued without request")
+	}
+	buffer.Flags = BufFlagRequestFD
+	buffer.RequestFD = uint32(requestFD)
+	if err := EnqueueBufferMPlane(fd, buffer); err != nil {
+		t.Fatal("unable to queue buffer in request")
+	}
+	if err := QueueRequest(requestFD); err != nil {
+		t.Fatal("unable to queue request")
+	}
+	if err := ReinitRequest(requestFD); !errors.Is(err, syscall.EBUSY) {
+		t.Fatal("queued request reinitialized")
+	}
+	if completed, err := WaitRequest(requestFD, 10*time.Millisecond); err != nil || completed {
+		t.Fatal("request completed without capture buffer")
+	}
+	if err := StreamOff(fd, BufTypeVideOutputMPlane); err != nil {
+		t.Fatal("unable to stop streaming")
+	}
+	if completed, err := WaitRequest(requestFD, time.Second); err != nil || !completed {
+		t.Fatal("request not completed by stopping streaming")
+	}
+	values := []*ExtControlValue{{ID: CidStatelessH264DecodeParams, Payload: make([]byte, 16)}}
+	if err := GetExtControls(fd, CtrlWhichRequestVal, requestFD, values); err != nil || !bytes.Equal(values[0].Payload, params.Payload) {
+		t.Fatal("incorrect request values returned")
+	}
+	if err := ReinitRequest(requestFD); err != nil {
+		t.Fatal("unable to reinitialize request")
+	}
+}
+
+func TestStatelessDecoder(t *testing.T) {
+	fake, err := NewFakeDevice(testStatelessConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	decoder, err := NewStatelessDecoder(&StatelessDecoderConfig{
+		Device:      fake,
+		Media:       fake,
+		CodedFormat: PixFmtH264Slice,
+		Width:       320,
+		Height:      240,
+		Controls:    []*ExtControlValue{{ID: CidStatelessH264SPS, Payload: bytes.Repeat([]byte{1}, 16)}},
+		BufCount:    2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new stateless decoder")
+	}
+	defer decoder.Close()
+	if decoder.Width() != 320 || decoder.Height() != 240 || decoder.PixFormat() != PixFmtNV12M {
+		t.Fatal("incorrect format negotiated")
+	}
+	for i := 0; i < 5; i++ {
+		params := &ExtControlValue{ID: CidStatelessH264DecodeParams, Payload: bytes.Repeat([]byte{byte(i)}, 16)}
+		if err := decoder.Decode([]byte{byte(i + 1), 0, 0}, time.Duration(i)*40*time.Millisecond, []*ExtControlValue{params}); err != nil {
+			t.Fatal("unable to decode packet")
+		}
+		frame, err := decoder.NextFrame(time.Second)
+		if err != nil {
+			t.Fatal("unable to get frame")
+		}
+		if !bytes.Equal(frame.Data, bytes.Repeat([]byte{byte(i + 1)}, 320*240)) || frame.Timestamp != time.Duration(i)*40*time.Millisecond {
+			t.Fatal("incorrect frame returned")
+		}
+		values := []*ExtControlValue{{ID: CidStatelessH264DecodeParams, Payload: make([]byte, 16)}}
+		if err := GetExtControls(fake.Fd(), CtrlWhichCurVal, 0, values); err != nil || !bytes.Equal(values[0].Payload, params.Payload) {
+			t.Fatal("request controls not applied")
+		}
+		if err := frame.Release(); err != nil {
+			t.Fatal("unable to release frame")
+		}
+	}
+	if _, err := decoder.NextFrame(10 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatal("frame returned without packet")
+	}
+	if err := decoder.Decode([]byte{6, 0, 0}, 0, nil); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	frame, err := decoder.NextFrame(time.Second)
+	if err != nil {
+		t.Fatal("unable to get frame")
+	}
+	if err := decoder.Close(); err != nil {
+		t.Fatal("unable to close decoder")
+	}
+	if !bytes.Equal(frame.Data, bytes.Repeat([]byte{6}, 320*240)) {
+		t.Fatal("frame leased at close not detached")
+	}
+	if err := frame.Release(); err != nil {
+		t.Fatal("release of a frame detached by close failed")
+	}
+	if err := decoder.Decode([]byte{1}, 0, nil); !errors.Is(err, ErrClosed) {
+		t.Fatal("packet accepted after close")
+	}
+}
+
+func TestStatelessDecoderReleaseWhilePolling(t *testing.T) {
+	fake, err := NewFakeDevice(testStatelessConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	decoder, err := NewStatelessDecoder(&StatelessDecoderConfig{
+		Device:      fake,
+		Media:       fake,
+		CodedFormat: PixFmtH264Slice,
+		Width:       320,
+		Height:      240,
+		BufCount:    2,
+	})
+	if err != nil {
+		t.Fatal("unable to create new stateless decoder")
+	}
+	defer decoder.Close()
+	if err := decoder.Decode([]byte{1, 0, 0}, 0, nil); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	frame, err := decoder.NextFrame(time.Second)
+	if err != nil {
+		t.Fatal("unable to get frame")
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := decoder.NextFrame(2 * time.Second)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := frame.Release(); err != nil {
+		t.Fatal("unable to release frame")
+	}
+	select {
+	case <-done:
+		t.Fatal("release waited for the pending NextFrame")
+	default:
+	}
+	if err := decoder.Decode([]byte{2, 0, 0}, 40*time.Millisecond, nil); err != nil {
+		t.Fatal("unable to decode packet")
+	}
+	if err := <-done; err != nil {
+		t.Fatal("pending NextFrame did not return the frame")
+	}
+}
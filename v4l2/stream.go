@@ -0,0 +1,242 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrStreaming is returned when a camera is asked to stream, or to grab or
+// dequeue a frame, while it is already streaming.
+var ErrStreaming = errors.New("v4l2: camera is already streaming")
+
+// streamPollInterval is how often the capture goroutine checks for cancellation.
+const streamPollInterval = 100 * time.Millisecond
+
+func (c *camera) Stream(ctx context.Context) (<-chan *Frame, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.streaming {
+		return nil, ErrStreaming
+	}
+	if err := c.streamOn(); err != nil {
+		return nil, err
+	}
+	c.streaming = true
+	frames := make(chan *Frame, len(c.buffers))
+	c.capturing.Add(1)
+	go c.capture(ctx, frames)
+	return frames, nil
+}
+
+// isStreaming reports whether a Stream goroutine is delivering the frames.
+func (c *camera) isStreaming() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.streaming
+}
+
+func (c *camera) Errors() <-chan error {
+	return c.errors
+}
+
+// capture delivers frames until ctx is cancelled, the camera is closed or the
+// device fails. Close tears streaming down itself.
+func (c *camera) capture(ctx context.Context, frames chan<- *Frame) {
+	defer c.capturing.Done()
+	defer close(frames)
+	for {
+		if c.isClosing() {
+			c.mutex.Lock()
+			c.streaming = false
+			c.mutex.Unlock()
+			return
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		frame, err := c.nextFrame(streamPollInterval)
+		if err != nil {
+			c.stopStreaming()
+			c.reportError(err)
+			return
+		}
+		if frame == nil {
+			continue
+		}
+		select {
+		case frames <- frame:
+		case <-ctx.Done():
+		case <-c.closing:
+		}
+	}
+	if err := c.stopStreaming(); err != nil {
+		c.reportError(err)
+	}
+}
+
+// nextFrame waits up to timeout for a frame, returning nil if none arrived.
+// The returned frame holds a copy of the data and the buffer is re-enqueued.
+func (c *camera) nextFrame(timeout time.Duration) (*Frame, error) {
+	if c.ioMethod == IOMethodReadWrite {
+		return c.readFrame(timeout)
+	}
+	buffer, err := c.dequeue(timeout)
+	if err != nil || buffer == nil {
+		return nil, err
+	}
+	frame := newFrame(buffer, c.buffers[buffer.Index], true)
+	if err := c.enqueue(buffer); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// readFrame waits up to timeout for a frame to read, returning nil if none arrived.
+func (c *camera) readFrame(timeout time.Duration) (*Frame, error) {
+	revents, err := poll(c.device, unix.POLLIN, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if revents&unix.POLLIN == 0 {
+		return nil, pollError(c.fd, revents)
+	}
+	data, err := ReadFrame(c.fd, c.sizeImage)
+	if err != nil {
+		return nil, err
+	}
+	var timestamp unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &timestamp); err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	sequence := c.sequence
+	c.sequence++
+	c.mutex.Unlock()
+	frame := &Frame{
+		Data:      data,
+		Planes:    []FramePlane{{Data: data, BytesUsed: uint32(len(data))}},
+		Sequence:  sequence,
+		Timestamp: time.Duration(timestamp.Nano()),
+		Flags:     BufFlagTimestampMonotonic,
+		BytesUsed: uint32(len(data)),
+	}
+	return frame, nil
+}
+
+// dequeue waits up to timeout for a filled buffer, returning nil if none arrived.
+// Single-planar buffers are returned with their only plane described in Planes[0].
+func (c *camera) dequeue(timeout time.Duration) (*BufferMPlane, error) {
+	revents, err := poll(c.device, unix.POLLIN, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if revents == 0 {
+		return nil, nil
+	}
+	buffer, err := c.dequeueBuffer()
+	if err != nil {
+		if !errors.Is(err, syscall.EAGAIN) {
+			return nil, err
+		}
+		return nil, pollError(c.fd, revents)
+	}
+	return buffer, nil
+}
+
+// pollError returns the error signalled by poll events without POLLIN on the
+// device identified by fd, which is nil when the poll merely timed out.
+func pollError(fd int, revents int16) error {
+	if revents&unix.POLLHUP != 0 {
+		return newIoctlError(fd, "poll", 0, syscall.ENODEV)
+	}
+	if revents&unix.POLLERR != 0 {
+		return newIoctlError(fd, "poll", 0, syscall.EIO)
+	}
+	return nil
+}
+
+// dequeueBuffer dequeues a buffer using the single- or multi-planar API.
+func (c *camera) dequeueBuffer() (*BufferMPlane, error) {
+	if IsMultiPlanar(c.bufType) {
+		return DequeueBufferMPlane(c.fd, c.bufType, c.memory)
+	}
+	buffer, err := DequeueBuffer(c.fd, c.bufType, c.memory)
+	if err != nil {
+		return nil, err
+	}
+	bufferMPlane := &BufferMPlane{Buffer: *buffer}
+	bufferMPlane.Planes[0].BytesUsed = buffer.BytesUsed
+	bufferMPlane.Planes[0].Length = buffer.Length
+	return bufferMPlane, nil
+}
+
+// queryBuffer queries a buffer using the single- or multi-planar API.
+func (c *camera) queryBuffer(index uint32) (*BufferMPlane, error) {
+	if IsMultiPlanar(c.bufType) {
+		return QueryBufferMPlane(c.fd, index, c.bufType, c.memory)
+	}
+	buffer, err := QueryBuffer(c.fd, index, c.bufType, c.memory)
+	if err != nil {
+		return nil, err
+	}
+	return &BufferMPlane{Buffer: *buffer}, nil
+}
+
+// enqueue enqueues a buffer using the single- or multi-planar API, handing
+// imported and user pointer buffers their memory again.
+func (c *camera) enqueue(buffer *BufferMPlane) error {
+	switch c.memory {
+	case MemoryDMABuf:
+		return EnqueueDMABuf(c.fd, c.bufType, buffer.Index, c.dmabufs[buffer.Index])
+	case MemoryUserPtr:
+		return EnqueueUserPtr(c.fd, c.bufType, buffer.Index, c.buffers[buffer.Index])
+	}
+	if IsMultiPlanar(c.bufType) {
+		return EnqueueBufferMPlane(c.fd, buffer)
+	}
+	return EnqueueBuffer(c.fd, &buffer.Buffer)
+}
+
+// stopStreaming ends a Stream, so that the camera can be streamed again.
+func (c *camera) stopStreaming() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.streaming = false
+	return c.streamOff()
+}
+
+// reportError makes a terminal streaming error available on the error channel.
+func (c *camera) reportError(err error) {
+	select {
+	case c.errors <- err:
+	default:
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package v4l2
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrNoTuner is returned when a camera is asked to tune while its current input has no tuner.
+var ErrNoTuner = errors.New("v4l2: current input has no tuner")
+
+// ErrNoModulator is returned when a camera is asked to modulate while its current output has no modulator.
+var ErrNoModulator = errors.New("v4l2: current output has no modulator")
+
+// ToHz converts a frequency in the units given by the capabilities, 62.5 kHz,
+// 62.5 Hz with TunerCapLow or 1 Hz with TunerCap1Hz, to Hz.
+func (c TunerCap) ToHz(frequency uint32) uint64 {
+	switch {
+	case c&TunerCap1Hz != 0:
+		return uint64(frequency)
+	case c&TunerCapLow != 0:
+		return uint64(frequency) * 125 / 2
+	}
+	return uint64(frequency) * 62500
+}
+
+// FromHz converts a frequency in Hz to the nearest one in the units given by the capabilities.
+func (c TunerCap) FromHz(hz uint64) uint32 {
+	var frequency uint64
+	switch {
+	case c&TunerCap1Hz != 0:
+		frequency = hz
+	case c&TunerCapLow != 0:
+		frequency = (hz*2 + 62) / 125
+	default:
+		frequency = (hz + 31250) / 62500
+	}
+	return uint32(min(frequency, math.MaxUint32))
+}
+
+// RangeHz returns the frequency range of the tuner in Hz.
+func (t *Tuner) RangeHz() (uint64, uint64) {
+	return t.Capability.ToHz(t.RangeLow), t.Capability.ToHz(t.RangeHigh)
+}
+
+// RangeHz returns the frequency range of the modulator in Hz.
+func (m *Modulator) RangeHz() (uint64, uint64) {
+	return m.Capability.ToHz(m.RangeLow), m.Capability.ToHz(m.RangeHigh)
+}
+
+// RangeHz returns the frequency range of the band in Hz.
+func (b *FrequencyBand) RangeHz() (uint64, uint64) {
+	return b.Capability.ToHz(b.RangeLow), b.Capability.ToHz(b.RangeHigh)
+}
+
+// GetFrequencyHz returns the frequency of the tuner in Hz.
+func GetFrequencyHz(fd int, tuner uint32) (uint64, error) {
+	t, err := GetTuner(fd, tuner)
+	if err != nil {
+		return 0, err
+	}
+	frequency, err := GetFrequency(fd, tuner)
+	if err != nil {
+		return 0, err
+	}
+	return t.Capability.ToHz(frequency.Frequency), nil
+}
+
+// SetFrequencyHz tunes the tuner to the frequency in Hz, returning the
+// frequency the driver settled on.
+func SetFrequencyHz(fd int, tuner uint32, hz uint64) (uint64, error) {
+	t, err := GetTuner(fd, tuner)
+	if err != nil {
+		return 0, err
+	}
+	if err := SetFrequency(fd, tuner, t.Type, t.Capability.FromHz(hz)); err != nil {
+		return 0, err
+	}
+	frequency, err := GetFrequency(fd, tuner)
+	if err != nil {
+		return 0, err
+	}
+	return t.Capability.ToHz(frequency.Frequency), nil
+}
+
+// GetModulatorFrequencyHz returns the frequency of the modulator in Hz.
+func GetModulatorFrequencyHz(fd int, modulator uint32) (uint64, error) {
+	m, err := GetModulator(fd, modulator)
+	if err != nil {
+		return 0, err
+	}
+	frequency, err := GetFrequency(fd, modulator)
+	if err != nil {
+		return 0, err
+	}
+	return m.Capability.ToHz(frequency.Frequency), nil
+}
+
+// SetModulatorFrequencyHz tunes the modulator to the frequency in Hz,
+// returning the frequency the driver settled on.
+func SetModulatorFrequencyHz(fd int, modulator uint32, hz uint64) (uint64, error) {
+	m, err := GetModulator(fd, modulator)
+	if err != nil {
+		return 0, err
+	}
+	if err := SetFrequency(fd, modulator, m.Type, m.Capability.FromHz(hz)); err != nil {
+		return 0, err
+	}
+	frequency, err := GetFrequency(fd, modulator)
+	if err != nil {
+		return 0, err
+	}
+	return m.Capability.ToHz(frequency.Frequency), nil
+}
+
+func (c *camera) GetTuner() (*Tuner, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	index, err := c.tuner()
+	if err != nil {
+		return nil, err
+	}
+	return GetTuner(c.fd, index)
+}
+
+func (c *camera) SetAudioMode(mode TunerMode) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	index, err := c.tuner()
+	if err != nil {
+		return err
+	}
+	return SetTuner(c.fd, index, mode)
+}
+
+func (c *camera) GetFrequency() (uint64, error) {
+	if err := c.enter(); err != nil {
+		return 0, err
+	}
+	defer c.leave()
+	index, err := c.tuner()
+	if err != nil {
+		return 0, err
+	}
+	return GetFrequencyHz(c.fd, index)
+}
+
+func (c *camera) SetFrequency(hz uint64) (uint64, error) {
+	if err := c.enter(); err != nil {
+		return 0, err
+	}
+	defer c.leave()
+	index, err := c.tuner()
+	if err != nil {
+		return 0, err
+	}
+	return SetFrequencyHz(c.fd, index, hz)
+}
+
+func (c *camera) EnumFreqBands() ([]*FrequencyBand, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	index, err := c.tuner()
+	if err != nil {
+		return nil, err
+	}
+	tuner, err := GetTuner(c.fd, index)
+	if err != nil {
+		return nil, err
+	}
+	return EnumFreqBands(c.fd, index, tuner.Type)
+}
+
+// SeekFrequency seeks the next station up or down from the current frequency
+// across the whole tuner range, returning its frequency in Hz.
+func (c *camera) SeekFrequency(upward, wrap bool) (uint64, error) {
+	if err := c.enter(); err != nil {
+		return 0, err
+	}
+	defer c.leave()
+	index, err := c.tuner()
+	if err != nil {
+		return 0, err
+	}
+	tuner, err := GetTuner(c.fd, index)
+	if err != nil {
+		return 0, err
+	}
+	seek := &HWFreqSeek{Tuner: index, Type: tuner.Type}
+	if upward {
+		seek.SeekUpward = 1
+	}
+	if wrap {
+		seek.WrapAround = 1
+	}
+	if err := SeekFrequency(c.fd, seek); err != nil {
+		return 0, err
+	}
+	return GetFrequencyHz(c.fd, index)
+}
+
+// tuner returns the index of the tuner feeding the current input. Radio
+// devices have no inputs, so their tuner is tuner 0.
+func (c *camera) tuner() (uint32, error) {
+	index, err := GetInput(c.fd)
+	if errors.Is(err, ErrUnsupported) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	inputs, err := EnumInputs(c.fd)
+	if err != nil {
+		return 0, err
+	}
+	if len(inputs) == 0 {
+		return 0, nil
+	}
+	if index >= uint32(len(inputs)) || inputs[index].Type != InputTypeTuner {
+		return 0, ErrNoTuner
+	}
+	return inputs[index].Tuner, nil
+}
+
+func (c *camera) GetModulator() (*Modulator, error) {
+	if err := c.enter(); err != nil {
+		return nil, err
+	}
+	defer c.leave()
+	index, err := c.modulator()
+	if err != nil {
+		return nil, err
+	}
+	return GetModulator(c.fd, index)
+}
+
+// SetModulator selects the sub-channels transmitted by the modulator, such
+// as TunerSubStereo or TunerSubRDS.
+func (c *camera) SetModulator(txSubChans TunerSub) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.leave()
+	index, err := c.modulator()
+	if err != nil {
+		return err
+	}
+	return SetModulator(c.fd, index, txSubChans)
+}
+
+func (c *camera) GetModulatorFrequency() (uint64, error) {
+	if err := c.enter(); err != nil {
+		return 0, err
+	}
+	defer c.leave()
+	index, err := c.modulator()
+	if err != nil {
+		return 0, err
+	}
+	return GetModulatorFrequencyHz(c.fd, index)
+}
+
+func (c *camera) SetModulatorFrequency(hz uint64) (uint64, error) {
+	if err := c.enter(); err != nil {
+		return 0, err
+	}
+	defer c.leave()
+	index, err := c.modulator()
+	if err != nil {
+		return 0, err
+	}
+	return SetModulatorFrequencyHz(c.fd, index, hz)
+}
+
+// modulator returns the index of the modulator fed by the current output.
+// Radio devices have no outputs, so their modulator is modulator 0.
+func (c *camera) modulator() (uint32, error) {
+	index, err := GetOutput(c.fd)
+	if errors.Is(err, ErrUnsupported) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	outputs, err := EnumOutputs(c.fd)
+	if err != nil {
+		return 0, err
+	}
+	if len(outputs) == 0 {
+		return 0, nil
+	}
+	if index >= uint32(len(outputs)) || outputs[index].Type != OutputTypeModulator {
+		return 0, ErrNoModulator
+	}
+	return outputs[index].Modulator, nil
+}
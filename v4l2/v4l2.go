@@ -22,7 +22,13 @@ package v4l2
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"runtime"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -42,9 +48,28 @@ type AudMode uint32
 
 // Audio mode flags.
 const (
-	AudModeAVL = 1 << iota
+	AudModeAVL AudMode = 1 << iota
 )
 
+// AudioSet is a bitmask of audio inputs or outputs, bit n standing for index n.
+type AudioSet uint32
+
+// Contains reports whether the set contains the audio input or output.
+func (s AudioSet) Contains(index uint32) bool {
+	return index < 32 && s&(1<<index) != 0
+}
+
+// Indexes returns the indexes in the set in ascending order.
+func (s AudioSet) Indexes() []uint32 {
+	indexes := make([]uint32, 0, bits.OnesCount32(uint32(s)))
+	for index := uint32(0); index < 32; index++ {
+		if s.Contains(index) {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
 // ColorSpace is the the color space type.
 type ColorSpace uint32
 
@@ -163,6 +188,354 @@ const (
 	CapDeviceCaps
 )
 
+// DVType is the DV timings type type.
+type DVType uint32
+
+// The DV timings types.
+const (
+	DVTypeBT6561120 DVType = 0
+)
+
+// The DV scan types.
+const (
+	DVProgressive uint32 = 0
+	DVInterlaced  uint32 = 1
+)
+
+// DVPolarity is the DV sync polarity type.
+type DVPolarity uint32
+
+// The DV sync polarities.
+const (
+	DVVSyncPosPol DVPolarity = 0x00000001
+	DVHSyncPosPol DVPolarity = 0x00000002
+)
+
+// DVBTStd is the DV timings standard type.
+type DVBTStd uint32
+
+// The DV timings standards.
+const (
+	DVBTStdCEA861 DVBTStd = 1 << 0
+	DVBTStdDMT    DVBTStd = 1 << 1
+	DVBTStdCVT    DVBTStd = 1 << 2
+	DVBTStdGTF    DVBTStd = 1 << 3
+	DVBTStdSDI    DVBTStd = 1 << 4
+)
+
+// DVFlag is the DV timings flag type.
+type DVFlag uint32
+
+// The DV timings flags.
+const (
+	DVFlReducedBlanking     DVFlag = 1 << 0
+	DVFlCanReduceFPS        DVFlag = 1 << 1
+	DVFlReducedFPS          DVFlag = 1 << 2
+	DVFlHalfLine            DVFlag = 1 << 3
+	DVFlIsCEVideo           DVFlag = 1 << 4
+	DVFlFirstFieldExtraLine DVFlag = 1 << 5
+	DVFlHasPictureAspect    DVFlag = 1 << 6
+	DVFlHasCEA861VIC        DVFlag = 1 << 7
+	DVFlHasHDMIVIC          DVFlag = 1 << 8
+	DVFlCanDetectReducedFPS DVFlag = 1 << 9
+)
+
+// DVBTCap is the DV timings capability type.
+type DVBTCap uint32
+
+// The DV timings capabilities.
+const (
+	DVBTCapInterlaced      DVBTCap = 1 << 0
+	DVBTCapProgressive     DVBTCap = 1 << 1
+	DVBTCapReducedBlanking DVBTCap = 1 << 2
+	DVBTCapCustom          DVBTCap = 1 << 3
+)
+
+// EncCmd is the encoder command type.
+type EncCmd uint32
+
+// The encoder commands.
+const (
+	EncCmdStart EncCmd = iota
+	EncCmdStop
+	EncCmdPause
+	EncCmdResume
+)
+
+// EncCmdFlag is the encoder command flag type.
+type EncCmdFlag uint32
+
+// Encoder command flags.
+const (
+	EncCmdStopAtGOPEnd EncCmdFlag = 1 << iota
+)
+
+// DecCmd is the decoder command type.
+type DecCmd uint32
+
+// The decoder commands.
+const (
+	DecCmdStart DecCmd = iota
+	DecCmdStop
+	DecCmdPause
+	DecCmdResume
+	DecCmdFlush
+)
+
+// H264SPSConstraint is the H.264 SPS constraint set flag type.
+type H264SPSConstraint uint8
+
+// H.264 SPS constraint set flags.
+const (
+	H264SPSConstraintSet0 H264SPSConstraint = 1 << iota
+	H264SPSConstraintSet1
+	H264SPSConstraintSet2
+	H264SPSConstraintSet3
+	H264SPSConstraintSet4
+	H264SPSConstraintSet5
+)
+
+// H264SPSFlag is the H.264 SPS flag type.
+type H264SPSFlag uint32
+
+// H.264 SPS flags.
+const (
+	H264SPSFlagSeparateColourPlane H264SPSFlag = 1 << iota
+	H264SPSFlagQPPrimeYZeroTransformBypass
+	H264SPSFlagDeltaPicOrderAlwaysZero
+	H264SPSFlagGapsInFrameNumValueAllowed
+	H264SPSFlagFrameMBSOnly
+	H264SPSFlagMBAdaptiveFrameField
+	H264SPSFlagDirect8x8Inference
+)
+
+// H264PPSFlag is the H.264 PPS flag type.
+type H264PPSFlag uint16
+
+// H.264 PPS flags.
+const (
+	H264PPSFlagEntropyCodingMode H264PPSFlag = 1 << iota
+	H264PPSFlagBottomFieldPicOrderInFramePresent
+	H264PPSFlagWeightedPred
+	H264PPSFlagDeblockingFilterControlPresent
+	H264PPSFlagConstrainedIntraPred
+	H264PPSFlagRedundantPicCntPresent
+	H264PPSFlagTransform8x8Mode
+	H264PPSFlagScalingMatrixPresent
+)
+
+// H264SliceType is the H.264 slice type type.
+type H264SliceType uint8
+
+// The H.264 slice types.
+const (
+	H264SliceTypeP H264SliceType = iota
+	H264SliceTypeB
+	H264SliceTypeI
+	H264SliceTypeSP
+	H264SliceTypeSI
+)
+
+// H264SliceFlag is the H.264 slice flag type.
+type H264SliceFlag uint32
+
+// H.264 slice flags.
+const (
+	H264SliceFlagDirectSpatialMVPred H264SliceFlag = 1 << iota
+	H264SliceFlagSPForSwitch
+)
+
+// H264Fields is the H.264 reference fields type.
+type H264Fields uint8
+
+// H.264 reference fields.
+const (
+	H264TopFieldRef    H264Fields = 0x1
+	H264BottomFieldRef H264Fields = 0x2
+	H264FrameRef       H264Fields = 0x3
+)
+
+// H264DPBEntryFlag is the H.264 DPB entry flag type.
+type H264DPBEntryFlag uint32
+
+// H.264 DPB entry flags.
+const (
+	H264DPBEntryFlagValid H264DPBEntryFlag = 1 << iota
+	H264DPBEntryFlagActive
+	H264DPBEntryFlagLongTerm
+	H264DPBEntryFlagField
+)
+
+// H264DecodeParamFlag is the H.264 decode parameter flag type.
+type H264DecodeParamFlag uint32
+
+// H.264 decode parameter flags.
+const (
+	H264DecodeParamFlagIDRPic H264DecodeParamFlag = 1 << iota
+	H264DecodeParamFlagFieldPic
+	H264DecodeParamFlagBottomField
+	H264DecodeParamFlagPFrame
+	H264DecodeParamFlagBFrame
+)
+
+// The values of CidStatelessH264DecodeMode.
+const (
+	H264DecodeModeSliceBased int64 = iota
+	H264DecodeModeFrameBased
+)
+
+// The values of CidStatelessH264StartCode.
+const (
+	H264StartCodeNone int64 = iota
+	H264StartCodeAnnexB
+)
+
+// H264NumDPBEntries is the number of entries in the H.264 DPB.
+const H264NumDPBEntries = 16
+
+// H264RefListLen is the length of the H.264 reference picture lists.
+const H264RefListLen = 2 * H264NumDPBEntries
+
+// VP8SegmentFlag is the VP8 segment flag type.
+type VP8SegmentFlag uint32
+
+// VP8 segment flags.
+const (
+	VP8SegmentFlagEnabled VP8SegmentFlag = 1 << iota
+	VP8SegmentFlagUpdateMap
+	VP8SegmentFlagUpdateFeatureData
+	VP8SegmentFlagDeltaValueMode
+)
+
+// VP8LoopfilterFlag is the VP8 loop filter flag type.
+type VP8LoopfilterFlag uint32
+
+// VP8 loop filter flags.
+const (
+	VP8LoopfilterFlagAdjEnable VP8LoopfilterFlag = 1 << iota
+	VP8LoopfilterFlagDeltaUpdate
+	VP8LoopfilterFlagFilterTypeSimple
+)
+
+// VP8FrameFlag is the VP8 frame flag type.
+type VP8FrameFlag uint64
+
+// VP8 frame flags.
+const (
+	VP8FrameFlagKeyFrame VP8FrameFlag = 1 << iota
+	VP8FrameFlagExperimental
+	VP8FrameFlagShowFrame
+	VP8FrameFlagMBNoSkipCoeff
+	VP8FrameFlagSignBiasGolden
+	VP8FrameFlagSignBiasAlt
+)
+
+// Mpeg2SeqFlag is the MPEG-2 sequence flag type.
+type Mpeg2SeqFlag uint8
+
+// MPEG-2 sequence flags.
+const (
+	Mpeg2SeqFlagProgressive Mpeg2SeqFlag = 1 << iota
+)
+
+// Mpeg2PicCodingType is the MPEG-2 picture coding type type.
+type Mpeg2PicCodingType uint8
+
+// The MPEG-2 picture coding types.
+const (
+	Mpeg2PicCodingTypeI Mpeg2PicCodingType = iota + 1
+	Mpeg2PicCodingTypeP
+	Mpeg2PicCodingTypeB
+	Mpeg2PicCodingTypeD
+)
+
+// Mpeg2PicStructure is the MPEG-2 picture structure type.
+type Mpeg2PicStructure uint8
+
+// The MPEG-2 picture structures.
+const (
+	Mpeg2PicTopField    Mpeg2PicStructure = 0x1
+	Mpeg2PicBottomField Mpeg2PicStructure = 0x2
+	Mpeg2PicFrame       Mpeg2PicStructure = 0x3
+)
+
+// Mpeg2PicFlag is the MPEG-2 picture flag type.
+type Mpeg2PicFlag uint32
+
+// MPEG-2 picture flags.
+const (
+	Mpeg2PicFlagTopFieldFirst Mpeg2PicFlag = 1 << iota
+	Mpeg2PicFlagFramePredDCT
+	Mpeg2PicFlagConcealmentMV
+	Mpeg2PicFlagQScaleType
+	Mpeg2PicFlagIntraVLC
+	Mpeg2PicFlagAltScan
+	Mpeg2PicFlagRepeatFirst
+	Mpeg2PicFlagProgressive
+)
+
+// DecCmdFlag is the decoder command flag type.
+type DecCmdFlag uint32
+
+// Decoder command flags. The flag values overlap and depend on the command.
+const (
+	DecCmdStartMuteAudio  DecCmdFlag = 1 << 0
+	DecCmdPauseToBlack    DecCmdFlag = 1 << 0
+	DecCmdStopToBlack     DecCmdFlag = 1 << 0
+	DecCmdStopImmediately DecCmdFlag = 1 << 1
+)
+
+// EventType is the event type type.
+type EventType uint32
+
+// The event types.
+const (
+	EventTypeAll          EventType = 0
+	EventTypeVSync        EventType = 1
+	EventTypeEOS          EventType = 2
+	EventTypeCtrl         EventType = 3
+	EventTypeFrameSync    EventType = 4
+	EventTypeSourceChange EventType = 5
+	EventTypeMotionDet    EventType = 6
+	EventTypePrivateStart EventType = 0x08000000
+)
+
+// EventSubFlag is the event subscription flag type.
+type EventSubFlag uint32
+
+// The event subscription flags.
+const (
+	EventSubFlSendInitial   EventSubFlag = 0x0001
+	EventSubFlAllowFeedback EventSubFlag = 0x0002
+)
+
+// EventCtrlChange is the control event change type.
+type EventCtrlChange uint32
+
+// The control event changes.
+const (
+	EventCtrlChValue      EventCtrlChange = 0x0001
+	EventCtrlChFlags      EventCtrlChange = 0x0002
+	EventCtrlChRange      EventCtrlChange = 0x0004
+	EventCtrlChDimensions EventCtrlChange = 0x0008
+)
+
+// EventSrcChangeFlag is the source change event change type.
+type EventSrcChangeFlag uint32
+
+// The source change event changes.
+const (
+	EventSrcChResolution EventSrcChangeFlag = 0x0001
+)
+
+// EventMdFlag is the motion detection event flag type.
+type EventMdFlag uint32
+
+// The motion detection event flags.
+const (
+	EventMdFlHaveFrameSeq EventMdFlag = 0x0001
+)
+
 // Field is the field type.
 type Field uint32
 
@@ -201,6 +574,16 @@ const (
 	FrmSizeTypeStepwise
 )
 
+// FrmIvalType is the frame interval type type.
+type FrmIvalType uint32
+
+// Frame interval types.
+const (
+	FrmIvalTypeDiscrete FrmIvalType = iota + 1
+	FrmIvalTypeContinuous
+	FrmIvalTypeStepwise
+)
+
 // InputCap is the input capabilities type.
 type InputCap uint32
 
@@ -246,6 +629,47 @@ const (
 	InputStatusVTR
 )
 
+// inputStatusNames are the names of the input status flags.
+var inputStatusNames = []struct {
+	status InputStatus
+	name   string
+}{
+	{InputStatusNoPower, "no power"},
+	{InputStatusNoSignal, "no signal"},
+	{InputStatusNoColor, "no color"},
+	{InputStatusHFlip, "hflip"},
+	{InputStatusVFlip, "vflip"},
+	{InputStatusNoHLock, "no hlock"},
+	{InputStatusColorKill, "color kill"},
+	{InputStatusNoVLock, "no vlock"},
+	{InputStatusNoStdLock, "no std lock"},
+	{InputStatusNoSync, "no sync"},
+	{InputStatusNoEqu, "no equalizer"},
+	{InputStatusNoCarrier, "no carrier"},
+	{InputStatusMacroVision, "macrovision"},
+	{InputStatusNoAccess, "no access"},
+	{InputStatusVTR, "vtr"},
+}
+
+// SignalLost reports whether the input has no power, signal, sync or carrier.
+func (s InputStatus) SignalLost() bool {
+	return s&(InputStatusNoPower|InputStatusNoSignal|InputStatusNoSync|InputStatusNoCarrier) != 0
+}
+
+// String returns the names of the set flags separated by commas, or "ok".
+func (s InputStatus) String() string {
+	names := make([]string, 0, 4)
+	for _, flag := range inputStatusNames {
+		if s&flag.status != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	if len(names) == 0 {
+		return "ok"
+	}
+	return strings.Join(names, ", ")
+}
+
 // InputType is the input type type.
 type InputType uint32
 
@@ -283,11 +707,27 @@ type OutputType uint32
 
 // Output types.
 const (
-	OutputTypeModulator = 1 + iota
+	OutputTypeModulator OutputType = 1 + iota
 	OutputTypeAnalog
 	OutputTypeAnalogVGAOverlay
 )
 
+// ParmCap is the streaming parameter capability type.
+type ParmCap uint32
+
+// Streaming parameter capabilities.
+const (
+	ParmCapTimePerFrame ParmCap = 0x1000
+)
+
+// ParmMode is the streaming parameter mode type.
+type ParmMode uint32
+
+// Streaming parameter modes.
+const (
+	ParmModeHighQuality ParmMode = 0x0001
+)
+
 // PixFmt is the pixel format type.
 type PixFmt uint32
 
@@ -442,6 +882,31 @@ const (
 	QuantizationLimRange
 )
 
+// SelTarget is the selection target type.
+type SelTarget uint32
+
+// The selection targets.
+const (
+	SelTgtCrop           SelTarget = 0x0000
+	SelTgtCropDefault    SelTarget = 0x0001
+	SelTgtCropBounds     SelTarget = 0x0002
+	SelTgtNativeSize     SelTarget = 0x0003
+	SelTgtCompose        SelTarget = 0x0100
+	SelTgtComposeDefault SelTarget = 0x0101
+	SelTgtComposeBounds  SelTarget = 0x0102
+	SelTgtComposePadded  SelTarget = 0x0103
+)
+
+// SelFlag is the selection constraint flag type.
+type SelFlag uint32
+
+// The selection constraint flags.
+const (
+	SelFlagGE         SelFlag = 0x00000001 // The rectangle may grow but not shrink.
+	SelFlagLE         SelFlag = 0x00000002 // The rectangle may shrink but not grow.
+	SelFlagKeepConfig SelFlag = 0x00000004 // Other pipeline stages must not change.
+)
+
 // SlicedVBIService is the sliced VBI service type.
 type SlicedVBIService uint16
 
@@ -536,19 +1001,31 @@ type CtrlClass uint32
 
 // The control classes.
 const (
-	CtrlClassUser        CtrlClass = 0x00980000
-	CtrlClassCodec       CtrlClass = 0x00990000
-	CtrlClassCamera      CtrlClass = 0x009a0000
-	CtrlClassFMTX        CtrlClass = 0x009b0000
-	CtrlClassFlash       CtrlClass = 0x009c0000
-	CtrlClassJPEG        CtrlClass = 0x009d0000
-	CtrlClassImageSource CtrlClass = 0x009e0000
-	CtrlClassImageProc   CtrlClass = 0x009f0000
-	CtrlClassDV          CtrlClass = 0x00a00000
-	CtrlClassFMRX        CtrlClass = 0x00a10000
-	CtrlClassRFTuner     CtrlClass = 0x00a20000
-	CtrlClassDetect      CtrlClass = 0x00a30000
-	CtrlClassColorimetry CtrlClass = 0x00a50000
+	CtrlClassUser           CtrlClass = 0x00980000
+	CtrlClassCodec          CtrlClass = 0x00990000
+	CtrlClassCamera         CtrlClass = 0x009a0000
+	CtrlClassFMTX           CtrlClass = 0x009b0000
+	CtrlClassFlash          CtrlClass = 0x009c0000
+	CtrlClassJPEG           CtrlClass = 0x009d0000
+	CtrlClassImageSource    CtrlClass = 0x009e0000
+	CtrlClassImageProc      CtrlClass = 0x009f0000
+	CtrlClassDV             CtrlClass = 0x00a00000
+	CtrlClassFMRX           CtrlClass = 0x00a10000
+	CtrlClassRFTuner        CtrlClass = 0x00a20000
+	CtrlClassDetect         CtrlClass = 0x00a30000
+	CtrlClassCodecStateless CtrlClass = 0x00a40000
+	CtrlClassColorimetry    CtrlClass = 0x00a50000
+)
+
+// CtrlWhich selects the control values an extended control request operates on.
+type CtrlWhich uint32
+
+// The control value selectors. A CtrlClass may be used as well to restrict a
+// request to the controls of that class.
+const (
+	CtrlWhichCurVal     CtrlWhich = 0
+	CtrlWhichDefVal     CtrlWhich = 0x0f000000
+	CtrlWhichRequestVal CtrlWhich = 0x0f010000
 )
 
 // CtrlID is the control ID type.
@@ -837,9 +1314,33 @@ const (
 	CidMPEGMFC51VideoH264ADAPTIVE_RC_SMOOTH           CtrlID = CidCodecMFC51_BASE + 52
 	CidMPEGMFC51VideoH264ADAPTIVE_RC_STATIC           CtrlID = CidCodecMFC51_BASE + 53
 	CidMPEGMFC51VideoH264NUM_REF_PIC_FOR_P            CtrlID = CidCodecMFC51_BASE + 54
+	CidCodecStatelessBase                             CtrlID = CtrlID(CtrlClassCodecStateless | 0x900)
+	CidStatelessH264DecodeMode                        CtrlID = CidCodecStatelessBase + 0
+	CidStatelessH264StartCode                         CtrlID = CidCodecStatelessBase + 1
+	CidStatelessH264SPS                               CtrlID = CidCodecStatelessBase + 2
+	CidStatelessH264PPS                               CtrlID = CidCodecStatelessBase + 3
+	CidStatelessH264ScalingMatrix                     CtrlID = CidCodecStatelessBase + 4
+	CidStatelessH264PredWeights                       CtrlID = CidCodecStatelessBase + 5
+	CidStatelessH264SliceParams                       CtrlID = CidCodecStatelessBase + 6
+	CidStatelessH264DecodeParams                      CtrlID = CidCodecStatelessBase + 7
+	CidStatelessFWHTParams                            CtrlID = CidCodecStatelessBase + 100
+	CidStatelessVP8Frame                              CtrlID = CidCodecStatelessBase + 200
+	CidStatelessMPEG2Sequence                         CtrlID = CidCodecStatelessBase + 220
+	CidStatelessMPEG2Picture                          CtrlID = CidCodecStatelessBase + 221
+	CidStatelessMPEG2Quantisation                     CtrlID = CidCodecStatelessBase + 222
+	CidStatelessVP9Frame                              CtrlID = CidCodecStatelessBase + 300
+	CidStatelessVP9CompressedHdr                      CtrlID = CidCodecStatelessBase + 301
+	CidStatelessHEVCSPS                               CtrlID = CidCodecStatelessBase + 400
+	CidStatelessHEVCPPS                               CtrlID = CidCodecStatelessBase + 401
+	CidStatelessHEVCSliceParams                       CtrlID = CidCodecStatelessBase + 402
+	CidStatelessHEVCScalingMatrix                     CtrlID = CidCodecStatelessBase + 403
+	CidStatelessHEVCDecodeParams                      CtrlID = CidCodecStatelessBase + 404
+	CidStatelessHEVCDecodeMode                        CtrlID = CidCodecStatelessBase + 405
+	CidStatelessHEVCStartCode                         CtrlID = CidCodecStatelessBase + 406
+	CidStatelessHEVCEntryPointOffsets                 CtrlID = CidCodecStatelessBase + 407
 )
 
-// The video ioctl values.
+// The video and media request ioctl values.
 const (
 	VidIocQueryCap           uint32 = 0x80685600
 	VidIocReserved           uint32 = 0x00005601
@@ -904,11 +1405,82 @@ const (
 	VidIocGEncIndex          uint32 = 0x8818564c
 	VidIocEncoderCmd         uint32 = 0xc028564d
 	VidIocTryEncoderCmd      uint32 = 0xc028564e
+	VidIocSHWFreqSeek        uint32 = 0x40305652
+	VidIocDQEvent            uint32 = 0x80885659
+	VidIocSubscribeEvent     uint32 = 0x4020565a
+	VidIocUnsubscribeEvent   uint32 = 0x4020565b
+	VidIocSDVTimings         uint32 = 0xc0845657
+	VidIocGDVTimings         uint32 = 0xc0845658
+	VidIocGSelection         uint32 = 0xc040565e
+	VidIocSSelection         uint32 = 0xc040565f
+	VidIocEnumDVTimings      uint32 = 0xc0945662
+	VidIocQueryDVTimings     uint32 = 0x80845663
+	VidIocDVTimingsCap       uint32 = 0xc0905664
+	VidIocEnumFreqBands      uint32 = 0xc0405665
+	VidIocDecoderCmd         uint32 = 0xc0485660
+	VidIocTryDecoderCmd      uint32 = 0xc0485661
+	VidIocQueryExtCtrl       uint32 = 0xc0e85667
+	MediaIocRequestAlloc     uint32 = 0x80047c05
+	MediaRequestIocQueue     uint32 = 0x00007c80
+	MediaRequestIocReinit    uint32 = 0x00007c81
 )
 
+// VideoMaxPlanes is the maximum number of planes in a multi-planar buffer.
+const VideoMaxPlanes = 8
+
 // StdID is the standard ID type.
 type StdID uint64
 
+// The standard IDs.
+const (
+	StdPALB      StdID = 0x00000001
+	StdPALB1     StdID = 0x00000002
+	StdPALG      StdID = 0x00000004
+	StdPALH      StdID = 0x00000008
+	StdPALI      StdID = 0x00000010
+	StdPALD      StdID = 0x00000020
+	StdPALD1     StdID = 0x00000040
+	StdPALK      StdID = 0x00000080
+	StdPALM      StdID = 0x00000100
+	StdPALN      StdID = 0x00000200
+	StdPALNc     StdID = 0x00000400
+	StdPAL60     StdID = 0x00000800
+	StdNTSCM     StdID = 0x00001000
+	StdNTSCMJP   StdID = 0x00002000
+	StdNTSC443   StdID = 0x00004000
+	StdNTSCMKR   StdID = 0x00008000
+	StdSECAMB    StdID = 0x00010000
+	StdSECAMD    StdID = 0x00020000
+	StdSECAMG    StdID = 0x00040000
+	StdSECAMH    StdID = 0x00080000
+	StdSECAMK    StdID = 0x00100000
+	StdSECAMK1   StdID = 0x00200000
+	StdSECAML    StdID = 0x00400000
+	StdSECAMLC   StdID = 0x00800000
+	StdATSC8VSB  StdID = 0x01000000
+	StdATSC16VSB StdID = 0x02000000
+	StdUnknown   StdID = 0
+	StdNTSC      StdID = StdNTSCM | StdNTSCMJP | StdNTSCMKR
+	StdSECAMDK   StdID = StdSECAMD | StdSECAMK | StdSECAMK1
+	StdSECAM     StdID = StdSECAMB | StdSECAMG | StdSECAMH | StdSECAMDK | StdSECAML | StdSECAMLC
+	StdPALBG     StdID = StdPALB | StdPALB1 | StdPALG
+	StdPALDK     StdID = StdPALD | StdPALD1 | StdPALK
+	StdPAL       StdID = StdPALBG | StdPALDK | StdPALH | StdPALI
+	StdB         StdID = StdPALB | StdPALB1 | StdSECAMB
+	StdG         StdID = StdPALG | StdSECAMG
+	StdH         StdID = StdPALH | StdSECAMH
+	StdL         StdID = StdSECAML | StdSECAMLC
+	StdGH        StdID = StdG | StdH
+	StdDK        StdID = StdPALDK | StdSECAMDK
+	StdBG        StdID = StdB | StdG
+	StdMN        StdID = StdPALM | StdPALN | StdPALNc | StdNTSC
+	StdMTS       StdID = StdNTSCM | StdPALM | StdPALN | StdPALNc
+	Std525_60    StdID = StdPALM | StdPAL60 | StdNTSC | StdNTSC443
+	Std625_50    StdID = StdPAL | StdPALN | StdPALNc | StdSECAM
+	StdATSC      StdID = StdATSC8VSB | StdATSC16VSB
+	StdAll       StdID = Std525_60 | Std625_50
+)
+
 // TunerCap is the tuner capability type.
 type TunerCap uint32
 
@@ -968,6 +1540,16 @@ const (
 	TunerTypeRF
 )
 
+// BandModulation is the frequency band modulation type.
+type BandModulation uint32
+
+// The frequency band modulations.
+const (
+	BandModulationVSB BandModulation = 1 << (iota + 1)
+	BandModulationFM
+	BandModulationAM
+)
+
 // VBIFmtFlag is the VBI format flag type.
 type VBIFmtFlag uint32
 
@@ -1001,6 +1583,15 @@ type Audio struct {
 	Reserved   [2]uint32
 }
 
+// AudioOut is the v4l2 audioout struct.
+type AudioOut struct {
+	Index      uint32
+	Name       [32]byte
+	Capability AudCap
+	Mode       AudMode
+	Reserved   [2]uint32
+}
+
 // Buffer is the v4l2 buffer struct.
 type Buffer struct {
 	Index     uint32
@@ -1018,6 +1609,23 @@ type Buffer struct {
 	RequestFD uint32
 }
 
+// CaptureParm is the v4l2 captureparm struct.
+type CaptureParm struct {
+	Capability   ParmCap
+	CaptureMode  ParmMode
+	TimePerFrame Fract
+	ExtendedMode uint32
+	ReadBuffers  uint32
+	Reserved     [4]uint32
+}
+
+// BufferMPlane is a multi-planar v4l2 buffer together with its plane array.
+// The buffer M field is pointed at Planes whenever the buffer is passed to the driver.
+type BufferMPlane struct {
+	Buffer
+	Planes [VideoMaxPlanes]Plane
+}
+
 // Capability is the v4l2 capability struct.
 type Capability struct {
 	Driver       [16]byte
@@ -1041,6 +1649,20 @@ type Control struct {
 	Value int32
 }
 
+// Crop is the v4l2 crop struct.
+type Crop struct {
+	Type BufType
+	C    Rect
+}
+
+// CropCap is the v4l2 cropcap struct.
+type CropCap struct {
+	Type        BufType
+	Bounds      Rect
+	DefRect     Rect
+	PixelAspect Fract
+}
+
 // CtrlFwhtparams is the v4l2 TODO.
 type CtrlFwhtparams struct {
 	BackwardRefTS uint64
@@ -1054,14 +1676,88 @@ type CtrlFwhtparams struct {
 	Quantization  uint32
 }
 
-// CtrlH264DecodeParams is the v4l2 TODO.
+// CtrlH264DecodeParams is the v4l2 ctrl_h264_decode_params.
 type CtrlH264DecodeParams struct {
-	DPD                 [16]H264DPDEntry
-	NumSlices           uint16
-	NALRefIDC           uint16
-	TopFieldOrderCnt    uint32
-	BottomFieldOrderCnt uint32
-	Flags               uint32
+	DPD                     [H264NumDPBEntries]H264DPDEntry
+	NALRefIDC               uint16
+	FrameNum                uint16
+	TopFieldOrderCnt        int32
+	BottomFieldOrderCnt     int32
+	IDRPicID                uint16
+	PicOrderCntLSB          uint16
+	DeltaPicOrderCntBottom  int32
+	DeltaPicOrderCnt0       int32
+	DeltaPicOrderCnt1       int32
+	DecRefPicMarkingBitSize uint32
+	PicOrderCntBitSize      uint32
+	SliceGroupChangeCycle   uint32
+	Reserved                uint32
+	Flags                   H264DecodeParamFlag
+}
+
+// CtrlH264PPS is the v4l2 ctrl_h264_pps.
+type CtrlH264PPS struct {
+	PicParameterSetID              uint8
+	SeqParameterSetID              uint8
+	NumSliceGroupsMinus1           uint8
+	NumRefIdxL0DefaultActiveMinus1 uint8
+	NumRefIdxL1DefaultActiveMinus1 uint8
+	WeightedBipredIDC              uint8
+	PicInitQPMinus26               int8
+	PicInitQSMinus26               int8
+	ChromaQPIndexOffset            int8
+	SecondChromaQPIndexOffset      int8
+	Flags                          H264PPSFlag
+}
+
+// CtrlH264ScalingMatrix is the v4l2 ctrl_h264_scaling_matrix.
+// The lists are in raster scan order.
+type CtrlH264ScalingMatrix struct {
+	ScalingList4x4 [6][16]uint8
+	ScalingList8x8 [6][64]uint8
+}
+
+// CtrlH264SliceParams is the v4l2 ctrl_h264_slice_params.
+type CtrlH264SliceParams struct {
+	HeaderBitSize              uint32
+	FirstMBInSlice             uint32
+	SliceType                  H264SliceType
+	ColourPlaneID              uint8
+	RedundantPicCnt            uint8
+	CABACInitIDC               uint8
+	SliceQPDelta               int8
+	SliceQSDelta               int8
+	DisableDeblockingFilterIDC uint8
+	SliceAlphaC0OffsetDiv2     int8
+	SliceBetaOffsetDiv2        int8
+	NumRefIdxL0ActiveMinus1    uint8
+	NumRefIdxL1ActiveMinus1    uint8
+	Reserved                   uint8
+	RefPicList0                [H264RefListLen]H264Reference
+	RefPicList1                [H264RefListLen]H264Reference
+	Flags                      H264SliceFlag
+}
+
+// CtrlH264SPS is the v4l2 ctrl_h264_sps.
+type CtrlH264SPS struct {
+	ProfileIDC                     uint8
+	ConstraintSetFlags             H264SPSConstraint
+	LevelIDC                       uint8
+	SeqParameterSetID              uint8
+	ChromaFormatIDC                uint8
+	BitDepthLumaMinus8             uint8
+	BitDepthChromaMinus8           uint8
+	Log2MaxFrameNumMinus4          uint8
+	PicOrderCntType                uint8
+	Log2MaxPicOrderCntLSBMinus4    uint8
+	MaxNumRefFrames                uint8
+	NumRefFramesInPicOrderCntCycle uint8
+	OffsetForRefFrame              [255]int32
+	OffsetForNonRefPic             int32
+	OffsetForTopToBottomField      int32
+	PicWidthInMBSMinus1            uint16
+	PicHeightInMapUnitsMinus1      uint16
+	Flags                          H264SPSFlag
 }
 
 // CtrlHevcPps is the v4l2 TODO.
@@ -1108,29 +1804,32 @@ type CtrlHevcSps struct {
 	Flags                                uint64
 }
 
-// CtrlMpeg2Quantization is the v4l2 TODO.
+// CtrlMpeg2Quantization is the v4l2 ctrl_mpeg2_quantisation.
+// The matrices are in zigzag scanning order.
 type CtrlMpeg2Quantization struct {
-	LoadIntraQuantiserMatrix          uint8
-	LoadNonIntraQuantiserMatrix       uint8
-	LoadChromaIntraQuantiserMatrix    uint8
-	LoadChromaNonIntraQuantiserMatrix uint8
-	IntraQuantiserMatrix              [64]uint8
-	NonIntraQuantiserMatrix           [64]uint8
-	ChromaIntraQuantiserMatrix        [64]uint8
-	ChromaNonIntraQuantiserMatrix     [64]uint8
+	IntraQuantiserMatrix          [64]uint8
+	NonIntraQuantiserMatrix       [64]uint8
+	ChromaIntraQuantiserMatrix    [64]uint8
+	ChromaNonIntraQuantiserMatrix [64]uint8
 }
 
-// CtrlMpeg2SliceParams is the v4l2 TODO.
+// CtrlMpeg2SliceParams is the v4l2 ctrl_mpeg2_slice_params of the staging
+// MPEG-2 uAPI.
+//
+// Deprecated: The stable uAPI has no slice parameters control; use
+// Mpeg2Sequence, Mpeg2Picture and CtrlMpeg2Quantization instead.
 type CtrlMpeg2SliceParams struct {
 	BitSize            uint32
 	DataBitOffset      uint32
-	Sequence           Mpeg2Sequence
-	Picture            Mpeg2Picture
+	Sequence           Mpeg2SliceSequence
+	Picture            Mpeg2SlicePicture
 	ForwardRefTS       uint64
 	QuantiserScaleCode uint32
 }
 
-// CtrlVP8FrameHeader is the v4l2 TODO.
+// CtrlVP8FrameHeader is the v4l2 ctrl_vp8_frame.
+// The timestamps identify the CAPTURE buffers of the reference frames, see
+// ReferenceTS.
 type CtrlVP8FrameHeader struct {
 	SegmentHeader         VP8SegmentHeader
 	LoopfilterHeader      VP8LoopfilterHeader
@@ -1153,95 +1852,424 @@ type CtrlVP8FrameHeader struct {
 	LastFrameTS           uint64
 	GoldenFrameTS         uint64
 	AltFrameTS            uint64
-	Flags                 uint64
+	Flags                 VP8FrameFlag
 }
 
-// FmtDesc is the v4l2 fmtdesc.
-type FmtDesc struct {
-	Index       uint32
-	Type        BufType
-	Flags       FmtFlag
-	Description [32]byte
-	PixFormat   PixFmt
-	Reserved    [4]uint32
+// BTTimings is the v4l2 bt timings struct. The kernel struct is packed, so it
+// is only ever carried in the raw data of DVTimings and DVTimingsCap.
+type BTTimings struct {
+	Width         uint32
+	Height        uint32
+	Interlaced    uint32
+	Polarities    DVPolarity
+	PixelClock    uint64
+	HFrontPorch   uint32
+	HSync         uint32
+	HBackPorch    uint32
+	VFrontPorch   uint32
+	VSync         uint32
+	VBackPorch    uint32
+	ILVFrontPorch uint32
+	ILVSync       uint32
+	ILVBackPorch  uint32
+	Standards     DVBTStd
+	Flags         DVFlag
+	PictureAspect Fract
+	CEA861VIC     uint8
+	HDMIVIC       uint8
+	Reserved      [46]uint8
+}
+
+// FrameWidth returns the total line length in pixels, including blanking.
+func (bt *BTTimings) FrameWidth() uint32 {
+	return bt.Width + bt.HFrontPorch + bt.HSync + bt.HBackPorch
+}
+
+// FrameHeight returns the total number of lines in a frame, including
+// blanking and, when interlaced, the blanking of the second field.
+func (bt *BTTimings) FrameHeight() uint32 {
+	height := bt.Height + bt.VFrontPorch + bt.VSync + bt.VBackPorch
+	if bt.Interlaced == DVInterlaced {
+		height += bt.ILVFrontPorch + bt.ILVSync + bt.ILVBackPorch
+	}
+	return height
 }
 
-// Format is the v4l2 format.
-type Format struct {
-	Type    BufType
-	_       uint32
-	RawData [200]byte // Union of several possible types.
+// FPS returns the frame rate, taking the 1000/1001 reduction into account.
+func (bt *BTTimings) FPS() float64 {
+	frameSize := uint64(bt.FrameWidth()) * uint64(bt.FrameHeight())
+	if frameSize == 0 {
+		return 0
+	}
+	fps := float64(bt.PixelClock) / float64(frameSize)
+	if bt.Flags&DVFlCanReduceFPS != 0 && bt.Flags&DVFlReducedFPS != 0 {
+		fps = fps * 1000 / 1001
+	}
+	return fps
 }
 
-// FrameSizeDiscrete is v4l2Framesize_discrete.
-type FrameSizeDiscrete struct {
-	Width  uint32
-	Height uint32
+// PixelClockForFPS returns the pixel clock in Hz needed to reach the frame rate.
+func (bt *BTTimings) PixelClockForFPS(fps float64) uint64 {
+	return uint64(fps*float64(bt.FrameWidth())*float64(bt.FrameHeight()) + 0.5)
 }
 
-// FrameSizeEnum is v4l2Framesizeenum.
-type FrameSizeEnum struct {
-	Index     uint32
-	PixFormat PixFmt
-	Type      FrmSizeType
-	M         [24]byte // Union
-	Reserved  [2]uint32
+// BTTimingsCap is the v4l2 bt timings cap struct. Like BTTimings it is packed
+// and carried in the raw data of DVTimingsCap.
+type BTTimingsCap struct {
+	MinWidth      uint32
+	MaxWidth      uint32
+	MinHeight     uint32
+	MaxHeight     uint32
+	MinPixelClock uint64
+	MaxPixelClock uint64
+	Standards     DVBTStd
+	Capabilities  DVBTCap
+	Reserved      [16]uint32
 }
 
-// FrameSizeStepwise is v4l2Framesize_stepwise.
-type FrameSizeStepwise struct {
-	MinWidth   uint32
-	MaxWidth   uint32
-	StepWidth  uint32
-	MinHeight  uint32
-	MaxHeight  uint32
-	StepHeight uint32
+// DVTimings is the v4l2 dv timings struct.
+type DVTimings struct {
+	Type    DVType
+	RawData [128]byte // Union of BTTimings and reserved space.
 }
 
-// Frequency is v4l2Frequency.
-type Frequency struct {
-	Tuner     uint32
-	Type      uint32
-	Frequency uint32
-	Reserved  [4]uint32
+// BT returns the BT.656/1120 timings.
+func (t *DVTimings) BT() (*BTTimings, error) {
+	bt := &BTTimings{}
+	if err := decodePacked(t.RawData[:], bt); err != nil {
+		return nil, err
+	}
+	return bt, nil
 }
 
-// H264DPDEntry is the v4l2 TODO.
-type H264DPDEntry struct {
-	ReferenceTS         uint64
-	FrameNum            uint16
-	PicNum              uint16
-	TopFieldOrderCnt    int32
-	BottomFieldOrderCnt int32
-	Flags               uint32
+// SetBT sets the BT.656/1120 timings.
+func (t *DVTimings) SetBT(bt *BTTimings) error {
+	t.Type = DVTypeBT6561120
+	t.RawData = [128]byte{}
+	return encodePacked(t.RawData[:], bt)
 }
 
-// H264PredWeightTable is the v4l2 TODO.
-type H264PredWeightTable struct {
-	LumaLog2WeightDenom   uint16
-	ChromaLog2WeightDenom uint16
-	Weightfactors         [2]H264WeightFactors
+// DVTimingsCap is the v4l2 dv timings cap struct.
+type DVTimingsCap struct {
+	Type     DVType
+	Pad      uint32
+	Reserved [2]uint32
+	RawData  [128]byte // Union of BTTimingsCap and reserved space.
 }
 
-// H264WeightFactors is the v4l2 TODO.
-type H264WeightFactors struct {
-	LumaWeight   [32]int16
-	LumaOffset   [32]int16
-	ChromaWeight [32]int16
-	ChromaOffset [32]int16
+// BT returns the BT.656/1120 timings capabilities.
+func (c *DVTimingsCap) BT() (*BTTimingsCap, error) {
+	bt := &BTTimingsCap{}
+	if err := decodePacked(c.RawData[:], bt); err != nil {
+		return nil, err
+	}
+	return bt, nil
 }
 
-// Input is the v4l2 input.
-type Input struct {
-	Index        uint32
-	Name         [32]byte
-	Type         InputType
-	AudioSet     uint32
-	Tuner        uint32
-	Standard     StdID
-	Status       InputStatus
-	Capabilities InputCap
-	Reserved     [3]uint32
+// SetBT sets the BT.656/1120 timings capabilities.
+func (c *DVTimingsCap) SetBT(bt *BTTimingsCap) error {
+	c.Type = DVTypeBT6561120
+	c.RawData = [128]byte{}
+	return encodePacked(c.RawData[:], bt)
+}
+
+// DVTimingsEnum is the v4l2 enum dv timings struct.
+type DVTimingsEnum struct {
+	Index    uint32
+	Pad      uint32
+	Reserved [2]uint32
+	Timings  DVTimings
+}
+
+// EDID is the v4l2 edid struct.
+type EDID struct {
+	Pad        uint32
+	StartBlock uint32
+	Blocks     uint32
+	Reserved   [5]uint32
+	EDID       uintptr // Points at Blocks blocks of EDIDBlockSize bytes.
+}
+
+// EDIDBlockSize is the size of an EDID block.
+const EDIDBlockSize = 128
+
+// EncoderCmd is the v4l2 encoder_cmd.
+type EncoderCmd struct {
+	Cmd   EncCmd
+	Flags EncCmdFlag
+	Data  [8]uint32
+}
+
+// DecoderCmd is the v4l2 decoder_cmd.
+type DecoderCmd struct {
+	Cmd   DecCmd
+	Flags DecCmdFlag
+	Data  [16]uint32
+}
+
+// Event is the v4l2 event struct.
+// The payload in U is accessed through the method matching Type.
+type Event struct {
+	Type      EventType
+	U         [8]uint64 // Union of the event payloads
+	Pending   uint32
+	Sequence  uint32
+	Timestamp syscall.Timespec
+	ID        uint32
+	Reserved  [8]uint32
+}
+
+// VSync returns the payload of an EventTypeVSync event.
+func (e *Event) VSync() *EventVSync {
+	return (*EventVSync)(unsafe.Pointer(&e.U))
+}
+
+// Ctrl returns the payload of an EventTypeCtrl event.
+func (e *Event) Ctrl() *EventCtrl {
+	return (*EventCtrl)(unsafe.Pointer(&e.U))
+}
+
+// FrameSync returns the payload of an EventTypeFrameSync event.
+func (e *Event) FrameSync() *EventFrameSync {
+	return (*EventFrameSync)(unsafe.Pointer(&e.U))
+}
+
+// SrcChange returns the payload of an EventTypeSourceChange event.
+func (e *Event) SrcChange() *EventSrcChange {
+	return (*EventSrcChange)(unsafe.Pointer(&e.U))
+}
+
+// MotionDet returns the payload of an EventTypeMotionDet event.
+func (e *Event) MotionDet() *EventMotionDet {
+	return (*EventMotionDet)(unsafe.Pointer(&e.U))
+}
+
+// EventCtrl is the v4l2 event ctrl struct.
+type EventCtrl struct {
+	Changes      EventCtrlChange
+	Type         CtrlType
+	Value        int64 // Union of value and value64
+	Flags        uint32
+	Minimum      int32
+	Maximum      int32
+	Step         int32
+	DefaultValue int32
+}
+
+// EventFrameSync is the v4l2 event frame sync struct.
+type EventFrameSync struct {
+	FrameSequence uint32
+}
+
+// EventMotionDet is the v4l2 event motion det struct.
+type EventMotionDet struct {
+	Flags         EventMdFlag
+	FrameSequence uint32
+	RegionMask    uint32
+}
+
+// EventSrcChange is the v4l2 event src change struct.
+type EventSrcChange struct {
+	Changes EventSrcChangeFlag
+}
+
+// EventSubscription is the v4l2 event subscription struct.
+type EventSubscription struct {
+	Type     EventType
+	ID       uint32
+	Flags    EventSubFlag
+	Reserved [5]uint32
+}
+
+// EventVSync is the v4l2 event vsync struct.
+type EventVSync struct {
+	Field uint8
+}
+
+// ExportBuf is the v4l2 exportbuffer struct.
+type ExportBuf struct {
+	Type     BufType
+	Index    uint32
+	Plane    uint32
+	Flags    uint32
+	FD       int32
+	Reserved [11]uint32
+}
+
+// ExtControl is the v4l2 ext control struct.
+type ExtControl struct {
+	ID        CtrlID
+	Size      uint32
+	Reserved2 uint32
+	Value     [8]byte // Union of value, value64 and the payload pointer
+}
+
+// ExtControls is the v4l2 ext controls struct.
+type ExtControls struct {
+	Which     CtrlWhich // Union of which and ctrl class
+	Count     uint32
+	ErrorIdx  uint32
+	RequestFD int32
+	Reserved  uint32
+	Controls  uintptr
+}
+
+// ExtControlValue is the value of one control in an extended control request.
+// Value holds integer, boolean, menu, bitmask and 64-bit integer controls;
+// 32-bit controls only use the low 32 bits, so read them with int32(Value).
+// Payload holds string, array and compound controls and must be sized to the
+// control payload, as reported by QueryExtControl, when getting values.
+type ExtControlValue struct {
+	ID      CtrlID
+	Value   int64
+	Payload []byte
+}
+
+// FmtDesc is the v4l2 fmtdesc.
+type FmtDesc struct {
+	Index       uint32
+	Type        BufType
+	Flags       FmtFlag
+	Description [32]byte
+	PixFormat   PixFmt
+	Reserved    [4]uint32
+}
+
+// Format is the v4l2 format.
+type Format struct {
+	Type    BufType
+	_       uint32
+	RawData [200]byte // Union of several possible types.
+}
+
+// Fract is the v4l2 fract.
+type Fract struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+// FrameIntervalEnum is v4l2_frmivalenum.
+type FrameIntervalEnum struct {
+	Index     uint32
+	PixFormat PixFmt
+	Width     uint32
+	Height    uint32
+	Type      FrmIvalType
+	M         [24]byte // Union
+	Reserved  [2]uint32
+}
+
+// FrameIntervalStepwise is v4l2_frmival_stepwise.
+type FrameIntervalStepwise struct {
+	Min  Fract
+	Max  Fract
+	Step Fract
+}
+
+// FrameSizeDiscrete is v4l2Framesize_discrete.
+type FrameSizeDiscrete struct {
+	Width  uint32
+	Height uint32
+}
+
+// FrameSizeEnum is v4l2Framesizeenum.
+type FrameSizeEnum struct {
+	Index     uint32
+	PixFormat PixFmt
+	Type      FrmSizeType
+	M         [24]byte // Union
+	Reserved  [2]uint32
+}
+
+// FrameSizeStepwise is v4l2Framesize_stepwise.
+type FrameSizeStepwise struct {
+	MinWidth   uint32
+	MaxWidth   uint32
+	StepWidth  uint32
+	MinHeight  uint32
+	MaxHeight  uint32
+	StepHeight uint32
+}
+
+// Frequency is v4l2Frequency.
+type Frequency struct {
+	Tuner     uint32
+	Type      TunerType
+	Frequency uint32
+	Reserved  [8]uint32
+}
+
+// FrequencyBand is the v4l2 frequency band.
+type FrequencyBand struct {
+	Tuner      uint32
+	Type       TunerType
+	Index      uint32
+	Capability TunerCap
+	RangeLow   uint32
+	RangeHigh  uint32
+	Modulation BandModulation
+	Reserved   [9]uint32
+}
+
+// H264DPDEntry is the v4l2 h264_dpb_entry.
+// ReferenceTS identifies the CAPTURE buffer holding the picture, see the
+// ReferenceTS function.
+type H264DPDEntry struct {
+	ReferenceTS         uint64
+	PicNum              uint32
+	FrameNum            uint16
+	Fields              H264Fields
+	Reserved            [5]uint8
+	TopFieldOrderCnt    int32
+	BottomFieldOrderCnt int32
+	Flags               H264DPBEntryFlag
+}
+
+// H264PredWeightTable is the v4l2 ctrl_h264_pred_weights.
+type H264PredWeightTable struct {
+	LumaLog2WeightDenom   uint16
+	ChromaLog2WeightDenom uint16
+	Weightfactors         [2]H264WeightFactors
+}
+
+// H264Reference is the v4l2 h264_reference, an entry of a reference picture
+// list indexing the DPB.
+type H264Reference struct {
+	Fields H264Fields
+	Index  uint8
+}
+
+// H264WeightFactors is the v4l2 h264_weight_factors.
+type H264WeightFactors struct {
+	LumaWeight   [32]int16
+	LumaOffset   [32]int16
+	ChromaWeight [32][2]int16
+	ChromaOffset [32][2]int16
+}
+
+// HWFreqSeek is the v4l2 hw_freq_seek.
+type HWFreqSeek struct {
+	Tuner      uint32
+	Type       TunerType
+	SeekUpward uint32
+	WrapAround uint32
+	Spacing    uint32
+	RangeLow   uint32
+	RangeHigh  uint32
+	Reserved   [5]uint32
+}
+
+// Input is the v4l2 input.
+type Input struct {
+	Index        uint32
+	Name         [32]byte
+	Type         InputType
+	AudioSet     AudioSet
+	Tuner        uint32
+	Standard     StdID
+	Status       InputStatus
+	Capabilities InputCap
+	Reserved     [3]uint32
 }
 
 // Modulator is the v4l2 modulator.
@@ -1256,8 +2284,34 @@ type Modulator struct {
 	Reserved   [3]uint32
 }
 
-// Mpeg2Picture is the v4l2 TODO.
+// Mpeg2Picture is the v4l2 ctrl_mpeg2_picture.
+// The timestamps identify the CAPTURE buffers of the reference pictures, see
+// ReferenceTS.
 type Mpeg2Picture struct {
+	BackwardRefTS     uint64
+	ForwardRefTS      uint64
+	Flags             Mpeg2PicFlag
+	FCode             [2][2]uint8
+	PictureCodingType Mpeg2PicCodingType
+	PictureStructure  Mpeg2PicStructure
+	IntraDCPrecision  uint8
+	Reserved          [5]uint8
+}
+
+// Mpeg2Sequence is the v4l2 ctrl_mpeg2_sequence.
+type Mpeg2Sequence struct {
+	HorizontalSize            uint16
+	VerticalSize              uint16
+	VBVBufferSize             uint32
+	ProfileAndLevelIndication uint16
+	ChromaFormat              uint8
+	Flags                     Mpeg2SeqFlag
+}
+
+// Mpeg2SlicePicture is the v4l2 mpeg2_picture of the staging MPEG-2 uAPI.
+//
+// Deprecated: Use Mpeg2Picture.
+type Mpeg2SlicePicture struct {
 	PictureCodingType        uint8
 	FCode                    [2][2]uint8
 	IntraDCPrecision         uint8
@@ -1272,8 +2326,10 @@ type Mpeg2Picture struct {
 	ProgressiveFrame         uint16
 }
 
-// Mpeg2Sequence is the v4l2 TODO.
-type Mpeg2Sequence struct {
+// Mpeg2SliceSequence is the v4l2 mpeg2_sequence of the staging MPEG-2 uAPI.
+//
+// Deprecated: Use Mpeg2Sequence.
+type Mpeg2SliceSequence struct {
 	HorizontalSize            uint16
 	VerticalSize              uint16
 	VBVBufferSize             uint32
@@ -1287,13 +2343,23 @@ type Output struct {
 	Index        uint32
 	Name         [32]byte
 	Type         OutputType
-	AudioSet     uint32
+	AudioSet     AudioSet
 	Modulator    uint32
 	Standard     StdID
 	Capabilities OutputCap
 	Reserved     [3]uint32
 }
 
+// OutputParm is the v4l2 outputparm struct.
+type OutputParm struct {
+	Capability   ParmCap
+	OutputMode   ParmMode
+	TimePerFrame Fract
+	ExtendedMode uint32
+	WriteBuffers uint32
+	Reserved     [4]uint32
+}
+
 // PixFormat is the v4l2 pix format.
 type PixFormat struct {
 	Width        uint32
@@ -1317,12 +2383,12 @@ type PixFormatMPlane struct {
 	PixFormat    PixFmt
 	Field        Field
 	ColorSpace   ColorSpace
-	PlaneFmt     [8]PlanePixFormat
+	PlaneFmt     [VideoMaxPlanes]PlanePixFormat
 	NumPlanes    uint8
-	Flags        PixFmtFlag
-	M            uint32 // Anonymous union of YCbCr and HSV
-	Quantization Quantization
-	XferFunc     XferFunc
+	Flags        uint8
+	M            uint8 // Anonymous union of YCbCr and HSV
+	Quantization uint8
+	XferFunc     uint8
 	Reserved     [7]uint8
 }
 
@@ -1330,7 +2396,7 @@ type PixFormatMPlane struct {
 type Plane struct {
 	BytesUsed  uint32
 	Length     uint32
-	M          uint32 // Union
+	M          uintptr // Union of mem offset, user pointer and fd
 	DataOffset uint32
 	Reserved   [11]uint32
 }
@@ -1357,13 +2423,13 @@ type QueryCtrl struct {
 
 // QueryExtCtrl is the v4l2 query extended control struct.
 type QueryExtCtrl struct {
-	ID           uint32
-	Type         uint32
+	ID           CtrlID
+	Type         CtrlType
 	Name         [32]byte
-	Minimum      int32
-	Maximum      int32
-	Step         int32
-	DefaultValue int32
+	Minimum      int64
+	Maximum      int64
+	Step         uint64
+	DefaultValue int64
 	Flags        uint32
 	ElemSize     uint32
 	Elems        uint32
@@ -1398,6 +2464,15 @@ type RequestBuffers struct {
 	Reserved     [1]uint32
 }
 
+// Selection is the v4l2 selection struct.
+type Selection struct {
+	Type     BufType
+	Target   SelTarget
+	Flags    SelFlag
+	R        Rect
+	Reserved [9]uint32
+}
+
 // SlicedVBIFormat is the v4l2 sliced_vbi_format.
 type SlicedVBIFormat struct {
 	ServiceSet   uint32
@@ -1406,6 +2481,22 @@ type SlicedVBIFormat struct {
 	Reserved     [2]uint32
 }
 
+// Standard is the v4l2 standard struct.
+type Standard struct {
+	Index       uint32
+	ID          StdID
+	Name        [24]byte
+	FramePeriod Fract
+	FrameLines  uint32
+	Reserved    [4]uint32
+}
+
+// StreamParm is the v4l2 streamparm.
+type StreamParm struct {
+	Type    BufType
+	RawData [200]byte // Union of CaptureParm and OutputParm.
+}
+
 // Timecode is the v4l2 timecode.
 type Timecode struct {
 	Type     TcType
@@ -1443,7 +2534,8 @@ type VBIFormat struct {
 	Reserved       uint32
 }
 
-// VP8EntropyCoderState is the v4l2 TODO.
+// VP8EntropyCoderState is the v4l2 vp8_entropy_coder_state, the state of the
+// boolean decoder at the end of the frame header.
 type VP8EntropyCoderState struct {
 	Range    uint8
 	Value    uint8
@@ -1451,25 +2543,26 @@ type VP8EntropyCoderState struct {
 	Padding  uint8
 }
 
-// VP8EntropyHeader is the v4l2 TODO.
+// VP8EntropyHeader is the v4l2 vp8_entropy.
 type VP8EntropyHeader struct {
 	CoeffProbs  [4][8][3][11]uint8
 	YModeProbs  [4]uint8
-	UVModeProbs [4]uint8
+	UVModeProbs [3]uint8
 	MVProb      [2][19]uint8
 	Padding     [3]uint8
 }
 
-// VP8LoopfilterHeader is the v4l2 TODO.
+// VP8LoopfilterHeader is the v4l2 vp8_loop_filter.
 type VP8LoopfilterHeader struct {
 	RefFrmDelta    [4]int8
 	MBModeDelta    [4]int8
 	SharpnessLevel uint8
+	Level          uint8
 	Padding        uint16
-	Flags          uint32
+	Flags          VP8LoopfilterFlag
 }
 
-// VP8QuantizationHeader is the v4l2 TODO.
+// VP8QuantizationHeader is the v4l2 vp8_quantization.
 type VP8QuantizationHeader struct {
 	YACQi     uint8
 	YDCDelta  int8
@@ -1480,13 +2573,13 @@ type VP8QuantizationHeader struct {
 	Padding   uint16
 }
 
-// VP8SegmentHeader is the v4l2 TODO.
+// VP8SegmentHeader is the v4l2 vp8_segment.
 type VP8SegmentHeader struct {
 	QuantUpdate  [4]int8
 	LFUpdate     [4]int8
 	SegmentProbs [3]uint8
 	Padding      uint8
-	Flags        uint32
+	Flags        VP8SegmentFlag
 }
 
 // Window is the v4l2 window.
@@ -1503,7 +2596,7 @@ type Window struct {
 // QueryCapabilities queries the device capabilities.
 func QueryCapabilities(fd int) (*Capability, error) {
 	capability := &Capability{}
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocQueryCap), uintptr(unsafe.Pointer(capability))); err != 0 {
+	if err := ioctl(fd, VidIocQueryCap, unsafe.Pointer(capability)); err != nil {
 		return nil, err
 	}
 	return capability, nil
@@ -1517,9 +2610,9 @@ func EnumFormats(fd int, bufType BufType) ([]*FmtDesc, error) {
 		fmtDesc := &FmtDesc{}
 		fmtDesc.Index = index
 		fmtDesc.Type = bufType
-		_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocEnumFmt), uintptr(unsafe.Pointer(fmtDesc)))
-		if err != 0 {
-			if err == syscall.EINVAL {
+		err := ioctl(fd, VidIocEnumFmt, unsafe.Pointer(fmtDesc))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
 				break
 			}
 			return nil, err
@@ -1538,9 +2631,9 @@ func EnumFrameSizes(fd int, pixFormat PixFmt) ([]*FrameSizeEnum, error) {
 		frameSizeEnum := &FrameSizeEnum{}
 		frameSizeEnum.Index = index
 		frameSizeEnum.PixFormat = pixFormat
-		_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocEnumFrameSizes), uintptr(unsafe.Pointer(frameSizeEnum)))
-		if err != 0 {
-			if err == syscall.EINVAL {
+		err := ioctl(fd, VidIocEnumFrameSizes, unsafe.Pointer(frameSizeEnum))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
 				break
 			}
 			return nil, err
@@ -1551,95 +2644,934 @@ func EnumFrameSizes(fd int, pixFormat PixFmt) ([]*FrameSizeEnum, error) {
 	return frameSizeEnums, nil
 }
 
-// QueryControls queries the controls.
-func QueryControls(fd int) ([]*QueryCtrl, error) {
-	controls := make([]*QueryCtrl, 0, 4)
-	id := CtrlID(CtrlFlagNextCtrl)
+// EnumFrameIntervals enumerates the available frame intervals for a pixel format and frame size.
+func EnumFrameIntervals(fd int, pixFormat PixFmt, width uint32, height uint32) ([]*FrameIntervalEnum, error) {
+	var index uint32 = 0
+	frameIntervalEnums := make([]*FrameIntervalEnum, 0, 4)
 	for {
-		queryCtrl := &QueryCtrl{}
-		queryCtrl.ID = id
-		_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocQueryCtrl), uintptr(unsafe.Pointer(queryCtrl)))
-		if err != 0 {
-			if err == syscall.EINVAL {
+		frameIntervalEnum := &FrameIntervalEnum{}
+		frameIntervalEnum.Index = index
+		frameIntervalEnum.PixFormat = pixFormat
+		frameIntervalEnum.Width = width
+		frameIntervalEnum.Height = height
+		err := ioctl(fd, VidIocEnumFrameIntervals, unsafe.Pointer(frameIntervalEnum))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
 				break
 			}
 			return nil, err
 		}
-		controls = append(controls, queryCtrl)
-		id = queryCtrl.ID | CtrlID(CtrlFlagNextCtrl)
+		frameIntervalEnums = append(frameIntervalEnums, frameIntervalEnum)
+		index++
 	}
-	return controls, nil
+	return frameIntervalEnums, nil
 }
 
-// QueryMenus queries all menus for a particular control ID.
-func QueryMenus(fd int, id CtrlID) ([]*QueryMenu, error) {
+// EnumInputs enumerates the video inputs.
+func EnumInputs(fd int) ([]*Input, error) {
 	var index uint32 = 0
-	menus := make([]*QueryMenu, 0, 4)
+	inputs := make([]*Input, 0, 4)
 	for {
-		queryMenu := &QueryMenu{}
-		queryMenu.ID = id
-		queryMenu.Index = index
-		_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocQueryMenu), uintptr(unsafe.Pointer(queryMenu)))
-		if err != 0 {
-			if err == syscall.EINVAL {
+		input := &Input{}
+		input.Index = index
+		err := ioctl(fd, VidIocEnumInput, unsafe.Pointer(input))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
 				break
 			}
 			return nil, err
 		}
-		menus = append(menus, queryMenu)
+		inputs = append(inputs, input)
 		index++
 	}
-	return menus, nil
+	return inputs, nil
 }
 
-// GetFormat returns the current format.
-func GetFormat(fd int, bufType BufType) (*Format, error) {
-	format := &Format{}
-	format.Type = bufType
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocGFmt), uintptr(unsafe.Pointer(format))); err != 0 {
-		return nil, err
+// GetInput returns the index of the current video input.
+func GetInput(fd int) (uint32, error) {
+	var index uint32
+	if err := ioctl(fd, VidIocGInput, unsafe.Pointer(&index)); err != nil {
+		return 0, err
 	}
-	return format, nil
+	return index, nil
 }
 
-// SetFormat sets the format and frame size.
-func SetFormat(fd int, bufType BufType, pixFormat PixFmt, width uint32, height uint32) (uint32, uint32, error) {
-	format := &Format{}
-	format.Type = bufType
-	pix := (*PixFormat)(unsafe.Pointer(&format.RawData[0]))
-	pix.Width = width
-	pix.Height = height
-	pix.PixFormat = pixFormat
-	pix.Field = FieldNone
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocSFmt), uintptr(unsafe.Pointer(format))); err != 0 {
-		return 0, 0, err
+// SetInput selects the video input.
+func SetInput(fd int, index uint32) error {
+	if err := ioctl(fd, VidIocSInput, unsafe.Pointer(&index)); err != nil {
+		return err
 	}
-	return pix.Width, pix.Height, nil
+	return nil
 }
 
-func GetControl(fd int, id CtrlID) (*Control, error) {
-	control := &Control{}
-	control.ID = id
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocGCtrl), uintptr(unsafe.Pointer(control))); err != 0 {
-		return nil, err
+// QueryInputStatus returns the status of the current video input.
+func QueryInputStatus(fd int) (InputStatus, error) {
+	index, err := GetInput(fd)
+	if err != nil {
+		return 0, err
 	}
-	return control, nil
+	input := &Input{}
+	input.Index = index
+	if err := ioctl(fd, VidIocEnumInput, unsafe.Pointer(input)); err != nil {
+		return 0, err
+	}
+	return input.Status, nil
 }
 
-func SetControl(fd int, control *Control) error {
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocSCtrl), uintptr(unsafe.Pointer(control))); err != 0 {
-		return err
+// EnumStandards enumerates the video standards of the current input or output.
+func EnumStandards(fd int) ([]*Standard, error) {
+	var index uint32 = 0
+	standards := make([]*Standard, 0, 8)
+	for {
+		standard := &Standard{}
+		standard.Index = index
+		err := ioctl(fd, VidIocEnumStd, unsafe.Pointer(standard))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		standards = append(standards, standard)
+		index++
 	}
-	return nil
+	return standards, nil
 }
 
-// RequestDriverBuffers requests driver buffers.
-func RequestDriverBuffers(fd int, count uint32, bufType BufType, memory Memory) (uint32, error) {
-	requestBuffers := &RequestBuffers{}
-	requestBuffers.Count = count
-	requestBuffers.Type = bufType
-	requestBuffers.Memory = memory
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocReqBufs), uintptr(unsafe.Pointer(requestBuffers))); err != 0 {
+// GetStandard returns the current video standard.
+func GetStandard(fd int) (StdID, error) {
+	var id StdID
+	if err := ioctl(fd, VidIocGStd, unsafe.Pointer(&id)); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// SetStandard selects the video standard. The driver picks one of the
+// standards in id if several are set.
+func SetStandard(fd int, id StdID) error {
+	if err := ioctl(fd, VidIocSStd, unsafe.Pointer(&id)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// QueryStandard senses the video standards of the input signal. The result
+// holds every standard that cannot be ruled out, and is StdUnknown without a signal.
+func QueryStandard(fd int) (StdID, error) {
+	var id StdID
+	if err := ioctl(fd, VidIocQueryStd, unsafe.Pointer(&id)); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// QueryDVTimings senses the DV timings of the input signal. It fails with
+// ENOLINK without a signal, ENOLCK if the signal is unstable and ERANGE if it
+// is out of range.
+func QueryDVTimings(fd int) (*DVTimings, error) {
+	timings := &DVTimings{}
+	if err := ioctl(fd, VidIocQueryDVTimings, unsafe.Pointer(timings)); err != nil {
+		return nil, err
+	}
+	return timings, nil
+}
+
+// GetDVTimings returns the current DV timings.
+func GetDVTimings(fd int) (*DVTimings, error) {
+	timings := &DVTimings{}
+	if err := ioctl(fd, VidIocGDVTimings, unsafe.Pointer(timings)); err != nil {
+		return nil, err
+	}
+	return timings, nil
+}
+
+// SetDVTimings sets the DV timings and returns the timings applied by the driver.
+func SetDVTimings(fd int, timings *DVTimings) (*DVTimings, error) {
+	result := *timings
+	if err := ioctl(fd, VidIocSDVTimings, unsafe.Pointer(&result)); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// EnumDVTimings enumerates the DV timings supported by the pad.
+func EnumDVTimings(fd int, pad uint32) ([]*DVTimings, error) {
+	var index uint32 = 0
+	timingsList := make([]*DVTimings, 0, 16)
+	for {
+		enum := &DVTimingsEnum{}
+		enum.Index = index
+		enum.Pad = pad
+		err := ioctl(fd, VidIocEnumDVTimings, unsafe.Pointer(enum))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		timingsList = append(timingsList, &enum.Timings)
+		index++
+	}
+	return timingsList, nil
+}
+
+// GetDVTimingsCap returns the DV timings capabilities of the pad.
+func GetDVTimingsCap(fd int, pad uint32) (*DVTimingsCap, error) {
+	timingsCap := &DVTimingsCap{}
+	timingsCap.Pad = pad
+	if err := ioctl(fd, VidIocDVTimingsCap, unsafe.Pointer(timingsCap)); err != nil {
+		return nil, err
+	}
+	return timingsCap, nil
+}
+
+// GetEDID reads all EDID blocks of the pad, returning nil if it has none.
+// Use the edid package to parse the result.
+func GetEDID(fd int, pad uint32) ([]byte, error) {
+	edid := &EDID{}
+	edid.Pad = pad
+	if err := ioctl(fd, VidIocGEDID, unsafe.Pointer(edid)); err != nil {
+		return nil, err
+	}
+	if edid.Blocks == 0 {
+		return nil, nil
+	}
+	data := make([]byte, edid.Blocks*EDIDBlockSize)
+	edid.EDID = uintptr(unsafe.Pointer(&data[0]))
+	err := ioctl(fd, VidIocGEDID, unsafe.Pointer(edid))
+	runtime.KeepAlive(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:edid.Blocks*EDIDBlockSize], nil
+}
+
+// SetEDID writes the EDID blocks of the pad, clearing the EDID if data is
+// empty. It fails with E2BIG if the receiver cannot hold that many blocks.
+func SetEDID(fd int, pad uint32, data []byte) error {
+	if len(data)%EDIDBlockSize != 0 {
+		return syscall.EINVAL
+	}
+	edid := &EDID{}
+	edid.Pad = pad
+	edid.Blocks = uint32(len(data) / EDIDBlockSize)
+	if len(data) > 0 {
+		edid.EDID = uintptr(unsafe.Pointer(&data[0]))
+	}
+	err := ioctl(fd, VidIocSEDID, unsafe.Pointer(edid))
+	runtime.KeepAlive(data)
+	return err
+}
+
+// EnumOutputs enumerates the video outputs.
+func EnumOutputs(fd int) ([]*Output, error) {
+	var index uint32 = 0
+	outputs := make([]*Output, 0, 4)
+	for {
+		output := &Output{}
+		output.Index = index
+		err := ioctl(fd, VidIocEnumOutput, unsafe.Pointer(output))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		outputs = append(outputs, output)
+		index++
+	}
+	return outputs, nil
+}
+
+// GetOutput returns the index of the current video output.
+func GetOutput(fd int) (uint32, error) {
+	var index uint32
+	if err := ioctl(fd, VidIocGOutput, unsafe.Pointer(&index)); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// SetOutput selects the video output.
+func SetOutput(fd int, index uint32) error {
+	if err := ioctl(fd, VidIocSOutput, unsafe.Pointer(&index)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// EnumAudio enumerates the audio inputs.
+func EnumAudio(fd int) ([]*Audio, error) {
+	var index uint32 = 0
+	audios := make([]*Audio, 0, 4)
+	for {
+		audio := &Audio{}
+		audio.Index = index
+		err := ioctl(fd, VidIocEnumAudio, unsafe.Pointer(audio))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		audios = append(audios, audio)
+		index++
+	}
+	return audios, nil
+}
+
+// GetAudio returns the current audio input.
+func GetAudio(fd int) (*Audio, error) {
+	audio := &Audio{}
+	if err := ioctl(fd, VidIocGAudio, unsafe.Pointer(audio)); err != nil {
+		return nil, err
+	}
+	return audio, nil
+}
+
+// SetAudio selects the audio input and its mode.
+func SetAudio(fd int, index uint32, mode AudMode) error {
+	audio := &Audio{}
+	audio.Index = index
+	audio.Mode = mode
+	if err := ioctl(fd, VidIocSAudio, unsafe.Pointer(audio)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// EnumAudioOut enumerates the audio outputs.
+func EnumAudioOut(fd int) ([]*AudioOut, error) {
+	var index uint32 = 0
+	audioOuts := make([]*AudioOut, 0, 4)
+	for {
+		audioOut := &AudioOut{}
+		audioOut.Index = index
+		err := ioctl(fd, VidIocEnumAudOut, unsafe.Pointer(audioOut))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		audioOuts = append(audioOuts, audioOut)
+		index++
+	}
+	return audioOuts, nil
+}
+
+// GetAudioOut returns the current audio output.
+func GetAudioOut(fd int) (*AudioOut, error) {
+	audioOut := &AudioOut{}
+	if err := ioctl(fd, VidIocGAudOut, unsafe.Pointer(audioOut)); err != nil {
+		return nil, err
+	}
+	return audioOut, nil
+}
+
+// SetAudioOut selects the audio output.
+func SetAudioOut(fd int, index uint32) error {
+	audioOut := &AudioOut{}
+	audioOut.Index = index
+	if err := ioctl(fd, VidIocSAudOut, unsafe.Pointer(audioOut)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// InputAudio returns the audio inputs that can be combined with the video input.
+func InputAudio(fd int, input uint32) ([]*Audio, error) {
+	in := &Input{}
+	in.Index = input
+	if err := ioctl(fd, VidIocEnumInput, unsafe.Pointer(in)); err != nil {
+		return nil, err
+	}
+	if in.AudioSet == 0 {
+		return nil, nil
+	}
+	audios, err := EnumAudio(fd)
+	if err != nil {
+		return nil, err
+	}
+	associated := make([]*Audio, 0, len(audios))
+	for _, audio := range audios {
+		if in.AudioSet.Contains(audio.Index) {
+			associated = append(associated, audio)
+		}
+	}
+	return associated, nil
+}
+
+// OutputAudio returns the audio outputs that can be combined with the video output.
+func OutputAudio(fd int, output uint32) ([]*AudioOut, error) {
+	out := &Output{}
+	out.Index = output
+	if err := ioctl(fd, VidIocEnumOutput, unsafe.Pointer(out)); err != nil {
+		return nil, err
+	}
+	if out.AudioSet == 0 {
+		return nil, nil
+	}
+	audioOuts, err := EnumAudioOut(fd)
+	if err != nil {
+		return nil, err
+	}
+	associated := make([]*AudioOut, 0, len(audioOuts))
+	for _, audioOut := range audioOuts {
+		if out.AudioSet.Contains(audioOut.Index) {
+			associated = append(associated, audioOut)
+		}
+	}
+	return associated, nil
+}
+
+// EnumTuners enumerates the tuners.
+func EnumTuners(fd int) ([]*Tuner, error) {
+	var index uint32 = 0
+	tuners := make([]*Tuner, 0, 2)
+	for {
+		tuner, err := GetTuner(fd, index)
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		tuners = append(tuners, tuner)
+		index++
+	}
+	return tuners, nil
+}
+
+// GetTuner returns the tuner, including its current signal strength and AFC.
+func GetTuner(fd int, index uint32) (*Tuner, error) {
+	tuner := &Tuner{}
+	tuner.Index = index
+	if err := ioctl(fd, VidIocGTuner, unsafe.Pointer(tuner)); err != nil {
+		return nil, err
+	}
+	return tuner, nil
+}
+
+// SetTuner sets the audio mode of the tuner.
+func SetTuner(fd int, index uint32, audMode TunerMode) error {
+	tuner := &Tuner{}
+	tuner.Index = index
+	tuner.AudMode = audMode
+	if err := ioctl(fd, VidIocSTuner, unsafe.Pointer(tuner)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetModulator returns the modulator.
+func GetModulator(fd int, index uint32) (*Modulator, error) {
+	modulator := &Modulator{}
+	modulator.Index = index
+	if err := ioctl(fd, VidIocGModulator, unsafe.Pointer(modulator)); err != nil {
+		return nil, err
+	}
+	return modulator, nil
+}
+
+// SetModulator sets the sub-channels transmitted by the modulator.
+func SetModulator(fd int, index uint32, txSubChans TunerSub) error {
+	modulator := &Modulator{}
+	modulator.Index = index
+	modulator.TXSubChans = txSubChans
+	if err := ioctl(fd, VidIocSModulator, unsafe.Pointer(modulator)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetFrequency returns the frequency of the tuner or modulator, in the units
+// given by its capabilities.
+func GetFrequency(fd int, tuner uint32) (*Frequency, error) {
+	frequency := &Frequency{}
+	frequency.Tuner = tuner
+	if err := ioctl(fd, VidIocGFrequency, unsafe.Pointer(frequency)); err != nil {
+		return nil, err
+	}
+	return frequency, nil
+}
+
+// SetFrequency tunes the tuner or modulator, in the units given by its
+// capabilities. Drivers clamp the frequency to the supported range.
+func SetFrequency(fd int, tuner uint32, tunerType TunerType, frequency uint32) error {
+	f := &Frequency{}
+	f.Tuner = tuner
+	f.Type = tunerType
+	f.Frequency = frequency
+	if err := ioctl(fd, VidIocSFrequency, unsafe.Pointer(f)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// EnumFreqBands enumerates the frequency bands of the tuner or modulator.
+func EnumFreqBands(fd int, tuner uint32, tunerType TunerType) ([]*FrequencyBand, error) {
+	var index uint32 = 0
+	bands := make([]*FrequencyBand, 0, 4)
+	for {
+		band := &FrequencyBand{}
+		band.Tuner = tuner
+		band.Type = tunerType
+		band.Index = index
+		err := ioctl(fd, VidIocEnumFreqBands, unsafe.Pointer(band))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		bands = append(bands, band)
+		index++
+	}
+	return bands, nil
+}
+
+// SeekFrequency performs a hardware frequency seek, which fails with ENODATA
+// if no station was found.
+func SeekFrequency(fd int, seek *HWFreqSeek) error {
+	if err := ioctl(fd, VidIocSHWFreqSeek, unsafe.Pointer(seek)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// QueryControls queries the controls.
+func QueryControls(fd int) ([]*QueryCtrl, error) {
+	controls := make([]*QueryCtrl, 0, 4)
+	id := CtrlID(CtrlFlagNextCtrl)
+	for {
+		queryCtrl := &QueryCtrl{}
+		queryCtrl.ID = id
+		err := ioctl(fd, VidIocQueryCtrl, unsafe.Pointer(queryCtrl))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		controls = append(controls, queryCtrl)
+		id = queryCtrl.ID | CtrlID(CtrlFlagNextCtrl)
+	}
+	return controls, nil
+}
+
+// QueryMenus queries all menus for a particular control ID.
+func QueryMenus(fd int, id CtrlID) ([]*QueryMenu, error) {
+	var index uint32 = 0
+	menus := make([]*QueryMenu, 0, 4)
+	for {
+		queryMenu := &QueryMenu{}
+		queryMenu.ID = id
+		queryMenu.Index = index
+		err := ioctl(fd, VidIocQueryMenu, unsafe.Pointer(queryMenu))
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		menus = append(menus, queryMenu)
+		index++
+	}
+	return menus, nil
+}
+
+// GetFormat returns the current format.
+func GetFormat(fd int, bufType BufType) (*Format, error) {
+	format := &Format{}
+	format.Type = bufType
+	if err := ioctl(fd, VidIocGFmt, unsafe.Pointer(format)); err != nil {
+		return nil, err
+	}
+	return format, nil
+}
+
+// SetFormat sets the format and frame size.
+func SetFormat(fd int, bufType BufType, pixFormat PixFmt, width uint32, height uint32) (uint32, uint32, error) {
+	format := &Format{}
+	format.Type = bufType
+	pix := (*PixFormat)(unsafe.Pointer(&format.RawData[0]))
+	pix.Width = width
+	pix.Height = height
+	pix.PixFormat = pixFormat
+	pix.Field = FieldNone
+	if err := ioctl(fd, VidIocSFmt, unsafe.Pointer(format)); err != nil {
+		return 0, 0, err
+	}
+	return pix.Width, pix.Height, nil
+}
+
+// GetFormatMPlane returns the current multi-planar format.
+func GetFormatMPlane(fd int, bufType BufType) (*PixFormatMPlane, error) {
+	format, err := GetFormat(fd, bufType)
+	if err != nil {
+		return nil, err
+	}
+	pix := *(*PixFormatMPlane)(unsafe.Pointer(&format.RawData[0]))
+	return &pix, nil
+}
+
+// SetFormatMPlane sets the multi-planar format and frame size and returns the format applied by the driver.
+func SetFormatMPlane(fd int, bufType BufType, pixFormat PixFmt, width uint32, height uint32) (*PixFormatMPlane, error) {
+	format := &Format{}
+	format.Type = bufType
+	pix := (*PixFormatMPlane)(unsafe.Pointer(&format.RawData[0]))
+	pix.Width = width
+	pix.Height = height
+	pix.PixFormat = pixFormat
+	pix.Field = FieldNone
+	if err := ioctl(fd, VidIocSFmt, unsafe.Pointer(format)); err != nil {
+		return nil, err
+	}
+	result := *pix
+	return &result, nil
+}
+
+// GetCropCap returns the cropping capabilities.
+func GetCropCap(fd int, bufType BufType) (*CropCap, error) {
+	cropCap := &CropCap{}
+	cropCap.Type = bufType
+	if err := ioctl(fd, VidIocCropCap, unsafe.Pointer(cropCap)); err != nil {
+		return nil, err
+	}
+	return cropCap, nil
+}
+
+// GetCrop returns the current cropping rectangle.
+func GetCrop(fd int, bufType BufType) (*Rect, error) {
+	crop := &Crop{}
+	crop.Type = bufType
+	if err := ioctl(fd, VidIocGCrop, unsafe.Pointer(crop)); err != nil {
+		return nil, err
+	}
+	return &crop.C, nil
+}
+
+// SetCrop sets the cropping rectangle. The driver may adjust it; use GetCrop
+// to learn the rectangle actually applied.
+func SetCrop(fd int, bufType BufType, rect Rect) error {
+	crop := &Crop{}
+	crop.Type = bufType
+	crop.C = rect
+	if err := ioctl(fd, VidIocSCrop, unsafe.Pointer(crop)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetSelection returns the selection rectangle of the target. Drivers without
+// the selection API are asked for the crop targets through the legacy crop ioctls.
+func GetSelection(fd int, bufType BufType, target SelTarget) (*Rect, error) {
+	selection := &Selection{}
+	selection.Type = bufType
+	selection.Target = target
+	err := ioctl(fd, VidIocGSelection, unsafe.Pointer(selection))
+	if err == nil {
+		return &selection.R, nil
+	}
+	if !errors.Is(err, syscall.ENOTTY) {
+		return nil, err
+	}
+	switch target {
+	case SelTgtCrop:
+		return GetCrop(fd, bufType)
+	case SelTgtCropDefault, SelTgtCropBounds:
+		cropCap, err := GetCropCap(fd, bufType)
+		if err != nil {
+			return nil, err
+		}
+		if target == SelTgtCropDefault {
+			return &cropCap.DefRect, nil
+		}
+		return &cropCap.Bounds, nil
+	}
+	return nil, err
+}
+
+// SetSelection sets the selection rectangle of the target subject to the
+// constraint flags and returns the rectangle applied by the driver. Drivers
+// without the selection API have the crop target set through the legacy crop
+// ioctls, which ignore the flags.
+func SetSelection(fd int, bufType BufType, target SelTarget, flags SelFlag, rect Rect) (*Rect, error) {
+	selection := &Selection{}
+	selection.Type = bufType
+	selection.Target = target
+	selection.Flags = flags
+	selection.R = rect
+	err := ioctl(fd, VidIocSSelection, unsafe.Pointer(selection))
+	if err == nil {
+		return &selection.R, nil
+	}
+	if !errors.Is(err, syscall.ENOTTY) || target != SelTgtCrop {
+		return nil, err
+	}
+	if err := SetCrop(fd, bufType, rect); err != nil {
+		return nil, err
+	}
+	return GetCrop(fd, bufType)
+}
+
+// GetStreamParm returns the current streaming parameters.
+func GetStreamParm(fd int, bufType BufType) (*StreamParm, error) {
+	streamParm := &StreamParm{}
+	streamParm.Type = bufType
+	if err := ioctl(fd, VidIocGParm, unsafe.Pointer(streamParm)); err != nil {
+		return nil, err
+	}
+	return streamParm, nil
+}
+
+// SetStreamParm sets the streaming parameters.
+// On return, streamParm holds the parameters actually applied by the driver.
+func SetStreamParm(fd int, streamParm *StreamParm) error {
+	if err := ioctl(fd, VidIocSParm, unsafe.Pointer(streamParm)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetTimePerFrame returns the current frame interval.
+func GetTimePerFrame(fd int, bufType BufType) (Fract, error) {
+	streamParm, err := GetStreamParm(fd, bufType)
+	if err != nil {
+		return Fract{}, err
+	}
+	return *timePerFrame(streamParm), nil
+}
+
+// SetTimePerFrame sets the frame interval and returns the interval accepted by the driver.
+func SetTimePerFrame(fd int, bufType BufType, interval Fract) (Fract, error) {
+	streamParm := &StreamParm{}
+	streamParm.Type = bufType
+	*timePerFrame(streamParm) = interval
+	if err := SetStreamParm(fd, streamParm); err != nil {
+		return Fract{}, err
+	}
+	return *timePerFrame(streamParm), nil
+}
+
+// timePerFrame returns the frame interval stored in either the capture or the output union member.
+func timePerFrame(streamParm *StreamParm) *Fract {
+	switch streamParm.Type {
+	case BufTypeVideoOutput, BufTypeVideOutputMPlane, BufTypeVideoOutputOverlay, BufTypeVBIOutput, BufTypeSlicedVBIOutput:
+		return &(*OutputParm)(unsafe.Pointer(&streamParm.RawData[0])).TimePerFrame
+	default:
+		return &(*CaptureParm)(unsafe.Pointer(&streamParm.RawData[0])).TimePerFrame
+	}
+}
+
+// parmCapability returns the capabilities stored in either the capture or the output union member.
+func parmCapability(streamParm *StreamParm) ParmCap {
+	switch streamParm.Type {
+	case BufTypeVideoOutput, BufTypeVideOutputMPlane, BufTypeVideoOutputOverlay, BufTypeVBIOutput, BufTypeSlicedVBIOutput:
+		return (*OutputParm)(unsafe.Pointer(&streamParm.RawData[0])).Capability
+	default:
+		return (*CaptureParm)(unsafe.Pointer(&streamParm.RawData[0])).Capability
+	}
+}
+
+func GetControl(fd int, id CtrlID) (*Control, error) {
+	control := &Control{}
+	control.ID = id
+	if err := ioctl(fd, VidIocGCtrl, unsafe.Pointer(control)); err != nil {
+		return nil, err
+	}
+	return control, nil
+}
+
+func SetControl(fd int, control *Control) error {
+	if err := ioctl(fd, VidIocSCtrl, unsafe.Pointer(control)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// QueryExtControl queries an extended control.
+func QueryExtControl(fd int, id CtrlID) (*QueryExtCtrl, error) {
+	queryExtCtrl := &QueryExtCtrl{}
+	queryExtCtrl.ID = id
+	if err := ioctl(fd, VidIocQueryExtCtrl, unsafe.Pointer(queryExtCtrl)); err != nil {
+		return nil, err
+	}
+	return queryExtCtrl, nil
+}
+
+// QueryExtControls queries all controls, including compound controls.
+func QueryExtControls(fd int) ([]*QueryExtCtrl, error) {
+	controls := make([]*QueryExtCtrl, 0, 4)
+	id := CtrlID(CtrlFlagNextCtrl | CtrlFlagNextCompound)
+	for {
+		queryExtCtrl, err := QueryExtControl(fd, id)
+		if err != nil {
+			if errors.Is(err, syscall.EINVAL) {
+				break
+			}
+			return nil, err
+		}
+		controls = append(controls, queryExtCtrl)
+		id = queryExtCtrl.ID | CtrlID(CtrlFlagNextCtrl|CtrlFlagNextCompound)
+	}
+	return controls, nil
+}
+
+// GetExtControls atomically gets the values of a batch of controls.
+// The requestFD is only used with CtrlWhichRequestVal.
+func GetExtControls(fd int, which CtrlWhich, requestFD int, controls []*ExtControlValue) error {
+	return extControls(fd, VidIocGExtCtrls, which, requestFD, controls)
+}
+
+// SetExtControls atomically sets the values of a batch of controls and
+// updates them with the values applied by the driver.
+// The requestFD is only used with CtrlWhichRequestVal.
+func SetExtControls(fd int, which CtrlWhich, requestFD int, controls []*ExtControlValue) error {
+	return extControls(fd, VidIocSExtCtrls, which, requestFD, controls)
+}
+
+// TryExtControls validates the values of a batch of controls without setting
+// them and updates them with the values the driver would apply.
+func TryExtControls(fd int, which CtrlWhich, requestFD int, controls []*ExtControlValue) error {
+	return extControls(fd, VidIocTryExtCtrls, which, requestFD, controls)
+}
+
+// extControls performs an extended control request. The driver reads and
+// writes the payloads in place, through pointers nested in the controls the
+// request points at, so the controls and payloads are pinned until it returns.
+func extControls(fd int, request uint32, which CtrlWhich, requestFD int, values []*ExtControlValue) error {
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	extControls := &ExtControls{}
+	extControls.Which = which
+	extControls.Count = uint32(len(values))
+	extControls.RequestFD = int32(requestFD)
+	controls := make([]ExtControl, len(values))
+	for i, value := range values {
+		controls[i].ID = value.ID
+		if value.Payload == nil {
+			binary.NativeEndian.PutUint64(controls[i].Value[:], uint64(value.Value))
+			continue
+		}
+		controls[i].Size = uint32(len(value.Payload))
+		if len(value.Payload) > 0 {
+			pinner.Pin(&value.Payload[0])
+			binary.NativeEndian.PutUint64(controls[i].Value[:], uint64(uintptr(unsafe.Pointer(&value.Payload[0]))))
+		}
+	}
+	if len(controls) > 0 {
+		pinner.Pin(&controls[0])
+		extControls.Controls = uintptr(unsafe.Pointer(&controls[0]))
+	}
+	err := ioctl(fd, request, unsafe.Pointer(extControls))
+	for i, value := range values {
+		if value.Payload == nil {
+			value.Value = int64(binary.NativeEndian.Uint64(controls[i].Value[:]))
+		} else if controls[i].Size > uint32(len(value.Payload)) {
+			// The payload is too small; resize it so that the caller can retry.
+			value.Payload = make([]byte, controls[i].Size)
+		}
+	}
+	if err != nil {
+		if extControls.ErrorIdx < extControls.Count {
+			return &ExtControlError{Index: int(extControls.ErrorIdx), ID: values[extControls.ErrorIdx].ID, Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// SubscribeEvent subscribes to events of the given type. The id selects the
+// control for EventTypeCtrl and the pad for EventTypeSourceChange, and is 0 otherwise.
+func SubscribeEvent(fd int, eventType EventType, id uint32, flags EventSubFlag) error {
+	subscription := &EventSubscription{}
+	subscription.Type = eventType
+	subscription.ID = id
+	subscription.Flags = flags
+	if err := ioctl(fd, VidIocSubscribeEvent, unsafe.Pointer(subscription)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnsubscribeEvent unsubscribes from events of the given type, or from all
+// events if the type is EventTypeAll.
+func UnsubscribeEvent(fd int, eventType EventType, id uint32) error {
+	subscription := &EventSubscription{}
+	subscription.Type = eventType
+	subscription.ID = id
+	if err := ioctl(fd, VidIocUnsubscribeEvent, unsafe.Pointer(subscription)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// EncoderCommand sends a command to an encoder. Stopping drains it: the
+// capture buffer holding the last encoded data is flagged BufFlagLast.
+func EncoderCommand(fd int, cmd EncCmd, flags EncCmdFlag) error {
+	encoderCmd := &EncoderCmd{}
+	encoderCmd.Cmd = cmd
+	encoderCmd.Flags = flags
+	if err := ioctl(fd, VidIocEncoderCmd, unsafe.Pointer(encoderCmd)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TryEncoderCommand checks whether the encoder accepts a command without sending it.
+func TryEncoderCommand(fd int, cmd EncCmd, flags EncCmdFlag) error {
+	encoderCmd := &EncoderCmd{}
+	encoderCmd.Cmd = cmd
+	encoderCmd.Flags = flags
+	if err := ioctl(fd, VidIocTryEncoderCmd, unsafe.Pointer(encoderCmd)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DecoderCommand sends a command to a decoder. Stopping drains it: the
+// capture buffer holding the last decoded frame is flagged BufFlagLast.
+func DecoderCommand(fd int, cmd DecCmd, flags DecCmdFlag) error {
+	decoderCmd := &DecoderCmd{}
+	decoderCmd.Cmd = cmd
+	decoderCmd.Flags = flags
+	if err := ioctl(fd, VidIocDecoderCmd, unsafe.Pointer(decoderCmd)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TryDecoderCommand checks whether the decoder accepts a command without sending it.
+func TryDecoderCommand(fd int, cmd DecCmd, flags DecCmdFlag) error {
+	decoderCmd := &DecoderCmd{}
+	decoderCmd.Cmd = cmd
+	decoderCmd.Flags = flags
+	if err := ioctl(fd, VidIocTryDecoderCmd, unsafe.Pointer(decoderCmd)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DequeueEvent dequeues a pending event. It fails with ENOENT if no event is
+// pending; poll for POLLPRI to wait for one.
+func DequeueEvent(fd int) (*Event, error) {
+	event := &Event{}
+	if err := ioctl(fd, VidIocDQEvent, unsafe.Pointer(event)); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// RequestDriverBuffers requests driver buffers.
+func RequestDriverBuffers(fd int, count uint32, bufType BufType, memory Memory) (uint32, error) {
+	requestBuffers := &RequestBuffers{}
+	requestBuffers.Count = count
+	requestBuffers.Type = bufType
+	requestBuffers.Memory = memory
+	if err := ioctl(fd, VidIocReqBufs, unsafe.Pointer(requestBuffers)); err != nil {
 		return 0, err
 	}
 	return requestBuffers.Count, nil
@@ -1651,7 +3583,7 @@ func QueryBuffer(fd int, index uint32, bufType BufType, memory Memory) (*Buffer,
 	buffer.Index = index
 	buffer.Type = bufType
 	buffer.Memory = memory
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocQueryBuf), uintptr(unsafe.Pointer(buffer))); err != 0 {
+	if err := ioctl(fd, VidIocQueryBuf, unsafe.Pointer(buffer)); err != nil {
 		return nil, err
 	}
 	return buffer, nil
@@ -1659,7 +3591,7 @@ func QueryBuffer(fd int, index uint32, bufType BufType, memory Memory) (*Buffer,
 
 // EnqueueBuffer enqueues a buffer.
 func EnqueueBuffer(fd int, buffer *Buffer) error {
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocQBuf), uintptr(unsafe.Pointer(buffer))); err != 0 {
+	if err := ioctl(fd, VidIocQBuf, unsafe.Pointer(buffer)); err != nil {
 		return err
 	}
 	return nil
@@ -1670,15 +3602,154 @@ func DequeueBuffer(fd int, bufType BufType, memory Memory) (*Buffer, error) {
 	buffer := &Buffer{}
 	buffer.Type = bufType
 	buffer.Memory = memory
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocDQBuf), uintptr(unsafe.Pointer(buffer))); err != 0 {
+	if err := ioctl(fd, VidIocDQBuf, unsafe.Pointer(buffer)); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// QueryBufferMPlane queries a multi-planar buffer.
+func QueryBufferMPlane(fd int, index uint32, bufType BufType, memory Memory) (*BufferMPlane, error) {
+	buffer := &BufferMPlane{}
+	buffer.Index = index
+	buffer.Type = bufType
+	buffer.Memory = memory
+	buffer.Length = VideoMaxPlanes
+	buffer.M = uintptr(unsafe.Pointer(&buffer.Planes[0]))
+	if err := ioctl(fd, VidIocQueryBuf, unsafe.Pointer(buffer)); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// EnqueueBufferMPlane enqueues a multi-planar buffer.
+// The buffer Length field holds the number of planes.
+func EnqueueBufferMPlane(fd int, buffer *BufferMPlane) error {
+	buffer.M = uintptr(unsafe.Pointer(&buffer.Planes[0]))
+	if err := ioctl(fd, VidIocQBuf, unsafe.Pointer(buffer)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DequeueBufferMPlane dequeues a multi-planar buffer.
+func DequeueBufferMPlane(fd int, bufType BufType, memory Memory) (*BufferMPlane, error) {
+	buffer := &BufferMPlane{}
+	buffer.Type = bufType
+	buffer.Memory = memory
+	buffer.Length = VideoMaxPlanes
+	buffer.M = uintptr(unsafe.Pointer(&buffer.Planes[0]))
+	if err := ioctl(fd, VidIocDQBuf, unsafe.Pointer(buffer)); err != nil {
 		return nil, err
 	}
 	return buffer, nil
 }
 
+// ExportBuffer exports a plane of a driver buffer as a DMABUF file descriptor.
+// The flags are open flags such as unix.O_CLOEXEC and unix.O_RDWR.
+// The caller owns the returned file descriptor and must close it.
+func ExportBuffer(fd int, bufType BufType, index uint32, plane uint32, flags int) (int, error) {
+	exportBuf := &ExportBuf{}
+	exportBuf.Type = bufType
+	exportBuf.Index = index
+	exportBuf.Plane = plane
+	exportBuf.Flags = uint32(flags)
+	if err := ioctl(fd, VidIocExpBuf, unsafe.Pointer(exportBuf)); err != nil {
+		return -1, err
+	}
+	return int(exportBuf.FD), nil
+}
+
+// EnqueueDMABuf enqueues a buffer backed by the DMABUF file descriptors in
+// dmabufFDs, one per plane.
+func EnqueueDMABuf(fd int, bufType BufType, index uint32, dmabufFDs []int) error {
+	if IsMultiPlanar(bufType) {
+		if len(dmabufFDs) == 0 || len(dmabufFDs) > VideoMaxPlanes {
+			return syscall.EINVAL
+		}
+		buffer := &BufferMPlane{}
+		buffer.Index = index
+		buffer.Type = bufType
+		buffer.Memory = MemoryDMABuf
+		buffer.Length = uint32(len(dmabufFDs))
+		for i, dmabufFD := range dmabufFDs {
+			buffer.Planes[i].M = uintptr(uint32(dmabufFD))
+		}
+		return EnqueueBufferMPlane(fd, buffer)
+	}
+	if len(dmabufFDs) != 1 {
+		return syscall.EINVAL
+	}
+	buffer := &Buffer{}
+	buffer.Index = index
+	buffer.Type = bufType
+	buffer.Memory = MemoryDMABuf
+	buffer.M = uintptr(uint32(dmabufFDs[0]))
+	return EnqueueBuffer(fd, buffer)
+}
+
+// EnqueueUserPtr enqueues a buffer backed by the user memory in planes, one
+// slice per plane. The memory must stay valid and must not move until the
+// buffer has been dequeued, so it should not be allocated by the Go runtime.
+func EnqueueUserPtr(fd int, bufType BufType, index uint32, planes [][]byte) error {
+	if IsMultiPlanar(bufType) {
+		if len(planes) == 0 || len(planes) > VideoMaxPlanes {
+			return syscall.EINVAL
+		}
+		buffer := &BufferMPlane{}
+		buffer.Index = index
+		buffer.Type = bufType
+		buffer.Memory = MemoryUserPtr
+		buffer.Length = uint32(len(planes))
+		for i, plane := range planes {
+			buffer.Planes[i].M = uintptr(unsafe.Pointer(unsafe.SliceData(plane)))
+			buffer.Planes[i].Length = uint32(len(plane))
+		}
+		return EnqueueBufferMPlane(fd, buffer)
+	}
+	if len(planes) != 1 {
+		return syscall.EINVAL
+	}
+	buffer := &Buffer{}
+	buffer.Index = index
+	buffer.Type = bufType
+	buffer.Memory = MemoryUserPtr
+	buffer.M = uintptr(unsafe.Pointer(unsafe.SliceData(planes[0])))
+	buffer.Length = uint32(len(planes[0]))
+	return EnqueueBuffer(fd, buffer)
+}
+
+// AllocateUserPtrBuffers allocates count page-aligned buffers outside the Go
+// heap for user pointer streaming, with one plane of each of the sizes.
+// The buffers are released with MunmapBuffersMPlane.
+func AllocateUserPtrBuffers(count uint32, sizes []uint32) ([][][]byte, error) {
+	buffers := make([][][]byte, count)
+	for index := range buffers {
+		for _, size := range sizes {
+			plane, err := unix.Mmap(-1, 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+			if err != nil {
+				MunmapBuffersMPlane(buffers)
+				return nil, err
+			}
+			buffers[index] = append(buffers[index], plane)
+		}
+	}
+	return buffers, nil
+}
+
+// ReadFrame reads a frame of at most size bytes using read() I/O.
+func ReadFrame(fd int, size uint32) ([]byte, error) {
+	data := make([]byte, size)
+	n, err := lookupDevice(fd).Read(data)
+	if err != nil {
+		return nil, newIoctlError(fd, "read", 0, err)
+	}
+	return data[:n], nil
+}
+
 // StreamOn turns on Streaming for the specified buffer type.
 func StreamOn(fd int, bufType BufType) error {
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocStreamOn), uintptr(unsafe.Pointer(&bufType))); err != 0 {
+	if err := ioctl(fd, VidIocStreamOn, unsafe.Pointer(&bufType)); err != nil {
 		return err
 	}
 	return nil
@@ -1686,7 +3757,7 @@ func StreamOn(fd int, bufType BufType) error {
 
 // StreamOff turns off Streaming for the specified buffer type.
 func StreamOff(fd int, bufType BufType) error {
-	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(VidIocStreamOff), uintptr(unsafe.Pointer(&bufType))); err != 0 {
+	if err := ioctl(fd, VidIocStreamOff, unsafe.Pointer(&bufType)); err != nil {
 		return err
 	}
 	return nil
@@ -1694,15 +3765,13 @@ func StreamOff(fd int, bufType BufType) error {
 
 // GrabFrame grabs a single frame.
 func GrabFrame(fd int, bufType BufType, memory Memory, buffers [][]byte) ([]byte, error) {
-	fdSet := &syscall.FdSet{}
-	fdSet.Bits[fd/32] |= 1 << (uint(fd) % 32)
-	timeout := &syscall.Timeval{
-		Sec:  2,
-		Usec: 0,
-	}
-	if _, err := syscall.Select(fd+1, fdSet, nil, nil, timeout); err != nil {
+	revents, err := poll(lookupDevice(fd), unix.POLLIN, 2*time.Second)
+	if err != nil {
 		return nil, err
 	}
+	if revents == 0 {
+		return nil, ErrTimeout
+	}
 	buffer, err := DequeueBuffer(fd, bufType, memory)
 	if err != nil {
 		return nil, err
@@ -1729,9 +3798,9 @@ func MmapBuffers(fd int, count uint32, bufType BufType) ([][]byte, error) {
 		}
 		offset := int64(buffer.M)
 		length := int(buffer.Length)
-		data, err := unix.Mmap(fd, offset, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		data, err := lookupDevice(fd).Mmap(offset, length)
 		if err != nil {
-			return nil, err
+			return nil, newIoctlError(fd, "mmap", 0, err)
 		}
 		buffers = append(buffers, data)
 		if err := EnqueueBuffer(fd, buffer); err != nil {
@@ -1751,6 +3820,80 @@ func MunmapBuffers(buffers [][]byte) error {
 	return nil
 }
 
+// MmapBuffersMPlane memory maps every plane of multi-planar buffers.
+// The buffers must have been requested with a memory type of MemoryMmap.
+func MmapBuffersMPlane(fd int, count uint32, bufType BufType) ([][][]byte, error) {
+	var index uint32
+	buffers := make([][][]byte, 0)
+	for index = 0; index < count; index++ {
+		buffer, err := QueryBufferMPlane(fd, index, bufType, MemoryMmap)
+		if err != nil {
+			return nil, err
+		}
+		planes := make([][]byte, buffer.Length)
+		for i := range planes {
+			offset := int64(uint32(buffer.Planes[i].M))
+			length := int(buffer.Planes[i].Length)
+			data, err := lookupDevice(fd).Mmap(offset, length)
+			if err != nil {
+				return nil, newIoctlError(fd, "mmap", 0, err)
+			}
+			planes[i] = data
+		}
+		buffers = append(buffers, planes)
+		if err := EnqueueBufferMPlane(fd, buffer); err != nil {
+			return nil, err
+		}
+	}
+	return buffers, nil
+}
+
+// MunmapBuffersMPlane memory unmaps previously mapped multi-planar driver buffers.
+func MunmapBuffersMPlane(buffers [][][]byte) error {
+	for _, planes := range buffers {
+		if err := MunmapBuffers(planes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsOutput reports whether bufType is a video output buffer type, which is
+// the type of the queue fed by the application on memory-to-memory devices.
+func IsOutput(bufType BufType) bool {
+	return bufType == BufTypeVideoOutput || bufType == BufTypeVideOutputMPlane
+}
+
+// IsMultiPlanar reports whether bufType is a multi-planar buffer type.
+func IsMultiPlanar(bufType BufType) bool {
+	return bufType == BufTypeVideCaptureMPlane || bufType == BufTypeVideOutputMPlane
+}
+
+// decodePacked decodes a packed kernel struct from its raw bytes.
+func decodePacked(raw []byte, v any) error {
+	return binary.Read(bytes.NewReader(raw), binary.NativeEndian, v)
+}
+
+// encodePacked encodes a struct into the raw bytes of a packed kernel struct.
+func encodePacked(raw []byte, v any) error {
+	buffer := &bytes.Buffer{}
+	if err := binary.Write(buffer, binary.NativeEndian, v); err != nil {
+		return err
+	}
+	copy(raw, buffer.Bytes())
+	return nil
+}
+
+// CompoundControl returns the value of a compound control, such as
+// CtrlH264SPS, encoded from its struct. The struct must be of fixed size.
+func CompoundControl(id CtrlID, v any) (*ExtControlValue, error) {
+	buffer := &bytes.Buffer{}
+	if err := binary.Write(buffer, binary.NativeEndian, v); err != nil {
+		return nil, err
+	}
+	return &ExtControlValue{ID: id, Payload: buffer.Bytes()}, nil
+}
+
 // BytesToString converts a low-level, null-terminated C-string to a string.
 func BytesToString(b []byte) string {
 	if n := bytes.IndexByte(b, 0); n <= 0 {
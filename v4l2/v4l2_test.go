@@ -22,21 +22,70 @@ package v4l2
 
 import (
 	"bytes"
+	"errors"
 	"image"
+	"image/jpeg"
+	"os"
+	"syscall"
 	"testing"
 	"unsafe"
 
-	_ "image/jpeg"
-
-	"golang.org/x/sys/unix"
+	"github.com/peterhagelund/go-v4l2/v4l2/edid"
 )
 
-func TestQueryCapabilities(t *testing.T) {
-	fd, err := unix.Open("/dev/video0", unix.O_RDWR, 0)
+// openTestDevice opens the device named by the V4L2_TEST_DEVICE environment
+// variable, or a fake device offering JPEG capture when it is not set.
+func openTestDevice(t *testing.T) Device {
+	if path := os.Getenv("V4L2_TEST_DEVICE"); path != "" {
+		device, err := OpenDevice(path)
+		if err != nil {
+			t.Fatal("unable to open device")
+		}
+		return device
+	}
+	device, err := NewFakeDevice(testFakeConfig())
 	if err != nil {
-		t.Fatal("unable to open device")
+		t.Fatal("unable to create fake device")
+	}
+	return device
+}
+
+// testFakeConfig returns the configuration of a fake webcam.
+func testFakeConfig() *FakeConfig {
+	frameSizes := []FrameSizeDiscrete{{Width: 640, Height: 480}, {Width: 1024, Height: 768}, {Width: 1920, Height: 1080}}
+	frameIntervals := []Fract{{Numerator: 1, Denominator: 30}, {Numerator: 1, Denominator: 60}}
+	return &FakeConfig{
+		Driver:       "fake",
+		Card:         "Fake Camera",
+		BusInfo:      "platform:fake",
+		Capabilities: CapVideoCapture | CapStreaming,
+		Formats: []FakeFormat{
+			{PixFormat: PixFmtMJPEG, Description: "Motion-JPEG", Flags: FmtFlagCompressed, FrameSizes: frameSizes, FrameIntervals: frameIntervals},
+			{PixFormat: PixFmtJPEG, Description: "JFIF JPEG", Flags: FmtFlagCompressed, FrameSizes: frameSizes, FrameIntervals: frameIntervals},
+			{PixFormat: PixFmtYUYV, Description: "YUYV 4:2:2", FrameSizes: frameSizes, FrameIntervals: frameIntervals[:1]},
+		},
+		Controls: []FakeControl{
+			{ID: CidBrightness, Type: CtrlTypeInteger, Name: "Brightness", Minimum: 0, Maximum: 255, Step: 1, DefaultValue: 128, Value: 128},
+			{ID: CidPowerLineFrequency, Type: CtrlTypeMenu, Name: "Power Line Frequency", Minimum: 0, Maximum: 2, Step: 1, DefaultValue: 1, Value: 1, Menu: []string{"Disabled", "50 Hz", "60 Hz"}},
+		},
+		Frame: func(sequence uint32, format *PixFormat) []byte {
+			if format.PixFormat != PixFmtMJPEG && format.PixFormat != PixFmtJPEG {
+				return bytes.Repeat([]byte{byte(sequence)}, int(format.SizeImage))
+			}
+			img := image.NewGray(image.Rect(0, 0, int(format.Width), int(format.Height)))
+			buffer := &bytes.Buffer{}
+			if err := jpeg.Encode(buffer, img, nil); err != nil {
+				return nil
+			}
+			return buffer.Bytes()
+		},
 	}
-	defer unix.Close(fd)
+}
+
+func TestQueryCapabilities(t *testing.T) {
+	device := openTestDevice(t)
+	defer device.Close()
+	fd := device.Fd()
 	capability, err := QueryCapabilities(fd)
 	if err != nil {
 		t.Fatal("unable to query capabilities")
@@ -62,11 +111,9 @@ func TestQueryCapabilities(t *testing.T) {
 }
 
 func TestEnumFormats(t *testing.T) {
-	fd, err := unix.Open("/dev/video0", unix.O_RDWR, 0)
-	if err != nil {
-		t.Fatal("unable to open device")
-	}
-	defer unix.Close(fd)
+	device := openTestDevice(t)
+	defer device.Close()
+	fd := device.Fd()
 	fmtDescs, err := EnumFormats(fd, BufTypeVideoCapture)
 	if err != nil {
 		t.Fatal("uanble to enumerate formats")
@@ -91,11 +138,9 @@ func TestEnumFormats(t *testing.T) {
 }
 
 func TestEnumFrameSizes(t *testing.T) {
-	fd, err := unix.Open("/dev/video0", unix.O_RDWR, 0)
-	if err != nil {
-		t.Fatal("unable to open device")
-	}
-	defer unix.Close(fd)
+	device := openTestDevice(t)
+	defer device.Close()
+	fd := device.Fd()
 	frameSizeEnums, err := EnumFrameSizes(fd, PixFmtMJPEG)
 	if err != nil {
 		t.Fatal("unable to enumerate frame sizes")
@@ -133,12 +178,57 @@ func TestEnumFrameSizes(t *testing.T) {
 	}
 }
 
-func TestGetFormat(t *testing.T) {
-	fd, err := unix.Open("/dev/video0", unix.O_RDWR, 0)
+func TestEnumFrameIntervals(t *testing.T) {
+	device := openTestDevice(t)
+	defer device.Close()
+	fd := device.Fd()
+	frameIntervalEnums, err := EnumFrameIntervals(fd, PixFmtMJPEG, 1024, 768)
+	if err != nil {
+		t.Fatal("unable to enumerate frame intervals")
+	}
+	if len(frameIntervalEnums) == 0 {
+		t.Fatal("no frame interval enums returned")
+	}
+	for _, frameIntervalEnum := range frameIntervalEnums {
+		if frameIntervalEnum.Type == FrmIvalTypeDiscrete {
+			discrete := (*Fract)(unsafe.Pointer(&frameIntervalEnum.M))
+			if discrete.Numerator == 0 || discrete.Denominator == 0 {
+				t.Fatal("zero frame interval")
+			}
+		} else {
+			stepwise := (*FrameIntervalStepwise)(unsafe.Pointer(&frameIntervalEnum.M))
+			if stepwise.Min.Denominator == 0 || stepwise.Max.Denominator == 0 {
+				t.Fatal("zero denominator in frame interval range")
+			}
+		}
+	}
+}
+
+func TestSetTimePerFrame(t *testing.T) {
+	device := openTestDevice(t)
+	defer device.Close()
+	fd := device.Fd()
+	streamParm, err := GetStreamParm(fd, BufTypeVideoCapture)
+	if err != nil {
+		t.Fatal("unable to get stream parameters")
+	}
+	captureParm := (*CaptureParm)(unsafe.Pointer(&streamParm.RawData[0]))
+	if captureParm.Capability&ParmCapTimePerFrame == 0 {
+		t.Skip("device does not support setting the frame interval")
+	}
+	interval, err := SetTimePerFrame(fd, BufTypeVideoCapture, Fract{Numerator: 1, Denominator: 30})
 	if err != nil {
-		t.Fatal("unable to open device")
+		t.Fatal("unable to set frame interval")
 	}
-	defer unix.Close(fd)
+	if interval.Numerator == 0 || interval.Denominator == 0 {
+		t.Fatal("invalid frame interval returned")
+	}
+}
+
+func TestGetFormat(t *testing.T) {
+	device := openTestDevice(t)
+	defer device.Close()
+	fd := device.Fd()
 	format, err := GetFormat(fd, BufTypeVideoCapture)
 	if err != nil {
 		t.Fatal("unable to get format")
@@ -153,11 +243,9 @@ func TestGetFormat(t *testing.T) {
 }
 
 func TestSetFormat(t *testing.T) {
-	fd, err := unix.Open("/dev/video0", unix.O_RDWR, 0)
-	if err != nil {
-		t.Fatal("unable to open device")
-	}
-	defer unix.Close(fd)
+	device := openTestDevice(t)
+	defer device.Close()
+	fd := device.Fd()
 	width, height, err := SetFormat(fd, BufTypeVideoCapture, PixFmtJPEG, 1024, 768)
 	if err != nil {
 		t.Fatal("unable to set format")
@@ -171,11 +259,9 @@ func TestSetFormat(t *testing.T) {
 }
 
 func TestRequestDriverBuffers(t *testing.T) {
-	fd, err := unix.Open("/dev/video0", unix.O_RDWR, 0)
-	if err != nil {
-		t.Fatal("unable to open device")
-	}
-	defer unix.Close(fd)
+	device := openTestDevice(t)
+	defer device.Close()
+	fd := device.Fd()
 	count, err := RequestDriverBuffers(fd, 4, BufTypeVideoCapture, MemoryMmap)
 	if err != nil {
 		t.Fatal("unable to request driver buffers")
@@ -190,11 +276,9 @@ func TestRequestDriverBuffers(t *testing.T) {
 }
 
 func TestGrabFrame(t *testing.T) {
-	fd, err := unix.Open("/dev/video0", unix.O_RDWR, 0)
-	if err != nil {
-		t.Fatal("unable to open device")
-	}
-	defer unix.Close(fd)
+	device := openTestDevice(t)
+	defer device.Close()
+	fd := device.Fd()
 	if _, _, err := SetFormat(fd, BufTypeVideoCapture, PixFmtJPEG, 1024, 768); err != nil {
 		t.Fatal("unable to set format")
 	}
@@ -248,3 +332,557 @@ func TestBytesToString(t *testing.T) {
 		t.Fatal("incorrect string returned")
 	}
 }
+
+func TestCompoundControl(t *testing.T) {
+	control, err := CompoundControl(CidStatelessH264SPS, &CtrlH264SPS{ProfileIDC: 100})
+	if err != nil || control.ID != CidStatelessH264SPS || len(control.Payload) != 1048 || control.Payload[0] != 100 {
+		t.Fatal("incorrect compound control")
+	}
+	if _, err := CompoundControl(CidStatelessH264SPS, []int{100}); err == nil {
+		t.Fatal("control not of fixed size encoded")
+	}
+}
+
+func TestExtControls(t *testing.T) {
+	config := testFakeConfig()
+	config.Controls = append(config.Controls,
+		FakeControl{ID: CidCodecBase + 1000, Type: CtrlTypeInteger64, Name: "Pixel Count", Minimum: 0, Maximum: 1 << 40, Step: 1, DefaultValue: 1 << 33, Value: 1 << 33},
+		FakeControl{ID: CidCodecBase + 1001, Type: CtrlTypeU8, Name: "Table", Maximum: 255, Step: 1, ElemSize: 1, Elems: 16},
+	)
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	queryExtCtrls, err := QueryExtControls(fd)
+	if err != nil {
+		t.Fatal("unable to query extended controls")
+	}
+	if len(queryExtCtrls) != 4 || queryExtCtrls[3].Elems != 16 || queryExtCtrls[3].Flags&uint32(CtrlFlagHasPayload) == 0 {
+		t.Fatal("incorrect extended controls returned")
+	}
+	queryCtrls, err := QueryControls(fd)
+	if err != nil || len(queryCtrls) != 3 {
+		t.Fatal("compound control returned by legacy query")
+	}
+	table := make([]byte, 16)
+	for i := range table {
+		table[i] = byte(i)
+	}
+	controls := []*ExtControlValue{
+		{ID: CidBrightness, Value: 64},
+		{ID: CidCodecBase + 1000, Value: 1 << 35},
+		{ID: CidCodecBase + 1001, Payload: table},
+	}
+	if err := SetExtControls(fd, CtrlWhichCurVal, 0, controls); err != nil {
+		t.Fatal("unable to set extended controls")
+	}
+	controls = []*ExtControlValue{
+		{ID: CidBrightness},
+		{ID: CidCodecBase + 1000},
+		{ID: CidCodecBase + 1001, Payload: make([]byte, 16)},
+	}
+	if err := GetExtControls(fd, CtrlWhichCurVal, 0, controls); err != nil {
+		t.Fatal("unable to get extended controls")
+	}
+	if int32(controls[0].Value) != 64 || controls[1].Value != 1<<35 || !bytes.Equal(controls[2].Payload, table) {
+		t.Fatal("incorrect extended control values returned")
+	}
+	if err := GetExtControls(fd, CtrlWhichDefVal, 0, controls); err != nil {
+		t.Fatal("unable to get default extended controls")
+	}
+	if int32(controls[0].Value) != 128 || controls[1].Value != 1<<33 || controls[2].Payload[1] != 0 {
+		t.Fatal("incorrect default extended control values returned")
+	}
+	controls = []*ExtControlValue{{ID: CidBrightness, Value: 32}, {ID: CidCodecBase + 1000, Value: -1}}
+	err = SetExtControls(fd, CtrlWhichCurVal, 0, controls)
+	var extControlError *ExtControlError
+	if !errors.As(err, &extControlError) || extControlError.Index != 1 || !errors.Is(err, syscall.ERANGE) {
+		t.Fatal("out of range extended control not reported")
+	}
+	if control, err := GetControl(fd, CidBrightness); err != nil || control.Value != 64 {
+		t.Fatal("failed extended control request was not atomic")
+	}
+	if err := TryExtControls(fd, CtrlWhich(CtrlClassUser), 0, controls[:1]); err != nil {
+		t.Fatal("unable to try extended controls")
+	}
+	if err := TryExtControls(fd, CtrlWhich(CtrlClassUser), 0, controls); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("control outside class accepted")
+	}
+	controls = []*ExtControlValue{{ID: CidCodecBase + 1001, Payload: make([]byte, 4)}}
+	if err := GetExtControls(fd, CtrlWhichCurVal, 0, controls); !errors.Is(err, syscall.ENOSPC) || len(controls[0].Payload) != 16 {
+		t.Fatal("undersized payload not resized")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	fake, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	if _, err := DequeueEvent(fd); !errors.Is(err, syscall.ENOENT) {
+		t.Fatal("dequeue from empty event queue not rejected")
+	}
+	if err := SubscribeEvent(fd, EventTypeCtrl, uint32(CidBrightness), EventSubFlSendInitial); err != nil {
+		t.Fatal("unable to subscribe to control events")
+	}
+	event, err := DequeueEvent(fd)
+	if err != nil {
+		t.Fatal("unable to dequeue initial event")
+	}
+	ctrl := event.Ctrl()
+	if event.Type != EventTypeCtrl || event.ID != uint32(CidBrightness) || ctrl.Value != 128 || ctrl.Maximum != 255 || ctrl.Changes&EventCtrlChValue == 0 {
+		t.Fatal("initial event has incorrect content")
+	}
+	if err := SetControl(fd, &Control{ID: CidBrightness, Value: 64}); err != nil {
+		t.Fatal("unable to set control")
+	}
+	if _, err := DequeueEvent(fd); !errors.Is(err, syscall.ENOENT) {
+		t.Fatal("own control change reported without feedback")
+	}
+	if err := fake.ChangeControl(CidBrightness, 32); err != nil {
+		t.Fatal("unable to change control")
+	}
+	if err := SubscribeEvent(fd, EventTypeSourceChange, 0, 0); err != nil {
+		t.Fatal("unable to subscribe to source change events")
+	}
+	event = &Event{Type: EventTypeSourceChange}
+	event.SrcChange().Changes = EventSrcChResolution
+	fake.QueueEvent(*event)
+	fake.QueueEvent(Event{Type: EventTypeEOS})
+	event, err = DequeueEvent(fd)
+	if err != nil {
+		t.Fatal("unable to dequeue control event")
+	}
+	if event.Type != EventTypeCtrl || event.Ctrl().Value != 32 || event.Pending != 1 {
+		t.Fatal("control event has incorrect content")
+	}
+	sequence := event.Sequence
+	event, err = DequeueEvent(fd)
+	if err != nil {
+		t.Fatal("unable to dequeue source change event")
+	}
+	if event.Type != EventTypeSourceChange || event.SrcChange().Changes != EventSrcChResolution || event.Sequence != sequence+1 {
+		t.Fatal("source change event has incorrect content")
+	}
+	if err := UnsubscribeEvent(fd, EventTypeAll, 0); err != nil {
+		t.Fatal("unable to unsubscribe from events")
+	}
+	if err := fake.ChangeControl(CidBrightness, 16); err != nil {
+		t.Fatal("unable to change control")
+	}
+	if _, err := DequeueEvent(fd); !errors.Is(err, syscall.ENOENT) {
+		t.Fatal("event delivered after unsubscribing")
+	}
+}
+
+func TestSelection(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		config := testFakeConfig()
+		config.LegacyCrop = legacy
+		fake, err := NewFakeDevice(config)
+		if err != nil {
+			t.Fatal("unable to create fake device")
+		}
+		defer fake.Close()
+		fd := fake.Fd()
+		bounds, err := GetSelection(fd, BufTypeVideoCapture, SelTgtCropBounds)
+		if err != nil {
+			t.Fatal("unable to get crop bounds")
+		}
+		if bounds.Width != 1920 || bounds.Height != 1080 {
+			t.Fatal("crop bounds are incorrect")
+		}
+		rect, err := SetSelection(fd, BufTypeVideoCapture, SelTgtCrop, 0, Rect{Left: 1800, Top: 100, Width: 641, Height: 480})
+		if err != nil {
+			t.Fatal("unable to set crop")
+		}
+		if *rect != (Rect{Left: 1280, Top: 100, Width: 640, Height: 480}) {
+			t.Fatal("applied crop is incorrect")
+		}
+		current, err := GetSelection(fd, BufTypeVideoCapture, SelTgtCrop)
+		if err != nil {
+			t.Fatal("unable to get crop")
+		}
+		if *current != *rect {
+			t.Fatal("current crop is incorrect")
+		}
+		_, err = GetSelection(fd, BufTypeVideoCapture, SelTgtCompose)
+		if legacy != errors.Is(err, syscall.ENOTTY) {
+			t.Fatal("compose target handled incorrectly")
+		}
+	}
+	fake, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	rect, err := SetSelection(fd, BufTypeVideoCapture, SelTgtCrop, SelFlagGE, Rect{Width: 321, Height: 241})
+	if err != nil {
+		t.Fatal("unable to set crop")
+	}
+	if rect.Width != 322 || rect.Height != 242 {
+		t.Fatal("crop shrunk despite SelFlagGE")
+	}
+	if _, err := SetSelection(fd, BufTypeVideoCapture, SelTgtCrop, SelFlagGE|SelFlagLE, Rect{Width: 321, Height: 240}); !errors.Is(err, syscall.ERANGE) {
+		t.Fatal("unsatisfiable constraints not rejected")
+	}
+}
+
+func TestInputsOutputs(t *testing.T) {
+	config := testFakeConfig()
+	config.Inputs = []FakeInput{
+		{Name: "Composite", Type: InputTypeCamera, Capabilities: InputCapStd},
+		{Name: "HDMI", Type: InputTypeCamera, Status: InputStatusNoSignal, Capabilities: InputCapDVTimings},
+	}
+	config.Outputs = []FakeOutput{{Name: "Loopback", Type: OutputTypeAnalog}}
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	inputs, err := EnumInputs(fd)
+	if err != nil {
+		t.Fatal("unable to enumerate inputs")
+	}
+	if len(inputs) != 2 || BytesToString(inputs[1].Name[:]) != "HDMI" || inputs[1].Capabilities != InputCapDVTimings {
+		t.Fatal("incorrect inputs returned")
+	}
+	if err := SetInput(fd, 1); err != nil {
+		t.Fatal("unable to set input")
+	}
+	if index, err := GetInput(fd); err != nil || index != 1 {
+		t.Fatal("input not selected")
+	}
+	status, err := QueryInputStatus(fd)
+	if err != nil {
+		t.Fatal("unable to query input status")
+	}
+	if !status.SignalLost() || status.String() != "no signal" {
+		t.Fatal("input status decoded incorrectly")
+	}
+	if err := SetInput(fd, 2); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("invalid input accepted")
+	}
+	outputs, err := EnumOutputs(fd)
+	if err != nil {
+		t.Fatal("unable to enumerate outputs")
+	}
+	if len(outputs) != 1 || BytesToString(outputs[0].Name[:]) != "Loopback" {
+		t.Fatal("incorrect outputs returned")
+	}
+	if err := SetOutput(fd, 0); err != nil {
+		t.Fatal("unable to set output")
+	}
+	if index, err := GetOutput(fd); err != nil || index != 0 {
+		t.Fatal("output not selected")
+	}
+	if (InputStatusNoPower|InputStatusNoSync).String() != "no power, no sync" || InputStatus(0).String() != "ok" {
+		t.Fatal("input status names are incorrect")
+	}
+}
+
+func TestStandards(t *testing.T) {
+	config := testFakeConfig()
+	config.Standards = []FakeStandard{{ID: StdNTSCM, Name: "NTSC-M"}, {ID: StdPALBG, Name: "PAL-BG"}, {ID: StdSECAML, Name: "SECAM-L"}}
+	config.Detected = StdPALB | StdPALG
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	standards, err := EnumStandards(fd)
+	if err != nil {
+		t.Fatal("unable to enumerate standards")
+	}
+	if len(standards) != 3 || BytesToString(standards[0].Name[:]) != "NTSC-M" || standards[0].FrameLines != 525 || standards[1].FramePeriod.Denominator != 25 {
+		t.Fatal("incorrect standards returned")
+	}
+	detected, err := QueryStandard(fd)
+	if err != nil {
+		t.Fatal("unable to query standard")
+	}
+	if detected&StdPAL == 0 || detected&Std525_60 != 0 {
+		t.Fatal("incorrect standard detected")
+	}
+	if err := SetStandard(fd, detected); err != nil {
+		t.Fatal("unable to set standard")
+	}
+	if id, err := GetStandard(fd); err != nil || id != StdPALBG {
+		t.Fatal("standard not selected")
+	}
+	if err := SetStandard(fd, StdATSC); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("unsupported standard accepted")
+	}
+	webcam, err := NewFakeDevice(testFakeConfig())
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer webcam.Close()
+	if _, err := EnumStandards(webcam.Fd()); !errors.Is(err, ErrUnsupported) {
+		t.Fatal("standards reported by device without standards")
+	}
+}
+
+// testDVTimings returns the CEA-861 720p60 and 1080p60 timings.
+func testDVTimings() []BTTimings {
+	return []BTTimings{
+		{Width: 1280, Height: 720, PixelClock: 74250000, HFrontPorch: 110, HSync: 40, HBackPorch: 220, VFrontPorch: 5, VSync: 5, VBackPorch: 20, Polarities: DVVSyncPosPol | DVHSyncPosPol, Standards: DVBTStdCEA861, Flags: DVFlCanReduceFPS | DVFlIsCEVideo},
+		{Width: 1920, Height: 1080, PixelClock: 148500000, HFrontPorch: 88, HSync: 44, HBackPorch: 148, VFrontPorch: 4, VSync: 5, VBackPorch: 36, Polarities: DVVSyncPosPol | DVHSyncPosPol, Standards: DVBTStdCEA861, Flags: DVFlCanReduceFPS | DVFlIsCEVideo},
+	}
+}
+
+func TestDVTimings(t *testing.T) {
+	config := testFakeConfig()
+	config.DVTimings = testDVTimings()
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	timingsList, err := EnumDVTimings(fd, 0)
+	if err != nil {
+		t.Fatal("unable to enumerate DV timings")
+	}
+	if len(timingsList) != 2 {
+		t.Fatal("incorrect DV timings returned")
+	}
+	if bt, err := timingsList[1].BT(); err != nil || bt.Width != 1920 {
+		t.Fatal("incorrect DV timings returned")
+	}
+	timingsCap, err := GetDVTimingsCap(fd, 0)
+	if err != nil {
+		t.Fatal("unable to get DV timings capabilities")
+	}
+	if bt, err := timingsCap.BT(); err != nil || bt.MaxWidth != 1920 || bt.MinHeight != 720 || bt.MaxPixelClock != 148500000 {
+		t.Fatal("incorrect DV timings capabilities returned")
+	}
+	fake.SetSignal(&testDVTimings()[1])
+	timings, err := QueryDVTimings(fd)
+	if err != nil {
+		t.Fatal("unable to query DV timings")
+	}
+	bt, err := timings.BT()
+	if err != nil {
+		t.Fatal("unable to decode DV timings")
+	}
+	if err := new(DVTimings).SetBT(nil); err == nil {
+		t.Fatal("invalid DV timings encoded")
+	}
+	if bt.Width != 1920 || bt.Height != 1080 || bt.Polarities != DVVSyncPosPol|DVHSyncPosPol {
+		t.Fatal("incorrect DV timings sensed")
+	}
+	if bt.FrameWidth() != 2200 || bt.FrameHeight() != 1125 || bt.FPS() != 60 {
+		t.Fatal("incorrect frame rate computed")
+	}
+	if bt.PixelClockForFPS(30) != 74250000 {
+		t.Fatal("incorrect pixel clock computed")
+	}
+	bt.Flags |= DVFlReducedFPS
+	if fps := bt.FPS(); fps < 59.94 || fps > 59.941 {
+		t.Fatal("incorrect reduced frame rate computed")
+	}
+	if _, err := SetDVTimings(fd, timings); err != nil {
+		t.Fatal("unable to set DV timings")
+	}
+	current, err := GetDVTimings(fd)
+	if err != nil {
+		t.Fatal("DV timings not applied")
+	}
+	if bt, err := current.BT(); err != nil || bt.Height != 1080 {
+		t.Fatal("DV timings not applied")
+	}
+	fake.SetSignal(nil)
+	if _, err := QueryDVTimings(fd); !errors.Is(err, syscall.ENOLINK) {
+		t.Fatal("missing signal not reported")
+	}
+}
+
+func TestEDID(t *testing.T) {
+	config := testFakeConfig()
+	config.EDIDBlocks = 2
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	data, err := GetEDID(fd, 0)
+	if err != nil || data != nil {
+		t.Fatal("EDID returned before one was set")
+	}
+	e, err := edid.New("PHA", 0x1234, "go-v4l2", 16, 4)
+	if err != nil {
+		t.Fatal("unable to create EDID")
+	}
+	data, err = e.Marshal()
+	if err != nil {
+		t.Fatal("unable to marshal EDID")
+	}
+	if err := SetEDID(fd, 0, data); err != nil {
+		t.Fatal("unable to set EDID")
+	}
+	read, err := GetEDID(fd, 0)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatal("incorrect EDID returned")
+	}
+	parsed, err := edid.Parse(read)
+	if err != nil || parsed.Name != "go-v4l2" || parsed.CEA == nil {
+		t.Fatal("unable to parse EDID")
+	}
+	if err := SetEDID(fd, 0, make([]byte, 3*EDIDBlockSize)); !errors.Is(err, syscall.E2BIG) {
+		t.Fatal("oversized EDID accepted")
+	}
+	if err := SetEDID(fd, 0, data[:100]); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("partial EDID block accepted")
+	}
+	if err := SetEDID(fd, 0, nil); err != nil {
+		t.Fatal("unable to clear EDID")
+	}
+	if data, err := GetEDID(fd, 0); err != nil || data != nil {
+		t.Fatal("EDID returned after it was cleared")
+	}
+}
+
+func TestTuner(t *testing.T) {
+	config := testFakeConfig()
+	config.Tuners = []FakeTuner{{
+		Name:       "Radio",
+		Type:       TunerTypeRadio,
+		Capability: TunerCapLow | TunerCapStereo | TunerCapFreqBands | TunerCapHWSeekWrap,
+		RangeLow:   8352,
+		RangeHigh:  1728000,
+		Bands: []FrequencyBand{
+			{RangeLow: 8352, RangeHigh: 27360, Modulation: BandModulationAM},
+			{RangeLow: 1400000, RangeHigh: 1728000, Modulation: BandModulationFM},
+		},
+		Stations: []uint32{1569600, 1620800},
+	}}
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	tuners, err := EnumTuners(fd)
+	if err != nil || len(tuners) != 1 {
+		t.Fatal("unable to enumerate tuners")
+	}
+	if low, high := tuners[0].RangeHz(); low != 522000 || high != 108000000 {
+		t.Fatal("incorrect tuner range returned")
+	}
+	bands, err := EnumFreqBands(fd, 0, TunerTypeRadio)
+	if err != nil || len(bands) != 2 || bands[1].Modulation != BandModulationFM {
+		t.Fatal("unable to enumerate frequency bands")
+	}
+	if low, _ := bands[1].RangeHz(); low != 87500000 {
+		t.Fatal("incorrect band range returned")
+	}
+	hz, err := SetFrequencyHz(fd, 0, 98100000)
+	if err != nil || hz != 98100000 {
+		t.Fatal("unable to set frequency")
+	}
+	tuner, err := GetTuner(fd, 0)
+	if err != nil || tuner.Signal != 0xffff || tuner.RXSubChans&TunerSubStereo == 0 {
+		t.Fatal("no signal reported on station")
+	}
+	if err := SetTuner(fd, 0, TunerModeMono); err != nil {
+		t.Fatal("unable to set audio mode")
+	}
+	seek := &HWFreqSeek{Tuner: 0, Type: TunerTypeRadio, SeekUpward: 1}
+	if err := SeekFrequency(fd, seek); err != nil {
+		t.Fatal("unable to seek upward")
+	}
+	if hz, err := GetFrequencyHz(fd, 0); err != nil || hz != 101300000 {
+		t.Fatal("seek did not find the next station")
+	}
+	if err := SeekFrequency(fd, seek); !errors.Is(err, syscall.ENODATA) {
+		t.Fatal("seek found a station beyond the last one")
+	}
+	seek.WrapAround = 1
+	if err := SeekFrequency(fd, seek); err != nil {
+		t.Fatal("unable to seek with wrap around")
+	}
+	if hz, err := GetFrequencyHz(fd, 0); err != nil || hz != 98100000 {
+		t.Fatal("seek did not wrap around")
+	}
+	if err := SetFrequency(fd, 0, TunerTypeAnalogTV, 1400000); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("frequency set for the wrong tuner type")
+	}
+	if hz, err := SetFrequencyHz(fd, 0, 200000000); err != nil || hz != 108000000 {
+		t.Fatal("frequency not clamped to the tuner range")
+	}
+}
+
+func TestTunerUnits(t *testing.T) {
+	if TunerCap(0).ToHz(TunerCap(0).FromHz(55250000)) != 55250000 {
+		t.Fatal("incorrect conversion in 62.5 kHz units")
+	}
+	if TunerCapLow.FromHz(98100000) != 1569600 {
+		t.Fatal("incorrect conversion in 62.5 Hz units")
+	}
+	if TunerCap1Hz.FromHz(98100001) != 98100001 {
+		t.Fatal("incorrect conversion in 1 Hz units")
+	}
+}
+
+func TestAudio(t *testing.T) {
+	config := testFakeConfig()
+	config.Inputs = []FakeInput{
+		{Name: "Camera", Type: InputTypeCamera, AudioSet: 0b001},
+		{Name: "Composite", Type: InputTypeCamera, AudioSet: 0b110},
+	}
+	config.Audio = []FakeAudio{{Name: "Microphone", Capability: AudCapAVL}, {Name: "Line"}, {Name: "S/PDIF", Capability: AudCapStereo}}
+	config.Outputs = []FakeOutput{{Name: "HDMI", Type: OutputTypeAnalog, AudioSet: 0b1}}
+	config.AudioOuts = []FakeAudio{{Name: "HDMI Audio", Capability: AudCapStereo}}
+	fake, err := NewFakeDevice(config)
+	if err != nil {
+		t.Fatal("unable to create fake device")
+	}
+	defer fake.Close()
+	fd := fake.Fd()
+	audios, err := EnumAudio(fd)
+	if err != nil || len(audios) != 3 {
+		t.Fatal("unable to enumerate audio inputs")
+	}
+	associated, err := InputAudio(fd, 1)
+	if err != nil || len(associated) != 2 || associated[0].Index != 1 || associated[1].Index != 2 {
+		t.Fatal("incorrect audio inputs associated with video input")
+	}
+	if err := SetAudio(fd, 1, 0); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("unassociated audio input selected")
+	}
+	if err := SetAudio(fd, 0, AudModeAVL); err != nil {
+		t.Fatal("unable to select audio input")
+	}
+	if err := SetInput(fd, 1); err != nil {
+		t.Fatal("unable to select video input")
+	}
+	audio, err := GetAudio(fd)
+	if err != nil || audio.Index != 1 || BytesToString(audio.Name[:]) != "Line" {
+		t.Fatal("audio input did not follow video input")
+	}
+	if err := SetAudio(fd, 2, AudModeAVL); !errors.Is(err, syscall.EINVAL) {
+		t.Fatal("unsupported audio mode accepted")
+	}
+	audioOuts, err := OutputAudio(fd, 0)
+	if err != nil || len(audioOuts) != 1 || audioOuts[0].Capability != AudCapStereo {
+		t.Fatal("incorrect audio outputs associated with video output")
+	}
+	if err := SetAudioOut(fd, 0); err != nil {
+		t.Fatal("unable to select audio output")
+	}
+	if audioOut, err := GetAudioOut(fd); err != nil || audioOut.Index != 0 {
+		t.Fatal("incorrect audio output returned")
+	}
+	if indexes := AudioSet(0b1010).Indexes(); len(indexes) != 2 || indexes[0] != 1 || indexes[1] != 3 {
+		t.Fatal("incorrect audio set indexes returned")
+	}
+}
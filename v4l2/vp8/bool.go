@@ -0,0 +1,124 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vp8
+
+import "github.com/peterhagelund/go-v4l2/v4l2"
+
+// boolDecoder is the boolean entropy decoder of RFC 6386 section 7. It shifts
+// the data in a bit at a time, so that its state can be handed over to the
+// hardware at any point. Reading past the end sets err and reads zeros.
+type boolDecoder struct {
+	data      []byte
+	pos       int    // Bit position of the next bit to shift into value.
+	value     uint32 // The 8 bits being compared against the split.
+	rangeSize uint32
+	err       error
+}
+
+// newBoolDecoder returns a decoder reading data.
+func newBoolDecoder(data []byte) *boolDecoder {
+	d := &boolDecoder{data: data, rangeSize: 255}
+	for i := 0; i < 8; i++ {
+		d.value = d.value<<1 | d.bit()
+	}
+	return d
+}
+
+// bit returns the next bit of the data.
+func (d *boolDecoder) bit() uint32 {
+	if d.pos >= len(d.data)*8 {
+		if d.err == nil {
+			d.err = ErrTruncated
+		}
+		d.pos++
+		return 0
+	}
+	bit := uint32(d.data[d.pos>>3]>>(7-d.pos&7)) & 1
+	d.pos++
+	return bit
+}
+
+// decode decodes a bool whose probability of being false is prob/256.
+func (d *boolDecoder) decode(prob uint8) bool {
+	split := 1 + (d.rangeSize-1)*uint32(prob)>>8
+	result := d.value >= split
+	if result {
+		d.rangeSize -= split
+		d.value -= split
+	} else {
+		d.rangeSize = split
+	}
+	for d.rangeSize < 128 {
+		d.value = d.value<<1 | d.bit()
+		d.rangeSize <<= 1
+	}
+	return result
+}
+
+// flag decodes a one bit flag, L(1).
+func (d *boolDecoder) flag() bool {
+	return d.decode(128)
+}
+
+// literal decodes an n bit unsigned literal, L(n).
+func (d *boolDecoder) literal(n int) uint32 {
+	var value uint32
+	for i := 0; i < n; i++ {
+		value <<= 1
+		if d.flag() {
+			value |= 1
+		}
+	}
+	return value
+}
+
+// signed decodes an n bit magnitude followed by a sign bit.
+func (d *boolDecoder) signed(n int) int32 {
+	value := int32(d.literal(n))
+	if d.flag() {
+		return -value
+	}
+	return value
+}
+
+// optionalSigned decodes a flag and, when it is set, a signed value.
+func (d *boolDecoder) optionalSigned(n int) int32 {
+	if !d.flag() {
+		return 0
+	}
+	return d.signed(n)
+}
+
+// headerBits returns the number of bits the decoder has consumed, not
+// counting the 8 bits held in value.
+func (d *boolDecoder) headerBits() uint32 {
+	return uint32(d.pos - 8)
+}
+
+// state returns the decoder state as handed to the hardware, which continues
+// decoding from bit headerBits()+8 of the partition.
+func (d *boolDecoder) state() v4l2.VP8EntropyCoderState {
+	return v4l2.VP8EntropyCoderState{
+		Range:    uint8(d.rangeSize),
+		Value:    uint8(d.value),
+		BitCount: uint8((8 - d.pos%8) % 8),
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vp8
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/peterhagelund/go-v4l2/v4l2"
+)
+
+// The sizes of the IVF file and frame headers, and the largest frame read.
+const (
+	ivfHeaderSize      = 32
+	ivfFrameHeaderSize = 12
+	ivfMaxFrameSize    = 64 << 20
+)
+
+// IVFHeader is the header of an IVF file. The timestamps of the frames are in
+// units of TimebaseNumerator/TimebaseDenominator seconds.
+type IVFHeader struct {
+	Version             uint16
+	FourCC              v4l2.PixFmt // PixFmtVP8 for VP8 streams.
+	Width               uint16
+	Height              uint16
+	TimebaseDenominator uint32
+	TimebaseNumerator   uint32
+	FrameCount          uint32
+}
+
+// Timestamp converts a frame timestamp to a duration.
+func (h *IVFHeader) Timestamp(pts uint64) time.Duration {
+	if h.TimebaseDenominator == 0 {
+		return 0
+	}
+	return time.Duration(pts * uint64(h.TimebaseNumerator) * uint64(time.Second) / uint64(h.TimebaseDenominator))
+}
+
+// IVFFrame is a frame of an IVF file.
+type IVFFrame struct {
+	PTS  uint64
+	Data []byte
+}
+
+// IVFReader reads the frames of an IVF file.
+type IVFReader struct {
+	Header IVFHeader
+	r      io.Reader
+}
+
+// NewIVFReader reads the IVF file header from r.
+func NewIVFReader(r io.Reader) (*IVFReader, error) {
+	header := make([]byte, ivfHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[0:4]) != "DKIF" {
+		return nil, ErrInvalidIVF
+	}
+	length := binary.LittleEndian.Uint16(header[6:])
+	if length < ivfHeaderSize {
+		return nil, ErrInvalidIVF
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(length-ivfHeaderSize)); err != nil {
+		return nil, err
+	}
+	return &IVFReader{
+		Header: IVFHeader{
+			Version:             binary.LittleEndian.Uint16(header[4:]),
+			FourCC:              v4l2.PixFmt(binary.LittleEndian.Uint32(header[8:])),
+			Width:               binary.LittleEndian.Uint16(header[12:]),
+			Height:              binary.LittleEndian.Uint16(header[14:]),
+			TimebaseDenominator: binary.LittleEndian.Uint32(header[16:]),
+			TimebaseNumerator:   binary.LittleEndian.Uint32(header[20:]),
+			FrameCount:          binary.LittleEndian.Uint32(header[24:]),
+		},
+		r: r,
+	}, nil
+}
+
+// ReadFrame reads the next frame, returning io.EOF after the last one.
+func (r *IVFReader) ReadFrame() (*IVFFrame, error) {
+	header := make([]byte, ivfFrameHeaderSize)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[0:])
+	if size > ivfMaxFrameSize {
+		return nil, ErrInvalidIVF
+	}
+	frame := &IVFFrame{
+		PTS:  binary.LittleEndian.Uint64(header[4:]),
+		Data: make([]byte, size),
+	}
+	if _, err := io.ReadFull(r.r, frame.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,369 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package vp8 parses VP8 streams into the controls of the v4l2 stateless VP8
+// decoder API. It reads IVF files, parses the uncompressed and compressed
+// frame headers, and keeps the probabilities and reference frames that carry
+// over from one frame to the next.
+package vp8
+
+import (
+	"errors"
+	"time"
+
+	"github.com/peterhagelund/go-v4l2/v4l2"
+)
+
+var (
+	ErrTruncated     = errors.New("vp8: unexpected end of data")
+	ErrInvalidHeader = errors.New("vp8: invalid frame header")
+	ErrInvalidIVF    = errors.New("vp8: invalid IVF file")
+	ErrNoKeyFrame    = errors.New("vp8: stream does not start with a key frame")
+)
+
+// keyFrameStartCode follows the frame tag of key frames.
+var keyFrameStartCode = []byte{0x9d, 0x01, 0x2a}
+
+// The buffers a golden or alternate reference frame can be copied from.
+const (
+	CopyNone      = 0
+	CopyLast      = 1
+	CopyAltGolden = 2 // The alternate frame for the golden frame and vice versa.
+)
+
+// Frame is a frame along with the control describing it.
+type Frame struct {
+	Header              v4l2.CtrlVP8FrameHeader
+	ColorSpace          uint8 // Key frames only.
+	ClampingType        uint8 // Key frames only.
+	RefreshGolden       bool
+	RefreshAlt          bool
+	RefreshLast         bool
+	CopyBufferToGolden  uint8
+	CopyBufferToAlt     uint8
+	RefreshEntropyProbs bool
+	Data                []byte // The whole frame, as queued to the decoder.
+}
+
+// KeyFrame reports whether the frame is a key frame.
+func (f *Frame) KeyFrame() bool {
+	return f.Header.Flags&v4l2.VP8FrameFlagKeyFrame != 0
+}
+
+// Controls returns the frame control.
+func (f *Frame) Controls() ([]*v4l2.ExtControlValue, error) {
+	control, err := v4l2.CompoundControl(v4l2.CidStatelessVP8Frame, &f.Header)
+	if err != nil {
+		return nil, err
+	}
+	return []*v4l2.ExtControlValue{control}, nil
+}
+
+// Parser turns the frames of a VP8 stream into frames ready to be queued to a
+// stateless decoder.
+type Parser struct {
+	started    bool
+	width      uint16
+	height     uint16
+	hScale     uint8
+	vScale     uint8
+	segment    v4l2.VP8SegmentHeader // Feature data and mode carried over.
+	loopfilter v4l2.VP8LoopfilterHeader
+	entropy    v4l2.VP8EntropyHeader
+	lastTS     uint64
+	goldenTS   uint64
+	altTS      uint64
+}
+
+// NewParser returns a parser for a new stream.
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+// Parse parses a frame. The timestamp is that of the OUTPUT buffer the frame
+// is queued in, by which later frames refer to it.
+func (p *Parser) Parse(data []byte, timestamp time.Duration) (*Frame, error) {
+	if len(data) < 3 {
+		return nil, ErrTruncated
+	}
+	tag := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+	frame := &Frame{Data: data}
+	header := &frame.Header
+	keyFrame := tag&1 == 0
+	header.Version = uint8(tag >> 1 & 0x07)
+	header.FirstPartSize = tag >> 5
+	if tag>>4&1 == 1 {
+		header.Flags |= v4l2.VP8FrameFlagShowFrame
+	}
+	if header.Version > 3 {
+		header.Flags |= v4l2.VP8FrameFlagExperimental
+	}
+	offset := 3
+	if keyFrame {
+		if len(data) < 10 {
+			return nil, ErrTruncated
+		}
+		if string(data[3:6]) != string(keyFrameStartCode) {
+			return nil, ErrInvalidHeader
+		}
+		p.width = uint16(data[6]) | uint16(data[7]&0x3f)<<8
+		p.hScale = data[7] >> 6
+		p.height = uint16(data[8]) | uint16(data[9]&0x3f)<<8
+		p.vScale = data[9] >> 6
+		if p.width == 0 || p.height == 0 {
+			return nil, ErrInvalidHeader
+		}
+		header.Flags |= v4l2.VP8FrameFlagKeyFrame
+		p.reset()
+		p.started = true
+		offset = 10
+	} else if !p.started {
+		return nil, ErrNoKeyFrame
+	}
+	if int(header.FirstPartSize) > len(data)-offset {
+		return nil, ErrTruncated
+	}
+	header.Width, header.Height = p.width, p.height
+	header.HorizontalScale, header.VerticalScalingFactor = p.hScale, p.vScale
+	d := newBoolDecoder(data[offset : offset+int(header.FirstPartSize)])
+	if keyFrame {
+		frame.ColorSpace = uint8(d.literal(1))
+		frame.ClampingType = uint8(d.literal(1))
+	}
+	p.parseSegmentHeader(d, header)
+	p.parseLoopfilterHeader(d, header)
+	partitions := 1 << d.literal(2)
+	header.NumDCTParts = uint8(partitions)
+	parseQuantHeader(d, header)
+	header.LastFrameTS, header.GoldenFrameTS, header.AltFrameTS = p.lastTS, p.goldenTS, p.altTS
+	if keyFrame {
+		frame.RefreshGolden, frame.RefreshAlt, frame.RefreshLast = true, true, true
+	} else {
+		frame.RefreshGolden = d.flag()
+		frame.RefreshAlt = d.flag()
+		if !frame.RefreshGolden {
+			frame.CopyBufferToGolden = uint8(d.literal(2))
+		}
+		if !frame.RefreshAlt {
+			frame.CopyBufferToAlt = uint8(d.literal(2))
+		}
+		if d.flag() {
+			header.Flags |= v4l2.VP8FrameFlagSignBiasGolden
+		}
+		if d.flag() {
+			header.Flags |= v4l2.VP8FrameFlagSignBiasAlt
+		}
+	}
+	frame.RefreshEntropyProbs = d.flag()
+	if !keyFrame {
+		frame.RefreshLast = d.flag()
+	}
+	saved := p.entropy
+	p.parseEntropyHeader(d, header, keyFrame)
+	header.EntropyHeader = p.entropy
+	if !frame.RefreshEntropyProbs {
+		p.entropy = saved
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	header.FirstPartHeaderBits = d.headerBits()
+	header.CoderState = d.state()
+	if err := parsePartitionSizes(data[offset+int(header.FirstPartSize):], header); err != nil {
+		return nil, err
+	}
+	p.updateReferences(frame, v4l2.ReferenceTS(timestamp))
+	return frame, nil
+}
+
+// reset restores the state a key frame starts from.
+func (p *Parser) reset() {
+	p.segment = v4l2.VP8SegmentHeader{Flags: v4l2.VP8SegmentFlagDeltaValueMode}
+	p.loopfilter = v4l2.VP8LoopfilterHeader{}
+	p.entropy.CoeffProbs = defaultCoeffProbs
+	p.entropy.YModeProbs = defaultYModeProbs
+	p.entropy.UVModeProbs = defaultUVModeProbs
+	p.entropy.MVProb = defaultMVProbs
+}
+
+// parseSegmentHeader parses the segmentation part of the frame header,
+// RFC 6386 section 9.3.
+func (p *Parser) parseSegmentHeader(d *boolDecoder, header *v4l2.CtrlVP8FrameHeader) {
+	p.segment.Flags &= v4l2.VP8SegmentFlagDeltaValueMode
+	p.segment.SegmentProbs = [3]uint8{255, 255, 255}
+	if d.flag() {
+		p.segment.Flags |= v4l2.VP8SegmentFlagEnabled
+		updateMap := d.flag()
+		if d.flag() {
+			p.segment.Flags |= v4l2.VP8SegmentFlagUpdateFeatureData
+			p.segment.Flags &^= v4l2.VP8SegmentFlagDeltaValueMode
+			if !d.flag() {
+				p.segment.Flags |= v4l2.VP8SegmentFlagDeltaValueMode
+			}
+			for i := range p.segment.QuantUpdate {
+				p.segment.QuantUpdate[i] = int8(d.optionalSigned(7))
+			}
+			for i := range p.segment.LFUpdate {
+				p.segment.LFUpdate[i] = int8(d.optionalSigned(6))
+			}
+		}
+		if updateMap {
+			p.segment.Flags |= v4l2.VP8SegmentFlagUpdateMap
+			for i := range p.segment.SegmentProbs {
+				if d.flag() {
+					p.segment.SegmentProbs[i] = uint8(d.literal(8))
+				}
+			}
+		}
+	}
+	header.SegmentHeader = p.segment
+}
+
+// parseLoopfilterHeader parses the loop filter part of the frame header,
+// RFC 6386 sections 9.6 and 9.7.
+func (p *Parser) parseLoopfilterHeader(d *boolDecoder, header *v4l2.CtrlVP8FrameHeader) {
+	p.loopfilter.Flags = 0
+	if d.flag() {
+		p.loopfilter.Flags |= v4l2.VP8LoopfilterFlagFilterTypeSimple
+	}
+	p.loopfilter.Level = uint8(d.literal(6))
+	p.loopfilter.SharpnessLevel = uint8(d.literal(3))
+	if d.flag() {
+		p.loopfilter.Flags |= v4l2.VP8LoopfilterFlagAdjEnable
+		if d.flag() {
+			p.loopfilter.Flags |= v4l2.VP8LoopfilterFlagDeltaUpdate
+			for i := range p.loopfilter.RefFrmDelta {
+				if d.flag() {
+					p.loopfilter.RefFrmDelta[i] = int8(d.signed(6))
+				}
+			}
+			for i := range p.loopfilter.MBModeDelta {
+				if d.flag() {
+					p.loopfilter.MBModeDelta[i] = int8(d.signed(6))
+				}
+			}
+		}
+	}
+	header.LoopfilterHeader = p.loopfilter
+}
+
+// parseQuantHeader parses the quantizer indices, RFC 6386 section 9.6.
+func parseQuantHeader(d *boolDecoder, header *v4l2.CtrlVP8FrameHeader) {
+	quant := &header.QuantHeader
+	quant.YACQi = uint8(d.literal(7))
+	quant.YDCDelta = int8(d.optionalSigned(4))
+	quant.Y2DCDelta = int8(d.optionalSigned(4))
+	quant.Y2ACDelta = int8(d.optionalSigned(4))
+	quant.UVDCDelta = int8(d.optionalSigned(4))
+	quant.UVACDelta = int8(d.optionalSigned(4))
+}
+
+// parseEntropyHeader parses the probability updates ending the frame header,
+// RFC 6386 sections 9.9 to 9.11.
+func (p *Parser) parseEntropyHeader(d *boolDecoder, header *v4l2.CtrlVP8FrameHeader, keyFrame bool) {
+	for i := range p.entropy.CoeffProbs {
+		for j := range p.entropy.CoeffProbs[i] {
+			for k := range p.entropy.CoeffProbs[i][j] {
+				for l := range p.entropy.CoeffProbs[i][j][k] {
+					if d.decode(coeffUpdateProbs[i][j][k][l]) {
+						p.entropy.CoeffProbs[i][j][k][l] = uint8(d.literal(8))
+					}
+				}
+			}
+		}
+	}
+	if d.flag() {
+		header.Flags |= v4l2.VP8FrameFlagMBNoSkipCoeff
+		header.PropSkipFalse = uint8(d.literal(8))
+	}
+	if keyFrame {
+		return
+	}
+	header.PropIntra = uint8(d.literal(8))
+	header.PropLast = uint8(d.literal(8))
+	header.PropGF = uint8(d.literal(8))
+	if d.flag() {
+		for i := range p.entropy.YModeProbs {
+			p.entropy.YModeProbs[i] = uint8(d.literal(8))
+		}
+	}
+	if d.flag() {
+		for i := range p.entropy.UVModeProbs {
+			p.entropy.UVModeProbs[i] = uint8(d.literal(8))
+		}
+	}
+	for i := range p.entropy.MVProb {
+		for j := range p.entropy.MVProb[i] {
+			if d.decode(mvUpdateProbs[i][j]) {
+				p.entropy.MVProb[i][j] = 1
+				if value := d.literal(7); value != 0 {
+					p.entropy.MVProb[i][j] = uint8(value << 1)
+				}
+			}
+		}
+	}
+}
+
+// parsePartitionSizes reads the sizes of the DCT partitions following the
+// first partition, RFC 6386 section 9.5.
+func parsePartitionSizes(data []byte, header *v4l2.CtrlVP8FrameHeader) error {
+	count := int(header.NumDCTParts)
+	sizes := 3 * (count - 1)
+	if len(data) < sizes {
+		return ErrTruncated
+	}
+	remaining := len(data) - sizes
+	for i := 0; i < count-1; i++ {
+		size := int(data[3*i]) | int(data[3*i+1])<<8 | int(data[3*i+2])<<16
+		if size > remaining {
+			return ErrTruncated
+		}
+		header.DCTPartSize[i] = uint32(size)
+		remaining -= size
+	}
+	header.DCTPartSize[count-1] = uint32(remaining)
+	return nil
+}
+
+// updateReferences updates the reference frames once the frame is decoded,
+// copying buffers before refreshing them with the frame as libvpx does.
+func (p *Parser) updateReferences(frame *Frame, ts uint64) {
+	switch frame.CopyBufferToAlt {
+	case CopyLast:
+		p.altTS = p.lastTS
+	case CopyAltGolden:
+		p.altTS = p.goldenTS
+	}
+	switch frame.CopyBufferToGolden {
+	case CopyLast:
+		p.goldenTS = p.lastTS
+	case CopyAltGolden:
+		p.goldenTS = p.altTS
+	}
+	if frame.RefreshGolden {
+		p.goldenTS = ts
+	}
+	if frame.RefreshAlt {
+		p.altTS = ts
+	}
+	if frame.RefreshLast {
+		p.lastTS = ts
+	}
+}
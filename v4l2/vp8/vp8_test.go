@@ -0,0 +1,510 @@
+// Copyright (c) 2020-2024 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package vp8
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/peterhagelund/go-v4l2/v4l2"
+)
+
+// boolEncoder is the boolean entropy encoder of RFC 6386 section 7.3.
+type boolEncoder struct {
+	out       []byte
+	rangeSize uint32
+	bottom    uint32
+	bitCount  int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rangeSize: 255, bitCount: 24}
+}
+
+func (e *boolEncoder) carry() {
+	i := len(e.out) - 1
+	for i >= 0 && e.out[i] == 0xff {
+		e.out[i] = 0
+		i--
+	}
+	e.out[i]++
+}
+
+func (e *boolEncoder) encode(prob uint8, value bool) {
+	split := 1 + (e.rangeSize-1)*uint32(prob)>>8
+	if value {
+		e.bottom += split
+		e.rangeSize -= split
+	} else {
+		e.rangeSize = split
+	}
+	for e.rangeSize < 128 {
+		e.rangeSize <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+func (e *boolEncoder) flag(value bool) {
+	e.encode(128, value)
+}
+
+func (e *boolEncoder) literal(n int, value uint32) {
+	for i := n - 1; i >= 0; i-- {
+		e.flag(value>>i&1 == 1)
+	}
+}
+
+func (e *boolEncoder) signed(n int, value int32) {
+	if value < 0 {
+		e.literal(n, uint32(-value))
+		e.flag(true)
+	} else {
+		e.literal(n, uint32(value))
+		e.flag(false)
+	}
+}
+
+func (e *boolEncoder) optionalSigned(n int, value int32) {
+	e.flag(value != 0)
+	if value != 0 {
+		e.signed(n, value)
+	}
+}
+
+func (e *boolEncoder) flush() []byte {
+	c := e.bitCount
+	v := e.bottom
+	if v&(1<<(32-c)) != 0 {
+		e.carry()
+	}
+	v <<= c & 7
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.out = append(e.out, byte(v>>24))
+		v <<= 8
+	}
+	return e.out
+}
+
+// testPattern follows the frame headers to check the handed over decoder state.
+const testPattern = 0xa5c3
+
+// testFrame returns a 320x240 frame whose first partition is written by
+// header, followed by the DCT partitions.
+func testFrame(key bool, header func(e *boolEncoder), partitions ...[]byte) []byte {
+	e := newBoolEncoder()
+	header(e)
+	e.literal(16, testPattern)
+	first := e.flush()
+	tag := uint32(len(first))<<5 | 1<<4
+	if !key {
+		tag |= 1
+	}
+	frame := []byte{byte(tag), byte(tag >> 8), byte(tag >> 16)}
+	if key {
+		frame = append(frame, keyFrameStartCode...)
+		frame = append(frame, 0x40, 0x01, 0xf0, 0x40)
+	}
+	frame = append(frame, first...)
+	for _, partition := range partitions[:len(partitions)-1] {
+		frame = append(frame, byte(len(partition)), byte(len(partition)>>8), byte(len(partition)>>16))
+	}
+	for _, partition := range partitions {
+		frame = append(frame, partition...)
+	}
+	return frame
+}
+
+// coeffUpdates writes the coefficient probability updates, updating the
+// probability at index to value.
+func coeffUpdates(e *boolEncoder, index [4]int, value uint32) {
+	for i := range coeffUpdateProbs {
+		for j := range coeffUpdateProbs[i] {
+			for k := range coeffUpdateProbs[i][j] {
+				for l, prob := range coeffUpdateProbs[i][j][k] {
+					update := [4]int{i, j, k, l} == index
+					e.encode(prob, update)
+					if update {
+						e.literal(8, value)
+					}
+				}
+			}
+		}
+	}
+}
+
+// mvUpdates writes the motion vector probability updates, updating the
+// probabilities of updates to their values.
+func mvUpdates(e *boolEncoder, updates map[[2]int]uint32) {
+	for i := range mvUpdateProbs {
+		for j, prob := range mvUpdateProbs[i] {
+			value, update := updates[[2]int{i, j}]
+			e.encode(prob, update)
+			if update {
+				e.literal(7, value)
+			}
+		}
+	}
+}
+
+func TestBoolDecoder(t *testing.T) {
+	e := newBoolEncoder()
+	probs := []uint8{1, 128, 255, 10, 200, 77}
+	for i := 0; i < 1000; i++ {
+		e.encode(probs[i%len(probs)], i%3 == 0 || i%7 == 0)
+	}
+	e.literal(8, 0xc5)
+	data := e.flush()
+	d := newBoolDecoder(data)
+	for i := 0; i < 1000; i++ {
+		if d.decode(probs[i%len(probs)]) != (i%3 == 0 || i%7 == 0) {
+			t.Fatal("incorrect bool")
+		}
+	}
+	bits := d.headerBits()
+	state := d.state()
+	if d.literal(8) != 0xc5 || d.err != nil {
+		t.Fatal("incorrect literal")
+	}
+	resumed := &boolDecoder{data: data, pos: int(bits) + 8, value: uint32(state.Value), rangeSize: uint32(state.Range)}
+	if resumed.literal(8) != 0xc5 || state.BitCount != uint8((8-(bits+8)%8)%8) {
+		t.Fatal("incorrect decoder state")
+	}
+	d = newBoolDecoder([]byte{0x00})
+	if d.literal(16); d.err != ErrTruncated {
+		t.Fatal("reading past the end not detected")
+	}
+}
+
+func TestIVF(t *testing.T) {
+	file := []byte("DKIF")
+	file = binary.LittleEndian.AppendUint16(file, 0)
+	file = binary.LittleEndian.AppendUint16(file, ivfHeaderSize)
+	file = binary.LittleEndian.AppendUint32(file, uint32(v4l2.PixFmtVP8))
+	file = binary.LittleEndian.AppendUint16(file, 320)
+	file = binary.LittleEndian.AppendUint16(file, 240)
+	file = binary.LittleEndian.AppendUint32(file, 30000)
+	file = binary.LittleEndian.AppendUint32(file, 1001)
+	file = binary.LittleEndian.AppendUint32(file, 2)
+	file = binary.LittleEndian.AppendUint32(file, 0)
+	for i, frame := range [][]byte{{0x01, 0x02, 0x03}, {0x04}} {
+		file = binary.LittleEndian.AppendUint32(file, uint32(len(frame)))
+		file = binary.LittleEndian.AppendUint64(file, uint64(i*3))
+		file = append(file, frame...)
+	}
+	reader, err := NewIVFReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal("unable to read IVF header")
+	}
+	header := reader.Header
+	if header.FourCC != v4l2.PixFmtVP8 || header.Width != 320 || header.Height != 240 || header.FrameCount != 2 {
+		t.Fatal("incorrect IVF header")
+	}
+	if header.Timestamp(3) != 100100*time.Microsecond {
+		t.Fatal("incorrect timestamp")
+	}
+	frame, err := reader.ReadFrame()
+	if err != nil || frame.PTS != 0 || !bytes.Equal(frame.Data, []byte{0x01, 0x02, 0x03}) {
+		t.Fatal("incorrect first frame")
+	}
+	if frame, err = reader.ReadFrame(); err != nil || frame.PTS != 3 || !bytes.Equal(frame.Data, []byte{0x04}) {
+		t.Fatal("incorrect second frame")
+	}
+	if _, err = reader.ReadFrame(); err != io.EOF {
+		t.Fatal("end of file not reported")
+	}
+	reader, _ = NewIVFReader(bytes.NewReader(file[:len(file)-1]))
+	reader.ReadFrame()
+	if _, err = reader.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatal("truncated frame not reported")
+	}
+	if _, err = NewIVFReader(bytes.NewReader(make([]byte, ivfHeaderSize))); err != ErrInvalidIVF {
+		t.Fatal("invalid signature accepted")
+	}
+}
+
+func TestParser(t *testing.T) {
+	key := testFrame(true, func(e *boolEncoder) {
+		e.flag(false)
+		e.flag(true)
+		e.flag(true)
+		e.flag(true)
+		e.flag(true)
+		e.flag(false)
+		for _, value := range []int32{-5, 0, 10, 0} {
+			e.optionalSigned(7, value)
+		}
+		for _, value := range []int32{0, -3, 0, 0} {
+			e.optionalSigned(6, value)
+		}
+		for _, prob := range []uint32{200, 0, 10} {
+			e.flag(prob != 0)
+			if prob != 0 {
+				e.literal(8, prob)
+			}
+		}
+		e.flag(true)
+		e.literal(6, 40)
+		e.literal(3, 3)
+		e.flag(true)
+		e.flag(true)
+		for _, delta := range []int32{2, 0, -2, -2, 4, -2, 2, 4} {
+			e.flag(true)
+			e.signed(6, delta)
+		}
+		e.literal(2, 1)
+		e.literal(7, 60)
+		for _, delta := range []int32{3, 0, -2, 0, 0} {
+			e.optionalSigned(4, delta)
+		}
+		e.flag(true)
+		coeffUpdates(e, [4]int{1, 2, 0, 3}, 77)
+		e.flag(true)
+		e.literal(8, 100)
+	}, []byte{1, 2, 3, 4, 5}, []byte{6, 7, 8, 9, 10, 11, 12})
+	inter := func(refreshGolden bool, copies uint32, refreshEntropy, refreshLast bool, updates bool) []byte {
+		return testFrame(false, func(e *boolEncoder) {
+			e.flag(true)
+			e.flag(false)
+			e.flag(false)
+			e.flag(false)
+			e.literal(6, 20)
+			e.literal(3, 0)
+			e.flag(true)
+			e.flag(false)
+			e.literal(2, 0)
+			e.literal(7, 50)
+			for i := 0; i < 5; i++ {
+				e.flag(false)
+			}
+			e.flag(refreshGolden)
+			e.flag(false)
+			if !refreshGolden {
+				e.literal(2, copies>>2)
+			}
+			e.literal(2, copies&3)
+			e.flag(true)
+			e.flag(false)
+			e.flag(refreshEntropy)
+			e.flag(refreshLast)
+			if updates {
+				coeffUpdates(e, [4]int{0, 1, 0, 0}, 9)
+			} else {
+				coeffUpdates(e, [4]int{}, 0)
+			}
+			e.flag(false)
+			e.literal(8, 30)
+			e.literal(8, 200)
+			e.literal(8, 128)
+			e.flag(updates)
+			if updates {
+				for _, prob := range []uint32{1, 2, 3, 4} {
+					e.literal(8, prob)
+				}
+			}
+			e.flag(false)
+			if updates {
+				mvUpdates(e, map[[2]int]uint32{{0, 0}: 50, {1, 18}: 0})
+			} else {
+				mvUpdates(e, nil)
+			}
+		}, []byte{0xff})
+	}
+	p := NewParser()
+	if _, err := p.Parse(inter(false, 0, true, true, false), 0); err != ErrNoKeyFrame {
+		t.Fatal("inter frame accepted before a key frame")
+	}
+	frame, err := p.Parse(key, 0)
+	if err != nil {
+		t.Fatal("unable to parse key frame")
+	}
+	header := &frame.Header
+	if !frame.KeyFrame() || header.Flags != v4l2.VP8FrameFlagKeyFrame|v4l2.VP8FrameFlagShowFrame|v4l2.VP8FrameFlagMBNoSkipCoeff || header.PropSkipFalse != 100 {
+		t.Fatal("incorrect key frame flags")
+	}
+	if header.Width != 320 || header.Height != 240 || header.HorizontalScale != 0 || header.VerticalScalingFactor != 1 || frame.ClampingType != 1 {
+		t.Fatal("incorrect key frame size")
+	}
+	segment := header.SegmentHeader
+	if segment.Flags != v4l2.VP8SegmentFlagEnabled|v4l2.VP8SegmentFlagUpdateMap|v4l2.VP8SegmentFlagUpdateFeatureData|v4l2.VP8SegmentFlagDeltaValueMode ||
+		segment.QuantUpdate != [4]int8{-5, 0, 10, 0} || segment.LFUpdate != [4]int8{0, -3, 0, 0} || segment.SegmentProbs != [3]uint8{200, 255, 10} {
+		t.Fatal("incorrect segment header")
+	}
+	loopfilter := header.LoopfilterHeader
+	if loopfilter.Flags != v4l2.VP8LoopfilterFlagFilterTypeSimple|v4l2.VP8LoopfilterFlagAdjEnable|v4l2.VP8LoopfilterFlagDeltaUpdate ||
+		loopfilter.Level != 40 || loopfilter.SharpnessLevel != 3 || loopfilter.RefFrmDelta != [4]int8{2, 0, -2, -2} || loopfilter.MBModeDelta != [4]int8{4, -2, 2, 4} {
+		t.Fatal("incorrect loop filter header")
+	}
+	if header.QuantHeader != (v4l2.VP8QuantizationHeader{YACQi: 60, YDCDelta: 3, Y2ACDelta: -2}) {
+		t.Fatal("incorrect quantization header")
+	}
+	entropy := &header.EntropyHeader
+	if entropy.CoeffProbs[1][2][0][3] != 77 || entropy.CoeffProbs[1][2][0][2] != defaultCoeffProbs[1][2][0][2] || entropy.YModeProbs != defaultYModeProbs || entropy.MVProb != defaultMVProbs {
+		t.Fatal("incorrect key frame probabilities")
+	}
+	if header.NumDCTParts != 2 || header.DCTPartSize != [8]uint32{5, 7} || header.FirstPartSize != uint32(len(key)-10-3-12) {
+		t.Fatal("incorrect partitions")
+	}
+	first := key[10 : 10+header.FirstPartSize]
+	resumed := &boolDecoder{data: first, pos: int(header.FirstPartHeaderBits) + 8, value: uint32(header.CoderState.Value), rangeSize: uint32(header.CoderState.Range)}
+	if resumed.literal(16) != testPattern {
+		t.Fatal("incorrect decoder state")
+	}
+	if controls, err := frame.Controls(); err != nil || len(controls) != 1 || controls[0].ID != v4l2.CidStatelessVP8Frame || len(controls[0].Payload) != 1232 {
+		t.Fatal("incorrect controls")
+	}
+	ts := func(i int) uint64 {
+		return uint64(time.Duration(i) * 40 * time.Millisecond)
+	}
+	frame, err = p.Parse(inter(false, 1<<2|2, false, true, true), 40*time.Millisecond)
+	if err != nil {
+		t.Fatal("unable to parse inter frame")
+	}
+	header = &frame.Header
+	if frame.KeyFrame() || header.Flags != v4l2.VP8FrameFlagShowFrame|v4l2.VP8FrameFlagSignBiasGolden || header.Width != 320 || header.NumDCTParts != 1 || header.DCTPartSize[0] != 1 {
+		t.Fatal("incorrect inter frame")
+	}
+	if header.PropIntra != 30 || header.PropLast != 200 || header.PropGF != 128 {
+		t.Fatal("incorrect inter frame probabilities")
+	}
+	if header.SegmentHeader.Flags != v4l2.VP8SegmentFlagEnabled|v4l2.VP8SegmentFlagDeltaValueMode || header.SegmentHeader.QuantUpdate != [4]int8{-5, 0, 10, 0} ||
+		header.LoopfilterHeader.Flags != v4l2.VP8LoopfilterFlagAdjEnable || header.LoopfilterHeader.RefFrmDelta != [4]int8{2, 0, -2, -2} {
+		t.Fatal("incorrect carried over segment and loop filter state")
+	}
+	entropy = &header.EntropyHeader
+	if entropy.CoeffProbs[0][1][0][0] != 9 || entropy.CoeffProbs[1][2][0][3] != 77 || entropy.YModeProbs != [4]uint8{1, 2, 3, 4} || entropy.MVProb[0][0] != 100 || entropy.MVProb[1][18] != 1 {
+		t.Fatal("incorrect probability updates")
+	}
+	if header.LastFrameTS != ts(0) || header.GoldenFrameTS != ts(0) || header.AltFrameTS != ts(0) {
+		t.Fatal("incorrect inter frame references")
+	}
+	frame, err = p.Parse(inter(true, 1, true, false, false), 80*time.Millisecond)
+	if err != nil {
+		t.Fatal("unable to parse inter frame")
+	}
+	entropy = &frame.Header.EntropyHeader
+	if entropy.CoeffProbs[0][1][0][0] != defaultCoeffProbs[0][1][0][0] || entropy.CoeffProbs[1][2][0][3] != 77 || entropy.YModeProbs != defaultYModeProbs {
+		t.Fatal("probabilities not restored")
+	}
+	if frame.Header.LastFrameTS != ts(1) || frame.Header.GoldenFrameTS != ts(0) || frame.Header.AltFrameTS != ts(0) {
+		t.Fatal("incorrect references after buffer copies")
+	}
+	if p.lastTS != ts(1) || p.goldenTS != ts(2) || p.altTS != ts(1) {
+		t.Fatal("incorrect references after golden frame refresh")
+	}
+	if _, err := p.Parse(key[:20], 0); err != ErrTruncated {
+		t.Fatal("truncated frame accepted")
+	}
+}
+
+func TestParserLibvpx(t *testing.T) {
+	file, err := os.Open("testdata/libvpx.ivf")
+	if err != nil {
+		t.Fatal("unable to open libvpx stream")
+	}
+	defer file.Close()
+	reader, err := NewIVFReader(file)
+	if err != nil {
+		t.Fatal("unable to read IVF header")
+	}
+	if header := reader.Header; header.Width != 320 || header.Height != 240 || header.FrameCount != 21 || header.Timestamp(233) != 233*time.Millisecond {
+		t.Fatal("incorrect libvpx IVF header")
+	}
+	p := NewParser()
+	var frames []*Frame
+	for {
+		ivfFrame, err := reader.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("unable to read libvpx frame")
+		}
+		frame, err := p.Parse(ivfFrame.Data, reader.Header.Timestamp(ivfFrame.PTS))
+		if err != nil {
+			t.Fatal("unable to parse libvpx frame")
+		}
+		header := &frame.Header
+		size := 3 + header.FirstPartSize + 3*uint32(header.NumDCTParts-1)
+		if frame.KeyFrame() {
+			size += 7
+		}
+		for _, partSize := range header.DCTPartSize[:header.NumDCTParts] {
+			size += partSize
+		}
+		if int(size) != len(frame.Data) || header.FirstPartHeaderBits >= 8*header.FirstPartSize {
+			t.Fatal("incorrect libvpx partitions")
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) != 21 {
+		t.Fatal("incorrect number of libvpx frames")
+	}
+	key := &frames[0].Header
+	if !frames[0].KeyFrame() || key.Width != 320 || key.Height != 240 || key.Version != 0 || key.Flags != v4l2.VP8FrameFlagKeyFrame|v4l2.VP8FrameFlagShowFrame|v4l2.VP8FrameFlagMBNoSkipCoeff {
+		t.Fatal("incorrect libvpx key frame")
+	}
+	if key.QuantHeader.YACQi != 127 || key.PropSkipFalse != 52 || key.NumDCTParts != 1 || key.FirstPartSize != 422 || key.DCTPartSize[0] != 788 {
+		t.Fatal("incorrect libvpx key frame header")
+	}
+	loopfilter := key.LoopfilterHeader
+	if loopfilter.Level != 17 || loopfilter.SharpnessLevel != 0 || loopfilter.Flags != v4l2.VP8LoopfilterFlagAdjEnable|v4l2.VP8LoopfilterFlagDeltaUpdate ||
+		loopfilter.RefFrmDelta != [4]int8{2, 0, -2, -2} || loopfilter.MBModeDelta != [4]int8{4, -2, 2, 4} {
+		t.Fatal("incorrect libvpx loop filter")
+	}
+	ts := func(i int) uint64 {
+		return v4l2.ReferenceTS(time.Duration(i) * time.Millisecond)
+	}
+	if frames[1].KeyFrame() || frames[1].RefreshGolden || !frames[1].RefreshLast || frames[1].Header.LastFrameTS != ts(0) || frames[1].Header.LoopfilterHeader.Level != 40 {
+		t.Fatal("incorrect libvpx inter frame")
+	}
+	// libvpx refreshes the golden frame every few frames, moving the
+	// previous golden frame to the alternate frame.
+	for _, i := range []int{7, 18} {
+		if !frames[i].RefreshGolden || frames[i].RefreshAlt || frames[i].CopyBufferToAlt != CopyAltGolden {
+			t.Fatal("incorrect libvpx golden frame")
+		}
+	}
+	if header := frames[8].Header; header.LastFrameTS != ts(233) || header.GoldenFrameTS != ts(233) || header.AltFrameTS != ts(0) {
+		t.Fatal("incorrect libvpx references after golden frame")
+	}
+	if header := frames[19].Header; header.GoldenFrameTS != ts(600) || header.AltFrameTS != ts(233) {
+		t.Fatal("incorrect libvpx references after second golden frame")
+	}
+	if controls, err := frames[20].Controls(); err != nil || len(controls) != 1 || len(controls[0].Payload) != 1232 {
+		t.Fatal("incorrect libvpx controls")
+	}
+}